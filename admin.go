@@ -0,0 +1,398 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// adminOnly guards admin routes. With admin_token set, callers must send it
+// as a Bearer token; without one, only loopback clients are allowed, and
+// changes must not come from another site's page.
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			audit.record("admin.denied", map[string]interface{}{
+				"method": r.Method, "path": r.URL.Path, "remote": clientIP(r),
+			})
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		audit.record("admin.access", map[string]interface{}{
+			"method": r.Method, "path": r.URL.Path, "query": r.URL.RawQuery, "remote": clientIP(r),
+		})
+		if limitBody(w, r) {
+			next(w, r)
+		}
+	}
+}
+
+func isAdmin(r *http.Request) bool {
+	if config.AdminToken == "" {
+		return isLoopback(r.RemoteAddr) && notCrossSite(r)
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(config.AdminToken)) == 1
+}
+
+// notCrossSite holds a tokenless call to what a browser can't forge from
+// another page. It must be addressed to localhost, so a rebound DNS name
+// can't pass as the proxy's own origin. A change must also carry no Origin
+// but the Host's, and send any body as JSON, which needs a preflight.
+// Tools such as curl send no Origin.
+func notCrossSite(r *http.Request) bool {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if ip := net.ParseIP(strings.Trim(host, "[]")); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return false
+	}
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return true
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			return false
+		}
+	}
+	if r.Method == "DELETE" {
+		return true
+	}
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return ct == "application/json"
+}
+
+func isLoopback(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Key vault admin. GET lists stored entries ("provider" or
+// "provider:profile"), POST {"provider", "profile", "key"} stores one and
+// DELETE ?provider=&profile= removes it. Profile is optional throughout.
+func handleAdminKeys(w http.ResponseWriter, r *http.Request) {
+	if keyVault == nil {
+		http.Error(w, "No key vault configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"keys": keyVault.providers()})
+
+	case "POST":
+		var body struct {
+			Provider string `json:"provider"`
+			Profile  string `json:"profile"`
+			Key      string `json:"key"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeDecodeError(w, err)
+			return
+		}
+		if _, ok := lookupProvider(body.Provider); !ok {
+			http.Error(w, "Unknown provider: "+body.Provider, http.StatusBadRequest)
+			return
+		}
+		if body.Key == "" || strings.Contains(body.Profile, ":") {
+			http.Error(w, "Key required and profile must not contain ':'", http.StatusBadRequest)
+			return
+		}
+		if err := keyVault.set(vaultKeyName(body.Provider, body.Profile), body.Key); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit.record("key.added", map[string]interface{}{
+			"provider": body.Provider,
+			"profile":  body.Profile,
+			"current":  keyFingerprint(body.Key),
+			"remote":   clientIP(r),
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	case "DELETE":
+		q := r.URL.Query()
+		if err := keyVault.delete(vaultKeyName(q.Get("provider"), q.Get("profile"))); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit.record("key.deleted", map[string]interface{}{
+			"provider": q.Get("provider"),
+			"profile":  q.Get("profile"),
+			"remote":   clientIP(r),
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAdminKeyRotate swaps in a new key for a provider or profile. Keys
+// are resolved once when a request starts, so requests already in flight
+// finish on the old key while new ones pick up the replacement; the old key
+// stays valid upstream until it is revoked there. The rotation is recorded
+// in the audit log by fingerprint.
+func handleAdminKeyRotate(w http.ResponseWriter, r *http.Request) {
+	if keyVault == nil {
+		http.Error(w, "No key vault configured", http.StatusServiceUnavailable)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Provider string `json:"provider"`
+		Profile  string `json:"profile"`
+		Key      string `json:"key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	p, ok := lookupProvider(body.Provider)
+	if !ok {
+		http.Error(w, "Unknown provider: "+body.Provider, http.StatusBadRequest)
+		return
+	}
+	if body.Key == "" || strings.Contains(body.Profile, ":") {
+		http.Error(w, "Key required and profile must not contain ':'", http.StatusBadRequest)
+		return
+	}
+
+	// The displaced key may come from config or the environment rather
+	// than the vault; the vault entry takes precedence from now on.
+	previous := serverAPIKey(p)
+	if body.Profile != "" {
+		previous = profileAPIKey(p, body.Profile)
+	}
+	if err := keyVault.set(vaultKeyName(body.Provider, body.Profile), body.Key); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := map[string]interface{}{
+		"provider": body.Provider,
+		"profile":  body.Profile,
+		"previous": keyFingerprint(previous),
+		"current":  keyFingerprint(body.Key),
+	}
+	audit.record("key.rotated", map[string]interface{}{
+		"provider": body.Provider,
+		"profile":  body.Profile,
+		"previous": result["previous"],
+		"current":  result["current"],
+		"remote":   clientIP(r),
+	})
+	writeJSON(w, http.StatusOK, result)
+}
+
+// started is when the process came up, for uptime in /api/admin/stats.
+var started = time.Now()
+
+// rateLimits is the body of /api/admin/ratelimits. Fields left out of a
+// PUT keep their current value.
+type rateLimits struct {
+	RPS       *float64             `json:"rps"`
+	Burst     *int                 `json:"burst"`
+	Providers map[string]keyLimits `json:"providers"`
+}
+
+func currentRateLimits() rateLimits {
+	rps, burst := limiter.settings()
+	out := rateLimits{RPS: &rps, Burst: &burst, Providers: map[string]keyLimits{}}
+	for _, name := range providerNames() {
+		if l := quotas.currentLimits(name); l.RPM > 0 || l.TPM > 0 {
+			out.Providers[name] = l
+		}
+	}
+	return out
+}
+
+// handleAdminRateLimits shows and changes the per-client rate limit and
+// per-key provider rpm/tpm. Changes last until restart; edit the config
+// to keep them.
+func handleAdminRateLimits(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, currentRateLimits())
+
+	case "PUT":
+		var body rateLimits
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeDecodeError(w, err)
+			return
+		}
+		if (body.RPS != nil && *body.RPS < 0) || (body.Burst != nil && *body.Burst < 0) {
+			http.Error(w, "rps and burst must not be negative", http.StatusBadRequest)
+			return
+		}
+		for name, l := range body.Providers {
+			if _, ok := lookupProvider(name); !ok {
+				http.Error(w, "Unknown provider: "+name, http.StatusBadRequest)
+				return
+			}
+			if l.RPM < 0 || l.TPM < 0 {
+				http.Error(w, "rpm and tpm must not be negative", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if body.RPS != nil || body.Burst != nil {
+			rps, burst := limiter.settings()
+			if body.RPS != nil {
+				rps = *body.RPS
+			}
+			if body.Burst != nil {
+				burst = *body.Burst
+			}
+			limiter.set(rps, burst)
+		}
+		for name, l := range body.Providers {
+			quotas.setLimits(name, l)
+		}
+		current := currentRateLimits()
+		audit.record("ratelimits.changed", map[string]interface{}{
+			"rps":       *current.RPS,
+			"burst":     *current.Burst,
+			"providers": current.Providers,
+			"remote":    clientIP(r),
+		})
+		writeJSON(w, http.StatusOK, current)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAdminUsers manages access tokens. GET lists users with a token or
+// a stored key, POST {"user"} issues a token, shown only in the response,
+// and DELETE ?user= revokes all of a user's tokens. Tokens from the config
+// file can only be removed there.
+func handleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		type userInfo struct {
+			User      string   `json:"user"`
+			Tokens    []string `json:"tokens"`
+			Providers []string `json:"providers"`
+		}
+		byUser := map[string]*userInfo{}
+		get := func(user string) *userInfo {
+			if byUser[user] == nil {
+				byUser[user] = &userInfo{User: user, Tokens: []string{}, Providers: []string{}}
+			}
+			return byUser[user]
+		}
+		if accessTokens != nil {
+			for user, sources := range accessTokens.users() {
+				get(user).Tokens = sources
+			}
+		}
+		if keyVault != nil {
+			for _, name := range keyVault.providers() {
+				if rest, ok := strings.CutPrefix(name, "user/"); ok {
+					if i := strings.LastIndex(rest, "/"); i > 0 {
+						u := get(rest[:i])
+						u.Providers = append(u.Providers, rest[i+1:])
+					}
+				}
+			}
+		}
+		users := make([]*userInfo, 0, len(byUser))
+		for _, u := range byUser {
+			users = append(users, u)
+		}
+		sort.Slice(users, func(i, j int) bool { return users[i].User < users[j].User })
+		writeJSON(w, http.StatusOK, map[string]interface{}{"users": users})
+
+	case "POST":
+		if accessTokens == nil {
+			http.Error(w, "Access tokens are not enabled; configure [auth] first", http.StatusConflict)
+			return
+		}
+		var body struct {
+			User string `json:"user"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeDecodeError(w, err)
+			return
+		}
+		if body.User == "" || strings.ContainsAny(body.User, " \t\r\n#") {
+			http.Error(w, "User required, without spaces or '#'", http.StatusBadRequest)
+			return
+		}
+		token, err := accessTokens.issue(body.User)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit.record("token.issued", map[string]interface{}{
+			"user":        body.User,
+			"fingerprint": keyFingerprint(token),
+			"remote":      clientIP(r),
+		})
+		writeJSON(w, http.StatusCreated, map[string]string{"user": body.User, "token": token})
+
+	case "DELETE":
+		if accessTokens == nil {
+			http.Error(w, "Access tokens are not enabled", http.StatusConflict)
+			return
+		}
+		user := r.URL.Query().Get("user")
+		n, err := accessTokens.revoke(user)
+		if errors.Is(err, errConfigToken) {
+			http.Error(w, "Token for "+user+" is set in the config file", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n == 0 {
+			http.Error(w, "No tokens for "+user, http.StatusNotFound)
+			return
+		}
+		audit.record("token.revoked", map[string]interface{}{
+			"user":   user,
+			"tokens": n,
+			"remote": clientIP(r),
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAdminStats is a one-call overview of the running proxy: uptime,
+// queues, today's usage, cache size and the limits in force.
+func handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	out := map[string]interface{}{
+		"started":        started.UTC().Format(time.RFC3339),
+		"uptime_seconds": int64(time.Since(started).Seconds()),
+		"ready":          ready.Load(),
+		"queue":          queueSnapshot(),
+		"circuits":       circuits.snapshot(),
+		"today":          tokenSpend(time.Now()),
+		"rate_limits":    currentRateLimits(),
+	}
+	if cache != nil {
+		out["cache_entries"] = cache.len()
+	}
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// modelAliases maps names like "fast" or "smart" to a concrete provider and
+// model, so clients and saved conversations keep working when a model is
+// retired: only the alias in the config changes. They start from
+// [aliases] and can be changed at runtime through the admin API.
+type modelAliases struct {
+	mu      sync.RWMutex
+	targets map[string]ChatTarget
+}
+
+var aliases = &modelAliases{targets: map[string]ChatTarget{}}
+
+func validateAliases(m map[string]ChatTarget) []error {
+	var errs []error
+	for name, t := range m {
+		if name == "" {
+			errs = append(errs, fmt.Errorf("aliases: empty alias name"))
+		}
+		errs = append(errs, t.validate("aliases."+name)...)
+	}
+	return errs
+}
+
+func (a *modelAliases) set(m map[string]ChatTarget) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.targets = make(map[string]ChatTarget, len(m))
+	for name, t := range m {
+		a.targets[name] = t
+	}
+}
+
+func (a *modelAliases) lookup(name string) (ChatTarget, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	t, ok := a.targets[name]
+	return t, ok
+}
+
+// resolveChat replaces an aliased model in cr with its target. A request
+// that names a provider must name the alias's.
+func (a *modelAliases) resolveChat(cr *chatRequest) error {
+	t, ok := a.lookup(cr.Model)
+	if !ok {
+		return nil
+	}
+	if cr.Provider != "" && cr.Provider != t.Provider {
+		return badRequest(fmt.Sprintf("Model alias %s is for %s, not %s", cr.Model, t.Provider, cr.Provider))
+	}
+	cr.Provider, cr.Model = t.Provider, t.Model
+	return nil
+}
+
+// resolveModel maps an alias to its model for a provider route, where the
+// provider is fixed; aliases for other providers are left alone.
+func (a *modelAliases) resolveModel(provider, model string) string {
+	if t, ok := a.lookup(model); ok && t.Provider == provider {
+		return t.Model
+	}
+	return model
+}
+
+// handleAdminAliases lists aliases (GET), adds or replaces one with
+// {"alias", "provider", "model"} (PUT) and removes one with ?alias= (DELETE).
+// Changes last until restart.
+func handleAdminAliases(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		aliases.mu.RLock()
+		out := make([]map[string]string, 0, len(aliases.targets))
+		for name, t := range aliases.targets {
+			out = append(out, map[string]string{"alias": name, "provider": t.Provider, "model": t.Model})
+		}
+		aliases.mu.RUnlock()
+		sort.Slice(out, func(i, j int) bool { return out[i]["alias"] < out[j]["alias"] })
+		writeJSON(w, http.StatusOK, map[string]interface{}{"aliases": out})
+
+	case "PUT":
+		var body struct {
+			Alias string `json:"alias"`
+			ChatTarget
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeDecodeError(w, err)
+			return
+		}
+		if errs := validateAliases(map[string]ChatTarget{body.Alias: body.ChatTarget}); len(errs) > 0 {
+			http.Error(w, errs[0].Error(), http.StatusBadRequest)
+			return
+		}
+		aliases.mu.Lock()
+		previous := aliases.targets[body.Alias]
+		aliases.targets[body.Alias] = body.ChatTarget
+		aliases.mu.Unlock()
+		audit.record("alias.set", map[string]interface{}{
+			"alias":    body.Alias,
+			"previous": previous,
+			"current":  body.ChatTarget,
+			"remote":   clientIP(r),
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	case "DELETE":
+		name := r.URL.Query().Get("alias")
+		aliases.mu.Lock()
+		_, ok := aliases.targets[name]
+		delete(aliases.targets, name)
+		aliases.mu.Unlock()
+		if !ok {
+			http.Error(w, "No alias "+name, http.StatusNotFound)
+			return
+		}
+		audit.record("alias.deleted", map[string]interface{}{"alias": name, "remote": clientIP(r)})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+func init() {
+	registerProvider(&providerSpec{
+		name:     "anthropic",
+		endpoint: "https://api.anthropic.com/v1/messages",
+		dialect:  &anthropicDialect,
+		build:    buildAnthropicRequest,
+	})
+}
+
+func buildAnthropicRequest(p *providerSpec, body map[string]interface{}, apiKey string) (*http.Request, error) {
+	autoCacheSystem(body)
+	req, err := newJSONRequest(p.Endpoint(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-api-key", apiKey)
+	req.Header.Set("anthropic-version", "2023-06-01")
+	return req, nil
+}
+
+// countTokensRequest is a request for Anthropic's count_tokens endpoint,
+// which sits beside the messages one and takes the same body.
+func countTokensRequest(p Provider, body map[string]interface{}, apiKey string) (*http.Request, error) {
+	req, err := p.BuildRequest(body, apiKey)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.Path = strings.TrimSuffix(req.URL.Path, "/") + "/count_tokens"
+	return req, nil
+}
+
+// handleAnthropicCountTokens relays a messages body to count_tokens, for an
+// exact count of a prompt with its tools and images before sending it. Keys
+// are taken as on /api/anthropic. Counting is free, so neither budgets nor
+// token quotas apply.
+func handleAnthropicCountTokens(w http.ResponseWriter, r *http.Request) {
+	p, _ := lookupProvider("anthropic")
+	body, ok := readJSONBody(w, r)
+	if !ok {
+		return
+	}
+	profile := takeString(body, "keyProfile", r.Header.Get("X-Key-Profile"))
+	apiKey, err := resolveAPIKey(p, recordFrom(r).user(), takeString(body, "apiKey", ""), profile)
+	if err == nil {
+		err = allowBetas(r)
+	}
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	delete(body, "stream")
+	model, _ := body["model"].(string)
+	if resolved := aliases.resolveModel(p.Name(), model); resolved != model {
+		model, body["model"] = resolved, resolved
+	}
+	rec := recordFrom(r)
+	rec.describe(p.Name(), model, false, body)
+	rec.setKey(apiKey)
+
+	req, err := countTokensRequest(p, body, apiKey)
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	release, err := acquireUpstream(w, r, p)
+	if err != nil {
+		writeAcquireError(w, err)
+		return
+	}
+	defer release()
+	forward(w, p, req.WithContext(r.Context()))
+}
+
+// anthropicMessages gives a message with images content blocks, each image
+// a base64 source ahead of the text. Tool calls become tool_use blocks, and
+// tool results tool_result blocks in a user message, one for a run of them.
+func anthropicMessages(messages []chatMessage) []interface{} {
+	out := make([]interface{}, 0, len(messages))
+	var results map[string]interface{} // the user message results go in
+	for _, m := range messages {
+		if m.Role == "tool" {
+			block := map[string]interface{}{"type": "tool_result", "tool_use_id": m.ToolCallID, "content": m.Content}
+			if results == nil {
+				results = map[string]interface{}{"role": "user", "content": []interface{}{}}
+				out = append(out, results)
+			}
+			setIf(block, "cache_control", m.CacheControl, len(m.CacheControl) > 0)
+			results["content"] = append(results["content"].([]interface{}), block)
+			continue
+		}
+		results = nil
+		if len(m.ToolCalls) > 0 {
+			blocks := append(anthropicThinking(m), anthropicToolBlocks(m)...)
+			out = append(out, map[string]interface{}{"role": m.Role, "content": cacheLastBlock(blocks, m.CacheControl)})
+			continue
+		}
+		if len(m.images) == 0 && len(m.Thinking) == 0 {
+			var content interface{} = m.Content
+			if len(m.CacheControl) > 0 {
+				content = cachedText(m.Content, m.CacheControl)
+			}
+			out = append(out, map[string]interface{}{"role": m.Role, "content": content})
+			continue
+		}
+		blocks := anthropicThinking(m)
+		for _, img := range m.images {
+			blocks = append(blocks, map[string]interface{}{
+				"type":   "image",
+				"source": map[string]interface{}{"type": "base64", "media_type": img.MediaType, "data": img.base64()},
+			})
+		}
+		if m.Content != "" {
+			blocks = append(blocks, map[string]interface{}{"type": "text", "text": m.Content})
+		}
+		out = append(out, map[string]interface{}{"role": m.Role, "content": cacheLastBlock(blocks, m.CacheControl)})
+	}
+	return out
+}
+
+var anthropicDialect = chatDialect{
+	schema: anthropicSchema,
+	body: func(cr *chatRequest) map[string]interface{} {
+		maxTokens := cr.MaxTokens
+		if maxTokens == 0 {
+			maxTokens = 4096 // required by the messages API
+			if cr.Thinking != nil {
+				maxTokens += cr.Thinking.BudgetTokens
+			}
+		}
+		body := map[string]interface{}{
+			"model":      cr.Model,
+			"messages":   anthropicMessages(cr.Messages),
+			"max_tokens": maxTokens,
+		}
+		switch {
+		case cr.System != "" && len(cr.systemCache) > 0:
+			body["system"] = cachedText(cr.System, cr.systemCache)
+		case cr.System != "":
+			body["system"] = cr.System
+		}
+		setIf(body, "temperature", cr.Temperature, cr.Temperature != nil)
+		setIf(body, "top_p", cr.TopP, cr.TopP != nil)
+		setIf(body, "stop_sequences", cr.Stop, len(cr.Stop) > 0)
+		setIf(body, "stream", true, cr.Stream)
+		if t := cr.Thinking; t != nil {
+			body["thinking"] = map[string]interface{}{"type": firstSet(t.Type, "enabled"), "budget_tokens": t.BudgetTokens}
+		}
+		if len(cr.Tools) > 0 {
+			anthropicTools(body, cr)
+		} else if len(cr.OutputSchema) > 0 {
+			anthropicStructured(body, cr)
+		}
+		return body
+	},
+	parse: func(data []byte) (*chatResponse, error) {
+		var r struct {
+			Model   string `json:"model"`
+			Content []struct {
+				Type      string          `json:"type"`
+				Text      string          `json:"text"`
+				ID        string          `json:"id"`
+				Name      string          `json:"name"`
+				Input     json.RawMessage `json:"input"`
+				Thinking  string          `json:"thinking"`
+				Signature string          `json:"signature"`
+				Data      string          `json:"data"`
+			} `json:"content"`
+			StopReason string    `json:"stop_reason"`
+			Usage      chatUsage `json:"usage"`
+		}
+		if err := json.Unmarshal(data, &r); err != nil {
+			return nil, err
+		}
+		var text strings.Builder
+		var calls []toolCall
+		var thinking []thinkingBlock
+		for _, c := range r.Content {
+			switch {
+			case isThinking(c.Type):
+				thinking = append(thinking, thinkingBlock{Type: c.Type, Thinking: c.Thinking, Signature: c.Signature, Data: c.Data})
+			case c.Type == "text":
+				text.WriteString(c.Text)
+			case c.Type == "tool_use" && c.Name == structuredTool:
+				// The structured reply is the reply; any text before it
+				// was the model thinking aloud.
+				text.Reset()
+				text.Write(c.Input)
+				r.StopReason = "end_turn"
+			case c.Type == "tool_use":
+				calls = append(calls, toolCall{ID: c.ID, Name: c.Name, Arguments: toolArguments(c.Input)})
+			}
+		}
+		return &chatResponse{Model: r.Model, Content: text.String(), StopReason: r.StopReason, Usage: r.Usage, ToolCalls: calls, Thinking: thinking}, nil
+	},
+	event: func(s *chatStream, _ string, data []byte) (string, bool) {
+		var ev struct {
+			Type    string `json:"type"`
+			Message struct {
+				Usage chatUsage `json:"usage"`
+			} `json:"message"`
+			ContentBlock struct {
+				Type string `json:"type"`
+				ID   string `json:"id"`
+				Name string `json:"name"`
+				Data string `json:"data"`
+			} `json:"content_block"`
+			Delta struct {
+				Type        string `json:"type"`
+				Text        string `json:"text"`
+				PartialJSON string `json:"partial_json"`
+				Thinking    string `json:"thinking"`
+				Signature   string `json:"signature"`
+				StopReason  string `json:"stop_reason"`
+			} `json:"delta"`
+			Usage chatUsage `json:"usage"`
+		}
+		if json.Unmarshal(data, &ev) != nil {
+			return "", false
+		}
+		switch ev.Type {
+		case "message_start":
+			u := ev.Message.Usage
+			s.usage.InputTokens = u.InputTokens
+			s.usage.CacheCreationInputTokens, s.usage.CacheReadInputTokens = u.CacheCreationInputTokens, u.CacheReadInputTokens
+		case "content_block_start":
+			if isThinking(ev.ContentBlock.Type) {
+				s.thinking = append(s.thinking, thinkingBlock{Type: ev.ContentBlock.Type, Data: ev.ContentBlock.Data})
+			} else if ev.ContentBlock.Type == "tool_use" && ev.ContentBlock.Name == structuredTool {
+				s.structured = true
+			} else if ev.ContentBlock.Type == "tool_use" {
+				s.startCall(ev.ContentBlock.ID, ev.ContentBlock.Name)
+			}
+		case "content_block_delta":
+			switch {
+			case ev.Delta.Type == "text_delta" && !s.structured:
+				return ev.Delta.Text, false
+			case ev.Delta.Type == "input_json_delta" && s.structured:
+				return ev.Delta.PartialJSON, false
+			case ev.Delta.Type == "input_json_delta":
+				s.callDelta(len(s.calls)-1, ev.Delta.PartialJSON)
+			case ev.Delta.Type == "thinking_delta" && len(s.thinking) > 0:
+				s.thinking[len(s.thinking)-1].Thinking += ev.Delta.Thinking
+				s.relayed += len(ev.Delta.Thinking)
+				s.pending = append(s.pending, chatStreamEvent{Type: "thinking", Text: ev.Delta.Thinking})
+			case ev.Delta.Type == "signature_delta" && len(s.thinking) > 0:
+				s.thinking[len(s.thinking)-1].Signature += ev.Delta.Signature
+			}
+		case "message_delta":
+			s.stopReason = ev.Delta.StopReason
+			if s.structured && s.stopReason == "tool_use" {
+				s.stopReason = "end_turn"
+			}
+			s.usage.OutputTokens = ev.Usage.OutputTokens
+		case "message_stop":
+			return "", true
+		}
+		return "", false
+	},
+	tools:    true,
+	thinking: true,
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Anthropic turns on beta features per request with a comma-separated
+// anthropic-beta header. Betas set in a provider's headers go on every
+// request; clients may add those anthropic_betas allows.
+const betaHeader = "anthropic-beta"
+
+// splitBetas is the beta names in anthropic-beta header values.
+func splitBetas(values []string) []string {
+	var betas []string
+	for _, v := range values {
+		for _, b := range strings.Split(v, ",") {
+			if b = strings.TrimSpace(b); b != "" && !slices.Contains(betas, b) {
+				betas = append(betas, b)
+			}
+		}
+	}
+	return betas
+}
+
+// allowBetas checks the betas a client asked for against anthropic_betas
+// ("*" allows any) and keeps them on the request's record for doUpstream.
+func allowBetas(r *http.Request) error {
+	betas := splitBetas(r.Header.Values(betaHeader))
+	allowed := config.AnthropicBetas
+	for _, b := range betas {
+		if !slices.Contains(allowed, "*") && !slices.Contains(allowed, b) {
+			return badRequest(fmt.Sprintf("%s: %q is not an allowed beta", betaHeader, b))
+		}
+	}
+	if rec := recordFrom(r); rec != nil {
+		rec.Betas = betas
+	}
+	return nil
+}
+
+// setBetas adds the client's betas to those already on an upstream
+// Anthropic request.
+func setBetas(req *http.Request) {
+	rec, _ := req.Context().Value(recordKey{}).(*requestRecord)
+	if rec == nil || len(rec.Betas) == 0 {
+		return
+	}
+	req.Header.Set(betaHeader, strings.Join(splitBetas(append(req.Header.Values(betaHeader), rec.Betas...)), ","))
+}
+
+// betaScope is name qualified by the request's betas, for cache keys:
+// a reply made with a beta is not one to serve without it.
+func betaScope(name string, rec *requestRecord) string {
+	if rec == nil || len(rec.Betas) == 0 {
+		return name
+	}
+	return name + "+" + strings.Join(rec.Betas, ",")
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthConfig requires an access token on /api routes once any token is
+// configured. Tokens say who may use the proxy; which provider key is
+// billed is still decided by the key settings.
+type AuthConfig struct {
+	Tokens []AccessToken `json:"tokens"`
+	// TokensFile holds one "user token" pair per line, # for comments. It
+	// is re-read when it changes.
+	TokensFile string `json:"tokens_file"`
+	// OwnKeysOnly stops authenticated users from falling back to shared
+	// server-side keys: each must store their own with /api/user/keys.
+	OwnKeysOnly bool `json:"own_keys_only"`
+}
+
+// AccessToken maps a token to the user it authenticates. Token may be
+// given as "sha256:<hex>" to keep plaintext out of the config.
+type AccessToken struct {
+	User  string `json:"user"`
+	Token string `json:"token"`
+}
+
+func (a AuthConfig) enabled() bool { return len(a.Tokens) > 0 || a.TokensFile != "" }
+
+func (a AuthConfig) validate() []error {
+	var errs []error
+	for i, t := range a.Tokens {
+		if t.User == "" || t.Token == "" {
+			errs = append(errs, fmt.Errorf("auth.tokens[%d]: user and token are required", i))
+		}
+	}
+	return errs
+}
+
+// tokenHash is how tokens are stored and compared: looking up a hash
+// keeps comparisons independent of how much of a guess was right.
+func tokenHash(token string) string {
+	if h, ok := strings.CutPrefix(token, "sha256:"); ok {
+		return strings.ToLower(h)
+	}
+	return sha256Hex([]byte(token))
+}
+
+// tokenStore resolves access tokens to users.
+type tokenStore struct {
+	static map[string]string // hash -> user, from config
+	path   string
+
+	mu      sync.Mutex
+	modTime time.Time
+	file    map[string]string
+	issued  map[string]string // from the admin API when there is no file
+}
+
+// errConfigToken is returned when revoking a token that only a config
+// change can remove.
+var errConfigToken = errors.New("token is set in the config file")
+
+var accessTokens *tokenStore
+
+func newTokenStore(a AuthConfig) (*tokenStore, error) {
+	s := &tokenStore{static: map[string]string{}, path: a.TokensFile, issued: map[string]string{}}
+	for _, t := range a.Tokens {
+		s.static[tokenHash(t.Token)] = t.User
+	}
+	if s.path != "" {
+		if err := s.refresh(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// refresh re-reads the tokens file if it changed since the last read.
+func (s *tokenStore) refresh() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	tokens := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		user, token, ok := strings.Cut(line, " ")
+		if token = strings.TrimSpace(token); !ok || token == "" {
+			return fmt.Errorf("%s:%d: want \"user token\"", s.path, n)
+		}
+		tokens[tokenHash(token)] = user
+	}
+	s.file, s.modTime = tokens, info.ModTime()
+	return nil
+}
+
+// user returns who token belongs to, or "" for an unknown token.
+func (s *tokenStore) user(token string) string {
+	h := tokenHash(token)
+	if u, ok := s.static[h]; ok {
+		return u
+	}
+	if s.path == "" {
+		return ""
+	}
+	if err := s.refresh(); err != nil {
+		slog.Warn("auth: tokens_file", "err", err) // keep the last good set
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.file[h]; ok {
+		return u
+	}
+	return s.issued[h]
+}
+
+// users lists each user with a token and where their tokens come from.
+func (s *tokenStore) users() map[string][]string {
+	if s.path != "" {
+		if err := s.refresh(); err != nil {
+			slog.Warn("auth: tokens_file", "err", err)
+		}
+	}
+	out := map[string][]string{}
+	add := func(tokens map[string]string, source string) {
+		for _, u := range tokens {
+			if !slices.Contains(out[u], source) {
+				out[u] = append(out[u], source)
+			}
+		}
+	}
+	add(s.static, "config")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	add(s.file, "tokens_file")
+	add(s.issued, "admin")
+	return out
+}
+
+// issue creates a token for user. It is appended to the tokens file, by
+// hash, when there is one; otherwise it lasts until restart.
+func (s *tokenStore) issue(user string) (string, error) {
+	token := randomToken()
+	h := tokenHash(token)
+	if s.path == "" {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.issued[h] = user
+		return token, nil
+	}
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	_, err = fmt.Fprintf(f, "%s sha256:%s\n", user, h)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	return token, s.refresh()
+}
+
+// revoke removes every token for user and reports how many there were.
+// Lines in the tokens file are rewritten in place, keeping comments.
+func (s *tokenStore) revoke(user string) (int, error) {
+	for _, u := range s.static {
+		if u == user {
+			return 0, errConfigToken
+		}
+	}
+	s.mu.Lock()
+	n := 0
+	for h, u := range s.issued {
+		if u == user {
+			delete(s.issued, h)
+			n++
+		}
+	}
+	s.mu.Unlock()
+	if s.path == "" {
+		return n, nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return n, err
+	}
+	var kept []string
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if u, _, _ := strings.Cut(strings.TrimSpace(line), " "); u == user {
+			n++
+			continue
+		}
+		kept = append(kept, line)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(kept, "")), 0o600); err != nil {
+		return n, err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return n, err
+	}
+	return n, s.refresh()
+}
+
+// authenticated requires a valid access token, as "Authorization: Bearer",
+// or a signed-in session when auth or OIDC is configured, and records the
+// user on the request.
+func authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if accessTokens == nil && oidc == nil {
+			next(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		user := ""
+		if ok && token != "" && accessTokens != nil {
+			user = accessTokens.user(token)
+		} else if !ok && oidc != nil {
+			user = sessions.user(r)
+		}
+		if user == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="quirk"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		recordFrom(r).setUser(user)
+		next(w, r)
+	}
+}
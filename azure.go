@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const azureDefaultAPIVersion = "2024-10-21"
+
+// Azure OpenAI. The resource, deployment and API version come from the
+// request body when present, falling back to AZURE_OPENAI_RESOURCE,
+// AZURE_OPENAI_DEPLOYMENT and AZURE_OPENAI_API_VERSION.
+func init() {
+	registerProvider(&providerSpec{
+		name:     "azure",
+		endpoint: "https://{resource}.openai.azure.com/openai/deployments/{deployment}/chat/completions?api-version={api-version}",
+		dialect:  &openAIDialect,
+		keyEnv:   "AZURE_OPENAI_API_KEY",
+		idHeader: "x-ms-client-request-id",
+		schema:   openAISchema.optional("model"), // the deployment picks it
+		build:    buildAzureRequest,
+	})
+}
+
+func buildAzureRequest(p *providerSpec, body map[string]interface{}, apiKey string) (*http.Request, error) {
+	resource := takeString(body, "resource", envOr("AZURE_OPENAI_RESOURCE", ""))
+	deployment := takeString(body, "deployment", envOr("AZURE_OPENAI_DEPLOYMENT", ""))
+	apiVersion := takeString(body, "apiVersion", envOr("AZURE_OPENAI_API_VERSION", azureDefaultAPIVersion))
+	if resource == "" || deployment == "" {
+		return nil, badRequest("Azure resource and deployment required")
+	}
+
+	endpoint := strings.NewReplacer(
+		"{resource}", url.PathEscape(resource),
+		"{deployment}", url.PathEscape(deployment),
+		"{api-version}", url.QueryEscape(apiVersion),
+	).Replace(p.Endpoint())
+	req, err := newJSONRequest(endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("api-key", apiKey)
+	return req, nil
+}
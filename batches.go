@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BatchConfig keeps the batches submitted through /api/batches, so their
+// results go back to whoever submitted them. Without DB they are held in
+// memory and forgotten on restart.
+type BatchConfig struct {
+	DB string `json:"db"`
+}
+
+// batchDiscount is what batched usage costs next to the same requests
+// made one by one.
+const batchDiscount = 0.5
+
+// maxBatchRequests is the most requests the Batch API takes in one file.
+const maxBatchRequests = 50000
+
+// batchEndpoints are the APIs a batch may call.
+var batchEndpoints = map[string]bool{"/v1/chat/completions": true, "/v1/embeddings": true, "/v1/responses": true}
+
+// batchJob is a submitted batch. Its status lives upstream.
+type batchJob struct {
+	ID       string    `json:"id"`
+	Endpoint string    `json:"endpoint"`
+	Model    string    `json:"model,omitempty"`
+	Requests int       `json:"requests"`
+	Created  time.Time `json:"created"`
+	user     string
+	keyID    string // fingerprint of the key that submitted it
+	profile  string
+	counted  bool // usage from the results has been recorded
+}
+
+type batchStore struct {
+	mu   sync.Mutex
+	jobs map[string]*batchJob
+	db   *sql.DB
+}
+
+var batches = &batchStore{jobs: map[string]*batchJob{}}
+
+const batchSchema = `CREATE TABLE IF NOT EXISTS batches (
+	id       TEXT PRIMARY KEY,
+	user     TEXT NOT NULL,
+	key_id   TEXT NOT NULL,
+	profile  TEXT NOT NULL,
+	endpoint TEXT NOT NULL,
+	model    TEXT NOT NULL,
+	requests INTEGER NOT NULL,
+	created  INTEGER NOT NULL,
+	counted  INTEGER NOT NULL
+)`
+
+// openBatches builds the store from config, loading the batches in its
+// database.
+func openBatches(c BatchConfig) (*batchStore, error) {
+	s := &batchStore{jobs: map[string]*batchJob{}}
+	if c.DB == "" {
+		return s, nil
+	}
+	db, err := sql.Open("sqlite", c.DB)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{"PRAGMA journal_mode=WAL", "PRAGMA busy_timeout=5000", batchSchema} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("batches: %w", err)
+		}
+	}
+	rows, err := db.Query(`SELECT id, user, key_id, profile, endpoint, model, requests, created, counted FROM batches`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("batches: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		j := &batchJob{}
+		var created int64
+		if err := rows.Scan(&j.ID, &j.user, &j.keyID, &j.profile, &j.Endpoint, &j.Model, &j.Requests, &created, &j.counted); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("batches: %w", err)
+		}
+		j.Created = time.Unix(created, 0)
+		s.jobs[j.ID] = j
+	}
+	s.db = db
+	return s, rows.Err()
+}
+
+func (s *batchStore) put(j *batchJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db != nil {
+		if _, err := s.db.Exec(`INSERT OR REPLACE INTO batches (id, user, key_id, profile, endpoint, model, requests, created, counted)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, j.ID, j.user, j.keyID, j.profile, j.Endpoint, j.Model, j.Requests, j.Created.Unix(), j.counted); err != nil {
+			return err
+		}
+	}
+	s.jobs[j.ID] = j
+	return nil
+}
+
+// get returns batch id if user submitted it, or nil.
+func (s *batchStore) get(id, user string) *batchJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if j := s.jobs[id]; j != nil && j.user == user {
+		return j
+	}
+	return nil
+}
+
+// count marks a batch's usage recorded, reporting false if it already was.
+func (s *batchStore) count(j *batchJob) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if j.counted {
+		return false
+	}
+	j.counted = true
+	if s.db != nil {
+		s.db.Exec(`UPDATE batches SET counted = 1 WHERE id = ?`, j.ID)
+	}
+	return true
+}
+
+func (s *batchStore) list(user string) []*batchJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []*batchJob{}
+	for _, j := range s.jobs {
+		if j.user == user {
+			out = append(out, j)
+		}
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].Created.After(out[b].Created) })
+	return out
+}
+
+// batchLine is one request in a batch file. Method and URL may be left
+// out; they default to POST and the batch's endpoint.
+type batchLine struct {
+	CustomID string                 `json:"custom_id"`
+	Method   string                 `json:"method,omitempty"`
+	URL      string                 `json:"url,omitempty"`
+	Body     map[string]interface{} `json:"body"`
+}
+
+// readBatch checks a JSONL batch and completes its lines, returning them
+// and the first model named.
+func readBatch(r io.Reader, endpoint string) (lines []batchLine, model string, err error) {
+	seen := map[string]bool{}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64<<10), 16<<20)
+	for line := 1; sc.Scan(); line++ {
+		text := bytes.TrimSpace(sc.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		var bl batchLine
+		if err := json.Unmarshal(text, &bl); err != nil {
+			return nil, "", badRequest(fmt.Sprintf("line %d: not a JSON object", line))
+		}
+		switch {
+		case bl.CustomID == "":
+			return nil, "", badRequest(fmt.Sprintf("line %d: custom_id: required", line))
+		case seen[bl.CustomID]:
+			return nil, "", badRequest(fmt.Sprintf("line %d: custom_id: %q is used twice", line, bl.CustomID))
+		case bl.Body == nil:
+			return nil, "", badRequest(fmt.Sprintf("line %d: body: required", line))
+		case bl.URL != "" && bl.URL != endpoint:
+			return nil, "", badRequest(fmt.Sprintf("line %d: url: %q is not the batch's endpoint %s", line, bl.URL, endpoint))
+		case bl.Method != "" && bl.Method != "POST":
+			return nil, "", badRequest(fmt.Sprintf("line %d: method: must be POST", line))
+		}
+		seen[bl.CustomID] = true
+		bl.Method, bl.URL = "POST", endpoint
+		m, _ := bl.Body["model"].(string)
+		if resolved := aliases.resolveModel("openai", m); resolved != m {
+			m, bl.Body["model"] = resolved, resolved
+		}
+		if model == "" {
+			model = m
+		}
+		if len(lines) == maxBatchRequests {
+			return nil, "", badRequest(fmt.Sprintf("A batch holds at most %d requests", maxBatchRequests))
+		}
+		lines = append(lines, bl)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, "", err
+	}
+	if len(lines) == 0 {
+		return nil, "", badRequest("The batch has no requests")
+	}
+	return lines, model, nil
+}
+
+// batchFile is the JSONL file to upload for lines, with the configured
+// system prompt added to each.
+func batchFile(lines []batchLine, endpoint string) ([]byte, error) {
+	var out bytes.Buffer
+	for _, bl := range lines {
+		switch endpoint {
+		case "/v1/chat/completions":
+			injectSystem(bl.Body, "openai", &openAIDialect)
+		case "/v1/responses":
+			injectInstructions(bl.Body, "openai", "responses")
+		}
+		raw, err := json.Marshal(bl)
+		if err != nil {
+			return nil, err
+		}
+		out.Write(raw)
+		out.WriteByte('\n')
+	}
+	return out.Bytes(), nil
+}
+
+// handleBatches runs OpenAI batches through the proxy. POST /api/batches
+// submits a JSONL body, one request per line, for ?endpoint (chat
+// completions by default); GET lists the caller's batches. GET
+// /api/batches/{id} reports a batch's status, POST .../cancel cancels it
+// and GET .../results returns its output as JSONL (?errors=true for the
+// failed requests). Usage in the results is recorded once, at the batch
+// discount.
+func handleBatches(w http.ResponseWriter, r *http.Request) {
+	p, _ := lookupProvider("openai")
+	rec := recordFrom(r)
+	user := rec.user()
+	id, action, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/batches"), "/"), "/")
+	if id == "" {
+		switch r.Method {
+		case "GET":
+			writeJSON(w, http.StatusOK, map[string]interface{}{"batches": batches.list(user)})
+		case "POST":
+			submitBatch(w, r, p)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	j := batches.get(id, user)
+	if j == nil {
+		http.Error(w, "No batch "+id, http.StatusNotFound)
+		return
+	}
+	apiKey, err := batchKey(p, j)
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	rec.describe(p.Name(), j.Model, false, map[string]interface{}{"batch": id, "action": action})
+	rec.setKey(apiKey)
+	t := ChatTarget{p.Name(), j.Model}
+	base := strings.TrimSuffix(p.Endpoint(), "/chat/completions")
+	switch {
+	case action == "" && r.Method == "GET":
+		raw, fail := batchCall(w, r, p, t, "GET", base+"/batches/"+id, "", nil, apiKey)
+		if fail != nil {
+			fail.write(w)
+			return
+		}
+		writeRaw(w, raw)
+	case action == "cancel" && r.Method == "POST":
+		raw, fail := batchCall(w, r, p, t, "POST", base+"/batches/"+id+"/cancel", "", nil, apiKey)
+		if fail != nil {
+			fail.write(w)
+			return
+		}
+		writeRaw(w, raw)
+	case action == "results" && r.Method == "GET":
+		batchResults(w, r, p, j, apiKey, r.URL.Query().Get("errors") == "true")
+	case action == "" || action == "cancel" || action == "results":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.Error(w, "No batch action "+action, http.StatusNotFound)
+	}
+}
+
+// submitBatch uploads the batch file and creates the batch.
+func submitBatch(w http.ResponseWriter, r *http.Request, p Provider) {
+	q := r.URL.Query()
+	endpoint := firstSet(q.Get("endpoint"), "/v1/chat/completions")
+	if !batchEndpoints[endpoint] {
+		http.Error(w, fmt.Sprintf("endpoint: %q is not /v1/chat/completions, /v1/embeddings or /v1/responses", endpoint), http.StatusBadRequest)
+		return
+	}
+	lines, model, err := readBatch(r.Body, endpoint)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeTooLarge(w, tooLarge.Limit)
+			return
+		}
+		writeBuildError(w, err)
+		return
+	}
+	rec := recordFrom(r)
+	n := len(lines)
+	bodies := make([]map[string]interface{}, n)
+	for i, bl := range lines {
+		m, _ := bl.Body["model"].(string)
+		truncated, err := limitProviderBody(bl.Body, p.Name(), m, rec.user())
+		if err != nil {
+			writeBuildError(w, badRequest(fmt.Sprintf("custom_id %q: %v", bl.CustomID, err)))
+			return
+		}
+		markTruncated(w, truncated)
+		bodies[i] = bl.Body
+	}
+	if !checkPrompts(w, r, bodies...) {
+		return
+	}
+	file, err := batchFile(lines, endpoint)
+	if err != nil {
+		http.Error(w, "Encoding batch: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	profile := firstSet(q.Get("keyProfile"), r.Header.Get("X-Key-Profile"))
+	apiKey, err := resolveAPIKey(p, rec.user(), "", profile)
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	rec.describe(p.Name(), model, false, map[string]interface{}{"endpoint": endpoint, "requests": n})
+	rec.setKey(apiKey)
+	t := ChatTarget{p.Name(), model}
+	if err := checkBudgets(w, rec, p.Name(), apiKey); err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	base := strings.TrimSuffix(p.Endpoint(), "/chat/completions")
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	mw.WriteField("purpose", "batch")
+	part := textproto.MIMEHeader{}
+	part.Set("Content-Disposition", `form-data; name="file"; filename="batch.jsonl"`)
+	part.Set("Content-Type", "application/jsonl")
+	fw, _ := mw.CreatePart(part)
+	fw.Write(file)
+	mw.Close()
+	raw, fail := batchCall(w, r, p, t, "POST", base+"/files", mw.FormDataContentType(), form.Bytes(), apiKey)
+	if fail != nil {
+		fail.write(w)
+		return
+	}
+	var uploaded struct {
+		ID string `json:"id"`
+	}
+	if json.Unmarshal(raw, &uploaded); uploaded.ID == "" {
+		http.Error(w, "Unexpected upstream response to the file upload", http.StatusBadGateway)
+		return
+	}
+
+	create := map[string]interface{}{
+		"input_file_id":     uploaded.ID,
+		"endpoint":          endpoint,
+		"completion_window": firstSet(q.Get("completion_window"), "24h"),
+	}
+	if user := rec.user(); user != "" {
+		create["metadata"] = map[string]string{"quirk_user": user}
+	}
+	body, _ := json.Marshal(create)
+	raw, fail = batchCall(w, r, p, t, "POST", base+"/batches", "application/json", body, apiKey)
+	if fail != nil {
+		fail.write(w)
+		return
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if json.Unmarshal(raw, &created); created.ID == "" {
+		http.Error(w, "Unexpected upstream response to the batch", http.StatusBadGateway)
+		return
+	}
+	j := &batchJob{
+		ID: created.ID, Endpoint: endpoint, Model: model, Requests: n, Created: time.Now(),
+		user: rec.user(), keyID: keyFingerprint(apiKey), profile: profile,
+	}
+	if err := batches.put(j); err != nil {
+		http.Error(w, "Saving batch: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(raw)
+}
+
+// batchKey is the key that submitted j, which alone can see it. A key pool
+// may hand out another, so the pool is searched for the one used.
+func batchKey(p Provider, j *batchJob) (string, error) {
+	key, err := resolveAPIKey(p, j.user, "", j.profile)
+	if err != nil || keyFingerprint(key) == j.keyID {
+		return key, err
+	}
+	if pool := poolFor(p.Name()); pool != nil {
+		if key := pool.lookup(j.keyID); key != "" {
+			return key, nil
+		}
+	}
+	return "", fmt.Errorf("The key batch %s was submitted with is no longer configured", j.ID)
+}
+
+// batchCall makes one buffered upstream call, returning its body.
+func batchCall(w http.ResponseWriter, r *http.Request, p Provider, t ChatTarget, method, url, contentType string, body []byte, apiKey string) ([]byte, *chatFailure) {
+	failed := func(err error, upstream bool) ([]byte, *chatFailure) {
+		return nil, &chatFailure{target: t, err: err, upstream: upstream}
+	}
+	var data io.Reader
+	if body != nil {
+		data = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(r.Context(), method, url, data)
+	if err != nil {
+		return failed(err, false)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	release, err := acquireUpstream(w, r, p)
+	if err != nil {
+		return failed(err, false)
+	}
+	defer release()
+	resp, err := doUpstream(p, req)
+	if err != nil {
+		return failed(err, true)
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return failed(err, true)
+	}
+	if resp.StatusCode >= 300 {
+		return nil, &chatFailure{target: t, status: resp.StatusCode, body: raw, upstream: true}
+	}
+	return raw, nil
+}
+
+// batchResults relays a finished batch's output file line by line, adding
+// up the usage of each response on the way.
+func batchResults(w http.ResponseWriter, r *http.Request, p Provider, j *batchJob, apiKey string, failures bool) {
+	t := ChatTarget{p.Name(), j.Model}
+	base := strings.TrimSuffix(p.Endpoint(), "/chat/completions")
+	raw, fail := batchCall(w, r, p, t, "GET", base+"/batches/"+j.ID, "", nil, apiKey)
+	if fail != nil {
+		fail.write(w)
+		return
+	}
+	var b struct {
+		Status       string `json:"status"`
+		OutputFileID string `json:"output_file_id"`
+		ErrorFileID  string `json:"error_file_id"`
+	}
+	json.Unmarshal(raw, &b)
+	fileID := b.OutputFileID
+	if failures {
+		fileID = b.ErrorFileID
+	}
+	if fileID == "" {
+		if b.Status == "completed" || b.Status == "expired" || b.Status == "cancelled" {
+			http.Error(w, "Batch "+j.ID+" has no such results", http.StatusNotFound)
+		} else {
+			http.Error(w, "Batch "+j.ID+" is "+b.Status+"; results are not ready", http.StatusConflict)
+		}
+		return
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), "GET", base+"/files/"+fileID+"/content", nil)
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	release, err := acquireUpstream(w, r, p)
+	if err != nil {
+		writeAcquireError(w, err)
+		return
+	}
+	defer release()
+	resp, err := doUpstream(p, req)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		raw, _ := io.ReadAll(resp.Body)
+		(&chatFailure{target: t, status: resp.StatusCode, body: raw, upstream: true}).write(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/jsonl")
+	w.WriteHeader(http.StatusOK)
+	var usage chatUsage
+	br := bufio.NewReaderSize(resp.Body, 64<<10)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			var out struct {
+				Response struct {
+					Body struct {
+						Usage resourceUsage `json:"usage"`
+					} `json:"body"`
+				} `json:"response"`
+			}
+			if json.Unmarshal(line, &out) == nil {
+				usage.add(out.Response.Body.Usage.chat())
+			}
+			if _, err := w.Write(line); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				return
+			}
+			break
+		}
+	}
+	if !failures && batches.count(j) {
+		rec := recordFrom(r)
+		rec.Batch = true
+		rec.setUsage(usage)
+	}
+}
+
+// writeRaw relays an upstream JSON body as it is.
+func writeRaw(w http.ResponseWriter, raw []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(raw)
+}
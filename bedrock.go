@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Bedrock. The body is the model's native payload (Anthropic messages
+// for Claude) plus "model" (the Bedrock model ID), an optional "stream" flag
+// and an optional "region". Requests are signed with SigV4 using credentials
+// from the standard AWS chain, so no apiKey is needed.
+func init() {
+	registerProvider(&providerSpec{
+		name:      "bedrock",
+		endpoint:  "https://bedrock-runtime.{region}.amazonaws.com/model/{model}/{action}",
+		dialect:   &anthropicDialect,
+		keyless:   true,
+		build:     buildBedrockRequest,
+		transform: bedrockStreamToSSE,
+	})
+}
+
+// awsRegion matches region names like us-east-1 or ap-southeast-2. The
+// region goes into the upstream host, so anything else is refused.
+var awsRegion = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d+$`)
+
+func buildBedrockRequest(p *providerSpec, body map[string]interface{}, _ string) (*http.Request, error) {
+	model := takeString(body, "model", "")
+	if model == "" {
+		return nil, badRequest("Model required")
+	}
+	region := takeString(body, "region", envOr("AWS_REGION", envOr("AWS_DEFAULT_REGION", "us-east-1")))
+	if !awsRegion.MatchString(region) {
+		return nil, badRequest("Bad region: " + region)
+	}
+	stream, _ := body["stream"].(bool)
+	delete(body, "stream")
+
+	// Claude on Bedrock takes the version in the body instead of a header
+	if strings.Contains(model, "anthropic.") {
+		if _, ok := body["anthropic_version"]; !ok {
+			body["anthropic_version"] = "bedrock-2023-05-31"
+		}
+	}
+
+	creds, err := loadAWSCredentials()
+	if err != nil {
+		return nil, errors.New("AWS credentials: " + err.Error())
+	}
+
+	action := "invoke"
+	if stream {
+		action = "invoke-with-response-stream"
+	}
+	endpoint := strings.NewReplacer(
+		"{region}", region,
+		"{model}", awsURIEncode(model),
+		"{action}", action,
+	).Replace(p.Endpoint())
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	signSigV4(req, payload, creds, region, "bedrock", time.Now())
+	return req, nil
+}
+
+// bedrockStreamToSSE re-encodes Bedrock's binary event stream as SSE, so a
+// streamed Claude response looks the same as one from the Anthropic API.
+func bedrockStreamToSSE(resp *http.Response) error {
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/vnd.amazon.eventstream") {
+		return nil
+	}
+	pr, pw := io.Pipe()
+	upstream := resp.Body
+	go func() {
+		pw.CloseWithError(writeBedrockSSE(pw, upstream))
+	}()
+	resp.Body = &pipedBody{PipeReader: pr, upstream: upstream}
+	resp.Header.Set("Content-Type", "text/event-stream")
+	resp.Header.Del("Content-Length")
+	return nil
+}
+
+// pipedBody closes both the converted stream and the upstream body.
+type pipedBody struct {
+	*io.PipeReader
+	upstream io.Closer
+}
+
+func (b *pipedBody) Close() error {
+	b.PipeReader.Close()
+	return b.upstream.Close()
+}
+
+func writeBedrockSSE(w io.Writer, r io.Reader) error {
+	for {
+		headers, payload, err := readEventStreamMessage(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			slog.Warn("bedrock stream error", "err", err)
+			return err
+		}
+
+		var event string
+		var data []byte
+		switch headers[":message-type"] {
+		case "event":
+			var chunk struct {
+				Bytes string `json:"bytes"`
+			}
+			if err := json.Unmarshal(payload, &chunk); err != nil {
+				return err
+			}
+			data, err = base64.StdEncoding.DecodeString(chunk.Bytes)
+			if err != nil {
+				return err
+			}
+			var typed struct {
+				Type string `json:"type"`
+			}
+			json.Unmarshal(data, &typed)
+			event = typed.Type
+		default:
+			event, data = "error", payload
+			if t := headers[":exception-type"]; t != "" {
+				data, _ = json.Marshal(map[string]interface{}{
+					"type":  "error",
+					"error": map[string]string{"type": t, "message": string(payload)},
+				})
+			}
+		}
+
+		if event != "" {
+			if _, err := fmt.Fprintf(w, "event: %s\n", event); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return err
+		}
+	}
+}
+
+// readEventStreamMessage reads one frame of the AWS event stream encoding:
+// a 12 byte prelude, binary headers, the payload and a trailing CRC.
+func readEventStreamMessage(r io.Reader) (map[string]string, []byte, error) {
+	var prelude [12]byte
+	if _, err := io.ReadFull(r, prelude[:]); err != nil {
+		return nil, nil, err
+	}
+	total := binary.BigEndian.Uint32(prelude[0:4])
+	headersLen := binary.BigEndian.Uint32(prelude[4:8])
+	if crc32.ChecksumIEEE(prelude[:8]) != binary.BigEndian.Uint32(prelude[8:12]) {
+		return nil, nil, errors.New("event stream prelude checksum mismatch")
+	}
+	if total < 16+headersLen || total > 16<<20 {
+		return nil, nil, errors.New("event stream frame has invalid length")
+	}
+
+	rest := make([]byte, total-12)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, nil, err
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(prelude[:])
+	crc.Write(rest[:len(rest)-4])
+	if crc.Sum32() != binary.BigEndian.Uint32(rest[len(rest)-4:]) {
+		return nil, nil, errors.New("event stream message checksum mismatch")
+	}
+
+	headers, err := parseEventStreamHeaders(rest[:headersLen])
+	if err != nil {
+		return nil, nil, err
+	}
+	return headers, rest[headersLen : len(rest)-4], nil
+}
+
+// parseEventStreamHeaders decodes frame headers, keeping only string values.
+func parseEventStreamHeaders(b []byte) (map[string]string, error) {
+	headers := map[string]string{}
+	for len(b) > 0 {
+		nameLen := int(b[0])
+		if len(b) < 2+nameLen {
+			return nil, errors.New("event stream header truncated")
+		}
+		name := string(b[1 : 1+nameLen])
+		valueType := b[1+nameLen]
+		b = b[2+nameLen:]
+
+		var size int
+		switch valueType {
+		case 0, 1: // bool true/false, no value bytes
+		case 2:
+			size = 1
+		case 3:
+			size = 2
+		case 4:
+			size = 4
+		case 5, 8:
+			size = 8
+		case 9:
+			size = 16
+		case 6, 7:
+			if len(b) < 2 {
+				return nil, errors.New("event stream header truncated")
+			}
+			size = 2 + int(binary.BigEndian.Uint16(b))
+		default:
+			return nil, fmt.Errorf("event stream header %q has unknown type %d", name, valueType)
+		}
+		if len(b) < size {
+			return nil, errors.New("event stream header truncated")
+		}
+		if valueType == 7 {
+			headers[name] = string(b[2:size])
+		}
+		b = b[size:]
+	}
+	return headers, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BreakerConfig stops sending requests to a provider that keeps failing.
+// After Failures consecutive connection errors or 5xx answers (counted
+// after retries) the circuit opens and requests fail fast with 503. Once
+// Cooldown has passed, one request is let through to probe the provider:
+// success closes the circuit, failure opens it for another cooldown.
+type BreakerConfig struct {
+	Failures int      `json:"failures"` // 0 disables the breaker
+	Cooldown duration `json:"cooldown"`
+}
+
+func (c BreakerConfig) validate() []error {
+	if c.Failures < 0 || (c.Failures > 0 && c.Cooldown <= 0) {
+		return []error{errors.New("breaker: failures must not be negative and cooldown must be positive")}
+	}
+	return nil
+}
+
+type breakerState int
+
+const (
+	circuitClosed breakerState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s breakerState) String() string {
+	return [...]string{"closed", "open", "half-open"}[s]
+}
+
+type breaker struct {
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool // a half-open probe is in flight
+}
+
+type breakers struct {
+	mu       sync.Mutex
+	circuits map[string]*breaker
+}
+
+var circuits = &breakers{circuits: map[string]*breaker{}}
+
+// errCircuitOpen is returned while a provider's circuit is open.
+type errCircuitOpen struct {
+	provider string
+	retryIn  time.Duration
+}
+
+func (e errCircuitOpen) Error() string {
+	return fmt.Sprintf("%s is failing; not sending requests for %s", e.provider, e.retryIn.Round(time.Second))
+}
+
+// allow reports whether a request may go to provider. Callers that are
+// allowed must report the outcome with done.
+func (b *breakers) allow(provider string, now time.Time) error {
+	c := config.Breaker
+	if c.Failures == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br := b.circuits[provider]
+	if br == nil {
+		return nil
+	}
+	switch br.state {
+	case circuitOpen:
+		if wait := br.openedAt.Add(time.Duration(c.Cooldown)).Sub(now); wait > 0 {
+			return errCircuitOpen{provider, wait}
+		}
+		br.state, br.probing = circuitHalfOpen, true
+		slog.Info("circuit half-open", "provider", provider)
+	case circuitHalfOpen:
+		if br.probing {
+			return errCircuitOpen{provider, time.Second}
+		}
+		br.probing = true
+	}
+	return nil
+}
+
+// done records the outcome of an allowed request.
+func (b *breakers) done(provider string, failed bool, now time.Time) {
+	c := config.Breaker
+	if c.Failures == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br := b.circuits[provider]
+	if br == nil {
+		br = &breaker{}
+		b.circuits[provider] = br
+	}
+	if !failed {
+		if br.state != circuitClosed {
+			slog.Info("circuit closed", "provider", provider)
+		}
+		*br = breaker{}
+		return
+	}
+	br.failures++
+	br.probing = false
+	if br.state == circuitHalfOpen || (br.state == circuitClosed && br.failures >= c.Failures) {
+		br.state, br.openedAt = circuitOpen, now
+		slog.Warn("circuit open", "provider", provider, "failures", br.failures, "cooldown", c.Cooldown)
+	}
+}
+
+// abandon ends an allowed request without an outcome, as when the client
+// went away, so a half-open circuit can send another probe.
+func (b *breakers) abandon(provider string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if br := b.circuits[provider]; br != nil {
+		br.probing = false
+	}
+}
+
+// snapshot maps each provider that has failed recently to its state.
+func (b *breakers) snapshot() map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := map[string]interface{}{}
+	for provider, br := range b.circuits {
+		if br.failures > 0 {
+			out[provider] = map[string]interface{}{"state": br.state.String(), "failures": br.failures}
+		}
+	}
+	return out
+}
+
+// upstreamFailed is what counts against the breaker: the provider could
+// not be reached or answered with a server error.
+func upstreamFailed(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= 500
+}
+
+func writeCircuitOpen(w http.ResponseWriter, err errCircuitOpen) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(err.retryIn.Seconds()))))
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+}
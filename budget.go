@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BudgetConfig caps estimated spend over a day or calendar month (UTC).
+// Scope it with at most one of User, Key ("provider" for the provider's
+// server key, "provider:profile" for a profile) or Provider; with none it
+// covers all traffic. Past Soft, responses carry X-Budget-Warning; past
+// Hard, requests are refused until the period rolls over.
+type BudgetConfig struct {
+	Period   string  `json:"period"`
+	User     string  `json:"user"`
+	Key      string  `json:"key"`
+	Provider string  `json:"provider"`
+	Soft     float64 `json:"soft"`
+	Hard     float64 `json:"hard"`
+}
+
+func (b BudgetConfig) validate(i int) []error {
+	var errs []error
+	if b.Period != "daily" && b.Period != "monthly" {
+		errs = append(errs, fmt.Errorf("budgets[%d].period: must be daily or monthly", i))
+	}
+	scopes := 0
+	for _, s := range []string{b.User, b.Key, b.Provider} {
+		if s != "" {
+			scopes++
+		}
+	}
+	if scopes > 1 {
+		errs = append(errs, fmt.Errorf("budgets[%d]: set at most one of user, key and provider", i))
+	}
+	name, _, _ := strings.Cut(b.Key, ":")
+	for _, p := range []string{name, b.Provider} {
+		if _, ok := lookupProvider(p); p != "" && !ok {
+			errs = append(errs, fmt.Errorf("budgets[%d]: unknown provider %q", i, p))
+		}
+	}
+	if b.Soft < 0 || b.Hard < 0 || (b.Soft == 0 && b.Hard == 0) {
+		errs = append(errs, fmt.Errorf("budgets[%d]: soft or hard must be a positive amount", i))
+	}
+	return errs
+}
+
+// describe names the budget for error messages.
+func (b BudgetConfig) describe() string {
+	switch {
+	case b.User != "":
+		return b.Period + " budget for user " + b.User
+	case b.Key != "":
+		return b.Period + " budget for key " + b.Key
+	case b.Provider != "":
+		return b.Period + " budget for " + b.Provider
+	}
+	return b.Period + " budget"
+}
+
+// scope is the spend bucket the budget draws from, or "" when the budget
+// does not apply to a request by user to provider with a key of the given
+// fingerprint.
+func (b BudgetConfig) scope(user, provider, keyID string) string {
+	switch {
+	case b.User != "":
+		if b.User == user {
+			return "user:" + user
+		}
+	case b.Key != "":
+		if name, profile, _ := strings.Cut(b.Key, ":"); name == provider && budgetKeyID(name, profile) == keyID {
+			return "key:" + keyID
+		}
+	case b.Provider != "":
+		if b.Provider == provider {
+			return "provider:" + provider
+		}
+	default:
+		return "all"
+	}
+	return ""
+}
+
+// budgetKeyID fingerprints the server-side key a Key-scoped budget names.
+func budgetKeyID(provider, profile string) string {
+	p, ok := lookupProvider(provider)
+	if !ok {
+		return ""
+	}
+	if profile != "" {
+		return keyFingerprint(profileAPIKey(p, profile))
+	}
+	return keyFingerprint(serverAPIKey(p))
+}
+
+// spendTracker totals estimated cost per scope and UTC day.
+type spendTracker struct {
+	mu    sync.Mutex
+	spent map[string]map[string]float64 // scope -> day -> USD
+}
+
+var spend = &spendTracker{spent: map[string]map[string]float64{}}
+
+func (t *spendTracker) add(scope, day string, usd float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	days, ok := t.spent[scope]
+	if !ok {
+		days = map[string]float64{}
+		t.spent[scope] = days
+	}
+	days[day] += usd
+}
+
+func (t *spendTracker) record(rec *requestRecord) {
+	if rec.Cost == 0 {
+		return
+	}
+	day := rec.Start.UTC().Format("2006-01-02")
+	t.add("all", day, rec.Cost)
+	t.add("provider:"+rec.Provider, day, rec.Cost)
+	if rec.User != "" {
+		t.add("user:"+rec.User, day, rec.Cost)
+	}
+	if rec.KeyID != "" {
+		t.add("key:"+rec.KeyID, day, rec.Cost)
+	}
+}
+
+// total sums scope's spend for the period containing now.
+func (t *spendTracker) total(scope, period string, now time.Time) float64 {
+	prefix := now.UTC().Format("2006-01-02")
+	if period == "monthly" {
+		prefix = prefix[:len("2006-01")]
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sum := 0.0
+	for day, usd := range t.spent[scope] {
+		if strings.HasPrefix(day, prefix) {
+			sum += usd
+		}
+	}
+	return sum
+}
+
+// overBudget is returned for a request past a hard limit.
+type overBudget string
+
+func (e overBudget) Error() string { return string(e) }
+
+// checkBudgets applies every budget that covers the request. It refuses
+// the request past a hard limit and otherwise adds X-Budget-Warning for
+// each soft limit passed. Cost is only known afterwards, so the request
+// that crosses a limit still goes through.
+func checkBudgets(w http.ResponseWriter, rec *requestRecord, provider, apiKey string) error {
+	if len(config.Budgets) == 0 {
+		return nil
+	}
+	user, keyID := "", keyFingerprint(apiKey)
+	if rec != nil {
+		user = rec.User
+	}
+	now := time.Now()
+	for _, b := range config.Budgets {
+		scope := b.scope(user, provider, keyID)
+		if scope == "" {
+			continue
+		}
+		spent := spend.total(scope, b.Period, now)
+		if b.Hard > 0 && spent >= b.Hard {
+			return overBudget(fmt.Sprintf("%s of $%.2f reached ($%.2f spent); resets %s",
+				capitalize(b.describe()), b.Hard, spent, budgetReset(b.Period, now).Format("2006-01-02 15:04 MST")))
+		}
+		if b.Soft > 0 && spent >= b.Soft {
+			w.Header().Add("X-Budget-Warning", fmt.Sprintf("%s: $%.2f of $%.2f soft limit spent", b.describe(), spent, b.Soft))
+		}
+	}
+	return nil
+}
+
+func budgetReset(period string, now time.Time) time.Time {
+	now = now.UTC()
+	if period == "monthly" {
+		return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
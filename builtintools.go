@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ToolsConfig sets up the built-in tools /api/chat requests can offer with
+// "builtin_tools", and limits every tool the proxy runs.
+type ToolsConfig struct {
+	// FetchDomains are the hosts fetch_url may read, "*.example.com"
+	// covering subdomains. fetch_url is not available without them.
+	FetchDomains  []string `json:"fetch_domains"`
+	FetchMaxBytes int64    `json:"fetch_max_bytes"` // 1 MiB by default
+	// Timeout bounds each built-in call; 10s by default.
+	Timeout duration `json:"timeout"`
+	// MaxResult caps the characters of a result, built-in or MCP, that
+	// go back to the model; 20000 by default.
+	MaxResult int `json:"max_result"`
+}
+
+func (c ToolsConfig) validate() []error {
+	var errs []error
+	for i, d := range c.FetchDomains {
+		if d == "" || strings.ContainsAny(d, "/?#@:") || (strings.HasPrefix(d, "*") && !strings.HasPrefix(d, "*.")) {
+			errs = append(errs, fmt.Errorf("tools.fetch_domains[%d]: %q is not a host name", i, d))
+		}
+	}
+	if c.FetchMaxBytes < 0 || c.Timeout < 0 || c.MaxResult < 0 {
+		errs = append(errs, errors.New("tools: fetch_max_bytes, timeout and max_result must not be negative"))
+	}
+	return errs
+}
+
+func (c ToolsConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout)
+	}
+	return 10 * time.Second
+}
+
+func (c ToolsConfig) maxResult() int {
+	if c.MaxResult > 0 {
+		return c.MaxResult
+	}
+	return 20000
+}
+
+// builtinTools are the tools the proxy has of its own, by name.
+var builtinTools = map[string]*serverTool{
+	"calculator": {
+		def: chatTool{
+			Name:        "calculator",
+			Description: "Evaluate an arithmetic expression, e.g. \"(2.5 + 4) * sqrt(16) ^ 2\". Supports + - * / % ^, parentheses, pi, e and the functions sqrt, abs, round, floor, ceil, exp, ln, log (base 10), log2, sin, cos, tan, asin, acos, atan, min, max, pow and hypot.",
+			Parameters:  json.RawMessage(`{"type":"object","properties":{"expression":{"type":"string"}},"required":["expression"]}`),
+		},
+		source: "builtin",
+		run:    runCalculator,
+	},
+	"time": {
+		def: chatTool{
+			Name:        "time",
+			Description: "Get the current date and time, in UTC or an IANA time zone such as \"Europe/Paris\".",
+			Parameters:  json.RawMessage(`{"type":"object","properties":{"timezone":{"type":"string"}}}`),
+		},
+		source: "builtin",
+		run:    runTime,
+	},
+	"fetch_url": {
+		def: chatTool{
+			Name:        "fetch_url",
+			Description: "Fetch a web page or text document over HTTP(S) and return its text. Only some domains can be fetched.",
+			Parameters:  json.RawMessage(`{"type":"object","properties":{"url":{"type":"string"}},"required":["url"]}`),
+		},
+		source: "builtin",
+		run:    runFetchURL,
+	},
+}
+
+// addBuiltinTools offers the built-in tools the request names.
+func (cr *chatRequest) addBuiltinTools() error {
+	for _, name := range cr.BuiltinTools {
+		t := builtinTools[name]
+		if t == nil {
+			return badRequest(fmt.Sprintf("builtin_tools: %q is not calculator, time or fetch_url", name))
+		}
+		if name == "fetch_url" && len(config.Tools.FetchDomains) == 0 {
+			return badRequest("builtin_tools: fetch_url needs tools.fetch_domains in the config")
+		}
+		cr.offerServerTool(t)
+	}
+	return nil
+}
+
+func runCalculator(_ context.Context, args json.RawMessage) (string, bool) {
+	var in struct {
+		Expression string `json:"expression"`
+	}
+	if err := json.Unmarshal(args, &in); err != nil || in.Expression == "" {
+		return "error: pass the expression as {\"expression\": \"...\"}", true
+	}
+	v, err := evaluate(in.Expression)
+	if err != nil {
+		return "error: " + err.Error(), true
+	}
+	return strconv.FormatFloat(v, 'g', 15, 64), false
+}
+
+func runTime(_ context.Context, args json.RawMessage) (string, bool) {
+	var in struct {
+		Timezone string `json:"timezone"`
+	}
+	json.Unmarshal(args, &in)
+	loc := time.UTC
+	if in.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(in.Timezone); err != nil {
+			return "error: unknown time zone " + strconv.Quote(in.Timezone), true
+		}
+	}
+	now := time.Now().In(loc)
+	return fmt.Sprintf("%s (%s, %s)", now.Format(time.RFC3339), now.Weekday(), loc), false
+}
+
+// runFetchURL reads a page on an allowed domain, following redirects only
+// as far as they stay on allowed domains, and returns its text.
+func runFetchURL(ctx context.Context, args json.RawMessage) (string, bool) {
+	var in struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(args, &in); err != nil || in.URL == "" {
+		return "error: pass the URL as {\"url\": \"...\"}", true
+	}
+	u, err := url.Parse(in.URL)
+	if err == nil {
+		err = fetchAllowed(u)
+	}
+	if err != nil {
+		return "error: " + err.Error(), true
+	}
+	ctx, cancel := context.WithTimeout(ctx, config.Tools.timeout())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return "error: " + err.Error(), true
+	}
+	req.Header.Set("Accept", "text/html, text/plain, text/markdown, application/json;q=0.9, */*;q=0.1")
+	client := &http.Client{Transport: upstreamTransport, CheckRedirect: func(next *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+		return fetchAllowed(next.URL)
+	}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "error: " + err.Error(), true
+	}
+	defer resp.Body.Close()
+
+	limit := config.Tools.FetchMaxBytes
+	if limit <= 0 {
+		limit = 1 << 20
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return "error: " + err.Error(), true
+	}
+	truncated := int64(len(data)) > limit
+	if truncated {
+		data = data[:limit]
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	var text string
+	switch {
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		title, body := htmlText(data)
+		text = tidyText(title + "\n\n" + body)
+	case strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "json") || strings.HasSuffix(mediaType, "xml"):
+		text = string(data)
+	default:
+		return fmt.Sprintf("error: %s is %s, not text", u, firstSet(mediaType, "of no content type")), true
+	}
+	if truncated {
+		text += "\n[truncated]"
+	}
+	out := fmt.Sprintf("%s %s\n\n%s", resp.Request.URL, resp.Status, text)
+	return out, resp.StatusCode/100 != 2
+}
+
+// fetchAllowed checks that u is http(s) on one of the fetch domains.
+func fetchAllowed(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%q is not an http or https URL", u)
+	}
+	for _, d := range config.Tools.FetchDomains {
+		if hostMatches(d, u.Hostname()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not a domain this tool may fetch", u.Hostname())
+}
+
+// maxExpression bounds what the calculator will parse.
+const maxExpression = 1000
+
+// evaluate computes an arithmetic expression.
+func evaluate(expr string) (float64, error) {
+	if len(expr) > maxExpression {
+		return 0, fmt.Errorf("expression is longer than %d characters", maxExpression)
+	}
+	p := &calcParser{src: expr}
+	v, err := p.expr()
+	if err != nil {
+		return 0, err
+	}
+	if p.skipSpace(); p.pos < len(p.src) {
+		return 0, fmt.Errorf("unexpected %q at %d", p.src[p.pos:], p.pos)
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, errors.New("the result is not a finite number")
+	}
+	return v, nil
+}
+
+// calcParser is a recursive descent parser that evaluates as it goes:
+//
+//	expr  = term { ("+" | "-") term }
+//	term  = unary { ("*" | "/" | "%") unary }
+//	unary = "-" unary | "+" unary | power
+//	power = atom [ "^" unary ]
+//	atom  = number | name | name "(" expr { "," expr } ")" | "(" expr ")"
+type calcParser struct {
+	src   string
+	pos   int
+	depth int
+}
+
+func (p *calcParser) skipSpace() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *calcParser) peek() byte {
+	if p.skipSpace(); p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+func (p *calcParser) expr() (float64, error) {
+	if p.depth++; p.depth > 100 {
+		return 0, errors.New("expression nests too deep")
+	}
+	defer func() { p.depth-- }()
+	v, err := p.term()
+	for err == nil {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			break
+		}
+		p.pos++
+		var rhs float64
+		if rhs, err = p.term(); op == '+' {
+			v += rhs
+		} else {
+			v -= rhs
+		}
+	}
+	return v, err
+}
+
+func (p *calcParser) term() (float64, error) {
+	v, err := p.unary()
+	for err == nil {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			break
+		}
+		p.pos++
+		var rhs float64
+		if rhs, err = p.unary(); err != nil {
+			break
+		}
+		if op != '*' && rhs == 0 {
+			return 0, errors.New("division by zero")
+		}
+		switch op {
+		case '*':
+			v *= rhs
+		case '/':
+			v /= rhs
+		case '%':
+			v = math.Mod(v, rhs)
+		}
+	}
+	return v, err
+}
+
+func (p *calcParser) unary() (float64, error) {
+	switch p.peek() {
+	case '-':
+		p.pos++
+		v, err := p.unary()
+		return -v, err
+	case '+':
+		p.pos++
+		return p.unary()
+	}
+	return p.power()
+}
+
+func (p *calcParser) power() (float64, error) {
+	v, err := p.atom()
+	if err != nil || p.peek() != '^' {
+		return v, err
+	}
+	p.pos++
+	exp, err := p.unary()
+	return math.Pow(v, exp), err
+}
+
+func (p *calcParser) atom() (float64, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.pos++
+		v, err := p.expr()
+		if err == nil && p.peek() != ')' {
+			err = fmt.Errorf("missing ) at %d", p.pos)
+		}
+		p.pos++
+		return v, err
+	case c >= '0' && c <= '9' || c == '.':
+		start := p.pos
+		for p.pos < len(p.src) && (p.src[p.pos] >= '0' && p.src[p.pos] <= '9' || p.src[p.pos] == '.') {
+			p.pos++
+		}
+		if p.pos < len(p.src) && (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+			if i := p.pos + 1; i < len(p.src) && (p.src[i] >= '0' && p.src[i] <= '9' || p.src[i] == '-' || p.src[i] == '+') {
+				for p.pos = i + 1; p.pos < len(p.src) && p.src[p.pos] >= '0' && p.src[p.pos] <= '9'; p.pos++ {
+				}
+			}
+		}
+		v, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad number %q", p.src[start:p.pos])
+		}
+		return v, nil
+	case unicode.IsLetter(rune(c)):
+		start := p.pos
+		for p.pos < len(p.src) && (unicode.IsLetter(rune(p.src[p.pos])) || p.src[p.pos] >= '0' && p.src[p.pos] <= '9') {
+			p.pos++
+		}
+		name := strings.ToLower(p.src[start:p.pos])
+		if p.peek() != '(' {
+			switch name {
+			case "pi":
+				return math.Pi, nil
+			case "e":
+				return math.E, nil
+			}
+			return 0, fmt.Errorf("unknown name %q", name)
+		}
+		p.pos++
+		var args []float64
+		for {
+			v, err := p.expr()
+			if err != nil {
+				return 0, err
+			}
+			args = append(args, v)
+			if p.peek() != ',' {
+				break
+			}
+			p.pos++
+		}
+		if p.peek() != ')' {
+			return 0, fmt.Errorf("missing ) at %d", p.pos)
+		}
+		p.pos++
+		return calcFunction(name, args)
+	case c == 0:
+		return 0, errors.New("unexpected end of expression")
+	}
+	return 0, fmt.Errorf("unexpected %q at %d", c, p.pos)
+}
+
+var calcFunctions1 = map[string]func(float64) float64{
+	"sqrt": math.Sqrt, "abs": math.Abs, "round": math.Round, "floor": math.Floor, "ceil": math.Ceil,
+	"exp": math.Exp, "ln": math.Log, "log": math.Log10, "log2": math.Log2,
+	"sin": math.Sin, "cos": math.Cos, "tan": math.Tan, "asin": math.Asin, "acos": math.Acos, "atan": math.Atan,
+}
+
+func calcFunction(name string, args []float64) (float64, error) {
+	if f, ok := calcFunctions1[name]; ok {
+		if len(args) != 1 {
+			return 0, fmt.Errorf("%s takes one argument", name)
+		}
+		return f(args[0]), nil
+	}
+	switch name {
+	case "pow", "hypot":
+		if len(args) != 2 {
+			return 0, fmt.Errorf("%s takes two arguments", name)
+		}
+		if name == "pow" {
+			return math.Pow(args[0], args[1]), nil
+		}
+		return math.Hypot(args[0], args[1]), nil
+	case "min", "max":
+		v := args[0]
+		for _, a := range args[1:] {
+			if name == "min" {
+				v = math.Min(v, a)
+			} else {
+				v = math.Max(v, a)
+			}
+		}
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown function %q", name)
+}
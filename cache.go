@@ -0,0 +1,148 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// responseCache holds non-streaming responses for exact repeats of a
+// request, evicting the least recently used entry beyond maxEntries.
+type responseCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu    sync.Mutex
+	ll    *list.List // front is most recently used
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key         string
+	expires     time.Time
+	status      int
+	contentType string
+	body        []byte
+}
+
+// maxCachedBody keeps one huge response from crowding out the cache.
+const maxCachedBody = 1 << 20
+
+// cache is the response cache, or nil when [cache] ttl is zero.
+var cache *responseCache
+
+func newResponseCache(ttl time.Duration, maxEntries int) *responseCache {
+	return &responseCache{ttl: ttl, maxEntries: maxEntries, ll: list.New(), items: map[string]*list.Element{}}
+}
+
+// cacheKey identifies a request by provider and body. encoding/json sorts
+// map keys, so field order in the client's JSON doesn't matter.
+func cacheKey(provider string, body interface{}) string {
+	raw, _ := json.Marshal(body)
+	return sha256Hex(append([]byte(provider+"\n"), raw...))
+}
+
+func (c *responseCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+func (c *responseCache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.expires) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return e, true
+}
+
+func (c *responseCache) put(key string, status int, contentType string, body []byte) {
+	if len(body) > maxCachedBody {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &cacheEntry{key: key, expires: time.Now().Add(c.ttl), status: status, contentType: contentType, body: body}
+	if el, ok := c.items[key]; ok {
+		el.Value = e
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(e)
+	for c.maxEntries > 0 && c.ll.Len() > c.maxEntries {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// cacheBypassed reports whether the client asked for a fresh response with
+// X-Cache-Bypass or Cache-Control: no-cache. The fresh response still
+// replaces the cached one.
+func cacheBypassed(r *http.Request) bool {
+	if v := r.Header.Get("X-Cache-Bypass"); v != "" && v != "0" && v != "false" {
+		return true
+	}
+	cc := r.Header.Get("Cache-Control")
+	return strings.Contains(cc, "no-cache") || strings.Contains(cc, "no-store")
+}
+
+// serveCached writes a cached response for key if there is one.
+func serveCached(w http.ResponseWriter, r *http.Request, key string) bool {
+	if cacheBypassed(r) {
+		return false
+	}
+	e, ok := cache.get(key)
+	if !ok {
+		metricCache.inc("exact", "miss")
+		return false
+	}
+	metricCache.inc("exact", "hit")
+	recordFrom(r).cacheHit()
+	w.Header().Set("Content-Type", e.contentType)
+	w.Header().Set("X-Cache", "HIT")
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+	return true
+}
+
+// forwardCached is forward for cacheable requests: a successful
+// non-streaming response is buffered, stored under key and relayed.
+func forwardCached(w http.ResponseWriter, p Provider, req *http.Request, key string) {
+	resp, err := doUpstream(p, req)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	contentType := resp.Header.Get("Content-Type")
+	if resp.StatusCode != http.StatusOK || isStreamingType(contentType) {
+		copyResponse(w, resp)
+		return
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	cache.put(key, resp.StatusCode, contentType, body)
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Cache", "MISS")
+	w.WriteHeader(resp.StatusCode)
+	w.Write(body)
+}
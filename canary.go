@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CanaryConfig rolls a new target out to part of the traffic: a routing
+// rule that only takes Percent of the requests it matches. The rest go
+// wherever they would have gone, so the two can be compared before the
+// change is promoted to all traffic or rolled back. Canaries are tried
+// before experiments and routes.
+type CanaryConfig struct {
+	RouteConfig
+	Percent float64 `json:"percent"`
+}
+
+func validateCanaries(list []CanaryConfig) []error {
+	var errs []error
+	seen := map[string]bool{}
+	for i, c := range list {
+		errs = append(errs, c.validate(i)...)
+		if seen[c.Name] {
+			errs = append(errs, fmt.Errorf("canaries.%s: duplicate name", c.Name))
+		}
+		seen[c.Name] = true
+	}
+	return errs
+}
+
+func (c CanaryConfig) validate(i int) []error {
+	if c.Name == "" {
+		return []error{fmt.Errorf("canaries[%d]: name required", i)}
+	}
+	errs := c.RouteConfig.validate("canaries", i)
+	if c.Percent < 0 || c.Percent > 100 {
+		errs = append(errs, fmt.Errorf("canaries.%s.percent: must be between 0 and 100", c.Name))
+	}
+	return errs
+}
+
+// armStats are the outcomes of one side of a canary.
+type armStats struct {
+	requests int64
+	errors   int64 // 5xx, and 429s from the upstream
+	latency  time.Duration
+}
+
+func (a armStats) report() map[string]interface{} {
+	out := map[string]interface{}{"requests": a.requests, "errors": a.errors}
+	if a.requests > 0 {
+		out["error_rate"] = float64(a.errors) / float64(a.requests)
+		out["avg_latency_ms"] = float64(a.latency.Milliseconds()) / float64(a.requests)
+	}
+	return out
+}
+
+type canary struct {
+	cfg      CanaryConfig
+	started  time.Time
+	promoted bool
+	stable   armStats
+	canary   armStats
+}
+
+type canaryRollouts struct {
+	mu   sync.Mutex
+	list []*canary
+}
+
+var canaries = &canaryRollouts{}
+
+func (cs *canaryRollouts) set(list []CanaryConfig, now time.Time) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.list = nil
+	for _, c := range list {
+		cs.list = append(cs.list, &canary{cfg: c, started: now})
+	}
+}
+
+// apply decides whether cr is part of a canary and, if it is, which side.
+// Requests on the canary side get its target.
+func (cs *canaryRollouts) apply(cr *chatRequest, user string, now time.Time) (name string, onCanary bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if len(cs.list) == 0 {
+		return "", false
+	}
+	promptTokens := len(cr.promptText()) / 4
+	for _, c := range cs.list {
+		if !c.cfg.matches(cr, user, promptTokens, now) {
+			continue
+		}
+		if c.promoted || rand.Float64()*100 < c.cfg.Percent {
+			cr.Provider, cr.Model, cr.routeSystem = c.cfg.To.Provider, c.cfg.To.Model, c.cfg.SystemPrompt
+			return c.cfg.Name, true
+		}
+		return c.cfg.Name, false
+	}
+	return "", false
+}
+
+// record counts a finished request against its canary's side.
+func (cs *canaryRollouts) record(rec *requestRecord) {
+	if rec.Canary == "" {
+		return
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for _, c := range cs.list {
+		if c.cfg.Name != rec.Canary {
+			continue
+		}
+		arm := &c.stable
+		if rec.OnCanary {
+			arm = &c.canary
+		}
+		arm.requests++
+		if rec.Status >= 500 || rec.Status == http.StatusTooManyRequests {
+			arm.errors++
+		}
+		arm.latency += rec.Latency
+		return
+	}
+}
+
+func (cs *canaryRollouts) report() []map[string]interface{} {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	out := []map[string]interface{}{}
+	for _, c := range cs.list {
+		status := "rolling_out"
+		if c.promoted {
+			status = "promoted"
+		}
+		out = append(out, map[string]interface{}{
+			"name":    c.cfg.Name,
+			"status":  status,
+			"percent": c.cfg.Percent,
+			"to":      c.cfg.To,
+			"started": c.started.UTC().Format(time.RFC3339),
+			"stable":  c.stable.report(),
+			"canary":  c.canary.report(),
+		})
+	}
+	return out
+}
+
+// handleAdminCanaries lists canaries with their metrics (GET), or starts or
+// changes one from a canary rule in JSON (PUT). Changing only the percent
+// keeps the metrics collected so far.
+func handleAdminCanaries(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"canaries": canaries.report()})
+
+	case "PUT":
+		var cfg CanaryConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			writeDecodeError(w, err)
+			return
+		}
+		if errs := cfg.validate(0); len(errs) > 0 {
+			http.Error(w, errs[0].Error(), http.StatusBadRequest)
+			return
+		}
+		canaries.mu.Lock()
+		var previous *CanaryConfig
+		found := false
+		for i, c := range canaries.list {
+			if c.cfg.Name != cfg.Name {
+				continue
+			}
+			p := c.cfg
+			previous, found = &p, true
+			if c.cfg.To == cfg.To {
+				c.cfg, c.promoted = cfg, false
+			} else {
+				canaries.list[i] = &canary{cfg: cfg, started: time.Now()}
+			}
+		}
+		if !found {
+			canaries.list = append(canaries.list, &canary{cfg: cfg, started: time.Now()})
+		}
+		canaries.mu.Unlock()
+		audit.record("canary.changed", map[string]interface{}{
+			"name":     cfg.Name,
+			"previous": previous,
+			"current":  cfg,
+			"remote":   clientIP(r),
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAdminCanaryAction promotes a canary to all matching traffic
+// (/promote) or rolls it back, removing it (/rollback). The canary is
+// named with ?name=.
+func handleAdminCanaryAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	promote := r.URL.Path == "/api/admin/canaries/promote"
+	canaries.mu.Lock()
+	var target *canary
+	var details map[string]interface{}
+	for i, c := range canaries.list {
+		if c.cfg.Name != name {
+			continue
+		}
+		target = c
+		details = map[string]interface{}{
+			"name":   name,
+			"to":     c.cfg.To,
+			"stable": c.stable.report(),
+			"canary": c.canary.report(),
+			"remote": clientIP(r),
+		}
+		if promote {
+			c.promoted = true
+		} else {
+			canaries.list = append(canaries.list[:i], canaries.list[i+1:]...)
+		}
+		break
+	}
+	canaries.mu.Unlock()
+	if target == nil {
+		http.Error(w, "No canary "+name, http.StatusNotFound)
+		return
+	}
+	event := "canary.rolled_back"
+	if promote {
+		event = "canary.promoted"
+	}
+	audit.record(event, details)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,691 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// chatRequest is the canonical body accepted by /api/chat. The same shape
+// works for every provider; chatDialects translate it to the upstream API.
+type chatRequest struct {
+	Provider    string        `json:"provider"`
+	Model       string        `json:"model"`
+	System      string        `json:"system,omitempty"`
+	Messages    []chatMessage `json:"messages"`
+	MaxTokens   int           `json:"max_tokens,omitempty"`
+	Temperature *float64      `json:"temperature,omitempty"`
+	TopP        *float64      `json:"top_p,omitempty"`
+	Stop        []string      `json:"stop,omitempty"`
+	Stream      bool          `json:"stream,omitempty"`
+	APIKey      string        `json:"apiKey,omitempty"`
+	KeyProfile  string        `json:"keyProfile,omitempty"`
+	// Tags label the request for routing rules, e.g. ["code"].
+	Tags []string `json:"tags,omitempty"`
+	// Template names a stored prompt template whose system prompt and
+	// messages go before the request's own, with Vars filling its
+	// placeholders. TemplateVersion pins a version; 0 is the latest.
+	Template        string            `json:"template,omitempty"`
+	TemplateVersion int               `json:"template_version,omitempty"`
+	Vars            map[string]string `json:"vars,omitempty"`
+	// Conversation continues a stored conversation: its earlier turns are
+	// sent ahead of Messages, and the exchange is appended once answered.
+	Conversation string `json:"conversation,omitempty"`
+	// Retrieval adds the closest chunks of a rag collection to the system
+	// prompt; see ragStore.
+	Retrieval *retrievalOptions `json:"retrieval,omitempty"`
+	// OutputSchema is a JSON Schema the reply must conform to. Replies
+	// that do not are sent back to the model with what is wrong, up to
+	// SchemaRetries times (2 by default).
+	OutputSchema  json.RawMessage `json:"output_schema,omitempty"`
+	SchemaRetries *int            `json:"schema_retries,omitempty"`
+	// Tools are functions the model may call instead of answering;
+	// ToolChoice is "auto" (the default), "none", "required" or the name
+	// of the one tool it must call.
+	Tools      []chatTool `json:"tools,omitempty"`
+	ToolChoice string     `json:"tool_choice,omitempty"`
+	// Thinking turns on extended thinking where the dialect has it.
+	Thinking *thinkingOptions `json:"thinking,omitempty"`
+	// BuiltinTools and MCP name built-in tools and configured MCP servers
+	// whose tools are offered too; the proxy runs the calls the model
+	// makes to them.
+	BuiltinTools []string               `json:"builtin_tools,omitempty"`
+	MCP          []string               `json:"mcp,omitempty"`
+	serverTools  map[string]*serverTool // by the name the model sees
+	systemCache  json.RawMessage        // cache_control of system messages
+	routeSystem  string                 // system prompt of the route taken
+}
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// Images are IDs from /api/uploads, sent with the message in each
+	// provider's own image format.
+	Images []string  `json:"images,omitempty"`
+	images []*upload // resolved by attachImages
+	// ToolCalls are the calls an assistant message made; a "tool" message
+	// answers the one named by ToolCallID with its result as Content.
+	ToolCalls  []toolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+	// CacheControl marks the end of a prompt prefix for Anthropic to
+	// cache, e.g. {"type": "ephemeral"}; other providers ignore it.
+	CacheControl json.RawMessage `json:"cache_control,omitempty"`
+	// Thinking is an assistant reply's thinking, sent back as it came so
+	// the model can carry on from a tool call it made while thinking.
+	Thinking []thinkingBlock `json:"thinking,omitempty"`
+}
+
+// chatResponse is the canonical non-streaming reply.
+type chatResponse struct {
+	Provider   string    `json:"provider"`
+	Model      string    `json:"model"`
+	Content    string    `json:"content"`
+	StopReason string    `json:"stop_reason,omitempty"`
+	Usage      chatUsage `json:"usage"`
+	// Thinking is the model's extended thinking before the reply.
+	Thinking []thinkingBlock `json:"thinking,omitempty"`
+	// Citations are the retrieved chunks the reply may cite by Index.
+	Citations []ragCitation `json:"citations,omitempty"`
+	// Output is the reply as JSON, when the request had an output_schema.
+	Output json.RawMessage `json:"output,omitempty"`
+	// ToolCalls are the tools the model called, for the client to run and
+	// answer with "tool" messages.
+	ToolCalls []toolCall `json:"tool_calls,omitempty"`
+	// ServerCalls are the calls the proxy ran itself on the way to the
+	// reply.
+	ServerCalls []serverCall `json:"server_calls,omitempty"`
+}
+
+type chatUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	// Cache counts are prompt tokens written to and read from Anthropic's
+	// prompt cache, on top of InputTokens.
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens,omitempty"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens,omitempty"`
+}
+
+func (u *chatUsage) add(o chatUsage) {
+	u.InputTokens += o.InputTokens
+	u.OutputTokens += o.OutputTokens
+	u.CacheCreationInputTokens += o.CacheCreationInputTokens
+	u.CacheReadInputTokens += o.CacheReadInputTokens
+}
+
+// chatStreamEvent is one SSE data payload on a streamed /api/chat reply:
+// "delta" events carry text, "tool_call" starts the Index'th tool call and
+// "tool_delta" adds to its arguments; a final "done" carries stop reason,
+// usage, the whole tool calls, any citations and the guardrail rules that
+// matched.
+type chatStreamEvent struct {
+	Type       string          `json:"type"`
+	Text       string          `json:"text,omitempty"`
+	Index      *int            `json:"index,omitempty"`
+	ID         string          `json:"id,omitempty"`
+	Name       string          `json:"name,omitempty"`
+	Arguments  string          `json:"arguments,omitempty"`
+	ToolCalls  []toolCall      `json:"tool_calls,omitempty"`
+	Thinking   []thinkingBlock `json:"thinking,omitempty"`
+	StopReason string          `json:"stop_reason,omitempty"`
+	Usage      *chatUsage      `json:"usage,omitempty"`
+	Citations  []ragCitation   `json:"citations,omitempty"`
+	Guardrails []string        `json:"guardrails,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// chatStream accumulates what a dialect learns while reading a stream.
+type chatStream struct {
+	usage      chatUsage
+	stopReason string
+	relayed    int  // characters of text passed on so far
+	structured bool // the reply is coming as structured output
+	calls      []toolCall
+	thinking   []thinkingBlock
+	pending    []chatStreamEvent // tool and thinking events yet to be relayed
+}
+
+// partial is the usage of a stream cut short. Most upstreams only report
+// output tokens at the end, so when they are missing they are estimated
+// from the text relayed.
+func (s *chatStream) partial() chatUsage {
+	u := s.usage
+	if u.OutputTokens == 0 {
+		u.OutputTokens = (s.relayed + 3) / 4
+	}
+	return u
+}
+
+// chatDialect is one upstream wire format. Several providers share the
+// OpenAI dialect.
+type chatDialect struct {
+	schema *bodySchema // what raw bodies in this format must look like
+	body   func(*chatRequest) map[string]interface{}
+	parse  func(data []byte) (*chatResponse, error)
+	// event handles one upstream stream event, returning any text delta
+	// and whether the stream is finished.
+	event    func(s *chatStream, event string, data []byte) (text string, done bool)
+	tools    bool // tools and tool messages translate to this dialect
+	thinking bool // and so does extended thinking
+}
+
+// Unified chat endpoint. The client names a provider and sends one canonical
+// body; the reply comes back in canonical form too, buffered or as SSE.
+func handleChat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var cr chatRequest
+	_, parse := startSpan(r.Context(), "parse request", spanInternal)
+	err := json.NewDecoder(r.Body).Decode(&cr)
+	parse.end()
+	if err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if err := cr.attachImages(recordFrom(r).user()); err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	if !guardPrompt(w, r, &cr) {
+		return
+	}
+	conv, turn, err := cr.useConversation(recordFrom(r).user())
+	if err == errNoConversation {
+		http.Error(w, "No conversation "+cr.Conversation, http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Loading conversation: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if tmpl, err := cr.expandTemplate(); err != nil {
+		writeBuildError(w, err)
+		return
+	} else if tmpl != "" {
+		w.Header().Set("X-Template", tmpl)
+	}
+	tokens := scrubPII(w, r, &cr)
+	if texts, images := cr.moderatedText(); !moderate(w, r, texts, images) {
+		return
+	}
+	if !screenMessages(w, r, &cr) {
+		return
+	}
+	citations, fail := cr.retrieve(w, r)
+	if fail != nil {
+		fail.write(w)
+		return
+	}
+	now := time.Now()
+	canary, onCanary := canaries.apply(&cr, recordFrom(r).user(), now)
+	recordFrom(r).setCanary(canary, onCanary)
+	if onCanary {
+		w.Header().Set("X-Canary", canary)
+	} else if name, variant := assignExperiment(r, &cr); name != "" {
+		recordFrom(r).setExperiment(name, variant)
+		w.Header().Set("X-Experiment", name+"/"+variant)
+	} else if route := routeChat(&cr, recordFrom(r).user(), now); route != "" {
+		w.Header().Set("X-Route", route)
+	}
+	if err := aliases.resolveChat(&cr); err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	p, _ := lookupProvider(cr.Provider)
+	target, ok := p.(ChatProvider)
+	if !ok || target.Dialect() == nil {
+		http.Error(w, "Unknown provider: "+cr.Provider, http.StatusBadRequest)
+		return
+	}
+	if !config.providerEnabled(cr.Provider) {
+		http.Error(w, "Provider disabled: "+cr.Provider, http.StatusBadRequest)
+		return
+	}
+	dialect := target.Dialect()
+	if cr.Model == "" {
+		http.Error(w, "Model required", http.StatusBadRequest)
+		return
+	}
+	if err := cr.validate(dialect.schema); err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	if len(cr.BuiltinTools) > 0 || len(cr.MCP) > 0 {
+		if err := cr.addServerTools(r.Context()); err != nil {
+			if _, ok := err.(badRequest); ok {
+				writeBuildError(w, err)
+			} else {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+			}
+			return
+		}
+	}
+	if err := cr.validateTools(dialect); err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	schema, err := cr.outputSchema()
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	truncated, err := limitChat(&cr, recordFrom(r).user())
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	markTruncated(w, truncated)
+	if err := cr.validateThinking(dialect); err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	if err := allowBetas(r); err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	if cr.Stream && !target.SupportsStreaming() {
+		http.Error(w, cr.Provider+" does not support streaming", http.StatusBadRequest)
+		return
+	}
+	if cr.KeyProfile == "" {
+		cr.KeyProfile = r.Header.Get("X-Key-Profile")
+	}
+	apiKey, err := resolveAPIKey(target, recordFrom(r).user(), cr.APIKey, cr.KeyProfile)
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	logged := cr
+	logged.APIKey = ""
+	recordFrom(r).describe(cr.Provider, cr.Model, cr.Stream, logged)
+	cr.splitSystem()
+	if schema != nil {
+		cr.askForSchema()
+	}
+	clientSystem := cr.System
+	cr.enforceSystem()
+
+	upstreamBody := dialect.body(&cr)
+	// Replies in a conversation are stored as they are given, so they are
+	// never served from cache, and neither are replies to tokenized prompts,
+	// which another prompt may tokenize the same way, or replies made with
+	// what server tools returned at the time.
+	cacheable := !cr.Stream && conv == nil && tokens == nil && len(cr.serverTools) == 0
+	var cacheKeyHash string
+	if cache != nil && cacheable {
+		cacheKeyHash = cacheKey(betaScope("chat:"+cr.Provider, recordFrom(r)), upstreamBody)
+		if serveCached(w, r, cacheKeyHash) {
+			return
+		}
+	}
+	var semVector []float64
+	semBucket := cr.Provider + "/" + cr.Model
+	// A reply found by meaning alone may be to a prompt without the same
+	// tools, so requests with tools only match exactly.
+	if semCache != nil && cacheable && !cr.usesTools() && !cacheBypassed(r) {
+		if semVector, err = semCache.embed(r.Context(), cr.promptText()); err != nil {
+			slog.Warn("semantic cache", "request_id", requestID(r.Context()), "err", err)
+		} else if hit, score := semCache.lookup(semBucket, semVector); hit != nil {
+			metricCache.inc("semantic", "hit")
+			recordFrom(r).cacheHit()
+			w.Header().Set("X-Cache", "HIT")
+			w.Header().Set("X-Cache-Match", "semantic")
+			w.Header().Set("X-Cache-Similarity", fmt.Sprintf("%.4f", score))
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(hit)
+			return
+		}
+		metricCache.inc("semantic", "miss")
+	}
+
+	// The requested provider first, then its fallbacks for as long as
+	// failures are the upstream's. Each fallback gets the same canonical
+	// request in its own dialect.
+	requested := ChatTarget{cr.Provider, cr.Model}
+	answered, estimated := requested, estimateTokens(upstreamBody)
+	resp, release, fail := sendChat(w, r, requested, target, upstreamBody, apiKey, estimated)
+	for _, next := range config.Providers[cr.Provider].Fallbacks {
+		if fail == nil || !fail.upstream {
+			break
+		}
+		p, _ := lookupProvider(next.Provider)
+		fb := p.(ChatProvider)
+		if !config.providerEnabled(next.Provider) || (cr.Stream && !fb.SupportsStreaming()) || (cr.usesTools() && !fb.Dialect().tools) {
+			continue
+		}
+		key, err := fallbackKey(r, fb)
+		if err != nil {
+			slog.Warn("chat failover", "request_id", requestID(r.Context()), "skipped", next.Provider, "err", err)
+			continue
+		}
+		logFailover(r, fail, next)
+		fcr := cr
+		fcr.Provider, fcr.Model, fcr.System = next.Provider, next.Model, clientSystem
+		fcr.enforceSystem()
+		body := fb.Dialect().body(&fcr)
+		est := estimateTokens(body)
+		var f *chatFailure
+		if resp, release, f = sendChat(w, r, next, fb, body, key, est); f == nil {
+			target, dialect, apiKey, estimated, answered, fail = fb, fb.Dialect(), key, est, next, nil
+			recordFrom(r).failedOver(next.Provider, next.Model)
+			w.Header().Set("X-Failover-From", requested.Provider+"/"+requested.Model)
+		} else if f.upstream {
+			fail = f
+		}
+	}
+	if fail != nil {
+		fail.write(w)
+		return
+	}
+	defer release()
+	defer resp.Body.Close()
+	w.Header().Set("X-Provider", answered.Provider)
+	w.Header().Set("X-Model", answered.Model)
+	if answered != requested {
+		cacheKeyHash, semVector = "", nil // cached replies are the requested model's
+	}
+
+	if cr.Stream {
+		usage, reply, finished := streamChat(w, resp, dialect, citations, replyFilters(r, tokens))
+		quotas.settle(target, apiKey, estimated, usage)
+		recordFrom(r).setUsage(usage)
+		if conv != nil && finished {
+			saveTurn(r, conv, turn, reply, answered)
+		}
+		return
+	}
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	out, err := dialect.parse(raw)
+	if err != nil {
+		http.Error(w, "Unexpected upstream response: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	quotas.settle(target, apiKey, estimated, out.Usage)
+	recordFrom(r).setUsage(out.Usage)
+	if len(cr.serverTools) > 0 {
+		if out = runServerTools(w, r, &cr, answered, target, apiKey, out); out == nil {
+			return
+		}
+	}
+	// A reply that calls tools is not the answer yet, so it has no schema
+	// to meet.
+	if schema != nil && len(out.ToolCalls) == 0 {
+		if out = enforceSchema(w, r, &cr, schema, answered, target, apiKey, out); out == nil {
+			return
+		}
+	}
+	var blocked bool
+	for i, c := range out.ToolCalls {
+		out.ToolCalls[i].Arguments = toolArguments([]byte(tokens.restore(string(c.Arguments))))
+	}
+	if out.Content, blocked = guardText(r, "completion", tokens.restore(out.Content)); blocked {
+		writeJSON(w, http.StatusBadGateway, map[string]interface{}{
+			"error": "Response blocked by guardrail",
+			"rules": strings.Split(recordFrom(r).Guardrails, ","),
+		})
+		return
+	}
+	if rules := recordFrom(r).Guardrails; rules != "" {
+		w.Header().Set("X-Guardrails", rules)
+	}
+	if schema != nil && json.Valid([]byte(out.Content)) {
+		out.Output = json.RawMessage(out.Content)
+	}
+	out.Provider = answered.Provider
+	if out.Model == "" {
+		out.Model = answered.Model
+	}
+	out.Citations = citations
+	out.Thinking = shownThinking(out.Thinking)
+	setCostHeader(w, answered.Provider, answered.Model, out.Usage)
+	if conv != nil {
+		saveTurn(r, conv, turn, out.Content, answered)
+	}
+	if cacheKeyHash != "" || semVector != nil {
+		if data, err := json.Marshal(out); err == nil {
+			if cacheKeyHash != "" {
+				cache.put(cacheKeyHash, http.StatusOK, "application/json", data)
+			}
+			if semVector != nil {
+				semCache.store(semBucket, semVector, data)
+			}
+		}
+		w.Header().Set("X-Cache", "MISS")
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// replyFilters are what a streamed reply passes through: tokenized values
+// are put back first, so guardrails see what the client will.
+func replyFilters(r *http.Request, tokens *piiTokens) filterChain {
+	var filters filterChain
+	if tokens != nil {
+		filters = append(filters, &piiRestorer{tokens: tokens})
+	}
+	if guard := newStreamGuard(r); guard != nil {
+		filters = append(filters, guard)
+	}
+	return filters
+}
+
+// saveTurn appends an answered exchange to its conversation. The client
+// already has the reply, so a failure is only logged.
+func saveTurn(r *http.Request, conv *conversation, turn []chatMessage, reply string, answered ChatTarget) {
+	if err := conversations.recordTurn(conv, turn, reply, answered); err != nil {
+		slog.Error("conversations", "request_id", requestID(r.Context()), "conversation", conv.ID, "err", err)
+	}
+}
+
+// splitSystem folds system-role messages into the System field, since not
+// every provider accepts them inline.
+func (cr *chatRequest) splitSystem() {
+	messages := cr.Messages[:0]
+	for _, m := range cr.Messages {
+		if m.Role == "system" {
+			if cr.System != "" {
+				cr.System += "\n\n"
+			}
+			cr.System += m.Content
+			if len(m.CacheControl) > 0 {
+				cr.systemCache = m.CacheControl
+			}
+			continue
+		}
+		messages = append(messages, m)
+	}
+	cr.Messages = messages
+}
+
+// textFilter rewrites streamed text on its way to the client, holding back
+// what it cannot decide on yet. feed returns what may be relayed now and
+// whether the reply must stop; flush releases what is still held.
+type textFilter interface {
+	feed(text string) (string, bool)
+	flush() (string, bool)
+}
+
+// filterChain passes text through each filter in turn.
+type filterChain []textFilter
+
+func (c filterChain) feed(text string) (string, bool) {
+	for _, f := range c {
+		var blocked bool
+		if text, blocked = f.feed(text); blocked {
+			return "", true
+		}
+	}
+	return text, false
+}
+
+func (c filterChain) flush() (string, bool) {
+	var text string
+	for _, f := range c {
+		out, blocked := f.feed(text)
+		rest, stop := f.flush()
+		if blocked || stop {
+			return "", true
+		}
+		text = out + rest
+	}
+	return text, false
+}
+
+// streamChat re-emits an upstream stream as canonical chatStreamEvents and
+// returns the usage the upstream reported, the text relayed, and whether
+// the stream ran to its end. citations go out with the done event. Text
+// passes through filters before it is relayed; a blocked reply ends with
+// an error event.
+func streamChat(w http.ResponseWriter, resp *http.Response, dialect *chatDialect, citations []ragCitation, filters filterChain) (chatUsage, string, bool) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+
+	send := func(ev chatStreamEvent) error {
+		data, _ := json.Marshal(ev)
+		_, err := fmt.Fprintf(w, "data: %s\n\n", data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return err
+	}
+
+	ctx := resp.Request.Context()
+	_, sp := startSpan(ctx, "stream copy", spanInternal)
+	defer sp.end()
+
+	// Reading stops as soon as the client stops listening; the caller
+	// closing the body then ends the upstream stream.
+	var s chatStream
+	var reply strings.Builder
+	var gone error
+	var blocked bool
+	emit := func(text string) bool {
+		if text == "" {
+			return true
+		}
+		s.relayed += len(text)
+		reply.WriteString(text)
+		gone = send(chatStreamEvent{Type: "delta", Text: text})
+		return gone == nil
+	}
+	err := readUpstreamEvents(resp, func(event string, data []byte) bool {
+		text, done := dialect.event(&s, event, data)
+		if len(filters) > 0 {
+			if text, blocked = filters.feed(text); blocked {
+				return false
+			}
+		}
+		if !emit(text) {
+			return false
+		}
+		for _, ev := range s.pending {
+			if ev.Type == "thinking" && config.StripThinking {
+				continue
+			}
+			if gone = send(ev); gone != nil {
+				return false
+			}
+		}
+		s.pending = s.pending[:0]
+		return !done
+	})
+	if len(filters) > 0 && gone == nil && !blocked {
+		var rest string
+		if rest, blocked = filters.flush(); !blocked {
+			emit(rest)
+		}
+	}
+	if gone != nil || clientGone(ctx) {
+		slog.Info("client disconnected", "request_id", requestID(ctx), "upstream", resp.Request.URL.Host, "relayed_chars", s.relayed)
+		return s.partial(), reply.String(), false
+	}
+	var rules []string
+	if rec := recordFrom(resp.Request); rec != nil && rec.Guardrails != "" {
+		rules = strings.Split(rec.Guardrails, ",")
+	}
+	if blocked {
+		send(chatStreamEvent{Type: "error", Error: "Response blocked by guardrail", Guardrails: rules})
+		return s.partial(), reply.String(), false
+	}
+	if err != nil {
+		slog.Warn("chat stream error", "request_id", requestID(resp.Request.Context()), "upstream", resp.Request.URL.Host, "err", err)
+		sp.fail(err)
+		send(chatStreamEvent{Type: "error", Error: err.Error()})
+		return s.usage, reply.String(), false
+	}
+	send(chatStreamEvent{Type: "done", StopReason: s.stopReason, Usage: &s.usage, ToolCalls: s.toolCalls(), Thinking: shownThinking(s.thinking), Citations: citations, Guardrails: rules})
+	return s.usage, reply.String(), true
+}
+
+// readUpstreamEvents calls fn for each event in an SSE or NDJSON body until
+// fn returns false or the body ends.
+func readUpstreamEvents(resp *http.Response, fn func(event string, data []byte) bool) error {
+	contentType := resp.Header.Get("Content-Type")
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 4<<20)
+
+	if !strings.HasPrefix(contentType, "text/event-stream") {
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) > 0 && !fn("", line) {
+				return nil
+			}
+		}
+		return scanner.Err()
+	}
+
+	var event string
+	var data []byte
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if len(data) > 0 && !fn(event, data) {
+				return nil
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(line[len("event:"):])
+		case strings.HasPrefix(line, "data:"):
+			if len(data) > 0 {
+				data = append(data, '\n')
+			}
+			data = append(data, strings.TrimPrefix(line[len("data:"):], " ")...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		fn(event, data)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// setIf adds key to m only when the optional value is present.
+func setIf(m map[string]interface{}, key string, v interface{}, present bool) {
+	if present {
+		m[key] = v
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Cohere v2 chat. Requests may use the OpenAI or Anthropic shape the frontend
+// already speaks; toCohereChat maps them onto Cohere's field names before
+// forwarding.
+func init() {
+	registerProvider(&providerSpec{
+		name:       "cohere",
+		endpoint:   "https://api.cohere.com/v2/chat",
+		dialect:    &cohereDialect,
+		embeddings: &cohereEmbeddings,
+		build:      buildCohereRequest,
+	})
+}
+
+func buildCohereRequest(p *providerSpec, body map[string]interface{}, apiKey string) (*http.Request, error) {
+	toCohereChat(body)
+	return bearerBuild(p, body, apiKey)
+}
+
+// toCohereChat rewrites body in place: a top-level system prompt becomes a
+// system message, Anthropic-style content blocks become Cohere text/image
+// parts, and sampling parameters are renamed.
+func toCohereChat(body map[string]interface{}) {
+	messages, _ := body["messages"].([]interface{})
+	if system, ok := body["system"].(string); ok && system != "" {
+		messages = append([]interface{}{map[string]interface{}{"role": "system", "content": system}}, messages...)
+	}
+	delete(body, "system")
+
+	for _, m := range messages {
+		msg, ok := m.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		blocks, ok := msg["content"].([]interface{})
+		if !ok {
+			continue
+		}
+		parts := make([]interface{}, 0, len(blocks))
+		for _, b := range blocks {
+			block, ok := b.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			switch block["type"] {
+			case "text":
+				parts = append(parts, map[string]interface{}{"type": "text", "text": block["text"]})
+			case "image_url":
+				parts = append(parts, block)
+			case "image":
+				// Anthropic base64 source -> data URL
+				if src, ok := block["source"].(map[string]interface{}); ok {
+					mediaType, _ := src["media_type"].(string)
+					data, _ := src["data"].(string)
+					parts = append(parts, map[string]interface{}{
+						"type":      "image_url",
+						"image_url": map[string]interface{}{"url": "data:" + mediaType + ";base64," + data},
+					})
+				}
+			}
+		}
+		msg["content"] = parts
+	}
+	if messages != nil {
+		body["messages"] = messages
+	}
+
+	renames := map[string]string{"stop": "stop_sequences", "top_p": "p", "top_k": "k"}
+	for from, to := range renames {
+		if v, ok := body[from]; ok {
+			if _, exists := body[to]; !exists {
+				body[to] = v
+			}
+			delete(body, from)
+		}
+	}
+	if s, ok := body["stop_sequences"].(string); ok {
+		body["stop_sequences"] = []interface{}{s}
+	}
+	// OpenAI's json_schema response format is Cohere's JSON mode with a
+	// schema.
+	if rf, ok := body["response_format"].(map[string]interface{}); ok && rf["type"] == "json_schema" {
+		js, _ := rf["json_schema"].(map[string]interface{})
+		body["response_format"] = map[string]interface{}{"type": "json_object", "json_schema": js["schema"]}
+	}
+}
+
+type cohereTokens struct {
+	Tokens struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"tokens"`
+}
+
+// cohereDialect sends the OpenAI shape; newCohereRequest renames fields.
+var cohereDialect = chatDialect{
+	schema: cohereSchema,
+	body:   openAIDialect.body,
+	parse: func(data []byte) (*chatResponse, error) {
+		var r struct {
+			Message struct {
+				Content []struct {
+					Type string `json:"type"`
+					Text string `json:"text"`
+				} `json:"content"`
+			} `json:"message"`
+			FinishReason string       `json:"finish_reason"`
+			Usage        cohereTokens `json:"usage"`
+		}
+		if err := json.Unmarshal(data, &r); err != nil {
+			return nil, err
+		}
+		var text strings.Builder
+		for _, c := range r.Message.Content {
+			if c.Type == "text" {
+				text.WriteString(c.Text)
+			}
+		}
+		return &chatResponse{
+			Content:    text.String(),
+			StopReason: r.FinishReason,
+			Usage:      chatUsage{InputTokens: r.Usage.Tokens.InputTokens, OutputTokens: r.Usage.Tokens.OutputTokens},
+		}, nil
+	},
+	event: func(s *chatStream, _ string, data []byte) (string, bool) {
+		var ev struct {
+			Type  string `json:"type"`
+			Delta struct {
+				Message struct {
+					Content struct {
+						Text string `json:"text"`
+					} `json:"content"`
+				} `json:"message"`
+				FinishReason string       `json:"finish_reason"`
+				Usage        cohereTokens `json:"usage"`
+			} `json:"delta"`
+		}
+		if json.Unmarshal(data, &ev) != nil {
+			return "", false
+		}
+		switch ev.Type {
+		case "content-delta":
+			return ev.Delta.Message.Content.Text, false
+		case "message-end":
+			s.stopReason = ev.Delta.FinishReason
+			s.usage = chatUsage{InputTokens: ev.Delta.Usage.Tokens.InputTokens, OutputTokens: ev.Delta.Usage.Tokens.OutputTokens}
+			return "", true
+		}
+		return "", false
+	},
+}
+
+// cohereEmbeddings uses v2 embed. Cohere needs to know what the texts are
+// for: "query" and "document" become its search types, other values
+// ("classification", "clustering") pass through, and documents are the
+// default.
+var cohereEmbeddings = embeddingDialect{
+	url: func(endpoint string) string {
+		return strings.TrimSuffix(endpoint, "/chat") + "/embed"
+	},
+	body: func(er *embeddingRequest) map[string]interface{} {
+		inputType := er.InputType
+		switch inputType {
+		case "", "document":
+			inputType = "search_document"
+		case "query":
+			inputType = "search_query"
+		}
+		body := map[string]interface{}{
+			"model":           er.Model,
+			"texts":           er.Input,
+			"input_type":      inputType,
+			"embedding_types": []string{"float"},
+		}
+		setIf(body, "output_dimension", er.Dimensions, er.Dimensions > 0)
+		return body
+	},
+	parse: func(data []byte) (*embeddingResponse, error) {
+		var r struct {
+			Embeddings struct {
+				Float [][]float64 `json:"float"`
+			} `json:"embeddings"`
+			Meta struct {
+				BilledUnits struct {
+					InputTokens int `json:"input_tokens"`
+				} `json:"billed_units"`
+			} `json:"meta"`
+		}
+		if err := json.Unmarshal(data, &r); err != nil {
+			return nil, err
+		}
+		return &embeddingResponse{Embeddings: r.Embeddings.Float, Usage: chatUsage{InputTokens: r.Meta.BilledUnits.InputTokens}}, nil
+	},
+}
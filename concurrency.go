@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// priority classes for queued requests. Interactive requests are served
+// before background ones and may bump them out of a full queue.
+type priority int
+
+const (
+	interactive priority = iota
+	background
+)
+
+// requestPriority reads X-Priority; anything but "background" is
+// interactive.
+func requestPriority(r *http.Request) priority {
+	if r.Header.Get("X-Priority") == "background" {
+		return background
+	}
+	return interactive
+}
+
+// slots bounds concurrent upstream requests. Up to queue callers wait for a
+// free slot, interactive first and FIFO within a class; beyond that,
+// callers are turned away.
+type slots struct {
+	max, queue int
+	maxWait    time.Duration
+
+	mu      sync.Mutex
+	inUse   int
+	waiters [2][]*waiter
+	stats   queueStats
+}
+
+type waiter struct {
+	ready chan struct{}
+	err   error // set before ready is closed when the waiter is evicted
+}
+
+// queueStats counts queue outcomes since startup.
+type queueStats struct {
+	Queued   int64         `json:"queued"`
+	Served   int64         `json:"served"`
+	Rejected int64         `json:"rejected"`
+	Timeouts int64         `json:"timeouts"`
+	WaitSum  time.Duration `json:"-"`
+	WaitMax  time.Duration `json:"-"`
+}
+
+func newSlots(max, queue int, maxWait time.Duration) *slots {
+	return &slots{max: max, queue: queue, maxWait: maxWait}
+}
+
+var (
+	errQueueFull    = errors.New("Too many concurrent requests")
+	errQueueTimeout = errors.New("Timed out waiting for an upstream slot")
+)
+
+// acquire takes a slot, waiting in the queue if needed, and reports how
+// long it waited.
+func (s *slots) acquire(ctx context.Context, prio priority) (time.Duration, error) {
+	s.mu.Lock()
+	if s.inUse < s.max {
+		s.inUse++
+		s.mu.Unlock()
+		return 0, nil
+	}
+	if len(s.waiters[interactive])+len(s.waiters[background]) >= s.queue {
+		// A full queue still admits interactive requests at the expense of
+		// the newest background one.
+		bg := s.waiters[background]
+		if prio != interactive || len(bg) == 0 {
+			s.stats.Rejected++
+			s.mu.Unlock()
+			return 0, errQueueFull
+		}
+		evicted := bg[len(bg)-1]
+		s.waiters[background] = bg[:len(bg)-1]
+		evicted.err = errQueueFull
+		close(evicted.ready)
+		s.stats.Rejected++
+	}
+	wt := &waiter{ready: make(chan struct{})}
+	s.waiters[prio] = append(s.waiters[prio], wt)
+	s.stats.Queued++
+	s.mu.Unlock()
+
+	start := time.Now()
+	var timeout <-chan time.Time
+	if s.maxWait > 0 {
+		t := time.NewTimer(s.maxWait)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	var err error
+	select {
+	case <-wt.ready:
+		if wt.err != nil {
+			return time.Since(start), wt.err
+		}
+		s.recordWait(time.Since(start))
+		return time.Since(start), nil
+	case <-timeout:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.remove(prio, wt) {
+		// Granted or evicted while we gave up; hand a granted slot on.
+		if wt.err == nil {
+			s.releaseLocked()
+		}
+	}
+	if err == errQueueTimeout {
+		s.stats.Timeouts++
+	}
+	return time.Since(start), err
+}
+
+func (s *slots) remove(prio priority, wt *waiter) bool {
+	for i, w := range s.waiters[prio] {
+		if w == wt {
+			s.waiters[prio] = append(s.waiters[prio][:i], s.waiters[prio][i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *slots) recordWait(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Served++
+	s.stats.WaitSum += d
+	if d > s.stats.WaitMax {
+		s.stats.WaitMax = d
+	}
+}
+
+func (s *slots) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseLocked()
+}
+
+// releaseLocked passes the slot straight to the next waiter, if any.
+func (s *slots) releaseLocked() {
+	for p := range s.waiters {
+		if q := s.waiters[p]; len(q) > 0 {
+			s.waiters[p] = q[1:]
+			close(q[0].ready)
+			return
+		}
+	}
+	s.inUse--
+}
+
+// snapshot reports current occupancy and queue statistics.
+func (s *slots) snapshot() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	avg := time.Duration(0)
+	if s.stats.Served > 0 {
+		avg = s.stats.WaitSum / time.Duration(s.stats.Served)
+	}
+	return map[string]interface{}{
+		"max":       s.max,
+		"in_flight": s.inUse,
+		"waiting": map[string]int{
+			"interactive": len(s.waiters[interactive]),
+			"background":  len(s.waiters[background]),
+		},
+		"stats":       s.stats,
+		"avg_wait_ms": avg.Milliseconds(),
+		"max_wait_ms": s.stats.WaitMax.Milliseconds(),
+	}
+}
+
+// globalSlots and providerSlots are set from [concurrency] and
+// max_concurrent; nil means unlimited.
+var (
+	globalSlots   *slots
+	providerSlots = map[string]*slots{}
+)
+
+// acquireUpstream takes a global and a per-provider slot for one upstream
+// request, queueing at the request's priority, and reports the time spent
+// queued in X-Queue-Time. On success the caller must call release once the
+// response has been relayed.
+func acquireUpstream(w http.ResponseWriter, r *http.Request, p Provider) (release func(), err error) {
+	prio := requestPriority(r)
+	var held []*slots
+	release = func() {
+		for _, s := range held {
+			s.release()
+		}
+	}
+	var waited time.Duration
+	// Provider first, so a queue for one busy provider doesn't hold global
+	// slots that others could use.
+	for _, s := range []*slots{providerSlots[p.Name()], globalSlots} {
+		if s == nil {
+			continue
+		}
+		d, err := s.acquire(r.Context(), prio)
+		waited += d
+		if err != nil {
+			release()
+			return nil, err
+		}
+		held = append(held, s)
+	}
+	if waited > 0 {
+		w.Header().Set("X-Queue-Time", strconv.FormatInt(waited.Milliseconds(), 10)+"ms")
+	}
+	return release, nil
+}
+
+func writeAcquireError(w http.ResponseWriter, err error) {
+	if err == errQueueFull || err == errQueueTimeout {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	}
+	// Otherwise the client went away while queued; nobody is listening.
+}
+
+// handleAdminQueue reports concurrency limits and queue statistics.
+func handleAdminQueue(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, queueSnapshot())
+}
+
+func queueSnapshot() map[string]interface{} {
+	out := map[string]interface{}{}
+	if globalSlots != nil {
+		out["global"] = globalSlots.snapshot()
+	}
+	perProvider := map[string]interface{}{}
+	for name, s := range providerSlots {
+		perProvider[name] = s.snapshot()
+	}
+	out["providers"] = perProvider
+	return out
+}
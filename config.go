@@ -0,0 +1,550 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Config is the server configuration, loaded from a TOML or JSON file.
+// Every field is optional; defaultConfig fills in what the file leaves out.
+type Config struct {
+	Listen         string                `json:"listen"`
+	TLS            TLSConfig             `json:"tls"`
+	ServerKeys     bool                  `json:"server_keys"`
+	VaultFile      string                `json:"vault_file"`
+	AdminToken     string                `json:"admin_token"`
+	MaxBodyBytes   int64                 `json:"max_body_bytes"` // 0 is no limit
+	AuditFile      string                `json:"audit_file"`
+	StaticDir      string                `json:"static_dir"`
+	Timeouts       TimeoutConfig         `json:"timeouts"`
+	Retry          RetryConfig           `json:"retry"`
+	Breaker        BreakerConfig         `json:"breaker"`
+	Connections    ConnectionsConfig     `json:"connections"`
+	Auth           AuthConfig            `json:"auth"`
+	OIDC           OIDCConfig            `json:"oidc"`
+	Sessions       SessionConfig         `json:"sessions"`
+	CORS           CORSConfig            `json:"cors"`
+	RateLimit      RateLimitConfig       `json:"rate_limit"`
+	Concurrency    ConcurrencyConfig     `json:"concurrency"`
+	Cache          CacheConfig           `json:"cache"`
+	SemanticCache  SemanticCacheConfig   `json:"semantic_cache"`
+	EmbeddingCache EmbeddingCacheConfig  `json:"embedding_cache"`
+	PromptCache    PromptCacheConfig     `json:"prompt_cache"`
+	SystemPrompt   SystemPromptConfig    `json:"system_prompt"`
+	RAG            RAGConfig             `json:"rag"`
+	Log            LogConfig             `json:"log"`
+	Pricing        map[string]ModelPrice `json:"pricing"`
+	CostHeaders    bool                  `json:"cost_headers"`
+	// AnthropicBetas are the anthropic-beta features clients may turn on
+	// with that header; "*" allows any.
+	AnthropicBetas []string `json:"anthropic_betas"`
+	// StripThinking keeps Claude's thinking blocks from clients; the
+	// tokens spent thinking are still counted.
+	StripThinking  bool                       `json:"strip_thinking"`
+	Budgets        []BudgetConfig             `json:"budgets"`
+	TokenLimits    []TokenLimitConfig         `json:"token_limits"`
+	Routes         []RouteConfig              `json:"routes"`
+	Canaries       []CanaryConfig             `json:"canaries"`
+	Experiments    []ExperimentConfig         `json:"experiments"`
+	Aliases        map[string]ChatTarget      `json:"aliases"`
+	Templates      TemplatesConfig            `json:"templates"`
+	Conversations  ConversationsConfig        `json:"conversations"`
+	Uploads        UploadsConfig              `json:"uploads"`
+	Batches        BatchConfig                `json:"batches"`
+	Moderation     ModerationConfig           `json:"moderation"`
+	Guardrails     GuardrailsConfig           `json:"guardrails"`
+	PII            PIIConfig                  `json:"pii"`
+	Injection      InjectionConfig            `json:"injection"`
+	Tools          ToolsConfig                `json:"tools"`
+	Tokenizer      TokenizerConfig            `json:"tokenizer"`
+	MCP            map[string]MCPServerConfig `json:"mcp"`
+	Health         HealthConfig               `json:"health"`
+	DefaultHeaders map[string]string          `json:"default_headers"`
+	Passthrough    PassthroughConfig          `json:"passthrough"`
+	Outbound       OutboundConfig             `json:"outbound"`
+	Traffic        TrafficConfig              `json:"traffic"`
+	Mock           MockConfig                 `json:"mock"`
+	Fixtures       FixturesConfig             `json:"fixtures"`
+	Providers      map[string]ProviderConfig  `json:"providers"`
+}
+
+// TimeoutConfig bounds how long the listener and upstream calls may take.
+// Zero disables a timeout.
+type TimeoutConfig struct {
+	Read  duration `json:"read"`
+	Write duration `json:"write"`
+	Idle  duration `json:"idle"`
+	// Upstream limits the wait for an upstream's response headers, so a
+	// long stream is not cut off once it has started.
+	Upstream duration `json:"upstream"`
+	// Call limits a whole upstream call, retries and body included; Stream
+	// replaces it for streamed responses.
+	Call   duration `json:"call"`
+	Stream duration `json:"stream"`
+	// Shutdown is how long in-flight requests, streams included, may run
+	// after SIGTERM or SIGINT before their connections are closed.
+	Shutdown duration `json:"shutdown"`
+}
+
+// RateLimitConfig limits requests per client IP on /api routes. A zero
+// RPS disables it.
+type RateLimitConfig struct {
+	RPS   float64 `json:"rps"`
+	Burst int     `json:"burst"`
+	// TrustForwarded takes the client IP from X-Forwarded-For. Only enable
+	// it behind a reverse proxy that sets the header.
+	TrustForwarded bool `json:"trust_forwarded"`
+	// TrustedProxies are the addresses or CIDR ranges the header is taken
+	// from; loopback by default. ForwardedHops is how many of them a request
+	// passes on its way in, 1 by default: the client is that many entries
+	// from the right, past what the proxies appended.
+	TrustedProxies []string `json:"trusted_proxies"`
+	ForwardedHops  int      `json:"forwarded_hops"`
+}
+
+// ConcurrencyConfig caps in-flight upstream requests. Max is the global
+// limit and Queue how many requests may wait for a slot, globally and per
+// provider, before new ones get 503. Zero Max is unlimited; zero MaxWait
+// waits as long as the client does.
+type ConcurrencyConfig struct {
+	Max     int      `json:"max"`
+	Queue   int      `json:"queue"`
+	MaxWait duration `json:"max_wait"`
+}
+
+// CacheConfig enables the exact-match response cache. Zero TTL disables it.
+type CacheConfig struct {
+	TTL        duration `json:"ttl"`
+	MaxEntries int      `json:"max_entries"`
+}
+
+// SemanticCacheConfig enables the /api/chat semantic cache. Prompts are
+// embedded with Model on Provider (OpenAI-compatible or Ollama) and a
+// cached reply is served when similarity reaches Threshold.
+type SemanticCacheConfig struct {
+	Provider   string   `json:"provider"`
+	Model      string   `json:"model"`
+	Threshold  float64  `json:"threshold"`
+	TTL        duration `json:"ttl"`
+	MaxEntries int      `json:"max_entries"`
+}
+
+// LogConfig controls logging. Level and Format set the server log (one
+// line per request at info); DB is a SQLite file that keeps every /api
+// request and the start of its response, minus API keys.
+type LogConfig struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+	DB     string `json:"db"`
+}
+
+// HealthConfig sets up /readyz. Probe lists providers whose upstream must
+// accept a TCP connection within Timeout for the proxy to report ready.
+type HealthConfig struct {
+	Probe   []string `json:"probe"`
+	Timeout duration `json:"timeout"`
+}
+
+// ProviderConfig customises one registered provider.
+type ProviderConfig struct {
+	Enabled *bool  `json:"enabled"`
+	BaseURL string `json:"base_url"`
+	// Endpoint replaces the whole upstream URL, for gateways that don't
+	// mirror the provider's paths. It may use the provider's {} template
+	// fields. Set base_url or endpoint, not both.
+	Endpoint string            `json:"endpoint"`
+	Headers  map[string]string `json:"headers"`
+	// RPM and TPM cap requests and tokens per minute for each key used
+	// with this provider; set them to your account tier. Zero is unlimited.
+	RPM int `json:"rpm"`
+	TPM int `json:"tpm"`
+	// MaxConcurrent caps this provider's in-flight requests; zero is
+	// unlimited.
+	MaxConcurrent int `json:"max_concurrent"`
+	KeySource
+	// APIKeys is a pool of server-side keys used in turn instead of a
+	// single api_key; KeyStrategy is "round_robin" (the default) or
+	// "least_limited", preferring keys that were rate limited longest ago.
+	APIKeys     []KeySource `json:"api_keys"`
+	KeyStrategy string      `json:"key_strategy"`
+	// Profiles are named alternative keys, e.g. "work" and "personal",
+	// chosen per request with keyProfile or X-Key-Profile.
+	Profiles       map[string]KeySource `json:"profiles"`
+	DefaultProfile string               `json:"default_profile"`
+	// Fallbacks answer /api/chat requests, in order, when this provider
+	// fails with a connection error, timeout, 429 or 5xx.
+	Fallbacks []ChatTarget `json:"fallbacks"`
+	// SystemPrompt is added to every chat request for this provider,
+	// after [system_prompt] text.
+	SystemPrompt string `json:"system_prompt"`
+}
+
+// KeySource is a server-side key given inline or by environment variable.
+type KeySource struct {
+	APIKey    string `json:"api_key"`
+	APIKeyEnv string `json:"api_key_env"`
+}
+
+// duration accepts "30s"-style strings or a number of seconds.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case float64:
+		*d = duration(v * float64(time.Second))
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %s", b)
+	}
+	return nil
+}
+
+func (d duration) String() string { return time.Duration(d).String() }
+
+// config is the active configuration, set once at startup.
+var config = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen: ":8080",
+		TLS:    TLSConfig{CacheDir: "quirk-certs"},
+		// The app lives in its own directory, so the config, vault and
+		// databases beside the binary are never served.
+		StaticDir: "web",
+		// Long conversations with images run to a few MB; nothing
+		// legitimate needs more.
+		MaxBodyBytes: 32 << 20,
+		CORS: CORSConfig{
+			AllowedMethods: []string{"GET", "POST", "DELETE", "OPTIONS"},
+			AllowedHeaders: []string{"Content-Type", "Authorization", "X-Key-Profile", "X-Priority",
+				"X-Cache-Bypass", "Cache-Control", "X-Request-ID", "traceparent", "anthropic-beta"},
+			MaxAge: duration(10 * time.Minute),
+		},
+		Retry: RetryConfig{
+			Attempts:   3,
+			Backoff:    duration(500 * time.Millisecond),
+			MaxBackoff: duration(10 * time.Second),
+		},
+		Breaker: BreakerConfig{Failures: 5, Cooldown: duration(30 * time.Second)},
+		Connections: ConnectionsConfig{
+			MaxIdlePerHost: 64,
+			IdleTimeout:    duration(90 * time.Second),
+			KeepAlive:      duration(30 * time.Second),
+		},
+		Timeouts: TimeoutConfig{
+			Read:     duration(30 * time.Second),
+			Idle:     duration(120 * time.Second),
+			Upstream: duration(60 * time.Second),
+			Call:     duration(2 * time.Minute),
+			Stream:   duration(10 * time.Minute),
+			Shutdown: duration(30 * time.Second),
+		},
+		Cache:    CacheConfig{MaxEntries: 1000},
+		Log:      LogConfig{Level: "info", Format: "text"},
+		Health:   HealthConfig{Timeout: duration(2 * time.Second)},
+		Sessions: SessionConfig{Store: "memory", TTL: duration(24 * time.Hour)},
+		SemanticCache: SemanticCacheConfig{
+			Threshold:  0.95,
+			TTL:        duration(time.Hour),
+			MaxEntries: 1000,
+		},
+	}
+}
+
+// loadConfig reads path on top of the defaults. An empty path returns the
+// defaults. Callers validate once flag and environment overrides are in.
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := data
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		tree, err := parseTOML(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		// Re-encode so TOML and JSON files share the json struct tags
+		if raw, err = json.Marshal(tree); err != nil {
+			return nil, err
+		}
+	}
+
+	dec := json.NewDecoder(strings.NewReader(string(raw)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func (c *Config) validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("listen: %w", err))
+	}
+	if info, err := os.Stat(c.StaticDir); err != nil || !info.IsDir() {
+		errs = append(errs, fmt.Errorf("static_dir: %q is not a directory", c.StaticDir))
+	}
+	for name, d := range map[string]duration{
+		"read": c.Timeouts.Read, "write": c.Timeouts.Write,
+		"idle": c.Timeouts.Idle, "upstream": c.Timeouts.Upstream,
+		"call": c.Timeouts.Call, "stream": c.Timeouts.Stream,
+		"shutdown": c.Timeouts.Shutdown,
+	} {
+		if d < 0 {
+			errs = append(errs, fmt.Errorf("timeouts.%s: must not be negative", name))
+		}
+	}
+	if c.MaxBodyBytes < 0 {
+		errs = append(errs, errors.New("max_body_bytes: must not be negative"))
+	}
+	if c.RateLimit.RPS < 0 || c.RateLimit.Burst < 0 || c.RateLimit.ForwardedHops < 0 {
+		errs = append(errs, errors.New("rate_limit: rps, burst and forwarded_hops must not be negative"))
+	}
+	for i, p := range c.RateLimit.TrustedProxies {
+		if _, err := parsePrefix(p); err != nil {
+			errs = append(errs, fmt.Errorf("rate_limit.trusted_proxies[%d]: %q is not an address or CIDR range", i, p))
+		}
+	}
+	if c.Concurrency.Max < 0 || c.Concurrency.Queue < 0 || c.Concurrency.MaxWait < 0 {
+		errs = append(errs, errors.New("concurrency: max, queue and max_wait must not be negative"))
+	}
+	if c.Cache.TTL < 0 || c.Cache.MaxEntries < 0 {
+		errs = append(errs, errors.New("cache: ttl and max_entries must not be negative"))
+	}
+	if !validLogLevel(c.Log.Level) {
+		errs = append(errs, fmt.Errorf("log.level: %q is not debug, info, warn or error", c.Log.Level))
+	}
+	if f, err := normalizeLogFormat(c.Log.Format); err != nil {
+		errs = append(errs, fmt.Errorf("log.format: %w", err))
+	} else {
+		c.Log.Format = f
+	}
+	errs = append(errs, c.TLS.validate()...)
+	errs = append(errs, c.CORS.validate()...)
+	errs = append(errs, c.Passthrough.validate()...)
+	errs = append(errs, c.Outbound.validate()...)
+	errs = append(errs, c.Retry.validate()...)
+	errs = append(errs, c.Breaker.validate()...)
+	errs = append(errs, c.Connections.validate()...)
+	errs = append(errs, c.Auth.validate()...)
+	errs = append(errs, c.OIDC.validate()...)
+	errs = append(errs, c.Sessions.validate()...)
+	errs = append(errs, c.Conversations.validate()...)
+	errs = append(errs, c.Uploads.validate()...)
+	errs = append(errs, c.EmbeddingCache.validate()...)
+	errs = append(errs, c.PromptCache.validate()...)
+	errs = append(errs, c.SystemPrompt.validate()...)
+	errs = append(errs, c.RAG.validate()...)
+	errs = append(errs, c.Moderation.validate()...)
+	errs = append(errs, c.Guardrails.validate()...)
+	errs = append(errs, c.PII.validate()...)
+	errs = append(errs, c.Injection.validate()...)
+	errs = append(errs, c.Tools.validate()...)
+	errs = append(errs, c.Tokenizer.validate()...)
+	errs = append(errs, c.Traffic.validate()...)
+	errs = append(errs, c.Mock.validate()...)
+	errs = append(errs, c.Fixtures.validate()...)
+	errs = append(errs, validateMCP(c.MCP)...)
+	errs = append(errs, validateAliases(c.Aliases)...)
+	errs = append(errs, validateExperiments(c.Experiments)...)
+	for i, rc := range c.Routes {
+		errs = append(errs, rc.validate("routes", i)...)
+	}
+	errs = append(errs, validateCanaries(c.Canaries)...)
+	for i, b := range c.Budgets {
+		errs = append(errs, b.validate(i)...)
+	}
+	for i, l := range c.TokenLimits {
+		errs = append(errs, l.validate(i)...)
+	}
+	for model, p := range c.Pricing {
+		if p.Input < 0 || p.Output < 0 {
+			errs = append(errs, fmt.Errorf("pricing.%s: prices must not be negative", model))
+		}
+	}
+	if sc := c.SemanticCache; sc.Provider != "" {
+		if _, ok := lookupProvider(sc.Provider); !ok {
+			errs = append(errs, fmt.Errorf("semantic_cache.provider: unknown provider %q", sc.Provider))
+		}
+		if sc.Model == "" {
+			errs = append(errs, errors.New("semantic_cache.model: required"))
+		}
+		if sc.Threshold <= 0 || sc.Threshold > 1 {
+			errs = append(errs, errors.New("semantic_cache.threshold: must be in (0, 1]"))
+		}
+		if sc.TTL <= 0 {
+			errs = append(errs, errors.New("semantic_cache.ttl: must be positive"))
+		}
+	}
+	for _, name := range c.Health.Probe {
+		if _, ok := lookupProvider(name); !ok {
+			errs = append(errs, fmt.Errorf("health.probe: unknown provider %q", name))
+		}
+	}
+	if c.Health.Timeout <= 0 {
+		errs = append(errs, errors.New("health.timeout: must be positive"))
+	}
+	for name, pc := range c.Providers {
+		if _, ok := lookupProvider(name); !ok {
+			errs = append(errs, fmt.Errorf("providers.%s: unknown provider", name))
+			continue
+		}
+		if pc.BaseURL != "" {
+			u, err := url.Parse(pc.BaseURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, fmt.Errorf("providers.%s.base_url: %q is not an http(s) URL", name, pc.BaseURL))
+			}
+		}
+		if pc.Endpoint != "" {
+			if !strings.HasPrefix(pc.Endpoint, "http://") && !strings.HasPrefix(pc.Endpoint, "https://") {
+				errs = append(errs, fmt.Errorf("providers.%s.endpoint: %q is not an http(s) URL", name, pc.Endpoint))
+			}
+			if pc.BaseURL != "" {
+				errs = append(errs, fmt.Errorf("providers.%s: set base_url or endpoint, not both", name))
+			}
+		}
+		if pc.RPM < 0 || pc.TPM < 0 || pc.MaxConcurrent < 0 {
+			errs = append(errs, fmt.Errorf("providers.%s: rpm, tpm and max_concurrent must not be negative", name))
+		}
+		errs = append(errs, pc.validateKeys(name)...)
+		for i, t := range pc.Fallbacks {
+			errs = append(errs, t.validate(fmt.Sprintf("providers.%s.fallbacks[%d]", name, i))...)
+		}
+		for profile := range pc.Profiles {
+			if profile == "" || strings.Contains(profile, ":") {
+				errs = append(errs, fmt.Errorf("providers.%s.profiles: invalid profile name %q", name, profile))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// providerEnabled reports whether name should be mounted.
+func (c *Config) providerEnabled(name string) bool {
+	pc, ok := c.Providers[name]
+	return !ok || pc.Enabled == nil || *pc.Enabled
+}
+
+// applyConfig points providers at configured base URLs or endpoints, sets the upstream
+// header timeout and sets up rate and concurrency limits and the cache.
+func applyConfig(c *Config) {
+	for name, pc := range c.Providers {
+		p, _ := lookupProvider(name)
+		if spec, ok := p.(*providerSpec); ok {
+			if pc.BaseURL != "" {
+				spec.endpoint = rebaseURL(spec.endpoint, pc.BaseURL)
+			} else if pc.Endpoint != "" {
+				spec.endpoint = pc.Endpoint
+			}
+		}
+		if pc.MaxConcurrent > 0 {
+			providerSlots[name] = newSlots(pc.MaxConcurrent, c.Concurrency.Queue, time.Duration(c.Concurrency.MaxWait))
+		}
+	}
+	if c.Concurrency.Max > 0 {
+		globalSlots = newSlots(c.Concurrency.Max, c.Concurrency.Queue, time.Duration(c.Concurrency.MaxWait))
+	}
+	if c.Cache.TTL > 0 {
+		cache = newResponseCache(time.Duration(c.Cache.TTL), c.Cache.MaxEntries)
+	}
+	if sc := c.SemanticCache; sc.Provider != "" {
+		embedder, _ := lookupProvider(sc.Provider)
+		semCache = &semanticCache{
+			embedder:   embedder,
+			model:      sc.Model,
+			threshold:  sc.Threshold,
+			ttl:        time.Duration(sc.TTL),
+			maxEntries: sc.MaxEntries,
+			entries:    map[string][]semanticEntry{},
+		}
+	}
+
+	moderator = newModeration(c.Moderation)
+	guardrails = newGuardrails(c.Guardrails)
+	piiHandling = newPIIPolicy(c.PII)
+	injections = newInjectionScreen(c.Injection)
+	mcpServers = newMCPServers(c.MCP)
+	fixtures = newFixtures(c.Fixtures)
+
+	limiter.set(c.RateLimit.RPS, c.RateLimit.Burst)
+	aliases.set(c.Aliases)
+	canaries.set(c.Canaries, time.Now())
+
+	outboundProxy = c.Outbound.proxyFunc()
+	setUpstreamTransport(&mockTransport{next: withTraffic(c.Traffic, newUpstreamTransport(c))})
+}
+
+// rebaseURL swaps the scheme and host of endpoint for base, keeping the API
+// path: "https://gw.example/openai" + ".../v1/chat/completions" gives
+// "https://gw.example/openai/v1/chat/completions". It works on the raw
+// string so URL templates like "{resource}" survive.
+func rebaseURL(endpoint, base string) string {
+	path := ""
+	if i := strings.Index(endpoint, "://"); i >= 0 {
+		if j := strings.IndexByte(endpoint[i+3:], '/'); j >= 0 {
+			path = endpoint[i+3+j:]
+		}
+	}
+	return strings.TrimRight(base, "/") + path
+}
+
+// servedSecrets lists the files with keys or user data, the config file
+// at configPath among them, that static_dir would serve to anyone.
+func (c *Config) servedSecrets(configPath string) []string {
+	root, err := filepath.Abs(c.StaticDir)
+	if err != nil {
+		return nil
+	}
+	secrets := []string{configPath, c.VaultFile, c.AuditFile, c.Auth.TokensFile, c.TLS.KeyFile,
+		c.Log.DB, c.Sessions.DB, c.Conversations.DB, c.Templates.DB, c.Batches.DB, c.EmbeddingCache.DB, c.RAG.DB}
+	if len(c.TLS.Autocert) > 0 {
+		secrets = append(secrets, c.TLS.CacheDir)
+	}
+	var served []string
+	for _, p := range secrets {
+		if p == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(p); err == nil && strings.HasPrefix(abs, root+string(filepath.Separator)) {
+			served = append(served, p)
+		}
+	}
+	return served
+}
+
+// upstreamHeaders returns the configured extra headers for provider name,
+// provider-specific values winning over default_headers.
+func (c *Config) upstreamHeaders(name string) map[string]string {
+	headers := map[string]string{}
+	for k, v := range c.DefaultHeaders {
+		headers[k] = v
+	}
+	for k, v := range c.Providers[name].Headers {
+		headers[k] = v
+	}
+	return headers
+}
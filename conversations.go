@@ -0,0 +1,502 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConversationsConfig sets where conversations are kept. Without a DB they
+// live in memory and are lost on restart.
+type ConversationsConfig struct {
+	DB string `json:"db"`
+	// MaxHistory caps how many earlier user and assistant messages are
+	// sent upstream with a new turn, the most recent kept; 0 sends them all.
+	MaxHistory int `json:"max_history"`
+}
+
+func (c ConversationsConfig) validate() []error {
+	if c.MaxHistory < 0 {
+		return []error{errors.New("conversations.max_history: must not be negative")}
+	}
+	return nil
+}
+
+// conversation is a stored chat. It belongs to the user who created it;
+// without authentication every client is the same anonymous user.
+type conversation struct {
+	ID           string                `json:"id"`
+	User         string                `json:"user,omitempty"`
+	Title        string                `json:"title,omitempty"`
+	Created      time.Time             `json:"created"`
+	Updated      time.Time             `json:"updated"`
+	MessageCount int                   `json:"message_count"`
+	Messages     []conversationMessage `json:"messages,omitempty"`
+}
+
+// conversationMessage is one stored turn. Replies note who gave them.
+type conversationMessage struct {
+	Role     string    `json:"role"`
+	Content  string    `json:"content"`
+	Provider string    `json:"provider,omitempty"`
+	Model    string    `json:"model,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+// conversationBackend persists conversations. get returns nil for an
+// unknown ID; list leaves out messages.
+type conversationBackend interface {
+	create(c *conversation) error
+	get(id string) (*conversation, error)
+	list(user string) ([]*conversation, error)
+	append(id string, messages []conversationMessage, now time.Time) error
+	delete(id string) (bool, error)
+}
+
+type conversationStore struct {
+	backend    conversationBackend
+	maxHistory int
+}
+
+var conversations = &conversationStore{backend: newMemoryConversations()}
+
+// openConversations builds the store from config.
+func openConversations(c ConversationsConfig) (*conversationStore, error) {
+	s := &conversationStore{maxHistory: c.MaxHistory}
+	if c.DB == "" {
+		s.backend = newMemoryConversations()
+		return s, nil
+	}
+	b, err := openSQLiteConversations(c.DB)
+	if err != nil {
+		return nil, err
+	}
+	s.backend = b
+	return s, nil
+}
+
+func newConversationID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// owned returns conversation id if user may see it, or nil.
+func (s *conversationStore) owned(id, user string) (*conversation, error) {
+	c, err := s.backend.get(id)
+	if err != nil || c == nil || c.User != user {
+		return nil, err
+	}
+	return c, nil
+}
+
+// history is what of c goes upstream ahead of a new turn. System messages
+// are always kept; max_history trims the oldest of the rest.
+func (s *conversationStore) history(c *conversation) []chatMessage {
+	drop := 0
+	if s.maxHistory > 0 {
+		turns := 0
+		for _, m := range c.Messages {
+			if m.Role != "system" {
+				turns++
+			}
+		}
+		drop = max(turns-s.maxHistory, 0)
+	}
+	out := make([]chatMessage, 0, len(c.Messages))
+	for _, m := range c.Messages {
+		if m.Role != "system" && drop > 0 {
+			drop--
+			continue
+		}
+		out = append(out, chatMessage{Role: m.Role, Content: m.Content})
+	}
+	return out
+}
+
+// storedMessages converts messages for storage. Uploads expire, so images
+// are kept only as a note in the text.
+func storedMessages(list []chatMessage, now time.Time) []conversationMessage {
+	out := make([]conversationMessage, len(list))
+	for i, m := range list {
+		content := m.Content
+		for _, id := range m.Images {
+			content = strings.TrimSpace(content + "\n[image " + id + "]")
+		}
+		out[i] = conversationMessage{Role: m.Role, Content: content, Created: now}
+	}
+	return out
+}
+
+// useConversation puts the stored turns of cr's conversation ahead of its
+// messages and returns the conversation with the new messages, ready for
+// recordTurn, or nil when cr names none.
+func (cr *chatRequest) useConversation(user string) (*conversation, []chatMessage, error) {
+	if cr.Conversation == "" {
+		return nil, nil, nil
+	}
+	c, err := conversations.owned(cr.Conversation, user)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c == nil {
+		return nil, nil, errNoConversation
+	}
+	turn := append([]chatMessage(nil), cr.Messages...)
+	cr.Messages = append(conversations.history(c), cr.Messages...)
+	return c, turn, nil
+}
+
+var errNoConversation = errors.New("no such conversation")
+
+// recordTurn appends a finished exchange to c.
+func (s *conversationStore) recordTurn(c *conversation, turn []chatMessage, reply string, answered ChatTarget) error {
+	now := time.Now()
+	msgs := storedMessages(turn, now)
+	msgs = append(msgs, conversationMessage{
+		Role: "assistant", Content: reply, Provider: answered.Provider, Model: answered.Model, Created: now,
+	})
+	return s.backend.append(c.ID, msgs, now)
+}
+
+// handleConversations serves the conversation API:
+//
+//	GET    /api/conversations                 the caller's conversations
+//	POST   /api/conversations                 create one from {"title", "messages"}
+//	GET    /api/conversations/{id}            one, with its messages
+//	DELETE /api/conversations/{id}
+//	POST   /api/conversations/{id}/messages   append {"messages"}
+//	GET    /api/conversations/{id}/export     as JSON or ?format=markdown
+//	POST   /api/conversations/import          a JSON export, as a new one
+//
+// /api/chat continues a conversation given its ID as "conversation".
+func handleConversations(w http.ResponseWriter, r *http.Request) {
+	user := recordFrom(r).user()
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/conversations"), "/")
+	id, sub, _ := strings.Cut(rest, "/")
+
+	if id == "" {
+		switch r.Method {
+		case "GET":
+			list, err := conversations.backend.list(user)
+			if err != nil {
+				http.Error(w, "Listing conversations: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"conversations": list})
+		case "POST":
+			var body struct {
+				Title    string        `json:"title"`
+				Messages []chatMessage `json:"messages"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				writeDecodeError(w, err)
+				return
+			}
+			if err := validateMessages(body.Messages); err != nil {
+				writeBuildError(w, err)
+				return
+			}
+			now := time.Now()
+			c := &conversation{
+				ID: newConversationID(), User: user, Title: body.Title, Created: now, Updated: now,
+				MessageCount: len(body.Messages), Messages: storedMessages(body.Messages, now),
+			}
+			if err := conversations.backend.create(c); err != nil {
+				http.Error(w, "Creating conversation: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusCreated, c)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	if id == "import" && sub == "" {
+		handleConversationImport(w, r)
+		return
+	}
+
+	c, err := conversations.owned(id, user)
+	if err != nil {
+		http.Error(w, "Loading conversation: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if c == nil {
+		http.Error(w, "No conversation "+id, http.StatusNotFound)
+		return
+	}
+	switch {
+	case sub == "" && r.Method == "GET":
+		writeJSON(w, http.StatusOK, c)
+	case sub == "" && r.Method == "DELETE":
+		if _, err := conversations.backend.delete(id); err != nil {
+			http.Error(w, "Deleting conversation: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case sub == "messages" && r.Method == "POST":
+		var body struct {
+			Messages []chatMessage `json:"messages"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeDecodeError(w, err)
+			return
+		}
+		if len(body.Messages) == 0 {
+			http.Error(w, "messages: must be a non-empty array", http.StatusBadRequest)
+			return
+		}
+		if err := validateMessages(body.Messages); err != nil {
+			writeBuildError(w, err)
+			return
+		}
+		if err := conversations.backend.append(id, storedMessages(body.Messages, time.Now()), time.Now()); err != nil {
+			http.Error(w, "Appending to conversation: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case sub == "export":
+		handleConversationExport(w, r, c)
+	case sub == "" || sub == "messages":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// memoryConversations is the default backend.
+type memoryConversations struct {
+	mu    sync.Mutex
+	convs map[string]*conversation
+}
+
+func newMemoryConversations() *memoryConversations {
+	return &memoryConversations{convs: map[string]*conversation{}}
+}
+
+func (m *memoryConversations) create(c *conversation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := *c
+	stored.Messages = append([]conversationMessage(nil), c.Messages...)
+	m.convs[c.ID] = &stored
+	return nil
+}
+
+func (m *memoryConversations) get(id string) (*conversation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.convs[id]
+	if !ok {
+		return nil, nil
+	}
+	out := *c
+	out.Messages = append([]conversationMessage(nil), c.Messages...)
+	return &out, nil
+}
+
+func (m *memoryConversations) list(user string) ([]*conversation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []*conversation{}
+	for _, c := range m.convs {
+		if c.User == user {
+			summary := *c
+			summary.Messages = nil
+			out = append(out, &summary)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Updated.After(out[j].Updated) })
+	return out, nil
+}
+
+func (m *memoryConversations) append(id string, messages []conversationMessage, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.convs[id]
+	if !ok {
+		return errNoConversation
+	}
+	c.Messages = append(c.Messages, messages...)
+	c.MessageCount = len(c.Messages)
+	c.Updated = now
+	return nil
+}
+
+func (m *memoryConversations) delete(id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.convs[id]
+	delete(m.convs, id)
+	return ok, nil
+}
+
+// sqliteConversations keeps conversations across restarts.
+type sqliteConversations struct {
+	db *sql.DB
+}
+
+var conversationSchema = []string{`
+CREATE TABLE IF NOT EXISTS conversations (
+	id      TEXT PRIMARY KEY,
+	user    TEXT NOT NULL,
+	title   TEXT NOT NULL,
+	created INTEGER NOT NULL,
+	updated INTEGER NOT NULL
+)`, `
+CREATE TABLE IF NOT EXISTS conversation_messages (
+	conversation_id TEXT NOT NULL,
+	seq      INTEGER NOT NULL,
+	role     TEXT NOT NULL,
+	content  TEXT NOT NULL,
+	provider TEXT NOT NULL,
+	model    TEXT NOT NULL,
+	created  INTEGER NOT NULL,
+	PRIMARY KEY (conversation_id, seq)
+)`,
+	`CREATE INDEX IF NOT EXISTS conversations_user ON conversations (user, updated)`,
+}
+
+func openSQLiteConversations(path string) (*sqliteConversations, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	for _, stmt := range append([]string{"PRAGMA journal_mode=WAL", "PRAGMA busy_timeout=5000"}, conversationSchema...) {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("conversations: %w", err)
+		}
+	}
+	return &sqliteConversations{db: db}, nil
+}
+
+func (s *sqliteConversations) create(c *conversation) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`INSERT INTO conversations (id, user, title, created, updated) VALUES (?, ?, ?, ?, ?)`,
+		c.ID, c.User, c.Title, c.Created.UnixMilli(), c.Updated.UnixMilli()); err != nil {
+		return err
+	}
+	if err := insertConversationMessages(tx, c.ID, 0, c.Messages); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertConversationMessages(tx *sql.Tx, id string, seq int, messages []conversationMessage) error {
+	for _, m := range messages {
+		seq++
+		if _, err := tx.Exec(`INSERT INTO conversation_messages
+			(conversation_id, seq, role, content, provider, model, created) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			id, seq, m.Role, m.Content, m.Provider, m.Model, m.Created.UnixMilli()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteConversations) get(id string) (*conversation, error) {
+	c := &conversation{ID: id}
+	var created, updated int64
+	err := s.db.QueryRow(`SELECT user, title, created, updated FROM conversations WHERE id = ?`, id).
+		Scan(&c.User, &c.Title, &created, &updated)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.Created, c.Updated = time.UnixMilli(created), time.UnixMilli(updated)
+	rows, err := s.db.Query(`SELECT role, content, provider, model, created FROM conversation_messages
+		WHERE conversation_id = ? ORDER BY seq`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m conversationMessage
+		var at int64
+		if err := rows.Scan(&m.Role, &m.Content, &m.Provider, &m.Model, &at); err != nil {
+			return nil, err
+		}
+		m.Created = time.UnixMilli(at)
+		c.Messages = append(c.Messages, m)
+	}
+	c.MessageCount = len(c.Messages)
+	return c, rows.Err()
+}
+
+func (s *sqliteConversations) list(user string) ([]*conversation, error) {
+	rows, err := s.db.Query(`SELECT c.id, c.title, c.created, c.updated,
+		(SELECT count(*) FROM conversation_messages m WHERE m.conversation_id = c.id)
+		FROM conversations c WHERE c.user = ? ORDER BY c.updated DESC`, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*conversation{}
+	for rows.Next() {
+		c := &conversation{User: user}
+		var created, updated int64
+		if err := rows.Scan(&c.ID, &c.Title, &created, &updated, &c.MessageCount); err != nil {
+			return nil, err
+		}
+		c.Created, c.Updated = time.UnixMilli(created), time.UnixMilli(updated)
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteConversations) append(id string, messages []conversationMessage, now time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`UPDATE conversations SET updated = ? WHERE id = ?`, now.UnixMilli(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNoConversation
+	}
+	var seq int
+	if err := tx.QueryRow(`SELECT coalesce(max(seq), 0) FROM conversation_messages WHERE conversation_id = ?`, id).Scan(&seq); err != nil {
+		return err
+	}
+	if err := insertConversationMessages(tx, id, seq, messages); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteConversations) delete(id string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`DELETE FROM conversations WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`DELETE FROM conversation_messages WHERE conversation_id = ?`, id); err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, tx.Commit()
+}
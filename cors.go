@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig lets browsers on other origins call the /api routes. With no
+// AllowedOrigins, no CORS headers are sent and only same-origin pages work.
+type CORSConfig struct {
+	// AllowedOrigins are exact origins such as "https://app.example.com",
+	// or "*" for any.
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	MaxAge           duration `json:"max_age"`
+}
+
+// corsExposed are the response headers the proxy adds that scripts may read.
+var corsExposed = strings.Join([]string{
+	"X-Request-ID", "X-Cache", "X-Cache-Match", "X-Cache-Similarity", costHeader,
+	"X-Queue-Time", "X-Budget-Warning", "Retry-After", "X-Provider", "X-Model", "X-Failover-From", "X-Route", "X-Experiment", "X-Canary", "X-Template",
+	"X-Moderation-Flagged", "X-Guardrails", "X-PII-Detected", "X-Injection-Score", "X-Schema-Attempts", "X-Token-Limit",
+}, ", ")
+
+func (c CORSConfig) validate() []error {
+	if c.AllowCredentials && slices.Contains(c.AllowedOrigins, "*") {
+		return []error{errors.New(`cors: allow_credentials cannot be combined with origin "*"`)}
+	}
+	return nil
+}
+
+func (c CORSConfig) allows(origin string) bool {
+	return slices.Contains(c.AllowedOrigins, "*") || slices.Contains(c.AllowedOrigins, origin)
+}
+
+// withCORS adds CORS headers for allowed origins and answers preflight
+// OPTIONS requests itself, before rate limits and logging.
+func withCORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := config.CORS
+		origin := r.Header.Get("Origin")
+		if len(c.AllowedOrigins) == 0 || origin == "" {
+			next(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if !c.allows(origin) {
+			if r.Method == "OPTIONS" {
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			next(w, r) // the browser blocks the response without our headers
+			return
+		}
+		if slices.Contains(c.AllowedOrigins, "*") && !c.AllowCredentials {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if c.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if r.Method != "OPTIONS" || r.Header.Get("Access-Control-Request-Method") == "" {
+			h.Set("Access-Control-Expose-Headers", corsExposed)
+			next(w, r)
+			return
+		}
+
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		h.Set("Access-Control-Allow-Methods", strings.Join(c.AllowedMethods, ", "))
+		h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+		if c.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(time.Duration(c.MaxAge).Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The dashboard keeps a short in-memory window of recent traffic for an
+// admin UI. Longer history belongs to the request log and /metrics.
+const (
+	dashboardBucket  = 10 * time.Second
+	dashboardBuckets = 90 // 15 minutes
+	dashboardErrors  = 50
+	latencySamples   = 500 // per provider
+)
+
+type trafficBucket struct {
+	Start    time.Time `json:"start"`
+	Requests int       `json:"requests"`
+	Errors   int       `json:"errors"`
+}
+
+// recentError is a finished request that failed.
+type recentError struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Path      string    `json:"path"`
+	Provider  string    `json:"provider,omitempty"`
+	Model     string    `json:"model,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Status    int       `json:"status"`
+	LatencyMS int64     `json:"latency_ms"`
+	Body      string    `json:"body,omitempty"` // start of the error response, with a request log
+}
+
+type latencySample struct {
+	at      time.Time
+	latency time.Duration
+}
+
+// activeStream is a streaming response still being written.
+type activeStream struct {
+	ID       string
+	Provider string
+	Model    string
+	User     string
+	Started  time.Time
+	bytes    atomic.Int64
+}
+
+type dashboardStats struct {
+	mu      sync.Mutex
+	buckets [dashboardBuckets]trafficBucket // ring, indexed by bucket number
+	errors  []recentError                   // newest last
+	latency map[string][]latencySample      // ring per provider
+	next    map[string]int
+	streams map[*activeStream]struct{}
+}
+
+var dashboard = &dashboardStats{
+	latency: map[string][]latencySample{},
+	next:    map[string]int{},
+	streams: map[*activeStream]struct{}{},
+}
+
+func (d *dashboardStats) bucket(t time.Time) *trafficBucket {
+	start := t.Truncate(dashboardBucket)
+	b := &d.buckets[(start.Unix()/int64(dashboardBucket.Seconds()))%dashboardBuckets]
+	if !b.Start.Equal(start) {
+		*b = trafficBucket{Start: start}
+	}
+	return b
+}
+
+// record adds a finished request to the window.
+func (d *dashboardStats) record(rec *requestRecord) {
+	now := rec.Start.Add(rec.Latency)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	b := d.bucket(now)
+	b.Requests++
+	if rec.Status >= 400 {
+		b.Errors++
+		e := recentError{
+			Time:      now.UTC(),
+			RequestID: rec.ID,
+			Path:      rec.Path,
+			Provider:  rec.Provider,
+			Model:     rec.Model,
+			User:      rec.User,
+			Status:    rec.Status,
+			LatencyMS: rec.Latency.Milliseconds(),
+			Body:      strings.TrimSpace(string(rec.Response.Bytes()[:min(rec.Response.Len(), 512)])),
+		}
+		if len(d.errors) == dashboardErrors {
+			d.errors = append(d.errors[:0], d.errors[1:]...)
+		}
+		d.errors = append(d.errors, e)
+	}
+
+	if rec.Provider != "" && !rec.Cached && rec.Status < 500 {
+		s := latencySample{at: now, latency: rec.Latency}
+		if ring := d.latency[rec.Provider]; len(ring) < latencySamples {
+			d.latency[rec.Provider] = append(ring, s)
+		} else {
+			ring[d.next[rec.Provider]] = s
+			d.next[rec.Provider] = (d.next[rec.Provider] + 1) % latencySamples
+		}
+	}
+}
+
+func (d *dashboardStats) streamStarted(rec *requestRecord) *activeStream {
+	s := &activeStream{ID: rec.ID, Provider: rec.Provider, Model: rec.Model, User: rec.User, Started: time.Now()}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.streams[s] = struct{}{}
+	return s
+}
+
+func (d *dashboardStats) streamEnded(s *activeStream) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.streams, s)
+}
+
+// throughput returns the window oldest first, with empty buckets filled
+// in, and the average requests per second over the last minute.
+func (d *dashboardStats) throughput(now time.Time) map[string]interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	series := make([]trafficBucket, 0, dashboardBuckets)
+	lastMinute := 0
+	for i := dashboardBuckets - 1; i >= 0; i-- {
+		start := now.Add(-time.Duration(i) * dashboardBucket).Truncate(dashboardBucket)
+		b := d.buckets[(start.Unix()/int64(dashboardBucket.Seconds()))%dashboardBuckets]
+		if !b.Start.Equal(start) {
+			b = trafficBucket{Start: start}
+		}
+		if now.Sub(start) < time.Minute {
+			lastMinute += b.Requests
+		}
+		b.Start = b.Start.UTC()
+		series = append(series, b)
+	}
+	return map[string]interface{}{
+		"bucket_seconds": int(dashboardBucket.Seconds()),
+		"rps_1m":         float64(lastMinute) / time.Minute.Seconds(),
+		"series":         series,
+	}
+}
+
+func (d *dashboardStats) recentErrors() []recentError {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make([]recentError, len(d.errors))
+	for i, e := range d.errors {
+		out[len(out)-1-i] = e
+	}
+	return out
+}
+
+// providerLatency summarises each provider's samples from the window.
+func (d *dashboardStats) providerLatency(now time.Time) map[string]interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := map[string]interface{}{}
+	for provider, ring := range d.latency {
+		var ms []float64
+		for _, s := range ring {
+			if now.Sub(s.at) <= dashboardBuckets*dashboardBucket {
+				ms = append(ms, float64(s.latency.Microseconds())/1000)
+			}
+		}
+		if len(ms) == 0 {
+			continue
+		}
+		sort.Float64s(ms)
+		pct := func(p float64) float64 { return ms[int(p*float64(len(ms)-1))] }
+		out[provider] = map[string]interface{}{
+			"requests": len(ms),
+			"p50_ms":   pct(0.5),
+			"p95_ms":   pct(0.95),
+			"p99_ms":   pct(0.99),
+			"max_ms":   ms[len(ms)-1],
+		}
+	}
+	return out
+}
+
+func (d *dashboardStats) activeStreams(now time.Time) []map[string]interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make([]map[string]interface{}, 0, len(d.streams))
+	for s := range d.streams {
+		out = append(out, map[string]interface{}{
+			"request_id":      s.ID,
+			"provider":        s.Provider,
+			"model":           s.Model,
+			"user":            s.User,
+			"started":         s.Started.UTC(),
+			"elapsed_seconds": now.Sub(s.Started).Seconds(),
+			"bytes":           s.bytes.Load(),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i]["started"].(time.Time).Before(out[j]["started"].(time.Time))
+	})
+	return out
+}
+
+// tokenSpend is today's usage and cost per provider.
+func tokenSpend(now time.Time) map[string]interface{} {
+	today := now.UTC().Format("2006-01-02")
+	rows, total := usage.report(map[string]bool{"provider": true}, today, today, usageKey{})
+	return map[string]interface{}{"day": today, "total": total, "providers": rows}
+}
+
+// handleAdminDashboard serves the data behind an admin dashboard:
+// /api/admin/dashboard returns every section, and
+// /api/admin/dashboard/{throughput,errors,latency,spend,streams} one.
+func handleAdminDashboard(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	sections := map[string]func() interface{}{
+		"throughput": func() interface{} { return dashboard.throughput(now) },
+		"errors":     func() interface{} { return dashboard.recentErrors() },
+		"latency":    func() interface{} { return dashboard.providerLatency(now) },
+		"spend":      func() interface{} { return tokenSpend(now) },
+		"streams":    func() interface{} { return dashboard.activeStreams(now) },
+	}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/dashboard"), "/")
+	if name == "" {
+		out := map[string]interface{}{}
+		for name, section := range sections {
+			out[name] = section()
+		}
+		writeJSON(w, http.StatusOK, out)
+		return
+	}
+	section, ok := sections[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, section())
+}
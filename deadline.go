@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// errUpstreamTimeout ends an upstream call that ran past [timeouts] call,
+// or stream for streamed responses.
+var errUpstreamTimeout = errors.New("upstream call timed out")
+
+// upstreamDeadline bounds a whole upstream call, retries and the response
+// body included, so a hung upstream cannot hold a handler forever. The
+// call limit applies until the response headers show a stream, which then
+// gets the longer stream limit counted from the same start. finish must
+// be given the call's outcome; the deadline ends when the body is closed.
+func upstreamDeadline(req *http.Request) (*http.Request, func(*http.Response, error) (*http.Response, error)) {
+	t := config.Timeouts
+	if t.Call == 0 && t.Stream == 0 {
+		return req, func(resp *http.Response, err error) (*http.Response, error) { return resp, err }
+	}
+	ctx, cancel := context.WithCancelCause(req.Context())
+	expire := func() { cancel(errUpstreamTimeout) }
+	start := time.Now()
+	var timer *time.Timer
+	if t.Call > 0 {
+		timer = time.AfterFunc(time.Duration(t.Call), expire)
+	}
+	stop := func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		cancel(nil)
+	}
+
+	finish := func(resp *http.Response, err error) (*http.Response, error) {
+		if err != nil {
+			if context.Cause(ctx) == errUpstreamTimeout {
+				err = errUpstreamTimeout
+			}
+			stop()
+			return nil, err
+		}
+		if streamedResponse(resp) {
+			if timer != nil {
+				timer.Stop()
+				timer = nil
+			}
+			if t.Stream > 0 {
+				timer = time.AfterFunc(time.Duration(t.Stream)-time.Since(start), expire)
+			}
+		}
+		resp.Body = &deadlineBody{ReadCloser: resp.Body, ctx: ctx, stop: stop}
+		return resp, nil
+	}
+	return req.WithContext(ctx), finish
+}
+
+func streamedResponse(resp *http.Response) bool {
+	ct := resp.Header.Get("Content-Type")
+	return isStreamingType(ct) || strings.HasPrefix(ct, "application/vnd.amazon.eventstream")
+}
+
+// deadlineBody reports a body cut off by the deadline as a timeout and
+// releases the deadline when closed.
+type deadlineBody struct {
+	io.ReadCloser
+	ctx  context.Context
+	stop func()
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && context.Cause(b.ctx) == errUpstreamTimeout {
+		err = errUpstreamTimeout
+	}
+	return n, err
+}
+
+func (b *deadlineBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.stop()
+	return err
+}
@@ -0,0 +1,25 @@
+package main
+
+import "net/http"
+
+// DeepSeek. Responses are relayed verbatim, so deepseek-reasoner's
+// reasoning_content (and its streamed deltas) reaches the client untouched.
+// DeepSeek rejects reasoning_content on input messages, so it is stripped
+// from any history the client echoes back.
+func init() {
+	p := openAICompatible("deepseek", "https://api.deepseek.com/chat/completions")
+	p.build = buildDeepSeekRequest
+	registerProvider(p)
+}
+
+func buildDeepSeekRequest(p *providerSpec, body map[string]interface{}, apiKey string) (*http.Request, error) {
+	if messages, ok := body["messages"].([]interface{}); ok {
+		for _, m := range messages {
+			if msg, ok := m.(map[string]interface{}); ok {
+				delete(msg, "reasoning_content")
+			}
+		}
+	}
+
+	return bearerBuild(p, body, apiKey)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// ElevenLabs is text-to-speech only. Its route takes ElevenLabs' own body
+// plus "voice_id", which picks the voice in the URL, and streams the audio
+// back; /api/tts translates canonical bodies.
+func init() {
+	registerProvider(&providerSpec{
+		name:        "elevenlabs",
+		endpoint:    "https://api.elevenlabs.io/v1/text-to-speech/",
+		speech:      &elevenLabsSpeech,
+		noStreaming: true,
+		build:       buildElevenLabsRequest,
+	})
+}
+
+func buildElevenLabsRequest(p *providerSpec, body map[string]interface{}, apiKey string) (*http.Request, error) {
+	voice := takeString(body, "voice_id", "")
+	if voice == "" {
+		return nil, badRequest("voice_id: required")
+	}
+	req, err := newJSONRequest(p.Endpoint()+url.PathEscape(voice)+"/stream", body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("xi-api-key", apiKey)
+	return req, nil
+}
+
+// elevenLabsSpeech names formats by codec, sample rate and bitrate; the
+// canonical ones map to its common choices.
+var elevenLabsSpeech = speechDialect{
+	formats: map[string]string{"mp3": "mp3_44100_128", "opus": "opus_48000_128", "pcm": "pcm_24000"},
+	build: func(endpoint string, sr *speechRequest, format, apiKey string) (*http.Request, error) {
+		body := map[string]interface{}{"text": sr.Input, "model_id": sr.Model}
+		if sr.Speed != nil {
+			body["voice_settings"] = map[string]interface{}{"speed": *sr.Speed}
+		}
+		req, err := newJSONRequest(endpoint+url.PathEscape(sr.Voice)+"/stream?output_format="+format, body)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("xi-api-key", apiKey)
+		return req, nil
+	},
+}
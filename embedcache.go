@@ -0,0 +1,131 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"time"
+)
+
+// EmbeddingCacheConfig keeps embedding vectors in a SQLite file, so texts
+// embedded again, as when documents are re-indexed, cost nothing. Vectors
+// are keyed by provider, model, dimensions, input type and a hash of the
+// text.
+type EmbeddingCacheConfig struct {
+	DB string `json:"db"`
+	// MaxEntries bounds the cache, dropping the oldest vectors; 0 keeps
+	// them all.
+	MaxEntries int `json:"max_entries"`
+}
+
+func (c EmbeddingCacheConfig) validate() []error {
+	if c.MaxEntries < 0 {
+		return []error{errors.New("embedding_cache.max_entries: must not be negative")}
+	}
+	return nil
+}
+
+type embeddingCache struct {
+	db         *sql.DB
+	maxEntries int
+}
+
+// embedCache is the embeddings cache, or nil when it is not configured.
+var embedCache *embeddingCache
+
+const embeddingCacheSchema = `
+CREATE TABLE IF NOT EXISTS embeddings (
+	key      TEXT PRIMARY KEY,
+	provider TEXT NOT NULL,
+	model    TEXT NOT NULL,
+	vector   BLOB NOT NULL,
+	created  INTEGER NOT NULL
+)`
+
+func openEmbeddingCache(c EmbeddingCacheConfig) (*embeddingCache, error) {
+	db, err := sql.Open("sqlite", c.DB)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{"PRAGMA journal_mode=WAL", "PRAGMA busy_timeout=5000", embeddingCacheSchema} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("embedding cache: %w", err)
+		}
+	}
+	return &embeddingCache{db: db, maxEntries: c.MaxEntries}, nil
+}
+
+// embeddingKey identifies the vector er's text gets. Input type and
+// dimensions are part of it since they change the vector.
+func embeddingKey(er *embeddingRequest, text string) string {
+	return sha256Hex([]byte(er.Provider + "\x00" + er.Model + "\x00" + strconv.Itoa(er.Dimensions) + "\x00" + er.InputType + "\x00" + text))
+}
+
+// lookup returns the cached vector for each of er's inputs, nil where
+// there is none.
+func (c *embeddingCache) lookup(er *embeddingRequest) [][]float64 {
+	out := make([][]float64, len(er.Input))
+	for i, text := range er.Input {
+		var blob []byte
+		err := c.db.QueryRow(`SELECT vector FROM embeddings WHERE key = ?`, embeddingKey(er, text)).Scan(&blob)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				slog.Warn("embedding cache", "err", err)
+			}
+			continue
+		}
+		out[i] = decodeVector(blob)
+	}
+	return out
+}
+
+// store caches the vectors for er's inputs.
+func (c *embeddingCache) store(er *embeddingRequest, vectors [][]float64) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		slog.Warn("embedding cache", "err", err)
+		return
+	}
+	defer tx.Rollback()
+	now := time.Now().Unix()
+	for i, text := range er.Input {
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO embeddings (key, provider, model, vector, created) VALUES (?, ?, ?, ?, ?)`,
+			embeddingKey(er, text), er.Provider, er.Model, encodeVector(vectors[i]), now); err != nil {
+			slog.Warn("embedding cache", "err", err)
+			return
+		}
+	}
+	if c.maxEntries > 0 {
+		if _, err := tx.Exec(`DELETE FROM embeddings WHERE rowid <= (SELECT max(rowid) FROM embeddings) - ?`, c.maxEntries); err != nil {
+			slog.Warn("embedding cache", "err", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		slog.Warn("embedding cache", "err", err)
+	}
+}
+
+// Vectors are stored as little-endian float64s, so a cached vector is
+// exactly the one the provider returned.
+func encodeVector(v []float64) []byte {
+	b := make([]byte, 8*len(v))
+	for i, f := range v {
+		binary.LittleEndian.PutUint64(b[8*i:], math.Float64bits(f))
+	}
+	return b
+}
+
+func decodeVector(b []byte) []float64 {
+	v := make([]float64, len(b)/8)
+	for i := range v {
+		v[i] = math.Float64frombits(binary.LittleEndian.Uint64(b[8*i:]))
+	}
+	return v
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// embeddingRequest is the canonical body accepted by /api/embeddings; as
+// with /api/chat, embeddingDialects translate it for each provider.
+type embeddingRequest struct {
+	Provider string         `json:"provider"`
+	Model    string         `json:"model"`
+	Input    embeddingInput `json:"input"`
+	// InputType is "query" or "document", for providers that embed search
+	// queries and the documents searched differently. Others ignore it.
+	InputType  string `json:"input_type,omitempty"`
+	Dimensions int    `json:"dimensions,omitempty"`
+	APIKey     string `json:"apiKey,omitempty"`
+	KeyProfile string `json:"keyProfile,omitempty"`
+}
+
+// embeddingInput is one text or a list of them.
+type embeddingInput []string
+
+func (in *embeddingInput) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*in = embeddingInput{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("input must be a string or an array of strings")
+	}
+	*in = many
+	return nil
+}
+
+// embeddingResponse is the canonical reply: one vector per input, in order.
+type embeddingResponse struct {
+	Provider   string      `json:"provider"`
+	Model      string      `json:"model"`
+	Embeddings [][]float64 `json:"embeddings"`
+	Usage      chatUsage   `json:"usage"`
+	cached     int         // embeddings served from the cache
+}
+
+// embeddingDialect is one upstream embeddings API.
+type embeddingDialect struct {
+	// url is the embeddings URL for a provider with this endpoint.
+	url   func(endpoint string) string
+	body  func(*embeddingRequest) map[string]interface{}
+	parse func(data []byte) (*embeddingResponse, error)
+}
+
+// EmbeddingProvider is a Provider that /api/embeddings can translate to.
+type EmbeddingProvider interface {
+	Provider
+	Embeddings() *embeddingDialect
+}
+
+func (er *embeddingRequest) validate() error {
+	if er.Model == "" {
+		return badRequest("model: required")
+	}
+	if len(er.Input) == 0 {
+		return badRequest("input: must not be empty")
+	}
+	for i, s := range er.Input {
+		if s == "" {
+			return badRequest(fmt.Sprintf("input[%d]: must not be empty", i))
+		}
+	}
+	if er.Dimensions < 0 {
+		return badRequest("dimensions: must not be negative")
+	}
+	return nil
+}
+
+// estimatedTokens guesses the input's size before the upstream counts it.
+func (er *embeddingRequest) estimatedTokens() int {
+	n := 0
+	for _, s := range er.Input {
+		n += (len(s) + 3) / 4
+	}
+	return n
+}
+
+// Unified embeddings endpoint. The client names a provider and sends one
+// canonical body, and gets the vectors back in one shape whoever made them.
+func handleEmbeddings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var er embeddingRequest
+	if err := json.NewDecoder(r.Body).Decode(&er); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	p, _ := lookupProvider(er.Provider)
+	target, ok := p.(EmbeddingProvider)
+	if !ok || target.Embeddings() == nil {
+		http.Error(w, "No embeddings API for provider: "+er.Provider, http.StatusBadRequest)
+		return
+	}
+	if !config.providerEnabled(er.Provider) {
+		http.Error(w, "Provider disabled: "+er.Provider, http.StatusBadRequest)
+		return
+	}
+	if err := er.validate(); err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	if er.KeyProfile == "" {
+		er.KeyProfile = r.Header.Get("X-Key-Profile")
+	}
+	apiKey, err := resolveAPIKey(target, recordFrom(r).user(), er.APIKey, er.KeyProfile)
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	logged := er
+	logged.APIKey = ""
+	rec := recordFrom(r)
+	rec.describe(er.Provider, er.Model, false, logged)
+
+	out, fail := embed(w, r, target, &er, apiKey)
+	if fail != nil {
+		fail.write(w)
+		return
+	}
+	rec.setUsage(out.Usage)
+	if embedCache != nil {
+		switch out.cached {
+		case 0:
+			w.Header().Set("X-Cache", "MISS")
+		case len(er.Input):
+			w.Header().Set("X-Cache", "HIT")
+		default:
+			w.Header().Set("X-Cache", "PARTIAL")
+		}
+	}
+	setCostHeader(w, er.Provider, er.Model, out.Usage)
+	writeJSON(w, http.StatusOK, out)
+}
+
+// embed answers er from the embeddings cache where it can; only the
+// inputs it misses go upstream, and are cached once answered.
+func embed(w http.ResponseWriter, r *http.Request, target EmbeddingProvider, er *embeddingRequest, apiKey string) (*embeddingResponse, *chatFailure) {
+	if embedCache == nil || cacheBypassed(r) {
+		return embedUpstream(w, r, target, er, apiKey)
+	}
+	vectors := embedCache.lookup(er)
+	missing := *er
+	missing.Input = nil
+	var at []int
+	for i, v := range vectors {
+		if v == nil {
+			missing.Input = append(missing.Input, er.Input[i])
+			at = append(at, i)
+			metricCache.inc("embeddings", "miss")
+		} else {
+			metricCache.inc("embeddings", "hit")
+		}
+	}
+	out := &embeddingResponse{Provider: er.Provider, Model: er.Model, Embeddings: vectors, cached: len(vectors) - len(at)}
+	if len(at) == 0 {
+		return out, nil
+	}
+	fresh, fail := embedUpstream(w, r, target, &missing, apiKey)
+	if fail != nil {
+		return nil, fail
+	}
+	embedCache.store(&missing, fresh.Embeddings)
+	for j, i := range at {
+		vectors[i] = fresh.Embeddings[j]
+	}
+	out.Model, out.Usage = fresh.Model, fresh.Usage
+	return out, nil
+}
+
+// embedUpstream is the upstream half of an embeddings request: budget and
+// quota checks, a concurrency slot, the call and the parsed reply.
+func embedUpstream(w http.ResponseWriter, r *http.Request, target EmbeddingProvider, er *embeddingRequest, apiKey string) (*embeddingResponse, *chatFailure) {
+	t := ChatTarget{er.Provider, er.Model}
+	failed := func(err error, upstream bool) (*embeddingResponse, *chatFailure) {
+		return nil, &chatFailure{target: t, err: err, upstream: upstream}
+	}
+	dialect := target.Embeddings()
+	recordFrom(r).setKey(apiKey)
+	if err := checkBudgets(w, recordFrom(r), er.Provider, apiKey); err != nil {
+		return failed(err, false)
+	}
+	estimated := er.estimatedTokens()
+	if err := quotas.reserve(target, apiKey, estimated); err != nil {
+		return failed(err, false)
+	}
+	req, err := newJSONRequest(dialect.url(target.Endpoint()), dialect.body(er))
+	if err != nil {
+		return failed(err, false)
+	}
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	req = req.WithContext(r.Context())
+
+	release, err := acquireUpstream(w, r, target)
+	if err != nil {
+		return failed(err, false)
+	}
+	defer release()
+	resp, err := doUpstream(target, req)
+	if err != nil {
+		return failed(err, true)
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return failed(err, true)
+	}
+	if resp.StatusCode >= 300 {
+		return nil, &chatFailure{target: t, status: resp.StatusCode, body: raw, upstream: true}
+	}
+	out, err := dialect.parse(raw)
+	if err == nil && len(out.Embeddings) != len(er.Input) {
+		err = fmt.Errorf("%d embeddings for %d inputs", len(out.Embeddings), len(er.Input))
+	}
+	if err != nil {
+		return nil, &chatFailure{target: t, status: http.StatusBadGateway, body: []byte("Unexpected upstream response: " + err.Error())}
+	}
+	quotas.settle(target, apiKey, estimated, out.Usage)
+	out.Provider = er.Provider
+	if out.Model == "" {
+		out.Model = er.Model
+	}
+	return out, nil
+}
+
+// parseOpenAIEmbeddings reads the OpenAI response shape, which Voyage
+// shares.
+func parseOpenAIEmbeddings(data []byte) (*embeddingResponse, error) {
+	var r struct {
+		Model string `json:"model"`
+		Data  []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+		Usage struct {
+			PromptTokens int `json:"prompt_tokens"`
+			TotalTokens  int `json:"total_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	out := &embeddingResponse{Model: r.Model, Embeddings: make([][]float64, len(r.Data))}
+	for _, d := range r.Data {
+		if d.Index < 0 || d.Index >= len(r.Data) {
+			return nil, fmt.Errorf("embedding index %d out of range", d.Index)
+		}
+		out.Embeddings[d.Index] = d.Embedding
+	}
+	out.Usage.InputTokens = r.Usage.PromptTokens
+	if out.Usage.InputTokens == 0 {
+		out.Usage.InputTokens = r.Usage.TotalTokens
+	}
+	return out, nil
+}
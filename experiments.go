@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"path"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ExperimentConfig splits /api/chat requests for some models between two
+// targets to compare them. Assignment is sticky: the same user (or, for
+// anonymous clients, the same X-Session-ID or address) always gets the
+// same variant. An experiment takes precedence over routes.
+type ExperimentConfig struct {
+	Name string `json:"name"`
+	// Models are the requested models taken into the experiment, with *
+	// wildcards as in routes.
+	Models []string   `json:"models"`
+	A      ChatTarget `json:"a"`
+	B      ChatTarget `json:"b"`
+	// Percent of subjects assigned to B; the rest get A.
+	Percent float64 `json:"percent"`
+}
+
+func validateExperiments(list []ExperimentConfig) []error {
+	var errs []error
+	seen := map[string]bool{}
+	for i, e := range list {
+		field := fmt.Sprintf("experiments[%d]", i)
+		if e.Name == "" {
+			errs = append(errs, fmt.Errorf("%s: name required", field))
+		} else if seen[e.Name] {
+			errs = append(errs, fmt.Errorf("%s: duplicate name %q", field, e.Name))
+		} else {
+			field = "experiments." + e.Name
+		}
+		seen[e.Name] = true
+		if len(e.Models) == 0 {
+			errs = append(errs, fmt.Errorf("%s.models: at least one model required", field))
+		}
+		for _, m := range e.Models {
+			if _, err := path.Match(m, ""); err != nil {
+				errs = append(errs, fmt.Errorf("%s.models: bad pattern %q", field, m))
+			}
+		}
+		if e.Percent < 0 || e.Percent > 100 {
+			errs = append(errs, fmt.Errorf("%s.percent: must be between 0 and 100", field))
+		}
+		errs = append(errs, e.A.validate(field+".a")...)
+		errs = append(errs, e.B.validate(field+".b")...)
+	}
+	return errs
+}
+
+// experimentSubject is who a request is assigned for.
+func experimentSubject(r *http.Request) string {
+	if user := recordFrom(r).user(); user != "" {
+		return "user:" + user
+	}
+	if s := r.Header.Get("X-Session-ID"); s != "" {
+		return "session:" + s
+	}
+	return "ip:" + clientIP(r)
+}
+
+// variant is "a" or "b" for subject, from a hash so no assignment table
+// is needed and every instance of the proxy agrees.
+func (e ExperimentConfig) variant(subject string) string {
+	h := fnv.New32a()
+	h.Write([]byte(e.Name + "\x00" + subject))
+	if float64(h.Sum32()%10000) < e.Percent*100 {
+		return "b"
+	}
+	return "a"
+}
+
+// assignExperiment puts cr into the first experiment for its model,
+// replacing the provider and model with the variant's, and returns the
+// experiment's name and variant, or "" when there is none.
+func assignExperiment(r *http.Request, cr *chatRequest) (name, variant string) {
+	for _, e := range config.Experiments {
+		if !slices.ContainsFunc(e.Models, func(m string) bool {
+			ok, _ := path.Match(m, cr.Model)
+			return ok
+		}) {
+			continue
+		}
+		variant = e.variant(experimentSubject(r))
+		t := e.A
+		if variant == "b" {
+			t = e.B
+		}
+		cr.Provider, cr.Model = t.Provider, t.Model
+		return e.Name, variant
+	}
+	return "", ""
+}
+
+// experimentFeedbackWindow is how many recent experiment requests can
+// still be rated.
+const experimentFeedbackWindow = 10000
+
+// variantStats compares the variants of an experiment.
+type variantStats struct {
+	requests     int64
+	errors       int64
+	latency      time.Duration
+	inputTokens  int64
+	outputTokens int64
+	cost         float64
+	up, down     int64
+}
+
+type assignment struct {
+	experiment, variant, user string
+	rating                    int // +1, -1 or 0 when not rated yet
+}
+
+type experimentStats struct {
+	mu       sync.Mutex
+	variants map[string]*variantStats // by experiment + "/" + variant
+	recent   map[string]*assignment   // by request ID
+	order    []string                 // request IDs in recent, oldest first
+}
+
+var experiments = &experimentStats{variants: map[string]*variantStats{}, recent: map[string]*assignment{}}
+
+func (s *experimentStats) statsFor(experiment, variant string) *variantStats {
+	vs := s.variants[experiment+"/"+variant]
+	if vs == nil {
+		vs = &variantStats{}
+		s.variants[experiment+"/"+variant] = vs
+	}
+	return vs
+}
+
+// record counts a finished request that was part of an experiment and
+// remembers it for feedback.
+func (s *experimentStats) record(rec *requestRecord) {
+	if rec.Experiment == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vs := s.statsFor(rec.Experiment, rec.Variant)
+	vs.requests++
+	if rec.Status >= 400 {
+		vs.errors++
+	}
+	vs.latency += rec.Latency
+	vs.inputTokens += int64(rec.Usage.InputTokens)
+	vs.outputTokens += int64(rec.Usage.OutputTokens)
+	vs.cost += rec.Cost
+
+	if _, ok := s.recent[rec.ID]; ok {
+		return
+	}
+	s.recent[rec.ID] = &assignment{experiment: rec.Experiment, variant: rec.Variant, user: rec.User}
+	s.order = append(s.order, rec.ID)
+	if len(s.order) > experimentFeedbackWindow {
+		delete(s.recent, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+var (
+	errNoExperimentRequest = errors.New("no recent experiment request with that ID")
+	errNotYourRequest      = errors.New("request belongs to another user")
+)
+
+// rate records a thumbs up (+1) or down (-1) for a request. Rating again
+// replaces the earlier rating.
+func (s *experimentStats) rate(requestID, user string, rating int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := s.recent[requestID]
+	if a == nil {
+		return errNoExperimentRequest
+	}
+	if a.user != "" && a.user != user {
+		return errNotYourRequest
+	}
+	vs := s.statsFor(a.experiment, a.variant)
+	switch a.rating {
+	case 1:
+		vs.up--
+	case -1:
+		vs.down--
+	}
+	a.rating = rating
+	if rating > 0 {
+		vs.up++
+	} else {
+		vs.down++
+	}
+	return nil
+}
+
+// report compares the variants of each configured experiment.
+func (s *experimentStats) report() []map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []map[string]interface{}{}
+	for _, e := range config.Experiments {
+		variants := map[string]interface{}{}
+		for v, t := range map[string]ChatTarget{"a": e.A, "b": e.B} {
+			vs := s.statsFor(e.Name, v)
+			entry := map[string]interface{}{
+				"provider":      t.Provider,
+				"model":         t.Model,
+				"requests":      vs.requests,
+				"errors":        vs.errors,
+				"input_tokens":  vs.inputTokens,
+				"output_tokens": vs.outputTokens,
+				"cost_usd":      vs.cost,
+				"thumbs_up":     vs.up,
+				"thumbs_down":   vs.down,
+			}
+			if vs.requests > 0 {
+				n := float64(vs.requests)
+				entry["avg_latency_ms"] = float64(vs.latency.Milliseconds()) / n
+				entry["avg_input_tokens"] = float64(vs.inputTokens) / n
+				entry["avg_output_tokens"] = float64(vs.outputTokens) / n
+			}
+			if rated := vs.up + vs.down; rated > 0 {
+				entry["thumbs_up_rate"] = float64(vs.up) / float64(rated)
+			}
+			variants[v] = entry
+		}
+		out = append(out, map[string]interface{}{
+			"name":     e.Name,
+			"models":   e.Models,
+			"percent":  e.Percent,
+			"variants": variants,
+		})
+	}
+	return out
+}
+
+// handleFeedback takes {"request_id", "rating": "up" | "down"} for a chat
+// request that was part of an experiment; the ID is the response's
+// X-Request-ID.
+func handleFeedback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		RequestID string `json:"request_id"`
+		Rating    string `json:"rating"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	rating := map[string]int{"up": 1, "down": -1}[body.Rating]
+	if rating == 0 {
+		http.Error(w, `Rating must be "up" or "down"`, http.StatusBadRequest)
+		return
+	}
+	switch err := experiments.rate(body.RequestID, recordFrom(r).user(), rating); err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errNotYourRequest:
+		http.Error(w, "Request belongs to another user", http.StatusForbidden)
+	default:
+		http.Error(w, "No recent experiment request "+body.RequestID, http.StatusNotFound)
+	}
+}
+
+// handleAdminExperiments reports each experiment's variants side by side.
+// Counts start at zero on restart.
+func handleAdminExperiments(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"experiments": experiments.report()})
+}
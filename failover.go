@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// ChatTarget is a provider and model to answer /api/chat requests.
+type ChatTarget struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+}
+
+func (t ChatTarget) validate(field string) []error {
+	p, _ := lookupProvider(t.Provider)
+	if cp, ok := p.(ChatProvider); !ok || cp.Dialect() == nil {
+		return []error{fmt.Errorf("%s: %q is not a provider /api/chat can use", field, t.Provider)}
+	}
+	if t.Model == "" {
+		return []error{fmt.Errorf("%s: model required", field)}
+	}
+	return nil
+}
+
+// chatFailure is why one target could not answer. Failures of the upstream
+// itself, rather than of a local check, move on to the next fallback.
+type chatFailure struct {
+	target   ChatTarget
+	err      error  // no upstream response
+	status   int    // or an error status, with its body
+	body     []byte //
+	upstream bool
+}
+
+// write sends the failure to the client as handleChat always has.
+func (f *chatFailure) write(w http.ResponseWriter) {
+	switch {
+	case f.status != 0:
+		// Upstream errors keep their status; the body is wrapped so the
+		// client gets JSON regardless of provider.
+		writeJSON(w, f.status, map[string]interface{}{
+			"error":    strings.TrimSpace(string(f.body)),
+			"provider": f.target.Provider,
+		})
+	case f.upstream:
+		writeUpstreamError(w, f.err)
+	case errors.Is(f.err, errQueueFull) || errors.Is(f.err, errQueueTimeout) || errors.Is(f.err, context.Canceled):
+		writeAcquireError(w, f.err)
+	default:
+		writeBuildError(w, f.err)
+	}
+}
+
+// shouldFailOver reports whether an upstream status means another
+// provider may do better: overload, rate limits and server errors, not
+// problems with the request itself.
+func shouldFailOver(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// sendChat is the upstream half of a chat request: budget and quota
+// checks, a concurrency slot and the call. On success the caller closes
+// the response and calls release.
+func sendChat(w http.ResponseWriter, r *http.Request, t ChatTarget, target ChatProvider, body map[string]interface{}, apiKey string, estimated int) (resp *http.Response, release func(), fail *chatFailure) {
+	failed := func(err error, upstream bool) (*http.Response, func(), *chatFailure) {
+		return nil, nil, &chatFailure{target: t, err: err, upstream: upstream}
+	}
+	recordFrom(r).setKey(apiKey)
+	if err := checkBudgets(w, recordFrom(r), t.Provider, apiKey); err != nil {
+		return failed(err, false)
+	}
+	if err := quotas.reserve(target, apiKey, estimated); err != nil {
+		return failed(err, false)
+	}
+	req, err := target.BuildRequest(body, apiKey)
+	if err != nil {
+		return failed(err, false)
+	}
+	req = req.WithContext(r.Context())
+
+	release, err = acquireUpstream(w, r, target)
+	if err != nil {
+		return failed(err, false)
+	}
+	resp, err = doUpstream(target, req)
+	if err != nil {
+		release()
+		// A client that went away is not the upstream's failure.
+		return failed(err, !clientGone(r.Context()))
+	}
+	if resp.StatusCode >= 300 {
+		raw, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		release()
+		return nil, nil, &chatFailure{target: t, status: resp.StatusCode, body: raw, upstream: shouldFailOver(resp.StatusCode)}
+	}
+	return resp, release, nil
+}
+
+// fallbackKey is the server-side key for a fallback: the client's key and
+// profile belong to the provider it asked for.
+func fallbackKey(r *http.Request, p Provider) (string, error) {
+	key, err := resolveAPIKey(p, recordFrom(r).user(), "", "")
+	if err == nil && key == "" && p.RequiresKey() {
+		err = errors.New("no server-side key")
+	}
+	return key, err
+}
+
+func logFailover(r *http.Request, f *chatFailure, next ChatTarget) {
+	reason := ""
+	if f.err != nil {
+		reason = f.err.Error()
+	} else {
+		reason = http.StatusText(f.status)
+	}
+	slog.Warn("chat failover", "request_id", requestID(r.Context()),
+		"from", f.target.Provider+"/"+f.target.Model, "to", next.Provider+"/"+next.Model, "reason", reason)
+}
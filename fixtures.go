@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FixturesConfig answers /api requests from files in Dir, for end-to-end
+// tests of apps built on the proxy. A request with no fixture is answered
+// as usual and its reply saved as one, or with Strict refused with a 404,
+// so a suite run once without Strict pins every reply for later runs.
+type FixturesConfig struct {
+	Dir    string `json:"dir"`
+	Strict bool   `json:"strict"`
+}
+
+func (c FixturesConfig) validate() []error {
+	if c.Dir == "" {
+		if c.Strict {
+			return []error{errors.New("fixtures.dir: required with strict")}
+		}
+		return nil
+	}
+	if info, err := os.Stat(c.Dir); c.Strict && (err != nil || !info.IsDir()) {
+		return []error{fmt.Errorf("fixtures.dir: %q is not a directory", c.Dir)}
+	}
+	return nil
+}
+
+// fixtures is nil unless fixtures.dir is set.
+var fixtures *FixturesConfig
+
+func newFixtures(c FixturesConfig) *FixturesConfig {
+	if c.Dir == "" {
+		return nil
+	}
+	return &c
+}
+
+// fixtureHeaders differ from one identical request to the next, so they
+// are not kept in fixtures.
+var fixtureHeaders = []string{"X-Request-Id", "X-Queue-Time", "Trailer", costHeader}
+
+// fixtureBody is body as a fixture key sees it: JSON with its keys sorted
+// and without the client's apiKey, so the same request from another
+// developer's browser finds the same fixture.
+func fixtureBody(body []byte) []byte {
+	var v map[string]interface{}
+	if json.Unmarshal(body, &v) != nil {
+		return body
+	}
+	delete(v, "apiKey")
+	canonical, _ := json.Marshal(v)
+	return canonical
+}
+
+// fixtureName names the fixture of a request by its path and a hash of
+// its method, path, query and body, e.g. "api_chat_3fa2….json".
+func fixtureName(r *http.Request, body []byte) string {
+	sum := sha256.Sum256([]byte(r.Method + " " + sanitizeURL(r.URL) + "\n" + string(body)))
+	slug := strings.ReplaceAll(strings.Trim(r.URL.Path, "/"), "/", "_")
+	return slug + "_" + hex.EncodeToString(sum[:16]) + ".json"
+}
+
+// fixtured answers a request from its fixture when one exists. Fixtures
+// share the traffic recording format; one written by hand needs only
+// response.body, and response.status if not 200.
+func fixtured(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f := fixtures
+		if f == nil {
+			next(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		key := fixtureBody(body)
+		name := fixtureName(r, key)
+		path := filepath.Join(f.Dir, name)
+
+		var rec trafficRecord
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &rec)
+			if err != nil {
+				slog.Error("fixture", "file", path, "err", err)
+			}
+		}
+		if err == nil {
+			for h, v := range rec.Response.Headers {
+				w.Header().Set(h, v)
+			}
+			w.Header().Set("X-Fixture", name)
+			if rec.Response.Status == 0 {
+				rec.Response.Status = http.StatusOK
+			}
+			w.WriteHeader(rec.Response.Status)
+			w.Write(rec.Response.body())
+			return
+		}
+		if f.Strict {
+			writeJSON(w, http.StatusNotFound, map[string]string{
+				"error":   "No fixture for this request",
+				"fixture": name,
+			})
+			return
+		}
+
+		cw := &fixtureWriter{ResponseWriter: w}
+		next(cw, r)
+		if cw.status >= 300 || clientGone(r.Context()) {
+			return
+		}
+		saved := &trafficRecord{
+			Recorded: time.Now().UTC(),
+			Request:  trafficMessage{Method: r.Method, URL: sanitizeURL(r.URL)},
+			Response: trafficMessage{Status: cw.status, Headers: recordedHeaders(w.Header())},
+		}
+		for _, h := range fixtureHeaders {
+			delete(saved.Response.Headers, h)
+		}
+		saved.Request.setBody(key)
+		saved.Response.setBody(cw.body.Bytes())
+		data, err = json.MarshalIndent(saved, "", "  ")
+		if err == nil {
+			err = os.MkdirAll(f.Dir, 0o755)
+		}
+		if err == nil {
+			err = os.WriteFile(path, data, 0o644)
+		}
+		if err != nil {
+			slog.Error("fixture", "file", path, "err", err)
+		}
+	}
+}
+
+// fixtureWriter keeps a copy of a response to save as a fixture.
+type fixtureWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (fw *fixtureWriter) WriteHeader(status int) {
+	if fw.status == 0 {
+		fw.status = status
+	}
+	fw.ResponseWriter.WriteHeader(status)
+}
+
+func (fw *fixtureWriter) Write(p []byte) (int, error) {
+	if fw.status == 0 {
+		fw.status = http.StatusOK
+	}
+	fw.body.Write(p)
+	return fw.ResponseWriter.Write(p)
+}
+
+func (fw *fixtureWriter) Flush() {
+	if f, ok := fw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (fw *fixtureWriter) Unwrap() http.ResponseWriter { return fw.ResponseWriter }
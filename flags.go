@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"os"
+	"strings"
+)
+
+// overrides are settings from flags and QUIRK_* environment variables. They
+// win over the config file, flags winning over the environment.
+type overrides struct {
+	config      string
+	addr        string
+	port        string
+	static      string
+	serverKeys  bool
+	logLevel    string
+	logFormat   string
+	verifyAudit string
+	urls        map[string]*string
+}
+
+// registerFlags defines the command line; call before flag.Parse.
+func registerFlags() *overrides {
+	o := &overrides{urls: map[string]*string{}}
+	flag.StringVar(&o.config, "config", "", "config file, .toml or .json (env QUIRK_CONFIG, default ./quirk.toml if present)")
+	flag.StringVar(&o.addr, "addr", "", "listen address, e.g. 127.0.0.1:8080 (env QUIRK_ADDR)")
+	flag.StringVar(&o.port, "port", "", "listen port, keeping the bind address (env QUIRK_PORT)")
+	flag.StringVar(&o.static, "static", "", "directory of static files to serve (env QUIRK_STATIC)")
+	flag.BoolVar(&o.serverKeys, "server-keys", false, "use only server-side provider keys, ignoring apiKey from clients (env QUIRK_SERVER_KEYS=1)")
+	flag.StringVar(&o.logLevel, "log-level", "", "debug, info, warn or error (env QUIRK_LOG_LEVEL)")
+	flag.StringVar(&o.logFormat, "log-format", "", "text or json (env QUIRK_LOG_FORMAT)")
+	flag.StringVar(&o.verifyAudit, "verify-audit", "", "check the hash chain of an audit file and exit")
+	for _, name := range providerNames() {
+		o.urls[name] = flag.String(name+"-url", "", "upstream base URL for "+name+" (env "+providerEnvVar(name)+")")
+	}
+	return o
+}
+
+func providerEnvVar(name string) string {
+	return "QUIRK_" + strings.ToUpper(name) + "_URL"
+}
+
+// providerEndpointEnvVar names the variable that replaces a provider's
+// whole upstream URL, like endpoint in the config.
+func providerEndpointEnvVar(name string) string {
+	return "QUIRK_" + strings.ToUpper(name) + "_ENDPOINT"
+}
+
+// configPath resolves which config file to load.
+func (o *overrides) configPath() string {
+	if path := firstSet(o.config, os.Getenv("QUIRK_CONFIG")); path != "" {
+		return path
+	}
+	return defaultConfigPath()
+}
+
+// apply writes the overrides into cfg.
+func (o *overrides) apply(cfg *Config) {
+	if addr := firstSet(o.addr, os.Getenv("QUIRK_ADDR")); addr != "" {
+		cfg.Listen = addr
+	}
+	if port := firstSet(o.port, os.Getenv("QUIRK_PORT")); port != "" {
+		host, _, err := net.SplitHostPort(cfg.Listen)
+		if err != nil {
+			host = ""
+		}
+		cfg.Listen = net.JoinHostPort(host, port)
+	}
+	if static := firstSet(o.static, os.Getenv("QUIRK_STATIC")); static != "" {
+		cfg.StaticDir = static
+	}
+	if level := firstSet(o.logLevel, os.Getenv("QUIRK_LOG_LEVEL")); level != "" {
+		cfg.Log.Level = level
+	}
+	if format := firstSet(o.logFormat, os.Getenv("QUIRK_LOG_FORMAT")); format != "" {
+		cfg.Log.Format = format
+	}
+	if token := os.Getenv("QUIRK_ADMIN_TOKEN"); token != "" {
+		cfg.AdminToken = token
+	}
+	if o.serverKeys || os.Getenv("QUIRK_SERVER_KEYS") == "1" || os.Getenv("QUIRK_SERVER_KEYS") == "true" {
+		cfg.ServerKeys = true
+	}
+	for name, flagValue := range o.urls {
+		if u := firstSet(*flagValue, os.Getenv(providerEnvVar(name))); u != "" {
+			if cfg.Providers == nil {
+				cfg.Providers = map[string]ProviderConfig{}
+			}
+			pc := cfg.Providers[name]
+			pc.BaseURL, pc.Endpoint = u, ""
+			cfg.Providers[name] = pc
+		} else if e := os.Getenv(providerEndpointEnvVar(name)); e != "" {
+			if cfg.Providers == nil {
+				cfg.Providers = map[string]ProviderConfig{}
+			}
+			pc := cfg.Providers[name]
+			pc.BaseURL, pc.Endpoint = "", e
+			cfg.Providers[name] = pc
+		}
+	}
+}
+
+func firstSet(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// defaultConfigPath picks up quirk.toml from the working directory if present.
+func defaultConfigPath() string {
+	if _, err := os.Stat("quirk.toml"); err == nil {
+		return "quirk.toml"
+	}
+	return ""
+}
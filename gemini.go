@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Gemini. The body is a generateContent payload plus "model" and an optional
+// "stream" flag, which select the upstream method under the models endpoint.
+func init() {
+	registerProvider(&providerSpec{
+		name:     "gemini",
+		endpoint: "https://generativelanguage.googleapis.com/v1beta/models/",
+		dialect:  &geminiDialect,
+		images:   &imagenImages,
+		build:    buildGeminiRequest,
+	})
+}
+
+func buildGeminiRequest(p *providerSpec, body map[string]interface{}, apiKey string) (*http.Request, error) {
+	model, _ := body["model"].(string)
+	if model == "" {
+		return nil, badRequest("Model required")
+	}
+	stream, _ := body["stream"].(bool)
+	delete(body, "model")
+	delete(body, "stream")
+
+	model = url.PathEscape(strings.TrimPrefix(model, "models/"))
+	endpoint := p.Endpoint() + model + ":generateContent"
+	if stream {
+		// alt=sse makes Gemini emit text/event-stream instead of a JSON array
+		endpoint = p.Endpoint() + model + ":streamGenerateContent?alt=sse"
+	}
+
+	req, err := newJSONRequest(endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-goog-api-key", apiKey)
+	return req, nil
+}
+
+type geminiCandidates struct {
+	Candidates []struct {
+		Content struct {
+			Parts []struct {
+				Text string `json:"text"`
+			} `json:"parts"`
+		} `json:"content"`
+		FinishReason string `json:"finishReason"`
+	} `json:"candidates"`
+	UsageMetadata *struct {
+		PromptTokenCount     int `json:"promptTokenCount"`
+		CandidatesTokenCount int `json:"candidatesTokenCount"`
+	} `json:"usageMetadata"`
+	ModelVersion string `json:"modelVersion"`
+}
+
+func (g *geminiCandidates) text() string {
+	if len(g.Candidates) == 0 {
+		return ""
+	}
+	var text strings.Builder
+	for _, p := range g.Candidates[0].Content.Parts {
+		text.WriteString(p.Text)
+	}
+	return text.String()
+}
+
+var geminiDialect = chatDialect{
+	schema: geminiSchema,
+	body: func(cr *chatRequest) map[string]interface{} {
+		contents := make([]interface{}, 0, len(cr.Messages))
+		for _, m := range cr.Messages {
+			role := m.Role
+			if role == "assistant" {
+				role = "model"
+			}
+			parts := make([]interface{}, 0, len(m.images)+1)
+			for _, img := range m.images {
+				parts = append(parts, map[string]interface{}{
+					"inline_data": map[string]interface{}{"mime_type": img.MediaType, "data": img.base64()},
+				})
+			}
+			if m.Content != "" {
+				parts = append(parts, map[string]interface{}{"text": m.Content})
+			}
+			contents = append(contents, map[string]interface{}{"role": role, "parts": parts})
+		}
+		config := map[string]interface{}{}
+		setIf(config, "maxOutputTokens", cr.MaxTokens, cr.MaxTokens > 0)
+		setIf(config, "temperature", cr.Temperature, cr.Temperature != nil)
+		setIf(config, "topP", cr.TopP, cr.TopP != nil)
+		setIf(config, "stopSequences", cr.Stop, len(cr.Stop) > 0)
+		if len(cr.OutputSchema) > 0 {
+			config["responseMimeType"] = "application/json"
+			config["responseJsonSchema"] = cr.OutputSchema
+		}
+
+		body := map[string]interface{}{
+			"model":    cr.Model,
+			"contents": contents,
+		}
+		if cr.System != "" {
+			body["systemInstruction"] = map[string]interface{}{
+				"parts": []interface{}{map[string]interface{}{"text": cr.System}},
+			}
+		}
+		setIf(body, "generationConfig", config, len(config) > 0)
+		setIf(body, "stream", true, cr.Stream)
+		return body
+	},
+	parse: func(data []byte) (*chatResponse, error) {
+		var r geminiCandidates
+		if err := json.Unmarshal(data, &r); err != nil {
+			return nil, err
+		}
+		out := &chatResponse{Model: r.ModelVersion, Content: r.text()}
+		if len(r.Candidates) > 0 {
+			out.StopReason = r.Candidates[0].FinishReason
+		}
+		if r.UsageMetadata != nil {
+			out.Usage = chatUsage{InputTokens: r.UsageMetadata.PromptTokenCount, OutputTokens: r.UsageMetadata.CandidatesTokenCount}
+		}
+		return out, nil
+	},
+	event: func(s *chatStream, _ string, data []byte) (string, bool) {
+		var r geminiCandidates
+		if json.Unmarshal(data, &r) != nil {
+			return "", false
+		}
+		if r.UsageMetadata != nil {
+			s.usage = chatUsage{InputTokens: r.UsageMetadata.PromptTokenCount, OutputTokens: r.UsageMetadata.CandidatesTokenCount}
+		}
+		if len(r.Candidates) > 0 && r.Candidates[0].FinishReason != "" {
+			s.stopReason = r.Candidates[0].FinishReason
+		}
+		return r.text(), false
+	},
+}
+
+// imagenImages generates images with Imagen models through the same API
+// key, by the models' predict method.
+var imagenImages = imageDialect{
+	url: func(endpoint, model string) string {
+		return endpoint + url.PathEscape(strings.TrimPrefix(model, "models/")) + ":predict"
+	},
+	body: func(ir *imageRequest) map[string]interface{} {
+		params := map[string]interface{}{"sampleCount": max(ir.N, 1)}
+		ratio := ir.aspectRatio("1:1", "3:4", "4:3", "9:16", "16:9")
+		setIf(params, "aspectRatio", ratio, ratio != "")
+		return map[string]interface{}{
+			"instances":  []interface{}{map[string]interface{}{"prompt": ir.Prompt}},
+			"parameters": params,
+		}
+	},
+	parse: func(data []byte) (*imageResponse, error) {
+		var r struct {
+			Predictions []struct {
+				BytesBase64Encoded string `json:"bytesBase64Encoded"`
+				MimeType           string `json:"mimeType"`
+				Prompt             string `json:"prompt"`
+			} `json:"predictions"`
+		}
+		if err := json.Unmarshal(data, &r); err != nil {
+			return nil, err
+		}
+		out := &imageResponse{}
+		for _, p := range r.Predictions {
+			out.Images = append(out.Images, generatedImage{
+				B64JSON: p.BytesBase64Encoded, MediaType: firstSet(p.MimeType, "image/png"), RevisedPrompt: p.Prompt,
+			})
+		}
+		return out, nil
+	},
+	auth: func(req *http.Request, apiKey string) { req.Header.Set("x-goog-api-key", apiKey) },
+}
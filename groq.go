@@ -0,0 +1,9 @@
+package main
+
+// Groq serves an OpenAI-compatible API under /openai/v1, Whisper
+// transcription included.
+func init() {
+	p := openAICompatible("groq", "https://api.groq.com/openai/v1/chat/completions")
+	p.transcribe = &openAITranscriptions
+	registerProvider(p)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// GuardrailsConfig is the deployment's content policy: rules matched
+// against prompts, and /api/chat completions, and what happens when one
+// matches.
+type GuardrailsConfig struct {
+	Rules []GuardrailRule `json:"rules"`
+	// Policies give the action for each category, for rules that name
+	// none; a rule with neither blocks.
+	Policies map[string]string `json:"policies"`
+}
+
+// GuardrailRule matches text by regular expression or keyword.
+type GuardrailRule struct {
+	Name     string   `json:"name"`
+	Category string   `json:"category"`
+	Patterns []string `json:"patterns"` // regular expressions
+	Keywords []string `json:"keywords"` // whole words, in any case
+	// Apply is "prompt", "completion" or "both" (the default).
+	Apply string `json:"apply"`
+	// Action is "block", "redact" or "annotate".
+	Action string `json:"action"`
+	// Replacement stands in for redacted matches; "[REDACTED]" by default.
+	Replacement string `json:"replacement"`
+}
+
+var guardrailActions = map[string]bool{"block": true, "redact": true, "annotate": true}
+
+func (c GuardrailsConfig) validate() []error {
+	var errs []error
+	names := map[string]bool{}
+	for i, rule := range c.Rules {
+		field := fmt.Sprintf("guardrails.rules[%d]", i)
+		switch {
+		case rule.Name == "":
+			errs = append(errs, errors.New(field+".name: required"))
+		case names[rule.Name]:
+			errs = append(errs, fmt.Errorf("%s.name: %q is used twice", field, rule.Name))
+		}
+		names[rule.Name] = true
+		if len(rule.Patterns) == 0 && len(rule.Keywords) == 0 {
+			errs = append(errs, errors.New(field+": needs patterns or keywords"))
+		}
+		for j, k := range rule.Keywords {
+			if k == "" {
+				errs = append(errs, fmt.Errorf("%s.keywords[%d]: empty", field, j))
+			}
+		}
+		for j, p := range rule.Patterns {
+			if _, err := regexp.Compile(p); err != nil {
+				errs = append(errs, fmt.Errorf("%s.patterns[%d]: %v", field, j, err))
+			}
+		}
+		switch rule.Apply {
+		case "", "both", "prompt", "completion":
+		default:
+			errs = append(errs, fmt.Errorf("%s.apply: %q is not prompt, completion or both", field, rule.Apply))
+		}
+		if rule.Action != "" && !guardrailActions[rule.Action] {
+			errs = append(errs, fmt.Errorf("%s.action: %q is not block, redact or annotate", field, rule.Action))
+		}
+	}
+	for category, action := range c.Policies {
+		if !guardrailActions[action] {
+			errs = append(errs, fmt.Errorf("guardrails.policies.%s: %q is not block, redact or annotate", category, action))
+		}
+	}
+	return errs
+}
+
+// guardrail is a compiled rule.
+type guardrail struct {
+	name, category, action, replacement string
+	prompt, completion                  bool
+	res                                 []*regexp.Regexp
+}
+
+type guardrailSet struct {
+	rules      []*guardrail
+	completion bool // some rule applies to completions
+}
+
+// guardrails are the configured rules, or nil when there are none.
+var guardrails *guardrailSet
+
+func newGuardrails(c GuardrailsConfig) *guardrailSet {
+	if len(c.Rules) == 0 {
+		return nil
+	}
+	g := &guardrailSet{}
+	for _, rule := range c.Rules {
+		gr := &guardrail{
+			name:        rule.Name,
+			category:    rule.Category,
+			action:      firstSet(rule.Action, c.Policies[rule.Category], "block"),
+			replacement: firstSet(rule.Replacement, "[REDACTED]"),
+			prompt:      rule.Apply != "completion",
+			completion:  rule.Apply != "prompt",
+		}
+		for _, p := range rule.Patterns {
+			gr.res = append(gr.res, regexp.MustCompile(p))
+		}
+		if len(rule.Keywords) > 0 {
+			gr.res = append(gr.res, keywordPattern(rule.Keywords))
+		}
+		g.completion = g.completion || gr.completion
+		g.rules = append(g.rules, gr)
+	}
+	return g
+}
+
+// keywordPattern matches any of words on its own, ignoring case. Word
+// boundaries only apply at edges that are word characters, so "c++" works.
+func keywordPattern(words []string) *regexp.Regexp {
+	alts := make([]string, len(words))
+	for i, w := range words {
+		alts[i] = regexp.QuoteMeta(w)
+		if isWordByte(w[0]) {
+			alts[i] = `\b` + alts[i]
+		}
+		if isWordByte(w[len(w)-1]) {
+			alts[i] += `\b`
+		}
+	}
+	return regexp.MustCompile(`(?i)(?:` + strings.Join(alts, "|") + `)`)
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// guardText applies the rules for stage ("prompt" or "completion") to
+// text. It returns the text with redactions made and whether a blocking
+// rule matched; each rule that matches is noted on the request record and
+// in the audit log.
+func guardText(r *http.Request, stage, text string) (string, bool) {
+	if guardrails == nil || text == "" {
+		return text, false
+	}
+	blocked := false
+	for _, rule := range guardrails.rules {
+		if (stage == "prompt" && !rule.prompt) || (stage == "completion" && !rule.completion) {
+			continue
+		}
+		matched := false
+		for _, re := range rule.res {
+			if !re.MatchString(text) {
+				continue
+			}
+			matched = true
+			if rule.action == "redact" {
+				text = re.ReplaceAllLiteralString(text, rule.replacement)
+			}
+		}
+		if !matched {
+			continue
+		}
+		blocked = blocked || rule.action == "block"
+		rec := recordFrom(r)
+		rec.guardrailHit(rule.name)
+		audit.record("guardrail."+rule.action, map[string]interface{}{
+			"request_id": rec.ID,
+			"path":       rec.Path,
+			"user":       rec.User,
+			"rule":       rule.name,
+			"category":   rule.category,
+			"stage":      stage,
+			"remote":     clientIP(r),
+		})
+	}
+	return text, blocked
+}
+
+// guardPrompt applies the prompt rules to a chat request's system prompt
+// and messages, redacting in place. It returns false once it has answered
+// the request itself because a rule blocked it.
+func guardPrompt(w http.ResponseWriter, r *http.Request, cr *chatRequest) bool {
+	if guardrails == nil {
+		return true
+	}
+	var blocked, b bool
+	cr.System, blocked = guardText(r, "prompt", cr.System)
+	for i := range cr.Messages {
+		cr.Messages[i].Content, b = guardText(r, "prompt", cr.Messages[i].Content)
+		blocked = blocked || b
+	}
+	return guarded(w, r, blocked)
+}
+
+// guardBodies applies the prompt rules to the prompt text of raw provider
+// bodies, as guardPrompt does for a chat request.
+func guardBodies(w http.ResponseWriter, r *http.Request, bodies []map[string]interface{}) bool {
+	if guardrails == nil {
+		return true
+	}
+	blocked := false
+	for _, body := range bodies {
+		rewritePrompt(body, func(text string) string {
+			text, b := guardText(r, "prompt", text)
+			blocked = blocked || b
+			return text
+		})
+	}
+	return guarded(w, r, blocked)
+}
+
+// guarded reports the rules a prompt matched, answering the request when
+// one blocked it.
+func guarded(w http.ResponseWriter, r *http.Request, blocked bool) bool {
+	rec := recordFrom(r)
+	if rec.Guardrails != "" {
+		w.Header().Set("X-Guardrails", rec.Guardrails)
+	}
+	if blocked {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": "Request blocked by guardrail",
+			"rules": strings.Split(rec.Guardrails, ","),
+		})
+		return false
+	}
+	return true
+}
+
+// maxHeldText bounds the streamed text held back while waiting for a line
+// to end.
+const maxHeldText = 2048
+
+// streamGuard applies the completion rules to a streamed reply. Text is
+// held back until its line ends, so a match split across deltas is still
+// seen before any of it reaches the client.
+type streamGuard struct {
+	r    *http.Request
+	held strings.Builder
+}
+
+// newStreamGuard returns nil when no rule applies to completions.
+func newStreamGuard(r *http.Request) *streamGuard {
+	if guardrails == nil || !guardrails.completion {
+		return nil
+	}
+	return &streamGuard{r: r}
+}
+
+// feed takes a text delta and returns what may be relayed now, and whether
+// a rule blocks the reply.
+func (g *streamGuard) feed(text string) (string, bool) {
+	g.held.WriteString(text)
+	held := g.held.String()
+	cut := strings.LastIndexByte(held, '\n') + 1
+	if cut == 0 && len(held) > maxHeldText {
+		cut = strings.LastIndexAny(held, " \t") + 1
+		if cut == 0 {
+			cut = len(held)
+		}
+	}
+	if cut == 0 {
+		return "", false
+	}
+	g.held.Reset()
+	g.held.WriteString(held[cut:])
+	return guardText(g.r, "completion", held[:cut])
+}
+
+// flush checks and returns whatever is still held at the end.
+func (g *streamGuard) flush() (string, bool) {
+	held := g.held.String()
+	g.held.Reset()
+	return guardText(g.r, "completion", held)
+}
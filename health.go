@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ready is set once startup has finished: config loaded and the vault, audit
+// and request logs opened.
+var ready atomic.Bool
+
+// handleHealthz reports that the process is up and serving.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports whether the proxy should receive traffic: startup
+// is complete and every provider in health.probe is reachable.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if !ready.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "starting"})
+		return
+	}
+
+	checks := probeUpstreams(config.Health.Probe, time.Duration(config.Health.Timeout))
+	status, code := "ready", http.StatusOK
+	for _, result := range checks {
+		if result != "ok" {
+			status, code = "unavailable", http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, code, map[string]interface{}{"status": status, "checks": checks})
+}
+
+// probeUpstreams dials each provider's upstream host in parallel and maps
+// provider name to "ok" or the error. A TCP connection is enough: it needs
+// no key and costs nothing upstream. Upstreams reached through an outbound
+// proxy are probed by dialing the proxy.
+func probeUpstreams(names []string, timeout time.Duration) map[string]string {
+	checks := make(map[string]string, len(names))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, name := range names {
+		p, _ := lookupProvider(name)
+		if name == "mock" {
+			checks[name] = "ok" // answered in process
+			continue
+		}
+		addr, err := upstreamAddr(p.Endpoint())
+		if err != nil {
+			checks[name] = err.Error()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := "ok"
+			conn, err := net.DialTimeout("tcp", addr, timeout)
+			if err != nil {
+				result = err.Error()
+			} else {
+				conn.Close()
+			}
+			mu.Lock()
+			checks[name] = result
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return checks
+}
+
+// upstreamAddr is host:port for an endpoint URL. Templated hosts, such as
+// Azure's {resource}, cannot be probed.
+func upstreamAddr(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || strings.Contains(u.Host, "{") {
+		return "", errors.New("templated endpoint; set base_url to probe it")
+	}
+	if proxy, err := outboundProxy(u); err != nil {
+		return "", err
+	} else if proxy != nil {
+		u = proxy
+	}
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Hugging Face. By default "model" names a Hub repo served through the
+// Inference Providers router. Sending "endpoint" (or setting HF_ENDPOINT_URL)
+// targets a dedicated Inference Endpoint instead. Both speak the OpenAI chat
+// completions shape and authenticate with the HF token as a Bearer key.
+func init() {
+	p := openAICompatible("huggingface", "https://router.huggingface.co/v1/chat/completions")
+	p.build = buildHuggingFaceRequest
+	p.keyEnv = "HF_TOKEN"
+	p.schema = openAISchema.optional("model") // dedicated endpoints serve one
+	registerProvider(p)
+}
+
+func buildHuggingFaceRequest(p *providerSpec, body map[string]interface{}, apiKey string) (*http.Request, error) {
+	target := p.Endpoint()
+	if endpoint := takeString(body, "endpoint", ""); endpoint != "" {
+		// Client-chosen URLs are limited to HF-hosted endpoints so the proxy
+		// can't be pointed at arbitrary hosts.
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Scheme != "https" || !strings.HasSuffix(u.Hostname(), ".huggingface.cloud") {
+			return nil, badRequest("endpoint must be an https://*.huggingface.cloud URL")
+		}
+		target = huggingFaceChatURL(u)
+	} else if endpoint := envOr("HF_ENDPOINT_URL", ""); endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, errors.New("invalid HF_ENDPOINT_URL")
+		}
+		target = huggingFaceChatURL(u)
+	}
+
+	req, err := newJSONRequest(target, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	return req, nil
+}
+
+// huggingFaceChatURL appends the chat completions route to a bare endpoint.
+func huggingFaceChatURL(u *url.URL) string {
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/chat/completions"
+	}
+	return u.String()
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// imageRequest is the canonical body accepted by /api/images; each
+// provider's imageDialect translates it.
+type imageRequest struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	Prompt   string `json:"prompt"`
+	N        int    `json:"n,omitempty"`
+	// Size is "WIDTHxHEIGHT". Providers that take an aspect ratio instead
+	// get the closest one they support, unless AspectRatio is given.
+	Size        string `json:"size,omitempty"`
+	AspectRatio string `json:"aspect_ratio,omitempty"`
+	Quality     string `json:"quality,omitempty"`
+	Style       string `json:"style,omitempty"`
+	// ResponseFormat is "url" (the default) or "b64_json", whatever the
+	// provider returns.
+	ResponseFormat string `json:"response_format,omitempty"`
+	APIKey         string `json:"apiKey,omitempty"`
+	KeyProfile     string `json:"keyProfile,omitempty"`
+}
+
+// generatedImage is one image, as a URL or base64 data.
+type generatedImage struct {
+	URL           string `json:"url,omitempty"`
+	B64JSON       string `json:"b64_json,omitempty"`
+	MediaType     string `json:"media_type,omitempty"`
+	RevisedPrompt string `json:"revised_prompt,omitempty"`
+}
+
+// imageResponse is the canonical reply, in the order the images came.
+type imageResponse struct {
+	Provider string           `json:"provider"`
+	Model    string           `json:"model"`
+	Created  time.Time        `json:"created"`
+	Images   []generatedImage `json:"images"`
+	Usage    *chatUsage       `json:"usage,omitempty"`
+}
+
+// imageDialect is one upstream image generation API.
+type imageDialect struct {
+	url   func(endpoint, model string) string
+	body  func(*imageRequest) map[string]interface{}
+	parse func(data []byte) (*imageResponse, error)
+	// auth sets the key on a request.
+	auth func(req *http.Request, apiKey string)
+}
+
+// ImageProvider is a Provider that /api/images can translate to.
+type ImageProvider interface {
+	Provider
+	Images() *imageDialect
+}
+
+func (ir *imageRequest) validate() error {
+	if ir.Model == "" {
+		return badRequest("model: required")
+	}
+	if strings.TrimSpace(ir.Prompt) == "" {
+		return badRequest("prompt: required")
+	}
+	if ir.N < 0 || ir.N > 10 {
+		return badRequest("n: must be between 1 and 10")
+	}
+	if ir.Size != "" {
+		if _, _, ok := ir.dimensions(); !ok {
+			return badRequest(fmt.Sprintf("size: %q is not WIDTHxHEIGHT", ir.Size))
+		}
+	}
+	if f := ir.ResponseFormat; f != "" && f != "url" && f != "b64_json" {
+		return badRequest(fmt.Sprintf("response_format: %q is not url or b64_json", f))
+	}
+	return nil
+}
+
+func (ir *imageRequest) dimensions() (w, h int, ok bool) {
+	ws, hs, found := strings.Cut(ir.Size, "x")
+	w, err1 := strconv.Atoi(ws)
+	h, err2 := strconv.Atoi(hs)
+	return w, h, found && err1 == nil && err2 == nil && w > 0 && h > 0
+}
+
+// aspectRatio returns the request's aspect ratio, or of those given the
+// one closest to its size.
+func (ir *imageRequest) aspectRatio(supported ...string) string {
+	if ir.AspectRatio != "" {
+		return ir.AspectRatio
+	}
+	w, h, ok := ir.dimensions()
+	if !ok {
+		return ""
+	}
+	best, bestDiff := "", 0.0
+	for _, r := range supported {
+		a, b, _ := strings.Cut(r, ":")
+		x, _ := strconv.ParseFloat(a, 64)
+		y, _ := strconv.ParseFloat(b, 64)
+		diff := float64(w)/float64(h) - x/y
+		if diff < 0 {
+			diff = -diff
+		}
+		if best == "" || diff < bestDiff {
+			best, bestDiff = r, diff
+		}
+	}
+	return best
+}
+
+// Unified image generation endpoint. Images come back as URLs or base64 as
+// the client asks: base64 images are kept as uploads to give them a URL,
+// and URLs are fetched for base64.
+func handleImages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var ir imageRequest
+	if err := json.NewDecoder(r.Body).Decode(&ir); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	p, _ := lookupProvider(ir.Provider)
+	target, ok := p.(ImageProvider)
+	if !ok || target.Images() == nil {
+		http.Error(w, "No image generation API for provider: "+ir.Provider, http.StatusBadRequest)
+		return
+	}
+	if !config.providerEnabled(ir.Provider) {
+		http.Error(w, "Provider disabled: "+ir.Provider, http.StatusBadRequest)
+		return
+	}
+	if err := ir.validate(); err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	if ir.KeyProfile == "" {
+		ir.KeyProfile = r.Header.Get("X-Key-Profile")
+	}
+	rec := recordFrom(r)
+	apiKey, err := resolveAPIKey(target, rec.user(), ir.APIKey, ir.KeyProfile)
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	logged := ir
+	logged.APIKey = ""
+	rec.describe(ir.Provider, ir.Model, false, logged)
+	if !moderate(w, r, []string{ir.Prompt}, nil) {
+		return
+	}
+
+	out, fail := generateImages(w, r, target, &ir, apiKey)
+	if fail != nil {
+		fail.write(w)
+		return
+	}
+	want := firstSet(ir.ResponseFormat, "url")
+	for i := range out.Images {
+		if err := convertImage(r, &out.Images[i], want); err != nil {
+			http.Error(w, "Converting image: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	if out.Usage != nil {
+		rec.setUsage(*out.Usage)
+		setCostHeader(w, ir.Provider, ir.Model, *out.Usage)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// generateImages makes the upstream call: budget checks, a concurrency
+// slot, the request and the parsed reply.
+func generateImages(w http.ResponseWriter, r *http.Request, target ImageProvider, ir *imageRequest, apiKey string) (*imageResponse, *chatFailure) {
+	t := ChatTarget{ir.Provider, ir.Model}
+	failed := func(err error, upstream bool) (*imageResponse, *chatFailure) {
+		return nil, &chatFailure{target: t, err: err, upstream: upstream}
+	}
+	dialect := target.Images()
+	recordFrom(r).setKey(apiKey)
+	if err := checkBudgets(w, recordFrom(r), ir.Provider, apiKey); err != nil {
+		return failed(err, false)
+	}
+	req, err := newJSONRequest(dialect.url(target.Endpoint(), ir.Model), dialect.body(ir))
+	if err != nil {
+		return failed(err, false)
+	}
+	if apiKey != "" {
+		dialect.auth(req, apiKey)
+	}
+	req = req.WithContext(r.Context())
+
+	release, err := acquireUpstream(w, r, target)
+	if err != nil {
+		return failed(err, false)
+	}
+	defer release()
+	resp, err := doUpstream(target, req)
+	if err != nil {
+		return failed(err, true)
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return failed(err, true)
+	}
+	if resp.StatusCode >= 300 {
+		return nil, &chatFailure{target: t, status: resp.StatusCode, body: raw, upstream: true}
+	}
+	out, err := dialect.parse(raw)
+	if err == nil && len(out.Images) == 0 {
+		err = fmt.Errorf("no images in the reply")
+	}
+	if err != nil {
+		return nil, &chatFailure{target: t, status: http.StatusBadGateway, body: []byte("Unexpected upstream response: " + err.Error())}
+	}
+	out.Provider = ir.Provider
+	if out.Model == "" {
+		out.Model = ir.Model
+	}
+	if out.Created.IsZero() {
+		out.Created = time.Now()
+	}
+	return out, nil
+}
+
+// maxImageFetch bounds an image fetched from a provider's URL.
+const maxImageFetch = 64 << 20
+
+// convertImage puts img in the format the client asked for.
+func convertImage(r *http.Request, img *generatedImage, want string) error {
+	switch {
+	case want == "b64_json" && img.B64JSON == "" && img.URL != "":
+		req, err := http.NewRequestWithContext(r.Context(), "GET", img.URL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := upstreamClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("fetching %s: %s", req.URL.Host, resp.Status)
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxImageFetch))
+		if err != nil {
+			return err
+		}
+		if img.MediaType == "" {
+			img.MediaType, _, _ = mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		}
+		img.B64JSON, img.URL = base64.StdEncoding.EncodeToString(data), ""
+
+	case want == "url" && img.URL == "" && img.B64JSON != "":
+		data, err := base64.StdEncoding.DecodeString(img.B64JSON)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		ttl := time.Duration(config.Uploads.TTL)
+		if ttl == 0 {
+			ttl = defaultUploadTTL
+		}
+		u := &upload{
+			ID: newUploadID(), MediaType: firstSet(img.MediaType, http.DetectContentType(data)), Size: len(data),
+			Created: now, Expires: now.Add(ttl), user: recordFrom(r).user(), data: data, sum: sha256Hex(data),
+		}
+		if err := uploads.put(u); err != nil {
+			return err
+		}
+		img.URL, img.B64JSON, img.MediaType = "/api/uploads/"+u.ID, "", u.MediaType
+	}
+	return nil
+}
+
+// parseOpenAIImages reads the OpenAI images response.
+func parseOpenAIImages(data []byte) (*imageResponse, error) {
+	var r struct {
+		Created int64 `json:"created"`
+		Data    []struct {
+			URL           string `json:"url"`
+			B64JSON       string `json:"b64_json"`
+			RevisedPrompt string `json:"revised_prompt"`
+		} `json:"data"`
+		OutputFormat string     `json:"output_format"`
+		Usage        *chatUsage `json:"usage"`
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	out := &imageResponse{Usage: r.Usage}
+	if r.Created > 0 {
+		out.Created = time.Unix(r.Created, 0)
+	}
+	mediaType := ""
+	if r.OutputFormat != "" {
+		mediaType = "image/" + r.OutputFormat
+	}
+	for _, d := range r.Data {
+		img := generatedImage{URL: d.URL, B64JSON: d.B64JSON, RevisedPrompt: d.RevisedPrompt, MediaType: mediaType}
+		if img.MediaType == "" && img.B64JSON != "" {
+			img.MediaType = "image/png"
+		}
+		out.Images = append(out.Images, img)
+	}
+	return out, nil
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	defaultChunkSize    = 1000
+	defaultChunkOverlap = 150
+	defaultMaxUpload    = 32 << 20
+)
+
+// extractedDoc is a document's text, by page for PDFs and as one page for
+// everything else.
+type extractedDoc struct {
+	Type  string // text, markdown, html or pdf
+	Title string
+	Pages []string
+}
+
+// documentType names the format of an upload from its content type, then
+// its file name, then its first bytes.
+func documentType(contentType, filename string, data []byte) string {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	switch mt {
+	case "text/plain":
+		return "text"
+	case "text/markdown", "text/x-markdown":
+		return "markdown"
+	case "text/html", "application/xhtml+xml":
+		return "html"
+	case "application/pdf":
+		return "pdf"
+	}
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".txt", ".text":
+		return "text"
+	case ".md", ".markdown":
+		return "markdown"
+	case ".html", ".htm", ".xhtml":
+		return "html"
+	case ".pdf":
+		return "pdf"
+	}
+	if bytes.HasPrefix(data, []byte("%PDF-")) {
+		return "pdf"
+	}
+	switch sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(data)); sniffed {
+	case "text/html":
+		return "html"
+	case "text/plain":
+		return "text"
+	}
+	return ""
+}
+
+func extractDocument(kind string, data []byte) (*extractedDoc, error) {
+	switch kind {
+	case "text", "markdown":
+		return &extractedDoc{Type: kind, Pages: []string{strings.ToValidUTF8(string(data), "�")}}, nil
+	case "html":
+		title, text := htmlText(data)
+		return &extractedDoc{Type: kind, Title: title, Pages: []string{text}}, nil
+	case "pdf":
+		pages, err := pdfText(data)
+		if err != nil {
+			return nil, err
+		}
+		return &extractedDoc{Type: kind, Pages: pages}, nil
+	}
+	return nil, fmt.Errorf("unsupported document type %q", kind)
+}
+
+// htmlText returns a page's title and readable text. Headings become
+// Markdown headings, so chunks can name the section they come from, and
+// scripts, styles and the rest of <head> are dropped.
+func htmlText(data []byte) (title, text string) {
+	var b strings.Builder
+	z := html.NewTokenizer(bytes.NewReader(data))
+	skip, pre, inTitle, space := 0, 0, false, false
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return strings.TrimSpace(title), b.String()
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			tag := string(name)
+			switch tag {
+			case "script", "style", "noscript", "template", "svg", "head":
+				skip++
+			case "title":
+				inTitle = true
+			case "pre":
+				pre++
+				b.WriteString("\n\n")
+			case "br":
+				b.WriteString("\n")
+			case "li":
+				b.WriteString("\n- ")
+			case "h1", "h2", "h3", "h4", "h5", "h6":
+				b.WriteString("\n\n" + strings.Repeat("#", int(tag[1]-'0')) + " ")
+			default:
+				if htmlBlock[tag] {
+					b.WriteString("\n\n")
+				}
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch tag := string(name); tag {
+			case "script", "style", "noscript", "template", "svg", "head":
+				if skip > 0 {
+					skip--
+				}
+			case "title":
+				inTitle = false
+			case "pre":
+				if pre > 0 {
+					pre--
+				}
+				b.WriteString("\n\n")
+			default:
+				if htmlBlock[tag] || tag[0] == 'h' && len(tag) == 2 {
+					b.WriteString("\n\n")
+				}
+			}
+		case html.TextToken:
+			if inTitle {
+				title += string(z.Text())
+				continue
+			}
+			if skip > 0 {
+				continue
+			}
+			raw := string(z.Text())
+			if pre > 0 {
+				b.WriteString(raw)
+				continue
+			}
+			// Whitespace between inline elements is kept as one space.
+			t := strings.Join(strings.Fields(raw), " ")
+			if t == "" {
+				space = space || raw != ""
+				continue
+			}
+			if last := b.String(); (space || unicode.IsSpace(rune(raw[0]))) && last != "" && !strings.HasSuffix(last, "\n") && !strings.HasSuffix(last, " ") {
+				b.WriteString(" ")
+			}
+			b.WriteString(t)
+			space = unicode.IsSpace(rune(raw[len(raw)-1]))
+		}
+	}
+}
+
+var htmlBlock = map[string]bool{
+	"p": true, "div": true, "section": true, "article": true, "header": true, "footer": true,
+	"main": true, "nav": true, "aside": true, "blockquote": true, "table": true, "tr": true,
+	"ul": true, "ol": true, "dl": true, "dt": true, "dd": true, "hr": true, "figure": true,
+	"figcaption": true, "form": true,
+}
+
+// textChunk is a piece of a page; Start is its offset in runes.
+type textChunk struct {
+	Text  string
+	Start int
+}
+
+// chunkText cuts text into pieces of at most size characters, each
+// repeating the last overlap characters of the one before. Cuts are made
+// at a paragraph, line, sentence or word break in the second half of a
+// piece where there is one.
+func chunkText(text string, size, overlap int) []textChunk {
+	rs := []rune(text)
+	var out []textChunk
+	for start := 0; start < len(rs); {
+		end := min(start+size, len(rs))
+		if end < len(rs) {
+			end = chunkBreak(rs, start+size/2, end)
+		}
+		if t := strings.TrimSpace(string(rs[start:end])); t != "" {
+			out = append(out, textChunk{t, start})
+		}
+		if end == len(rs) {
+			break
+		}
+		next := max(end-overlap, start+1)
+		for next < end && !unicode.IsSpace(rs[next-1]) {
+			next++
+		}
+		start = next
+	}
+	return out
+}
+
+// chunkBreak returns where to end a chunk that may not run past end,
+// preferring the strongest break at or after from.
+func chunkBreak(rs []rune, from, end int) int {
+	for _, sep := range []string{"\n\n", "\n", ". ", "? ", "! ", " "} {
+		s := []rune(sep)
+		for i := end - len(s); i >= from; i-- {
+			if string(rs[i:i+len(s)]) == sep {
+				return i + len(s)
+			}
+		}
+	}
+	return end
+}
+
+// markdownSections returns the rune offset and text of each heading in a
+// Markdown page.
+func markdownSections(text string) (starts []int, titles []string) {
+	at := 0
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if t := strings.TrimSpace(line); strings.HasPrefix(t, "#") {
+			if h := strings.TrimSpace(strings.TrimLeft(t, "#")); h != "" {
+				starts, titles = append(starts, at), append(titles, h)
+			}
+		}
+		at += utf8.RuneCountInString(line)
+	}
+	return starts, titles
+}
+
+// chunkDocument cuts a document into chunks carrying what a citation
+// needs: the document's type and title, and the page or section.
+func chunkDocument(doc *extractedDoc, filename string, size, overlap int) []ragInput {
+	var out []ragInput
+	for i, page := range doc.Pages {
+		page = tidyText(page)
+		var starts []int
+		var titles []string
+		if doc.Type == "markdown" || doc.Type == "html" {
+			starts, titles = markdownSections(page)
+		}
+		for _, c := range chunkText(page, size, overlap) {
+			meta := map[string]string{"type": doc.Type}
+			if doc.Title != "" {
+				meta["title"] = doc.Title
+			}
+			if filename != "" {
+				meta["filename"] = filename
+			}
+			if doc.Type == "pdf" {
+				meta["page"] = strconv.Itoa(i + 1)
+			}
+			for j := len(starts) - 1; j >= 0; j-- {
+				if starts[j] <= c.Start {
+					meta["section"] = titles[j]
+					break
+				}
+			}
+			out = append(out, ragInput{Text: c.Text, Metadata: meta})
+		}
+	}
+	return out
+}
+
+// tidyText trims trailing spaces from lines and runs of blank lines down
+// to one.
+func tidyText(s string) string {
+	lines := strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
+	var b strings.Builder
+	blank := 0
+	for _, l := range lines {
+		l = strings.TrimRightFunc(l, unicode.IsSpace)
+		if l == "" {
+			blank++
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString(strings.Repeat("\n", min(blank, 1)+1))
+		}
+		blank = 0
+		b.WriteString(l)
+	}
+	return b.String()
+}
+
+// ingestFile is one document in an /api/ingest request.
+type ingestFile struct {
+	source, filename, contentType string
+	data                          []byte
+}
+
+// handleIngest indexes whole documents: text, Markdown, HTML or PDF. A
+// multipart form may carry several "file" parts, each indexed under its
+// file name unless a single one is given a "source"; any other body is one
+// document whose type is its Content-Type and whose source is ?source=.
+// Both take collection, chunk_size and chunk_overlap as form fields or
+// query parameters.
+func handleIngest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	maxUpload := rag.cfg.MaxUpload
+	if maxUpload == 0 {
+		maxUpload = defaultMaxUpload
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxUpload)
+	files, err := ingestFiles(r)
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			http.Error(w, fmt.Sprintf("Upload larger than %d bytes", maxUpload), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if _, ok := err.(badRequest); !ok {
+			err = badRequest("Reading upload: " + err.Error())
+		}
+		writeBuildError(w, err)
+		return
+	}
+	size, overlap, err := chunkParams(r)
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	collection := firstSet(r.FormValue("collection"), defaultCollection)
+
+	// Everything is extracted before anything is indexed, so a bad file
+	// fails the request without leaving the others half done.
+	chunks := make([][]ragInput, len(files))
+	kinds := make([]string, len(files))
+	pages := make([]int, len(files))
+	for i, f := range files {
+		kinds[i] = documentType(f.contentType, f.filename, f.data)
+		if kinds[i] == "" {
+			http.Error(w, "Unsupported document type for "+f.source+": expected text, Markdown, HTML or PDF", http.StatusUnsupportedMediaType)
+			return
+		}
+		doc, err := extractDocument(kinds[i], f.data)
+		if err != nil {
+			http.Error(w, "Reading "+f.source+": "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		chunks[i], pages[i] = chunkDocument(doc, f.filename, size, overlap), len(doc.Pages)
+		if len(chunks[i]) == 0 {
+			http.Error(w, "No text found in "+f.source, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	var docs []map[string]interface{}
+	for i, f := range files {
+		stored, fail := rag.index(w, r, collection, f.source, chunks[i])
+		if fail != nil {
+			fail.write(w)
+			return
+		}
+		ids := make([]int64, len(stored))
+		for j, ch := range stored {
+			ids[j] = ch.ID
+		}
+		docs = append(docs, map[string]interface{}{
+			"source": f.source, "type": kinds[i], "pages": pages[i], "chunks": len(stored), "ids": ids,
+		})
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"collection": collection, "documents": docs})
+}
+
+// ingestFiles reads the documents of an /api/ingest request.
+func ingestFiles(r *http.Request) ([]ingestFile, error) {
+	mt, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mt != "multipart/form-data" {
+		_, disp, _ := mime.ParseMediaType(r.Header.Get("Content-Disposition"))
+		filename := disp["filename"]
+		source := firstSet(r.URL.Query().Get("source"), filename)
+		if source == "" {
+			return nil, badRequest("source: required")
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		return []ingestFile{{source, filename, r.Header.Get("Content-Type"), data}}, nil
+	}
+	if params["boundary"] == "" {
+		return nil, badRequest("multipart body without a boundary")
+	}
+	if err := r.ParseMultipartForm(8 << 20); err != nil {
+		return nil, err
+	}
+	parts := r.MultipartForm.File["file"]
+	if len(parts) == 0 {
+		return nil, badRequest(`file: no "file" parts in the form`)
+	}
+	source := r.FormValue("source")
+	if source != "" && len(parts) > 1 {
+		return nil, badRequest("source: only allowed with a single file")
+	}
+	var files []ingestFile
+	for _, fh := range parts {
+		f, err := fh.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, ingestFile{firstSet(source, fh.Filename), fh.Filename, fh.Header.Get("Content-Type"), data})
+	}
+	for _, f := range files {
+		if f.source == "" {
+			return nil, badRequest("source: required for files without a name")
+		}
+	}
+	return files, nil
+}
+
+// chunkParams returns the request's chunk size and overlap, falling back
+// to the config. Without either, overlap is a fifth of the size, at most
+// defaultChunkOverlap.
+func chunkParams(r *http.Request) (size, overlap int, err error) {
+	size, err = formInt(r, "chunk_size", firstInt(rag.cfg.ChunkSize, defaultChunkSize))
+	if err != nil {
+		return 0, 0, err
+	}
+	if size < 50 {
+		return 0, 0, badRequest("chunk_size: must be at least 50")
+	}
+	overlap, err = formInt(r, "chunk_overlap", firstInt(rag.cfg.ChunkOverlap, min(defaultChunkOverlap, size/5)))
+	if err != nil {
+		return 0, 0, err
+	}
+	if overlap >= size {
+		return 0, 0, badRequest("chunk_overlap: must be less than chunk_size")
+	}
+	return size, overlap, nil
+}
+
+func formInt(r *http.Request, name string, def int) (int, error) {
+	s := r.FormValue(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, badRequest(name + ": must be a non-negative integer")
+	}
+	return n, nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// InjectionConfig screens what goes into prompts for attempts to take over
+// the model: text in user messages, and chunks retrieved for RAG, which
+// anyone able to get a document ingested can write.
+type InjectionConfig struct {
+	// Action is "flag" (note the score and pass it on), "strip" (drop
+	// retrieved chunks, cut the matched phrases out of messages) or
+	// "block" (refuse the request). Empty turns screening off.
+	Action string `json:"action"`
+	// Threshold is the score from which text counts as an injection;
+	// 0.5 by default.
+	Threshold float64 `json:"threshold"`
+	// Sources limits screening to "user" or "retrieved"; empty screens
+	// both.
+	Sources []string `json:"sources"`
+	// Patterns add regular expressions to the built-in heuristics, each
+	// with the score a match adds.
+	Patterns map[string]float64 `json:"patterns"`
+	// Classifier is an optional URL that scores texts too: it is sent
+	// {"inputs": [{"text", "source"}]} and answers {"scores": [...]}. The
+	// higher of its score and the heuristics' counts.
+	Classifier        string   `json:"classifier"`
+	ClassifierTimeout duration `json:"classifier_timeout"` // 5s by default
+}
+
+func (c InjectionConfig) validate() []error {
+	var errs []error
+	switch c.Action {
+	case "", "flag", "strip", "block":
+	default:
+		errs = append(errs, fmt.Errorf("injection.action: %q is not flag, strip or block", c.Action))
+	}
+	if c.Threshold < 0 || c.Threshold > 1 {
+		errs = append(errs, errors.New("injection.threshold: must be between 0 and 1"))
+	}
+	for i, s := range c.Sources {
+		if s != "user" && s != "retrieved" {
+			errs = append(errs, fmt.Errorf("injection.sources[%d]: %q is not user or retrieved", i, s))
+		}
+	}
+	for p, score := range c.Patterns {
+		if _, err := regexp.Compile(p); err != nil {
+			errs = append(errs, fmt.Errorf("injection.patterns: %q: %v", p, err))
+		}
+		if score <= 0 || score > 1 {
+			errs = append(errs, fmt.Errorf("injection.patterns: %q: score must be above 0 and at most 1", p))
+		}
+	}
+	return errs
+}
+
+// injectionPattern is one heuristic and how much a match says.
+type injectionPattern struct {
+	re    *regexp.Regexp
+	score float64
+}
+
+// injectionHeuristics are phrasings common to injections: overriding
+// earlier instructions, reassigning the model's role, prying out the
+// system prompt, fake chat markup, and getting data sent off to a URL.
+var injectionHeuristics = []injectionPattern{
+	{regexp.MustCompile(`(?i)\b(ignore|disregard|forget|override)\b.{0,20}\b(previous|prior|above|earlier|preceding|all|any|your)\b.{0,20}\b(instructions?|prompts?|rules|directions|guidelines|context)\b`), 0.9},
+	{regexp.MustCompile(`(?i)\b(you are now|from now on,? you|pretend (to be|you are)|act as if you)\b`), 0.4},
+	{regexp.MustCompile(`(?i)\b(reveal|print|show|repeat|output|leak)\b.{0,20}\b(system prompt|initial prompt|hidden instructions|your instructions)\b`), 0.7},
+	{regexp.MustCompile(`(?im)^\s*(system|assistant)\s*:|<\|im_start\|>|\[/?INST\]|<</?SYS>>|###\s*(system|instruction)`), 0.6},
+	{regexp.MustCompile(`(?i)\b(do not|don't|never) (tell|inform|mention (this|it) to) the user\b|\bwithout (telling|informing) the user\b`), 0.6},
+	{regexp.MustCompile(`(?i)\b(developer mode|jailbreak|DAN mode|do anything now)\b`), 0.5},
+	// A markdown image whose URL carries a query string leaks whatever the
+	// model puts there as soon as the reply is rendered.
+	{regexp.MustCompile(`!\[[^\]]*\]\(\s*https?://[^)\s]*\?[^)\s]*\)`), 0.8},
+	{regexp.MustCompile(`(?i)\b(send|post|forward|upload|exfiltrate|append)\b.{0,60}\b(to|into)\b.{0,20}https?://`), 0.7},
+	{regexp.MustCompile(`(?i)https?://\S*(\{|%7B|\$\{|<)\S*(conversation|chat|data|secret|password|key|history|prompt)`), 0.7},
+}
+
+// injectionScreen is the configured screening, or nil when it is off.
+type injectionScreen struct {
+	cfg      InjectionConfig
+	patterns []injectionPattern
+}
+
+var injections *injectionScreen
+
+func newInjectionScreen(c InjectionConfig) *injectionScreen {
+	if c.Action == "" {
+		return nil
+	}
+	s := &injectionScreen{cfg: c, patterns: append([]injectionPattern(nil), injectionHeuristics...)}
+	for p, score := range c.Patterns {
+		s.patterns = append(s.patterns, injectionPattern{regexp.MustCompile(p), score})
+	}
+	return s
+}
+
+func (s *injectionScreen) threshold() float64 {
+	if s.cfg.Threshold > 0 {
+		return s.cfg.Threshold
+	}
+	return 0.5
+}
+
+func (s *injectionScreen) screens(source string) bool {
+	return len(s.cfg.Sources) == 0 || slices.Contains(s.cfg.Sources, source)
+}
+
+// heuristic scores text from 0 to 1: each pattern that matches takes away
+// its share of the doubt that remains.
+func (s *injectionScreen) heuristic(text string) float64 {
+	doubt := 1.0
+	for _, p := range s.patterns {
+		if p.re.MatchString(text) {
+			doubt *= 1 - p.score
+		}
+	}
+	return 1 - doubt
+}
+
+// scores rates each text, from source, by the heuristics and the
+// classifier if there is one. A classifier that fails is logged and left
+// out.
+func (s *injectionScreen) scores(r *http.Request, source string, texts []string) []float64 {
+	out := make([]float64, len(texts))
+	for i, t := range texts {
+		out[i] = s.heuristic(t)
+	}
+	if s.cfg.Classifier == "" || len(texts) == 0 {
+		return out
+	}
+	classified, err := s.classify(r, source, texts)
+	if err != nil {
+		slog.Warn("injection classifier", "request_id", requestID(r.Context()), "err", err)
+		return out
+	}
+	for i := range out {
+		out[i] = math.Max(out[i], classified[i])
+	}
+	return out
+}
+
+func (s *injectionScreen) classify(r *http.Request, source string, texts []string) ([]float64, error) {
+	inputs := make([]map[string]string, len(texts))
+	for i, t := range texts {
+		inputs[i] = map[string]string{"text": t, "source": source}
+	}
+	body, _ := json.Marshal(map[string]interface{}{"inputs": inputs})
+	timeout := time.Duration(s.cfg.ClassifierTimeout)
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", s.cfg.Classifier, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("classifier answered %s", resp.Status)
+	}
+	var out struct {
+		Scores []float64 `json:"scores"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	if len(out.Scores) != len(texts) {
+		return nil, fmt.Errorf("classifier returned %d scores for %d texts", len(out.Scores), len(texts))
+	}
+	return out.Scores, nil
+}
+
+// strip cuts what the patterns match out of text.
+func (s *injectionScreen) strip(text string) string {
+	for _, p := range s.patterns {
+		text = p.re.ReplaceAllString(text, "")
+	}
+	return strings.TrimSpace(text)
+}
+
+// noteInjection records text that scored as an injection: the highest
+// score goes on the request record and in X-Injection-Score, and each one
+// in the audit log.
+func noteInjection(w http.ResponseWriter, r *http.Request, source, what string, score float64) {
+	rec := recordFrom(r)
+	if score > rec.Injection {
+		rec.Injection = score
+		w.Header().Set("X-Injection-Score", fmt.Sprintf("%.2f", score))
+	}
+	audit.record("injection."+injections.cfg.Action, map[string]interface{}{
+		"request_id": rec.ID,
+		"user":       rec.User,
+		"source":     source,
+		"item":       what,
+		"score":      math.Round(score*100) / 100,
+		"remote":     clientIP(r),
+	})
+}
+
+// screenMessages scores a chat request's user messages. It returns false
+// once it has answered the request itself because one was blocked.
+func screenMessages(w http.ResponseWriter, r *http.Request, cr *chatRequest) bool {
+	if injections == nil || !injections.screens("user") {
+		return true
+	}
+	var texts []string
+	var at []int
+	for i, m := range cr.Messages {
+		if m.Role == "user" && m.Content != "" {
+			texts, at = append(texts, m.Content), append(at, i)
+		}
+	}
+	for j, score := range injections.scores(r, "user", texts) {
+		if score < injections.threshold() {
+			continue
+		}
+		i := at[j]
+		noteInjection(w, r, "user", fmt.Sprintf("messages[%d]", i), score)
+		switch injections.cfg.Action {
+		case "block":
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"error": "Request blocked as a likely prompt injection",
+				"item":  fmt.Sprintf("messages[%d]", i),
+				"score": math.Round(score*100) / 100,
+			})
+			return false
+		case "strip":
+			cr.Messages[i].Content = injections.strip(cr.Messages[i].Content)
+		}
+	}
+	return true
+}
+
+// screenBodies scores the prompt text of raw provider bodies, as
+// screenMessages does a chat request's user messages. Items are numbered
+// in the order they were scored.
+func screenBodies(w http.ResponseWriter, r *http.Request, bodies []map[string]interface{}) bool {
+	if injections == nil || !injections.screens("user") {
+		return true
+	}
+	var texts []string
+	for _, body := range bodies {
+		texts = append(texts, promptStrings(body)...)
+	}
+	stripped := map[string]string{}
+	for i, score := range injections.scores(r, "user", texts) {
+		if score < injections.threshold() {
+			continue
+		}
+		noteInjection(w, r, "user", fmt.Sprintf("prompt[%d]", i), score)
+		switch injections.cfg.Action {
+		case "block":
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"error": "Request blocked as a likely prompt injection",
+				"item":  fmt.Sprintf("prompt[%d]", i),
+				"score": math.Round(score*100) / 100,
+			})
+			return false
+		case "strip":
+			stripped[texts[i]] = injections.strip(texts[i])
+		}
+	}
+	if len(stripped) > 0 {
+		for _, body := range bodies {
+			rewritePrompt(body, func(text string) string {
+				if s, ok := stripped[text]; ok {
+					return s
+				}
+				return text
+			})
+		}
+	}
+	return true
+}
+
+// screenRetrieved scores retrieved chunks before they go into the system
+// prompt, dropping those that count as injections unless the action is
+// only to flag them. Citations are renumbered to match.
+func screenRetrieved(w http.ResponseWriter, r *http.Request, hits []ragCitation) []ragCitation {
+	if injections == nil || !injections.screens("retrieved") || len(hits) == 0 {
+		return hits
+	}
+	texts := make([]string, len(hits))
+	for i, h := range hits {
+		texts[i] = h.Text
+	}
+	kept := hits[:0]
+	for i, score := range injections.scores(r, "retrieved", texts) {
+		if score >= injections.threshold() {
+			noteInjection(w, r, "retrieved", fmt.Sprintf("%s#%d", hits[i].Source, hits[i].Position), score)
+			if injections.cfg.Action != "flag" {
+				continue
+			}
+		}
+		kept = append(kept, hits[i])
+	}
+	for i := range kept {
+		kept[i].Index = i + 1
+	}
+	return kept
+}
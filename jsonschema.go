@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonSchema is a compiled JSON Schema. It covers what structured output
+// is written with: type, enum and const, properties, required and
+// additionalProperties, items and prefixItems, length, size and range
+// bounds, pattern, the allOf/anyOf/oneOf/not combinators and $ref within
+// the document. Other keywords, format among them, are not checked.
+type jsonSchema struct {
+	root     interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+// maxSchemaErrors bounds the problems reported for one value.
+const maxSchemaErrors = 20
+
+func compileSchema(raw json.RawMessage) (*jsonSchema, error) {
+	var root interface{}
+	if err := json.Unmarshal(raw, &root); err != nil {
+		return nil, err
+	}
+	switch root.(type) {
+	case map[string]interface{}, bool:
+	default:
+		return nil, errors.New("must be an object")
+	}
+	s := &jsonSchema{root: root, patterns: map[string]*regexp.Regexp{}}
+	if err := s.compile(root); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// compile checks patterns and references ahead of validation.
+func (s *jsonSchema) compile(node interface{}) error {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if p, ok := n["pattern"].(string); ok {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return fmt.Errorf("pattern %q: %v", p, err)
+			}
+			s.patterns[p] = re
+		}
+		if ref, ok := n["$ref"].(string); ok {
+			if _, err := s.resolve(ref); err != nil {
+				return err
+			}
+		}
+		for k, v := range n {
+			if k == "enum" || k == "const" || k == "default" || k == "examples" {
+				continue
+			}
+			if err := s.compile(v); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, v := range n {
+			if err := s.compile(v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pattern returns the compiled pattern p. Patterns are compiled with the
+// schema, except under keys compile skips as data, which are compiled here;
+// one that does not compile matches nothing.
+func (s *jsonSchema) pattern(p string) *regexp.Regexp {
+	re, ok := s.patterns[p]
+	if !ok {
+		var err error
+		if re, err = regexp.Compile(p); err != nil {
+			re = regexp.MustCompile(`[^\s\S]`)
+		}
+		s.patterns[p] = re
+	}
+	return re
+}
+
+// resolve follows a "#/..." JSON pointer within the schema.
+func (s *jsonSchema) resolve(ref string) (interface{}, error) {
+	if ref == "#" {
+		return s.root, nil
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("$ref %q: only references within the schema are supported", ref)
+	}
+	node := s.root
+	for _, part := range strings.Split(ref[2:], "/") {
+		part = strings.NewReplacer("~1", "/", "~0", "~").Replace(part)
+		switch n := node.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if node, ok = n[part]; !ok {
+				return nil, fmt.Errorf("$ref %q: not found", ref)
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(n) {
+				return nil, fmt.Errorf("$ref %q: not found", ref)
+			}
+			node = n[i]
+		default:
+			return nil, fmt.Errorf("$ref %q: not found", ref)
+		}
+	}
+	return node, nil
+}
+
+// validate returns what is wrong with v, each problem prefixed with where
+// it is ($ for the value itself).
+func (s *jsonSchema) validate(v interface{}) []string {
+	var errs []string
+	s.check(s.root, v, "$", &errs, 0)
+	if len(errs) > maxSchemaErrors {
+		errs = errs[:maxSchemaErrors]
+	}
+	return errs
+}
+
+func (s *jsonSchema) check(node, v interface{}, path string, errs *[]string, depth int) {
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, path+": "+fmt.Sprintf(format, args...))
+	}
+	if depth > 64 {
+		fail("schema nests too deep")
+		return
+	}
+	n, ok := node.(map[string]interface{})
+	if !ok {
+		if node == false {
+			fail("not allowed")
+		}
+		return
+	}
+	if ref, ok := n["$ref"].(string); ok {
+		target, _ := s.resolve(ref) // checked when compiled
+		s.check(target, v, path, errs, depth+1)
+	}
+
+	if t, ok := n["type"]; ok {
+		var types []string
+		switch t := t.(type) {
+		case string:
+			types = []string{t}
+		case []interface{}:
+			for _, e := range t {
+				if s, ok := e.(string); ok {
+					types = append(types, s)
+				}
+			}
+		}
+		if !typeMatches(types, v) {
+			fail("must be %s, not %s", strings.Join(types, " or "), jsonType(v))
+			return
+		}
+	}
+	if enum, ok := n["enum"].([]interface{}); ok && !slicesContainValue(enum, v) {
+		fail("must be one of %s", compactJSON(enum))
+	}
+	if c, ok := n["const"]; ok && !reflect.DeepEqual(c, v) {
+		fail("must be %s", compactJSON(c))
+	}
+
+	switch v := v.(type) {
+	case string:
+		length := float64(utf8.RuneCountInString(v))
+		if lo, ok := n["minLength"].(float64); ok && length < lo {
+			fail("must be at least %v characters", lo)
+		}
+		if hi, ok := n["maxLength"].(float64); ok && length > hi {
+			fail("must be at most %v characters", hi)
+		}
+		if p, ok := n["pattern"].(string); ok && !s.pattern(p).MatchString(v) {
+			fail("must match %q", p)
+		}
+	case float64:
+		if lo, ok := n["minimum"].(float64); ok && v < lo {
+			fail("must be at least %v", lo)
+		}
+		if hi, ok := n["maximum"].(float64); ok && v > hi {
+			fail("must be at most %v", hi)
+		}
+		if lo, ok := n["exclusiveMinimum"].(float64); ok && v <= lo {
+			fail("must be more than %v", lo)
+		}
+		if hi, ok := n["exclusiveMaximum"].(float64); ok && v >= hi {
+			fail("must be less than %v", hi)
+		}
+		if m, ok := n["multipleOf"].(float64); ok && m > 0 {
+			if q := v / m; math.Abs(q-math.Round(q)) > 1e-9 {
+				fail("must be a multiple of %v", m)
+			}
+		}
+	case map[string]interface{}:
+		if required, ok := n["required"].([]interface{}); ok {
+			for _, r := range required {
+				if name, _ := r.(string); name != "" {
+					if _, ok := v[name]; !ok {
+						fail("%s: required", name)
+					}
+				}
+			}
+		}
+		props, _ := n["properties"].(map[string]interface{})
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			child := path + "." + k
+			if p, ok := props[k]; ok {
+				s.check(p, v[k], child, errs, depth+1)
+				continue
+			}
+			switch extra := n["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					*errs = append(*errs, child+": not allowed")
+				}
+			case map[string]interface{}:
+				s.check(extra, v[k], child, errs, depth+1)
+			}
+		}
+		if lo, ok := n["minProperties"].(float64); ok && float64(len(v)) < lo {
+			fail("must have at least %v properties", lo)
+		}
+		if hi, ok := n["maxProperties"].(float64); ok && float64(len(v)) > hi {
+			fail("must have at most %v properties", hi)
+		}
+	case []interface{}:
+		var prefix []interface{}
+		if p, ok := n["prefixItems"].([]interface{}); ok {
+			prefix = p
+		} else if p, ok := n["items"].([]interface{}); ok {
+			prefix = p // the older tuple form
+		}
+		for i, e := range v {
+			child := fmt.Sprintf("%s[%d]", path, i)
+			if i < len(prefix) {
+				s.check(prefix[i], e, child, errs, depth+1)
+			} else if items, ok := n["items"].(map[string]interface{}); ok {
+				s.check(items, e, child, errs, depth+1)
+			} else if items, ok := n["items"].(bool); ok && !items {
+				*errs = append(*errs, child+": not allowed")
+			}
+		}
+		if lo, ok := n["minItems"].(float64); ok && float64(len(v)) < lo {
+			fail("must have at least %v items", lo)
+		}
+		if hi, ok := n["maxItems"].(float64); ok && float64(len(v)) > hi {
+			fail("must have at most %v items", hi)
+		}
+		if unique, _ := n["uniqueItems"].(bool); unique {
+			for i := range v {
+				if slicesContainValue(v[:i], v[i]) {
+					fail("items must be unique; [%d] repeats an earlier one", i)
+					break
+				}
+			}
+		}
+	}
+
+	if all, ok := n["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			s.check(sub, v, path, errs, depth+1)
+		}
+	}
+	if anyOf, ok := n["anyOf"].([]interface{}); ok && s.matching(anyOf, v, depth) == 0 {
+		fail("must match at least one of anyOf")
+	}
+	if oneOf, ok := n["oneOf"].([]interface{}); ok {
+		if m := s.matching(oneOf, v, depth); m != 1 {
+			fail("must match exactly one of oneOf, matches %d", m)
+		}
+	}
+	if not, ok := n["not"]; ok && s.matching([]interface{}{not}, v, depth) == 1 {
+		fail("must not match not")
+	}
+}
+
+// matching counts the schemas v is valid against.
+func (s *jsonSchema) matching(schemas []interface{}, v interface{}, depth int) int {
+	n := 0
+	for _, sub := range schemas {
+		var errs []string
+		if s.check(sub, v, "$", &errs, depth+1); len(errs) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func typeMatches(types []string, v interface{}) bool {
+	actual := jsonType(v)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return len(types) == 0
+}
+
+func slicesContainValue(list []interface{}, v interface{}) bool {
+	for _, e := range list {
+		if reflect.DeepEqual(e, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func compactJSON(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// extractJSON finds the JSON value in a model's reply, which may come
+// wrapped in a markdown fence or a sentence of its own.
+func extractJSON(text string) (string, interface{}, error) {
+	text = strings.TrimSpace(text)
+	if rest, ok := strings.CutPrefix(text, "```"); ok {
+		if nl := strings.IndexByte(rest, '\n'); nl >= 0 {
+			rest = rest[nl+1:]
+		}
+		text = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(rest), "```"))
+	}
+	var v interface{}
+	err := json.Unmarshal([]byte(text), &v)
+	if err == nil {
+		return text, v, nil
+	}
+	if i := strings.IndexAny(text, "{["); i >= 0 {
+		closer := map[byte]byte{'{': '}', '[': ']'}[text[i]]
+		if j := strings.LastIndexByte(text, closer); j > i {
+			inner := text[i : j+1]
+			if json.Unmarshal([]byte(inner), &v) == nil {
+				return inner, v, nil
+			}
+		}
+	}
+	return "", nil, err
+}
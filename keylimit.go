@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyQuotas throttles each upstream key locally to the provider's rpm and
+// tpm, so bursts wait here instead of earning upstream 429s. Token use is
+// estimated up front and corrected once the response reports real usage.
+type keyQuotas struct {
+	mu     sync.Mutex
+	quotas map[string]*keyQuota // provider + key fingerprint
+	limits map[string]keyLimits // set through the admin API, over config
+	swept  time.Time
+}
+
+// keyLimits are a provider's per-key requests and tokens per minute.
+type keyLimits struct {
+	RPM int `json:"rpm"`
+	TPM int `json:"tpm"`
+}
+
+type keyQuota struct {
+	requests, tokens *tokenBucket
+}
+
+var quotas = &keyQuotas{quotas: map[string]*keyQuota{}, limits: map[string]keyLimits{}}
+
+// limitsFor returns provider's current limits. Callers hold mu.
+func (q *keyQuotas) limitsFor(provider string) keyLimits {
+	if l, ok := q.limits[provider]; ok {
+		return l
+	}
+	pc := config.Providers[provider]
+	return keyLimits{RPM: pc.RPM, TPM: pc.TPM}
+}
+
+// setLimits replaces provider's limits until restart; keys start over
+// with full buckets.
+func (q *keyQuotas) setLimits(provider string, l keyLimits) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.limits[provider] = l
+	for id := range q.quotas {
+		if strings.HasPrefix(id, provider+":") {
+			delete(q.quotas, id)
+		}
+	}
+}
+
+func (q *keyQuotas) currentLimits(provider string) keyLimits {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.limitsFor(provider)
+}
+
+// throttled is returned when a key is over its local limit; the value is
+// how long the caller should wait.
+type throttled time.Duration
+
+func (e throttled) Error() string { return "Rate limit for this API key reached" }
+
+// reserve charges one request and an estimated token count against the
+// key's quota, or returns throttled if either is exhausted.
+func (q *keyQuotas) reserve(p Provider, apiKey string, tokens int) error {
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pc := q.limitsFor(p.Name())
+	if pc.RPM <= 0 && pc.TPM <= 0 {
+		return nil
+	}
+	if now.Sub(q.swept) > time.Minute {
+		for k, kq := range q.quotas {
+			if kq.idle(now) {
+				delete(q.quotas, k)
+			}
+		}
+		q.swept = now
+	}
+
+	id := p.Name() + ":" + keyFingerprint(apiKey)
+	kq, ok := q.quotas[id]
+	if !ok {
+		kq = &keyQuota{}
+		if pc.RPM > 0 {
+			kq.requests = newTokenBucket(float64(pc.RPM)/60, float64(pc.RPM), now)
+		}
+		if pc.TPM > 0 {
+			kq.tokens = newTokenBucket(float64(pc.TPM)/60, float64(pc.TPM), now)
+		}
+		q.quotas[id] = kq
+	}
+
+	// Check both buckets before charging either, and never ask for more
+	// than a full bucket so an oversized request can still go through.
+	var wait time.Duration
+	n := 0.0
+	if kq.tokens != nil {
+		n = math.Min(float64(tokens), kq.tokens.burst)
+		if w := kq.tokens.wait(n, now); w > wait {
+			wait = w
+		}
+	}
+	if kq.requests != nil {
+		if w := kq.requests.wait(1, now); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		return throttled(wait)
+	}
+	if kq.requests != nil {
+		kq.requests.take(1, now)
+	}
+	if kq.tokens != nil {
+		kq.tokens.take(n, now)
+	}
+	return nil
+}
+
+// settle corrects a reservation once actual usage is known.
+func (q *keyQuotas) settle(p Provider, apiKey string, estimated int, usage chatUsage) {
+	actual := usage.InputTokens + usage.OutputTokens
+	if actual == 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if kq, ok := q.quotas[p.Name()+":"+keyFingerprint(apiKey)]; ok && kq.tokens != nil {
+		kq.tokens.tokens = math.Min(kq.tokens.burst, kq.tokens.tokens+float64(estimated-actual))
+	}
+}
+
+func (kq *keyQuota) idle(now time.Time) bool {
+	for _, b := range []*tokenBucket{kq.requests, kq.tokens} {
+		if b != nil {
+			if b.refill(now); b.tokens < b.burst {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// estimateTokens guesses a request's token cost: about four bytes of JSON
+// per input token plus whatever output the body allows for.
+func estimateTokens(body map[string]interface{}) int {
+	raw, _ := json.Marshal(body)
+	n := len(raw) / 4
+	for _, key := range []string{"max_tokens", "max_completion_tokens", "num_predict"} {
+		if v, ok := body[key].(float64); ok {
+			return n + int(v)
+		}
+		if v, ok := body[key].(int); ok {
+			return n + v
+		}
+	}
+	return n
+}
+
+func writeThrottled(w http.ResponseWriter, err throttled) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Duration(err).Seconds()))))
+	http.Error(w, err.Error(), http.StatusTooManyRequests)
+}
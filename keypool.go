@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A key pool spreads a provider's server-side traffic over several keys
+// listed as api_keys, to raise the effective rate limit. Each key's health
+// is tracked from upstream answers: a 429 rests it for the upstream's
+// Retry-After (keyRest without one), and a 401 or 403 for keyRejectedRest,
+// since a revoked key will not recover by itself.
+const (
+	keyRest         = 10 * time.Second
+	keyRejectedRest = 5 * time.Minute
+)
+
+type pooledKey struct {
+	key         string
+	id          string // fingerprint
+	requests    int64
+	rateLimited int64
+	rejected    int64
+	lastLimited time.Time
+	restUntil   time.Time
+}
+
+type keyPool struct {
+	strategy string
+
+	mu   sync.Mutex
+	keys []*pooledKey
+	next int
+}
+
+var keyPools = struct {
+	mu    sync.Mutex
+	pools map[string]*keyPool
+}{pools: map[string]*keyPool{}}
+
+func validKeyStrategy(s string) bool {
+	return s == "" || s == "round_robin" || s == "least_limited"
+}
+
+func (pc ProviderConfig) validateKeys(name string) []error {
+	var errs []error
+	if len(pc.APIKeys) > 0 && (pc.APIKey != "" || pc.APIKeyEnv != "") {
+		errs = append(errs, fmt.Errorf("providers.%s: set api_key/api_key_env or api_keys, not both", name))
+	}
+	if !validKeyStrategy(pc.KeyStrategy) {
+		errs = append(errs, fmt.Errorf("providers.%s.key_strategy: %q is not round_robin or least_limited", name, pc.KeyStrategy))
+	}
+	for i, k := range pc.APIKeys {
+		if k.APIKey == "" && k.APIKeyEnv == "" {
+			errs = append(errs, fmt.Errorf("providers.%s.api_keys[%d]: api_key or api_key_env required", name, i))
+		}
+	}
+	return errs
+}
+
+// poolFor returns provider's pool, reading its keys on first use, or nil
+// when it has no api_keys.
+func poolFor(provider string) *keyPool {
+	pc := config.Providers[provider]
+	if len(pc.APIKeys) == 0 {
+		return nil
+	}
+	keyPools.mu.Lock()
+	defer keyPools.mu.Unlock()
+	if p := keyPools.pools[provider]; p != nil {
+		return p
+	}
+	p := &keyPool{strategy: pc.KeyStrategy}
+	for _, ks := range pc.APIKeys {
+		if key := ks.lookup(); key != "" {
+			p.keys = append(p.keys, &pooledKey{key: key, id: keyFingerprint(key)})
+		}
+	}
+	keyPools.pools[provider] = p
+	return p
+}
+
+// pick chooses the key for the next request, starting the search after
+// the last key used. Resting keys are passed over unless every key is
+// resting, in which case the one back soonest is used.
+func (p *keyPool) pick(now time.Time) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.keys) == 0 {
+		return ""
+	}
+	bestAt := -1
+	for i := range p.keys {
+		at := (p.next + i) % len(p.keys)
+		if bestAt < 0 || p.better(p.keys[at], p.keys[bestAt], now) {
+			bestAt = at
+		}
+	}
+	p.next = (bestAt + 1) % len(p.keys)
+	p.keys[bestAt].requests++
+	return p.keys[bestAt].key
+}
+
+// lookup returns the pool's key with fingerprint id, or "".
+func (p *keyPool) lookup(id string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, k := range p.keys {
+		if k.id == id {
+			return k.key
+		}
+	}
+	return ""
+}
+
+// better reports whether k should be used over b, which comes earlier in
+// the rotation.
+func (p *keyPool) better(k, b *pooledKey, now time.Time) bool {
+	kResting, bResting := k.restUntil.After(now), b.restUntil.After(now)
+	switch {
+	case kResting != bResting:
+		return !kResting
+	case kResting:
+		return k.restUntil.Before(b.restUntil)
+	case p.strategy == "least_limited":
+		return k.lastLimited.Before(b.lastLimited)
+	}
+	return false
+}
+
+// observe updates a key's health from an upstream answer.
+func (p *keyPool) observe(id string, resp *http.Response, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, k := range p.keys {
+		if k.id != id {
+			continue
+		}
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests:
+			rest := keyRest
+			if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+				rest = time.Duration(s) * time.Second
+			}
+			k.rateLimited++
+			k.lastLimited, k.restUntil = now, now.Add(rest)
+		case http.StatusUnauthorized, http.StatusForbidden:
+			k.rejected++
+			k.restUntil = now.Add(keyRejectedRest)
+		}
+		return
+	}
+}
+
+// observeKey feeds an upstream answer to the pool of the key the request
+// used, if it came from one.
+func observeKey(provider string, req *http.Request, resp *http.Response) {
+	rec, _ := req.Context().Value(recordKey{}).(*requestRecord)
+	if rec == nil || rec.KeyID == "" || resp == nil {
+		return
+	}
+	if p := poolFor(provider); p != nil {
+		p.observe(rec.KeyID, resp, time.Now())
+	}
+}
+
+// snapshot reports each key by fingerprint with its health.
+func (p *keyPool) snapshot(now time.Time) []map[string]interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]map[string]interface{}, 0, len(p.keys))
+	for _, k := range p.keys {
+		status := "ok"
+		if k.restUntil.After(now) {
+			status = "resting"
+		}
+		entry := map[string]interface{}{
+			"key_id":       k.id,
+			"status":       status,
+			"requests":     k.requests,
+			"rate_limited": k.rateLimited,
+			"rejected":     k.rejected,
+		}
+		if status == "resting" {
+			entry["resting_until"] = k.restUntil.UTC().Format(time.RFC3339)
+		}
+		out = append(out, entry)
+	}
+	return out
+}
+
+// handleAdminKeyPools reports the health of every provider's key pool.
+func handleAdminKeyPools(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	out := map[string]interface{}{}
+	for _, name := range providerNames() {
+		if p := poolFor(name); p != nil {
+			out[name] = map[string]interface{}{"strategy": p.strategyName(), "keys": p.snapshot(now)}
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (p *keyPool) strategyName() string {
+	if p.strategy == "" {
+		return "round_robin"
+	}
+	return p.strategy
+}
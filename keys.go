@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+// resolveAPIKey picks the key for a request to p. Naming a key profile
+// always selects a server-side key. Otherwise, in server_keys mode the
+// client's key is ignored and only server-side keys are used; outside it the
+// client's key wins and the server key is a fallback, so the frontend can
+// leave its key field empty. A signed-in user's own stored key comes before
+// the shared ones, and with own_keys_only it is the only server-side key
+// they can use.
+func resolveAPIKey(p Provider, user, clientKey, profile string) (string, error) {
+	if !p.RequiresKey() {
+		return "", nil
+	}
+	if user != "" && config.Auth.OwnKeysOnly {
+		if clientKey != "" && !config.ServerKeys {
+			return clientKey, nil
+		}
+		if key := userAPIKey(user, p); key != "" {
+			return key, nil
+		}
+		return "", badRequest("No " + p.Name() + " key stored for " + user + "; add one with POST /api/user/keys")
+	}
+	if profile == "" {
+		if clientKey != "" && !config.ServerKeys {
+			return clientKey, nil
+		}
+		if key := userAPIKey(user, p); key != "" {
+			return key, nil
+		}
+		profile = config.Providers[p.Name()].DefaultProfile
+	}
+
+	if profile != "" {
+		if key := profileAPIKey(p, profile); key != "" {
+			return key, nil
+		}
+		return "", badRequest("Unknown key profile " + profile + " for " + p.Name())
+	}
+	if key := serverAPIKey(p); key != "" {
+		return key, nil
+	}
+	if config.ServerKeys {
+		return "", errors.New("No server-side API key configured for " + p.Name())
+	}
+	return "", badRequest("API key required")
+}
+
+// serverAPIKey looks up a provider key from, in order, the encrypted vault,
+// the api_keys pool, the config file's api_key, the variable named by
+// api_key_env, and the provider's conventional variable
+// (ANTHROPIC_API_KEY, OPENAI_API_KEY, ...).
+func serverAPIKey(p Provider) string {
+	if keyVault != nil {
+		if key := keyVault.get(p.Name()); key != "" {
+			return key
+		}
+	}
+	if pool := poolFor(p.Name()); pool != nil {
+		return pool.pick(time.Now())
+	}
+	pc := config.Providers[p.Name()]
+	if pc.APIKey != "" || pc.APIKeyEnv != "" {
+		return pc.lookup()
+	}
+	return os.Getenv(providerKeyEnv(p))
+}
+
+// profileAPIKey looks up a named profile's key in the vault, then in the
+// provider's profiles table.
+func profileAPIKey(p Provider, profile string) string {
+	if keyVault != nil {
+		if key := keyVault.get(vaultKeyName(p.Name(), profile)); key != "" {
+			return key
+		}
+	}
+	return config.Providers[p.Name()].Profiles[profile].lookup()
+}
+
+// userAPIKey is the key user stored for p, if any.
+func userAPIKey(user string, p Provider) string {
+	if user == "" || keyVault == nil {
+		return ""
+	}
+	return keyVault.get(userKeyName(user, p.Name()))
+}
+
+// userKeyName is the vault entry for a user's own key. The "user/" prefix
+// keeps it apart from provider and provider:profile entries.
+func userKeyName(user, provider string) string {
+	return "user/" + user + "/" + provider
+}
+
+// vaultKeyName is the vault entry for a provider's profile; the default
+// profile is stored under the bare provider name.
+func vaultKeyName(provider, profile string) string {
+	if profile == "" {
+		return provider
+	}
+	return provider + ":" + profile
+}
+
+func (k KeySource) lookup() string {
+	if k.APIKey != "" {
+		return k.APIKey
+	}
+	if k.APIKeyEnv != "" {
+		return os.Getenv(k.APIKeyEnv)
+	}
+	return ""
+}
+
+func providerKeyEnv(p Provider) string {
+	if k, ok := p.(interface{ KeyEnv() string }); ok && k.KeyEnv() != "" {
+		return k.KeyEnv()
+	}
+	return strings.ToUpper(p.Name()) + "_API_KEY"
+}
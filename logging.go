@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// setupLogging installs the default slog logger from [log] level and
+// format. The standard log package is routed through it too.
+func setupLogging(c LogConfig) {
+	var level slog.Level
+	level.UnmarshalText([]byte(c.Level)) // validated in Config.validate
+
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if c.Format == "json" {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(h))
+}
+
+func validLogLevel(s string) bool {
+	var level slog.Level
+	return level.UnmarshalText([]byte(s)) == nil
+}
+
+// fatal logs msg with err and exits, for startup failures.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// logAttrs lists a finished request for the access log.
+func (rec *requestRecord) logAttrs() []slog.Attr {
+	attrs := []slog.Attr{
+		slog.String("request_id", rec.ID),
+		slog.String("method", rec.Method),
+		slog.String("path", rec.Path),
+		slog.Int("status", rec.Status),
+		slog.Duration("duration", rec.Latency),
+		slog.Int64("bytes", rec.Bytes),
+	}
+	if rec.Provider != "" {
+		attrs = append(attrs,
+			slog.String("provider", rec.Provider),
+			slog.String("model", rec.Model),
+			slog.Bool("stream", rec.Stream),
+		)
+	}
+	if rec.Cached {
+		attrs = append(attrs, slog.Bool("cached", true))
+	}
+	if rec.Aborted {
+		attrs = append(attrs, slog.Bool("aborted", true))
+	}
+	if rec.Usage.InputTokens+rec.Usage.OutputTokens > 0 {
+		attrs = append(attrs,
+			slog.Int("input_tokens", rec.Usage.InputTokens),
+			slog.Int("output_tokens", rec.Usage.OutputTokens),
+		)
+	}
+	if u := rec.Usage; u.CacheCreationInputTokens+u.CacheReadInputTokens > 0 {
+		attrs = append(attrs,
+			slog.Int("cache_write_tokens", u.CacheCreationInputTokens),
+			slog.Int("cache_read_tokens", u.CacheReadInputTokens),
+		)
+	}
+	if rec.User != "" {
+		attrs = append(attrs, slog.String("user", rec.User))
+	}
+	if rec.Experiment != "" {
+		attrs = append(attrs, slog.String("experiment", rec.Experiment+"/"+rec.Variant))
+	}
+	if rec.Flagged != "" {
+		attrs = append(attrs, slog.String("moderation", rec.Flagged))
+	}
+	if rec.Guardrails != "" {
+		attrs = append(attrs, slog.String("guardrails", rec.Guardrails))
+	}
+	if rec.PII != "" {
+		attrs = append(attrs, slog.String("pii", rec.PII))
+	}
+	if rec.Injection > 0 {
+		attrs = append(attrs, slog.String("injection", fmt.Sprintf("%.2f", rec.Injection)))
+	}
+	return attrs
+}
+
+func logLevelFor(status int) slog.Level {
+	switch {
+	case status >= 500:
+		return slog.LevelError
+	case status >= 400:
+		return slog.LevelWarn
+	}
+	return slog.LevelInfo
+}
+
+// normalizeLogFormat accepts "text" and "json" in any case.
+func normalizeLogFormat(s string) (string, error) {
+	switch f := strings.ToLower(s); f {
+	case "text", "json":
+		return f, nil
+	}
+	return "", fmt.Errorf("must be text or json, not %q", s)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// maxLoggedBody caps how much of each response body is stored.
+const maxLoggedBody = 64 << 10
+
+// sqliteLog persists finished request records to a SQLite database. Writes
+// happen on one goroutine so requests never wait on the disk.
+type sqliteLog struct {
+	db      *sql.DB
+	records chan *requestRecord
+	done    chan struct{}
+
+	mu     sync.RWMutex // guards closed against late adds during shutdown
+	closed bool
+}
+
+// logStore is the request log, or nil when [log] db is unset.
+var logStore *sqliteLog
+
+const logSchema = `
+CREATE TABLE IF NOT EXISTS requests (
+	id            INTEGER PRIMARY KEY AUTOINCREMENT,
+	request_id    TEXT NOT NULL DEFAULT '',
+	started_at    TEXT NOT NULL,
+	method        TEXT NOT NULL,
+	path          TEXT NOT NULL,
+	provider      TEXT NOT NULL,
+	model         TEXT NOT NULL,
+	user          TEXT NOT NULL DEFAULT '',
+	key_id        TEXT NOT NULL DEFAULT '',
+	stream        INTEGER NOT NULL,
+	status        INTEGER NOT NULL,
+	latency_ms    INTEGER NOT NULL,
+	input_tokens  INTEGER NOT NULL,
+	output_tokens INTEGER NOT NULL,
+	cost_usd      REAL,
+	bytes         INTEGER NOT NULL,
+	request       TEXT NOT NULL,
+	response      TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS requests_started_at ON requests (started_at);
+CREATE INDEX IF NOT EXISTS requests_provider ON requests (provider, model);
+`
+
+var logMigrations = []string{
+	"ALTER TABLE requests ADD COLUMN user TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE requests ADD COLUMN cost_usd REAL",
+	"ALTER TABLE requests ADD COLUMN key_id TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE requests ADD COLUMN request_id TEXT NOT NULL DEFAULT ''",
+}
+
+func openLogStore(path string) (*sqliteLog, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// One writer; WAL lets the admin API read while it writes.
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{"PRAGMA journal_mode=WAL", "PRAGMA busy_timeout=5000", logSchema} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	// Columns added after the first release; existing databases get them
+	// here, new ones already have them.
+	for _, stmt := range logMigrations {
+		if _, err := db.Exec(stmt); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			db.Close()
+			return nil, err
+		}
+	}
+	s := &sqliteLog{db: db, records: make(chan *requestRecord, 1024), done: make(chan struct{})}
+	go s.run()
+	return s, nil
+}
+
+// add queues rec for writing, dropping it if the writer has fallen far
+// behind rather than slowing down requests.
+func (s *sqliteLog) add(rec *requestRecord) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.records <- rec:
+	default:
+		slog.Warn("request log: queue full, dropping record")
+	}
+}
+
+func (s *sqliteLog) run() {
+	defer close(s.done)
+	for rec := range s.records {
+		var cost interface{} // NULL when the model has no price
+		if rec.Priced {
+			cost = rec.Cost
+		}
+		_, err := s.db.Exec(`INSERT INTO requests
+			(request_id, started_at, method, path, provider, model, user, key_id, stream, status, latency_ms,
+			 input_tokens, output_tokens, cost_usd, bytes, request, response)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			rec.ID, rec.Start.UTC().Format(time.RFC3339Nano), rec.Method, rec.Path, rec.Provider, rec.Model, rec.User, rec.KeyID,
+			rec.Stream, rec.Status, rec.Latency.Milliseconds(),
+			rec.Usage.InputTokens, rec.Usage.OutputTokens, cost, rec.Bytes,
+			string(rec.Request), rec.Response.String())
+		if err != nil {
+			slog.Error("request log", "err", err)
+		}
+	}
+}
+
+// loadUsage seeds the usage and spend trackers with the totals already in
+// the log, so reports and budgets survive restarts.
+func (s *sqliteLog) loadUsage(t *usageTracker, sp *spendTracker) error {
+	rows, err := s.db.Query(`SELECT substr(started_at, 1, 10), provider, model, user,
+		count(*), sum(input_tokens), sum(output_tokens), coalesce(sum(cost_usd), 0)
+		FROM requests WHERE provider != '' GROUP BY 1, 2, 3, 4`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k usageKey
+		var u usageTotals
+		if err := rows.Scan(&k.Day, &k.Provider, &k.Model, &k.User, &u.Requests, &u.InputTokens, &u.OutputTokens, &u.CostUSD); err != nil {
+			return err
+		}
+		t.add(k, u)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Budgets only look at the current month.
+	rows, err = s.db.Query(`SELECT substr(started_at, 1, 10), provider, user, key_id, sum(cost_usd)
+		FROM requests WHERE cost_usd > 0 AND started_at >= ? GROUP BY 1, 2, 3, 4`,
+		time.Now().UTC().Format("2006-01"))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var day, provider, user, keyID string
+		var usd float64
+		if err := rows.Scan(&day, &provider, &user, &keyID, &usd); err != nil {
+			return err
+		}
+		sp.add("all", day, usd)
+		sp.add("provider:"+provider, day, usd)
+		if user != "" {
+			sp.add("user:"+user, day, usd)
+		}
+		if keyID != "" {
+			sp.add("key:"+keyID, day, usd)
+		}
+	}
+	return rows.Err()
+}
+
+// close flushes queued records and closes the database.
+func (s *sqliteLog) close() error {
+	s.mu.Lock()
+	s.closed = true
+	close(s.records)
+	s.mu.Unlock()
+	<-s.done
+	return s.db.Close()
+}
+
+// handleAdminLogs lists recent requests, newest first. Query parameters:
+// limit (default 50, max 1000), provider, request_id, and bodies=1 to
+// include request and response bodies.
+func handleAdminLogs(w http.ResponseWriter, r *http.Request) {
+	if logStore == nil {
+		http.Error(w, "No request log configured", http.StatusServiceUnavailable)
+		return
+	}
+	q := r.URL.Query()
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	if limit <= 0 {
+		limit = 50
+	}
+	limit = min(limit, 1000)
+	bodies := q.Get("bodies") == "1"
+
+	query := `SELECT id, request_id, started_at, method, path, provider, model, user, stream, status, latency_ms,
+		input_tokens, output_tokens, cost_usd, bytes, request, response FROM requests`
+	args := []interface{}{}
+	var where []string
+	if provider := q.Get("provider"); provider != "" {
+		where = append(where, "provider = ?")
+		args = append(args, provider)
+	}
+	if id := q.Get("request_id"); id != "" {
+		where = append(where, "request_id = ?")
+		args = append(args, id)
+	}
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := logStore.db.QueryContext(r.Context(), query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []map[string]interface{}{}
+	for rows.Next() {
+		var (
+			id, status, latency, in, out, size int64
+			requestID, started, method, path   string
+			provider                           string
+			model, user, request, response     string
+			stream                             bool
+			cost                               sql.NullFloat64
+		)
+		if err := rows.Scan(&id, &requestID, &started, &method, &path, &provider, &model, &user, &stream, &status,
+			&latency, &in, &out, &cost, &size, &request, &response); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		e := map[string]interface{}{
+			"id": id, "request_id": requestID, "started_at": started, "method": method, "path": path,
+			"provider": provider, "model": model, "user": user, "stream": stream, "status": status,
+			"latency_ms": latency, "bytes": size,
+			"usage": chatUsage{InputTokens: int(in), OutputTokens: int(out)},
+		}
+		if cost.Valid {
+			e["cost_usd"] = cost.Float64
+		}
+		if bodies {
+			e["request"], e["response"] = request, response
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"requests": entries})
+}
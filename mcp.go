@@ -0,0 +1,605 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MCPServerConfig is a Model Context Protocol server whose tools /api/chat
+// requests can offer models, by naming it in "mcp". The proxy runs the
+// calls itself.
+type MCPServerConfig struct {
+	// Command starts a server that speaks MCP on stdin and stdout, with
+	// Env added to the proxy's environment. URL reaches one over streamable
+	// HTTP instead, sending Headers. Set one of the two.
+	Command []string          `json:"command"`
+	Env     map[string]string `json:"env"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	// Allow lists the server's tools models may call, or ["*"] for all.
+	Allow []string `json:"allow"`
+	// Timeout bounds each call, and connecting; 30s by default.
+	Timeout duration `json:"timeout"`
+}
+
+var mcpServerName = regexp.MustCompile(`^[A-Za-z0-9-]{1,32}$`)
+
+func validateMCP(servers map[string]MCPServerConfig) []error {
+	var errs []error
+	for name, s := range servers {
+		if !mcpServerName.MatchString(name) {
+			errs = append(errs, fmt.Errorf("mcp.%s: names are 1-32 letters, digits or -", name))
+		}
+		if (len(s.Command) == 0) == (s.URL == "") {
+			errs = append(errs, fmt.Errorf("mcp.%s: set command or url, not both", name))
+		}
+		if s.URL != "" {
+			if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				errs = append(errs, fmt.Errorf("mcp.%s.url: %q is not an http or https URL", name, s.URL))
+			}
+		}
+		if len(s.Allow) == 0 {
+			errs = append(errs, fmt.Errorf("mcp.%s.allow: list the tools models may call, or [\"*\"]", name))
+		}
+		if s.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("mcp.%s.timeout: must not be negative", name))
+		}
+	}
+	return errs
+}
+
+// mcpProtocolVersion is the MCP revision the client asks for.
+const mcpProtocolVersion = "2025-06-18"
+
+// mcpConn is one session with a server: JSON-RPC calls and notifications
+// over stdio or HTTP.
+type mcpConn interface {
+	call(ctx context.Context, method string, params interface{}) (json.RawMessage, error)
+	notify(ctx context.Context, method string, params interface{}) error
+	close() error
+}
+
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  interface{}     `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.Code)
+}
+
+// mcpTool is a tool as a server lists it.
+type mcpTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"inputSchema"`
+}
+
+// mcpClient is one configured server. It connects on first use, and again
+// after its connection fails; the tools it lists are kept until the server
+// says they changed.
+type mcpClient struct {
+	name string
+	cfg  MCPServerConfig
+
+	mu      sync.Mutex
+	conn    mcpConn
+	dialing chan struct{} // closed when the session being set up is ready or failed
+	tools   []mcpTool     // allowed ones only; nil until listed
+	stale   atomic.Bool
+}
+
+var mcpServers map[string]*mcpClient
+
+func newMCPServers(servers map[string]MCPServerConfig) map[string]*mcpClient {
+	out := make(map[string]*mcpClient, len(servers))
+	for name, s := range servers {
+		out[name] = &mcpClient{name: name, cfg: s}
+	}
+	return out
+}
+
+// closeMCP ends every session, stopping stdio servers.
+func closeMCP() {
+	for _, c := range mcpServers {
+		c.mu.Lock()
+		if c.conn != nil {
+			c.conn.close()
+			c.conn = nil
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *mcpClient) timeout() time.Duration {
+	if c.cfg.Timeout > 0 {
+		return time.Duration(c.cfg.Timeout)
+	}
+	return 30 * time.Second
+}
+
+func (c *mcpClient) allows(tool string) bool {
+	return slices.Contains(c.cfg.Allow, "*") || slices.Contains(c.cfg.Allow, tool)
+}
+
+// session returns the connection, starting it and initializing the session
+// if need be. Setup runs without c.mu and within the server's timeout, so a
+// server that hangs in initialize holds up only the callers waiting for it,
+// and only until their deadline.
+func (c *mcpClient) session(ctx context.Context) (mcpConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
+	for {
+		c.mu.Lock()
+		conn, dialing := c.conn, c.dialing
+		if conn == nil && dialing == nil {
+			c.dialing = make(chan struct{})
+		}
+		c.mu.Unlock()
+		if conn != nil {
+			return conn, nil
+		}
+		if dialing == nil {
+			break
+		}
+		select {
+		case <-dialing:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("initialize: %w", ctx.Err())
+		}
+	}
+	conn, err := c.connect(ctx)
+	c.mu.Lock()
+	if err == nil {
+		c.conn, c.tools = conn, nil
+	}
+	close(c.dialing)
+	c.dialing = nil
+	c.mu.Unlock()
+	return conn, err
+}
+
+// connect starts a connection and initializes the session on it.
+func (c *mcpClient) connect(ctx context.Context) (mcpConn, error) {
+	var conn mcpConn
+	var err error
+	if c.cfg.URL != "" {
+		conn = &mcpHTTP{url: c.cfg.URL, headers: c.cfg.Headers}
+	} else if conn, err = startMCPStdio(c); err != nil {
+		return nil, err
+	}
+	init := map[string]interface{}{
+		"protocolVersion": mcpProtocolVersion,
+		"capabilities":    map[string]interface{}{},
+		"clientInfo":      map[string]interface{}{"name": "quirk", "version": "1"},
+	}
+	if _, err := conn.call(ctx, "initialize", init); err != nil {
+		conn.close()
+		return nil, fmt.Errorf("initialize: %w", err)
+	}
+	if err := conn.notify(ctx, "notifications/initialized", nil); err != nil {
+		conn.close()
+		return nil, err
+	}
+	slog.Info("mcp connected", "server", c.name)
+	return conn, nil
+}
+
+// drop forgets a connection that failed, so the next use reconnects.
+// c.mu must be held.
+func (c *mcpClient) drop(conn mcpConn) {
+	if c.conn == conn {
+		conn.close()
+		c.conn, c.tools = nil, nil
+	}
+}
+
+// listTools returns the allowed tools, listing them if need be.
+func (c *mcpClient) listTools(ctx context.Context) ([]mcpTool, error) {
+	conn, err := c.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tools != nil && !c.stale.Load() && c.conn == conn {
+		return c.tools, nil
+	}
+	c.stale.Store(false)
+	tools := []mcpTool{}
+	params := map[string]interface{}{}
+	for {
+		raw, err := conn.call(ctx, "tools/list", params)
+		if err != nil {
+			c.drop(conn)
+			return nil, fmt.Errorf("tools/list: %w", err)
+		}
+		var page struct {
+			Tools      []mcpTool `json:"tools"`
+			NextCursor string    `json:"nextCursor"`
+		}
+		if err := json.Unmarshal(raw, &page); err != nil {
+			return nil, fmt.Errorf("tools/list: %w", err)
+		}
+		for _, t := range page.Tools {
+			if c.allows(t.Name) {
+				tools = append(tools, t)
+			}
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		params = map[string]interface{}{"cursor": page.NextCursor}
+	}
+	if c.conn == conn {
+		c.tools = tools
+	}
+	return tools, nil
+}
+
+// callTool runs a tool, returning its content as text for the model and
+// whether it reports an error.
+func (c *mcpClient) callTool(ctx context.Context, name string, args json.RawMessage) (string, bool) {
+	if !c.allows(name) {
+		return "tool " + name + " is not allowed", true
+	}
+	conn, err := c.session(ctx)
+	if err != nil {
+		return "error: " + err.Error(), true
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout())
+	defer cancel()
+	raw, err := conn.call(ctx, "tools/call", map[string]interface{}{"name": name, "arguments": toolArguments(args)})
+	var rpcErr *rpcError
+	if err != nil && !errors.As(err, &rpcErr) {
+		c.mu.Lock()
+		c.drop(conn)
+		c.mu.Unlock()
+	}
+	if err != nil {
+		return "error: " + err.Error(), true
+	}
+	var result struct {
+		Content []struct {
+			Type     string `json:"type"`
+			Text     string `json:"text"`
+			Resource struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"resource"`
+		} `json:"content"`
+		StructuredContent json.RawMessage `json:"structuredContent"`
+		IsError           bool            `json:"isError"`
+	}
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return "error: " + err.Error(), true
+	}
+	var parts []string
+	for _, item := range result.Content {
+		switch item.Type {
+		case "text":
+			parts = append(parts, item.Text)
+		case "resource":
+			parts = append(parts, item.Resource.URI+":\n"+item.Resource.Text)
+		default:
+			parts = append(parts, "["+item.Type+" omitted]")
+		}
+	}
+	if len(parts) == 0 && len(result.StructuredContent) > 0 {
+		parts = append(parts, string(result.StructuredContent))
+	}
+	return strings.Join(parts, "\n"), result.IsError
+}
+
+// mcpToolSeparator joins server and tool names in the names models see.
+const mcpToolSeparator = "__"
+
+// addMCPTools offers the tools of the servers the request names. A server
+// that cannot be reached fails the request.
+func (cr *chatRequest) addMCPTools(ctx context.Context) error {
+	for _, name := range cr.MCP {
+		client := mcpServers[name]
+		if client == nil {
+			return badRequest("mcp: no server " + strconv.Quote(name))
+		}
+		tools, err := client.listTools(ctx)
+		if err != nil {
+			return fmt.Errorf("mcp server %s: %w", name, err)
+		}
+		for _, t := range tools {
+			full := name + mcpToolSeparator + t.Name
+			if !toolName.MatchString(full) {
+				slog.Warn("mcp tool skipped", "server", name, "tool", t.Name, "reason", "name too long or not allowed by providers")
+				continue
+			}
+			tool := t.Name
+			cr.offerServerTool(&serverTool{
+				def:    chatTool{Name: full, Description: t.Description, Parameters: t.InputSchema},
+				source: "mcp:" + name,
+				run: func(ctx context.Context, args json.RawMessage) (string, bool) {
+					return client.callTool(ctx, tool, args)
+				},
+			})
+		}
+	}
+	return nil
+}
+
+// mcpNames lists the configured servers, for the startup log.
+func mcpNames() []string {
+	names := make([]string, 0, len(mcpServers))
+	for name := range mcpServers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mcpStdio is a server run as a child process, one JSON-RPC message per
+// line each way.
+type mcpStdio struct {
+	client *mcpClient
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	nextID atomic.Int64
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	pending map[string]chan rpcMessage
+	done    chan struct{} // closed once stdout ends
+}
+
+func startMCPStdio(c *mcpClient) (*mcpStdio, error) {
+	cmd := exec.Command(c.cfg.Command[0], c.cfg.Command[1:]...)
+	cmd.Env = os.Environ()
+	for k, v := range c.cfg.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	s := &mcpStdio{client: c, cmd: cmd, stdin: stdin, pending: map[string]chan rpcMessage{}, done: make(chan struct{})}
+	go s.read(stdout)
+	go func() {
+		lines := bufio.NewScanner(stderr)
+		for lines.Scan() {
+			slog.Debug("mcp stderr", "server", c.name, "line", lines.Text())
+		}
+	}()
+	return s, nil
+}
+
+// read dispatches what the server writes: replies to waiting calls, and
+// requests and notifications of its own.
+func (s *mcpStdio) read(stdout io.Reader) {
+	defer close(s.done)
+	lines := bufio.NewScanner(stdout)
+	lines.Buffer(make([]byte, 64*1024), 16<<20)
+	for lines.Scan() {
+		var msg rpcMessage
+		if json.Unmarshal(lines.Bytes(), &msg) != nil {
+			continue
+		}
+		switch {
+		case msg.Method != "" && len(msg.ID) > 0:
+			s.answer(msg)
+		case msg.Method == "notifications/tools/list_changed":
+			s.client.stale.Store(true)
+		case len(msg.ID) > 0:
+			s.mu.Lock()
+			ch := s.pending[string(msg.ID)]
+			delete(s.pending, string(msg.ID))
+			s.mu.Unlock()
+			if ch != nil {
+				ch <- msg
+			}
+		}
+	}
+}
+
+// answer replies to a request from the server. The client offers no
+// capabilities beyond ping.
+func (s *mcpStdio) answer(req rpcMessage) {
+	reply := rpcMessage{JSONRPC: "2.0", ID: req.ID}
+	if req.Method == "ping" {
+		reply.Result = json.RawMessage("{}")
+	} else {
+		reply.Error = &rpcError{Code: -32601, Message: "method not found"}
+	}
+	s.write(reply)
+}
+
+func (s *mcpStdio) write(msg rpcMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err = s.stdin.Write(append(data, '\n'))
+	return err
+}
+
+func (s *mcpStdio) call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	id := json.RawMessage(strconv.FormatInt(s.nextID.Add(1), 10))
+	ch := make(chan rpcMessage, 1)
+	s.mu.Lock()
+	s.pending[string(id)] = ch
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, string(id))
+		s.mu.Unlock()
+	}()
+	if err := s.write(rpcMessage{JSONRPC: "2.0", ID: id, Method: method, Params: params}); err != nil {
+		return nil, err
+	}
+	select {
+	case msg := <-ch:
+		if msg.Error != nil {
+			return nil, msg.Error
+		}
+		return msg.Result, nil
+	case <-s.done:
+		return nil, errors.New("server exited")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *mcpStdio) notify(_ context.Context, method string, params interface{}) error {
+	return s.write(rpcMessage{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+// close ends the session by closing the server's stdin, killing it if it
+// has not exited a few seconds later.
+func (s *mcpStdio) close() error {
+	s.stdin.Close()
+	select {
+	case <-s.done:
+	case <-time.After(3 * time.Second):
+		s.cmd.Process.Kill()
+	}
+	return s.cmd.Wait()
+}
+
+// mcpHTTP is a server reached over streamable HTTP: each message is a
+// POST, answered with JSON or an SSE stream that carries the reply.
+type mcpHTTP struct {
+	url     string
+	headers map[string]string
+	nextID  atomic.Int64
+	session atomic.Value // Mcp-Session-Id, once the server assigns one
+}
+
+func (h *mcpHTTP) post(ctx context.Context, msg rpcMessage) (*http.Response, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", h.url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	for k, v := range h.headers {
+		req.Header.Set(k, v)
+	}
+	if id, _ := h.session.Load().(string); id != "" {
+		req.Header.Set("Mcp-Session-Id", id)
+		req.Header.Set("MCP-Protocol-Version", mcpProtocolVersion)
+	}
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if id := resp.Header.Get("Mcp-Session-Id"); id != "" {
+		h.session.Store(id)
+	}
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("server answered %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return resp, nil
+}
+
+func (h *mcpHTTP) call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	id := json.RawMessage(strconv.FormatInt(h.nextID.Add(1), 10))
+	resp, err := h.post(ctx, rpcMessage{JSONRPC: "2.0", ID: id, Method: method, Params: params})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var reply *rpcMessage
+	err = readUpstreamEvents(resp, func(_ string, data []byte) bool {
+		var msg rpcMessage
+		if json.Unmarshal(data, &msg) == nil && string(msg.ID) == string(id) && msg.Method == "" {
+			reply = &msg
+			return false
+		}
+		return true
+	})
+	if reply == nil {
+		if err == nil {
+			err = errors.New("no reply")
+		}
+		return nil, err
+	}
+	if reply.Error != nil {
+		return nil, reply.Error
+	}
+	return reply.Result, nil
+}
+
+func (h *mcpHTTP) notify(ctx context.Context, method string, params interface{}) error {
+	resp, err := h.post(ctx, rpcMessage{JSONRPC: "2.0", Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// close ends the server's session.
+func (h *mcpHTTP) close() error {
+	id, _ := h.session.Load().(string)
+	if id == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "DELETE", h.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Mcp-Session-Id", id)
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
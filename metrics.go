@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A tiny Prometheus text-format registry; the handful of metric types the
+// proxy needs don't justify the client library.
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var metricsRegistry []metric
+
+// counterVec is a counter with labels.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64 // joined label values
+}
+
+func newCounter(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+	metricsRegistry = append(metricsRegistry, c)
+	return c
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) inc(labelValues ...string) { c.add(1, labelValues...) }
+
+func (c *counterVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, "", ""), formatFloat(c.values[key]))
+	}
+}
+
+// gaugeFunc reports a value computed at scrape time.
+type gaugeFunc struct {
+	name, help string
+	value      func() float64
+}
+
+func newGaugeFunc(name, help string, value func() float64) {
+	metricsRegistry = append(metricsRegistry, &gaugeFunc{name, help, value})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(g.value()))
+}
+
+// histogramVec is a histogram with labels and fixed buckets.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// latencyBuckets suit upstream calls, which range from tens of
+// milliseconds to minutes of generation.
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+	metricsRegistry = append(metricsRegistry, h)
+	return h
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogramVec) observeSince(start time.Time, labelValues ...string) {
+	h.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, "", ""), s.count)
+	}
+}
+
+func formatLabels(names []string, joined, extraName, extraValue string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(joined, "\xff") {
+			if i < len(names) {
+				pairs = append(pairs, names[i]+"="+strconv.Quote(v))
+			}
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+"="+strconv.Quote(extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var (
+	metricRequests = newCounter("quirk_requests_total",
+		"API requests served, by route, provider and status code.", "path", "provider", "code")
+	metricRequestDuration = newHistogram("quirk_request_duration_seconds",
+		"Time to serve API requests, including streaming.", latencyBuckets, "provider", "stream")
+	metricUpstreamLatency = newHistogram("quirk_upstream_latency_seconds",
+		"Time until an upstream returned response headers.", latencyBuckets, "provider")
+	metricUpstreamErrors = newCounter("quirk_upstream_errors_total",
+		"Upstream calls that failed before a response, or answered with an error status.", "provider")
+	metricUpstreamRetries = newCounter("quirk_upstream_retries_total",
+		"Upstream calls retried after a transient failure.", "provider")
+	metricTokens = newCounter("quirk_tokens_total",
+		"Tokens reported by upstreams.", "provider", "model", "direction")
+	metricCost = newCounter("quirk_cost_usd_total",
+		"Estimated spend in US dollars.", "provider")
+	metricCache = newCounter("quirk_cache_requests_total",
+		"Cache lookups by cache and result.", "cache", "result")
+)
+
+func init() {
+	newGaugeFunc("quirk_upstream_in_flight", "Upstream requests holding a concurrency slot.", func() float64 {
+		if globalSlots == nil {
+			return math.NaN()
+		}
+		globalSlots.mu.Lock()
+		defer globalSlots.mu.Unlock()
+		return float64(globalSlots.inUse)
+	})
+}
+
+// observeRequest updates request metrics from a finished record.
+func observeRequest(rec *requestRecord) {
+	provider := rec.Provider
+	metricRequests.inc(rec.Path, provider, strconv.Itoa(rec.Status))
+	if provider == "" || rec.Cached {
+		return
+	}
+	metricRequestDuration.observe(rec.Latency.Seconds(), provider, strconv.FormatBool(rec.Stream))
+	if rec.Usage.InputTokens > 0 {
+		metricTokens.add(float64(rec.Usage.InputTokens), provider, rec.Model, "input")
+	}
+	if rec.Usage.OutputTokens > 0 {
+		metricTokens.add(float64(rec.Usage.OutputTokens), provider, rec.Model, "output")
+	}
+	if rec.Usage.CacheCreationInputTokens > 0 {
+		metricTokens.add(float64(rec.Usage.CacheCreationInputTokens), provider, rec.Model, "cache_write")
+	}
+	if rec.Usage.CacheReadInputTokens > 0 {
+		metricTokens.add(float64(rec.Usage.CacheReadInputTokens), provider, rec.Model, "cache_read")
+	}
+	if rec.Cost > 0 {
+		metricCost.add(rec.Cost, provider)
+	}
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metricsRegistry {
+		m.write(w)
+	}
+}
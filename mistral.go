@@ -0,0 +1,6 @@
+package main
+
+// Mistral. The chat API mirrors OpenAI's, including SSE streaming.
+func init() {
+	registerProvider(openAICompatible("mistral", "https://api.mistral.ai/v1/chat/completions"))
+}
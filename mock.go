@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mockHost is the mock provider's upstream. Nothing resolves under
+// .invalid; mockTransport answers it in process.
+const mockHost = "mock.invalid"
+
+// The mock provider answers like an OpenAI-compatible API without calling
+// one, for frontend work and load tests that shouldn't cost anything.
+// [mock] sets what it says, how fast and how often it fails.
+func init() {
+	registerProvider(&providerSpec{
+		name:     "mock",
+		endpoint: "http://" + mockHost + "/v1/chat/completions",
+		dialect:  &mockDialect,
+		keyless:  true,
+		build: func(p *providerSpec, body map[string]interface{}, _ string) (*http.Request, error) {
+			return newJSONRequest(p.Endpoint(), body)
+		},
+	})
+}
+
+// mockDialect is OpenAI's without tool calls, which the mock never makes.
+var mockDialect = func() chatDialect {
+	d := openAIDialect
+	d.tools = false
+	return d
+}()
+
+// MockConfig sets up the mock provider. A reply is the first of Responses
+// whose Match occurs in the last user message (an empty Match always
+// does), or an echo of that message. It streams at TokensPerSecond after
+// Latency; a buffered reply takes as long in all. ErrorRate and
+// RateLimitRate are the fractions of requests failed with a 500 or a 429.
+type MockConfig struct {
+	Responses       []MockResponse `json:"responses"`
+	TokensPerSecond float64        `json:"tokens_per_second"`
+	Latency         duration       `json:"latency"`
+	ErrorRate       float64        `json:"error_rate"`
+	RateLimitRate   float64        `json:"rate_limit_rate"`
+}
+
+// MockResponse is a canned reply. Match is compared case-insensitively; a
+// Status of 400 or more answers with that error instead of Content.
+type MockResponse struct {
+	Match   string `json:"match"`
+	Content string `json:"content"`
+	Status  int    `json:"status"`
+}
+
+func (c MockConfig) validate() []error {
+	var errs []error
+	if c.TokensPerSecond < 0 {
+		errs = append(errs, errors.New("mock.tokens_per_second: must not be negative"))
+	}
+	if c.Latency < 0 {
+		errs = append(errs, errors.New("mock.latency: must not be negative"))
+	}
+	if c.ErrorRate < 0 || c.RateLimitRate < 0 || c.ErrorRate+c.RateLimitRate > 1 {
+		errs = append(errs, errors.New("mock: error_rate and rate_limit_rate must be fractions adding up to at most 1"))
+	}
+	for i, r := range c.Responses {
+		if r.Status != 0 && (r.Status < 400 || r.Status > 599) {
+			errs = append(errs, fmt.Errorf("mock.responses[%d].status: %d is not an error status", i, r.Status))
+		}
+	}
+	return errs
+}
+
+func (c MockConfig) tokensPerSecond() float64 {
+	if c.TokensPerSecond > 0 {
+		return c.TokensPerSecond
+	}
+	return 30
+}
+
+// mockTransport answers requests for mockHost and passes the rest to next.
+type mockTransport struct {
+	next http.RoundTripper
+}
+
+func (t *mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != mockHost {
+		return t.next.RoundTrip(req)
+	}
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+	var body struct {
+		Model    string `json:"model"`
+		Stream   bool   `json:"stream"`
+		Messages []struct {
+			Role    string          `json:"role"`
+			Content json.RawMessage `json:"content"`
+		} `json:"messages"`
+	}
+	raw, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Path != "/v1/chat/completions" {
+		return mockError(req, http.StatusNotFound, "The mock provider only answers chat completions"), nil
+	}
+	if err := json.Unmarshal(raw, &body); err != nil {
+		return mockError(req, http.StatusBadRequest, "Invalid JSON: "+err.Error()), nil
+	}
+
+	mc := config.Mock
+	switch roll := rand.Float64(); {
+	case roll < mc.ErrorRate:
+		return mockError(req, http.StatusInternalServerError, "Simulated server error"), nil
+	case roll < mc.ErrorRate+mc.RateLimitRate:
+		resp := mockError(req, http.StatusTooManyRequests, "Simulated rate limit")
+		resp.Header.Set("Retry-After", "1")
+		return resp, nil
+	}
+
+	var prompt string
+	for _, m := range body.Messages {
+		if m.Role == "user" {
+			prompt = mockText(m.Content)
+		}
+	}
+	content := "Mock reply to: " + prompt
+	for _, r := range mc.Responses {
+		if strings.Contains(strings.ToLower(prompt), strings.ToLower(r.Match)) {
+			if r.Status != 0 {
+				return mockError(req, r.Status, "Simulated error for "+strconv.Quote(r.Match)), nil
+			}
+			content = r.Content
+			break
+		}
+	}
+
+	tokens := mockTokens(content)
+	usage := map[string]int{"prompt_tokens": len(raw) / 4, "completion_tokens": len(tokens), "total_tokens": len(raw)/4 + len(tokens)}
+	model := firstSet(body.Model, "mock")
+	id := "mock-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	perToken := time.Duration(float64(time.Second) / mc.tokensPerSecond())
+
+	if !body.Stream {
+		if !mockSleep(req, time.Duration(mc.Latency)+time.Duration(len(tokens))*perToken) {
+			return nil, req.Context().Err()
+		}
+		data, _ := json.Marshal(map[string]interface{}{
+			"id":     id,
+			"object": "chat.completion",
+			"model":  model,
+			"choices": []interface{}{map[string]interface{}{
+				"index":         0,
+				"message":       map[string]string{"role": "assistant", "content": content},
+				"finish_reason": "stop",
+			}},
+			"usage": usage,
+		})
+		resp := mockResponse(req, http.StatusOK, "application/json", io.NopCloser(bytes.NewReader(data)))
+		resp.ContentLength = int64(len(data))
+		return resp, nil
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		chunk := func(delta map[string]string, finish interface{}) []byte {
+			data, _ := json.Marshal(map[string]interface{}{
+				"id":      id,
+				"object":  "chat.completion.chunk",
+				"model":   model,
+				"choices": []interface{}{map[string]interface{}{"index": 0, "delta": delta, "finish_reason": finish}},
+			})
+			return data
+		}
+		send := func(data []byte) bool {
+			_, err := fmt.Fprintf(pw, "data: %s\n\n", data)
+			return err == nil
+		}
+		if !mockSleep(req, time.Duration(mc.Latency)) || !send(chunk(map[string]string{"role": "assistant", "content": ""}, nil)) {
+			pw.CloseWithError(req.Context().Err())
+			return
+		}
+		for _, tok := range tokens {
+			if !mockSleep(req, perToken) || !send(chunk(map[string]string{"content": tok}, nil)) {
+				pw.CloseWithError(req.Context().Err())
+				return
+			}
+		}
+		final, _ := json.Marshal(map[string]interface{}{"id": id, "object": "chat.completion.chunk", "model": model, "choices": []interface{}{}, "usage": usage})
+		if send(chunk(map[string]string{}, "stop")) && send(final) {
+			send([]byte("[DONE]"))
+		}
+		pw.Close()
+	}()
+	return mockResponse(req, http.StatusOK, "text/event-stream", pr), nil
+}
+
+// mockText is a message's text, whether content is a string or parts.
+func mockText(content json.RawMessage) string {
+	var s string
+	if json.Unmarshal(content, &s) == nil {
+		return s
+	}
+	var parts []struct {
+		Text string `json:"text"`
+	}
+	json.Unmarshal(content, &parts)
+	texts := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p.Text != "" {
+			texts = append(texts, p.Text)
+		}
+	}
+	return strings.Join(texts, " ")
+}
+
+// mockTokens cuts s into tokens of a word each, spaces kept with the word
+// after them, so joining them gives s back.
+func mockTokens(s string) []string {
+	var tokens []string
+	start := 0
+	for i := 1; i < len(s); i++ {
+		if s[i] == ' ' && s[i-1] != ' ' {
+			tokens = append(tokens, s[start:i])
+			start = i
+		}
+	}
+	if start < len(s) {
+		tokens = append(tokens, s[start:])
+	}
+	return tokens
+}
+
+// mockSleep waits d, or reports false if the request is cancelled first.
+func mockSleep(req *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return req.Context().Err() == nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-req.Context().Done():
+		return false
+	}
+}
+
+func mockResponse(req *http.Request, status int, contentType string, body io.ReadCloser) *http.Response {
+	return &http.Response{
+		Status:     strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode: status,
+		Proto:      "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1,
+		Header:        http.Header{"Content-Type": {contentType}},
+		Body:          body,
+		ContentLength: -1,
+		Request:       req,
+	}
+}
+
+// mockError is an error in OpenAI's shape.
+func mockError(req *http.Request, status int, message string) *http.Response {
+	data, _ := json.Marshal(map[string]interface{}{"error": map[string]string{"message": message, "type": "mock_error"}})
+	resp := mockResponse(req, status, "application/json", io.NopCloser(bytes.NewReader(data)))
+	resp.ContentLength = int64(len(data))
+	return resp
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ModerationConfig checks prompts before they go upstream, with OpenAI's
+// moderation endpoint or local rules. Requests that trip a category are
+// blocked, or with action "flag" forwarded and marked.
+type ModerationConfig struct {
+	// Provider is "openai" or "local"; empty turns moderation off.
+	Provider string `json:"provider"`
+	Model    string `json:"model"` // omni-moderation-latest by default
+	// Action is "block" (the default) or "flag".
+	Action string `json:"action"`
+	// Categories limits which categories count; empty counts all of them.
+	Categories []string `json:"categories"`
+	// Threshold is the score from which an OpenAI category counts, in
+	// place of its own verdict.
+	Threshold float64 `json:"threshold"`
+	// FailClosed refuses requests when the check itself fails; otherwise
+	// they go through unchecked.
+	FailClosed bool `json:"fail_closed"`
+	// Rules are the local classifier: regular expressions by category.
+	Rules map[string][]string `json:"rules"`
+}
+
+func (c ModerationConfig) validate() []error {
+	var errs []error
+	switch c.Provider {
+	case "", "openai":
+	case "local":
+		if len(c.Rules) == 0 {
+			errs = append(errs, errors.New("moderation.rules: required for the local classifier"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("moderation.provider: %q is not openai or local", c.Provider))
+	}
+	if c.Action != "" && c.Action != "block" && c.Action != "flag" {
+		errs = append(errs, fmt.Errorf("moderation.action: %q is not block or flag", c.Action))
+	}
+	if c.Threshold < 0 || c.Threshold > 1 {
+		errs = append(errs, errors.New("moderation.threshold: must be between 0 and 1"))
+	}
+	for category, patterns := range c.Rules {
+		for i, p := range patterns {
+			if _, err := regexp.Compile(p); err != nil {
+				errs = append(errs, fmt.Errorf("moderation.rules.%s[%d]: %v", category, i, err))
+			}
+		}
+	}
+	return errs
+}
+
+// moderation is the configured check.
+type moderation struct {
+	cfg   ModerationConfig
+	rules map[string][]*regexp.Regexp
+}
+
+// moderator is the moderation check, or nil when it is not configured.
+var moderator *moderation
+
+func newModeration(c ModerationConfig) *moderation {
+	if c.Provider == "" {
+		return nil
+	}
+	m := &moderation{cfg: c, rules: map[string][]*regexp.Regexp{}}
+	for category, patterns := range c.Rules {
+		for _, p := range patterns {
+			m.rules[category] = append(m.rules[category], regexp.MustCompile(p))
+		}
+	}
+	return m
+}
+
+// counts reports whether category is one the deployment cares about.
+func (m *moderation) counts(category string) bool {
+	if len(m.cfg.Categories) == 0 {
+		return true
+	}
+	for _, c := range m.cfg.Categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns the categories texts and images trip, sorted.
+func (m *moderation) check(w http.ResponseWriter, r *http.Request, texts []string, images []*upload) ([]string, error) {
+	tripped := map[string]bool{}
+	if m.cfg.Provider == "local" {
+		for category, res := range m.rules {
+			for _, re := range res {
+				for _, t := range texts {
+					if m.counts(category) && re.MatchString(t) {
+						tripped[category] = true
+					}
+				}
+			}
+		}
+	} else if err := m.checkOpenAI(w, r, texts, images, tripped); err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, len(tripped))
+	for c := range tripped {
+		out = append(out, c)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// checkOpenAI sends everything in one moderation call; the omni models
+// take images as well.
+func (m *moderation) checkOpenAI(w http.ResponseWriter, r *http.Request, texts []string, images []*upload, tripped map[string]bool) error {
+	p, _ := lookupProvider("openai")
+	model := firstSet(m.cfg.Model, "omni-moderation-latest")
+	apiKey, err := resolveAPIKey(p, recordFrom(r).user(), "", "")
+	if err != nil {
+		return err
+	}
+	var input []interface{}
+	for _, t := range texts {
+		input = append(input, map[string]interface{}{"type": "text", "text": t})
+	}
+	if strings.HasPrefix(model, "omni") {
+		for _, img := range images {
+			input = append(input, map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": img.dataURL()}})
+		}
+	}
+	if len(input) == 0 {
+		return nil
+	}
+	req, err := newJSONRequest(strings.TrimSuffix(p.Endpoint(), "/chat/completions")+"/moderations",
+		map[string]interface{}{"model": model, "input": input})
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	req = req.WithContext(r.Context())
+
+	release, err := acquireUpstream(w, r, p)
+	if err != nil {
+		return err
+	}
+	defer release()
+	resp, err := doUpstream(p, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("moderation endpoint answered %s: %s", resp.Status, strings.TrimSpace(string(raw)))
+	}
+	var out struct {
+		Results []struct {
+			Categories map[string]bool    `json:"categories"`
+			Scores     map[string]float64 `json:"category_scores"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return err
+	}
+	for _, res := range out.Results {
+		for category, flagged := range res.Categories {
+			if m.cfg.Threshold > 0 {
+				flagged = res.Scores[category] >= m.cfg.Threshold
+			}
+			if flagged && m.counts(category) {
+				tripped[category] = true
+			}
+		}
+	}
+	return nil
+}
+
+// moderate runs a prompt through the moderation check, if there is one.
+// It returns false once it has answered the request itself: the prompt
+// was blocked, or could not be checked and fail_closed is set. Flagged
+// prompts go on with X-Moderation-Flagged naming the categories.
+func moderate(w http.ResponseWriter, r *http.Request, texts []string, images []*upload) bool {
+	if moderator == nil {
+		return true
+	}
+	rec := recordFrom(r)
+	tripped, err := moderator.check(w, r, texts, images)
+	if err != nil {
+		slog.Warn("moderation check failed", "request_id", rec.ID, "err", err)
+		if moderator.cfg.FailClosed {
+			http.Error(w, "Moderation check failed: "+err.Error(), http.StatusServiceUnavailable)
+			return false
+		}
+		return true
+	}
+	if len(tripped) == 0 {
+		return true
+	}
+	action := firstSet(moderator.cfg.Action, "block")
+	rec.Flagged = strings.Join(tripped, ",")
+	audit.record("moderation."+action, map[string]interface{}{
+		"request_id": rec.ID,
+		"path":       rec.Path,
+		"user":       rec.User,
+		"categories": tripped,
+		"remote":     clientIP(r),
+	})
+	if action == "flag" {
+		w.Header().Set("X-Moderation-Flagged", rec.Flagged)
+		return true
+	}
+	writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+		"error":      "Request blocked by moderation",
+		"categories": tripped,
+	})
+	return false
+}
+
+// moderatedText is what of a chat request is moderated: the system prompt
+// and what users wrote, not earlier replies.
+func (cr *chatRequest) moderatedText() (texts []string, images []*upload) {
+	if cr.System != "" {
+		texts = append(texts, cr.System)
+	}
+	for _, m := range cr.Messages {
+		if m.Role == "assistant" {
+			continue
+		}
+		if m.Content != "" {
+			texts = append(texts, m.Content)
+		}
+		images = append(images, m.images...)
+	}
+	return texts, images
+}
+
+// promptStrings collects the prompt text of a raw provider body, whatever
+// its shape: the strings under content, text, system, prompt and input,
+// skipping assistant turns.
+func promptStrings(v interface{}) []string {
+	var out []string
+	rewritePrompt(v, func(s string) string {
+		out = append(out, s)
+		return s
+	})
+	return out
+}
+
+// rewritePrompt hands each string promptStrings would collect to f and
+// puts back what f returns.
+func rewritePrompt(v interface{}, f func(string) string) {
+	var walk func(v interface{}, take bool) interface{}
+	walk = func(v interface{}, take bool) interface{} {
+		switch v := v.(type) {
+		case string:
+			if take && strings.TrimSpace(v) != "" {
+				return f(v)
+			}
+		case []interface{}:
+			for i, e := range v {
+				v[i] = walk(e, take)
+			}
+		case map[string]interface{}:
+			if role, _ := v["role"].(string); role == "assistant" || role == "model" {
+				break
+			}
+			for k, e := range v {
+				switch k {
+				case "content", "text", "system", "prompt", "input", "parts", "messages", "contents":
+					v[k] = walk(e, true)
+				default:
+					if _, nested := e.(string); !nested {
+						v[k] = walk(e, take)
+					}
+				}
+			}
+		}
+		return v
+	}
+	walk(v, false)
+}
+
+// checkPrompts puts raw provider bodies through the prompt checks of
+// /api/chat, in the same order: guardrails, PII, moderation and injection
+// screening. Redactions are made in place. It returns false once it has
+// answered the request itself.
+func checkPrompts(w http.ResponseWriter, r *http.Request, bodies ...map[string]interface{}) bool {
+	if !guardBodies(w, r, bodies) {
+		return false
+	}
+	scrubBodies(w, r, bodies)
+	var texts []string
+	for _, body := range bodies {
+		texts = append(texts, promptStrings(body)...)
+	}
+	if !moderate(w, r, texts, nil) {
+		return false
+	}
+	return screenBodies(w, r, bodies)
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDCConfig signs users in to the web UI with an OpenID Connect issuer,
+// or GitHub's OAuth, which has no OIDC. Signed-in browsers get a session
+// cookie that the /api routes accept in place of an access token.
+type OIDCConfig struct {
+	// Provider is "google", "github" or "" for a generic issuer.
+	Provider        string   `json:"provider"`
+	Issuer          string   `json:"issuer"`
+	ClientID        string   `json:"client_id"`
+	ClientSecret    string   `json:"client_secret"`
+	ClientSecretEnv string   `json:"client_secret_env"`
+	RedirectURL     string   `json:"redirect_url"`
+	Scopes          []string `json:"scopes"`
+	// AllowedDomains and AllowedUsers restrict who may sign in, by email
+	// domain and by user name (email, or login on GitHub). Empty lets in
+	// anyone the issuer authenticates.
+	AllowedDomains []string `json:"allowed_domains"`
+	AllowedUsers   []string `json:"allowed_users"`
+}
+
+func (o OIDCConfig) enabled() bool { return o.ClientID != "" }
+
+func (o OIDCConfig) validate() []error {
+	if !o.enabled() {
+		return nil
+	}
+	var errs []error
+	switch o.Provider {
+	case "", "google", "github":
+	default:
+		errs = append(errs, fmt.Errorf("oidc.provider: %q is not google, github or empty", o.Provider))
+	}
+	if o.Provider == "" && o.Issuer == "" {
+		errs = append(errs, errors.New("oidc.issuer: required for a generic provider"))
+	}
+	if o.secret() == "" {
+		errs = append(errs, errors.New("oidc: client_secret or client_secret_env is required"))
+	}
+	if u, err := url.Parse(o.RedirectURL); err != nil || u.Host == "" || !strings.HasSuffix(u.Path, "/auth/callback") {
+		errs = append(errs, errors.New("oidc.redirect_url: must be an absolute URL ending in /auth/callback"))
+	}
+	return errs
+}
+
+func (o OIDCConfig) secret() string {
+	return KeySource{APIKey: o.ClientSecret, APIKeyEnv: o.ClientSecretEnv}.lookup()
+}
+
+// oidcEndpoints are the issuer URLs a login needs.
+type oidcEndpoints struct {
+	Issuer        string `json:"issuer"`
+	Authorization string `json:"authorization_endpoint"`
+	Token         string `json:"token_endpoint"`
+}
+
+var githubEndpoints = oidcEndpoints{
+	Authorization: "https://github.com/login/oauth/authorize",
+	Token:         "https://github.com/login/oauth/access_token",
+}
+
+// oidcClient runs the authorization code flow with PKCE.
+type oidcClient struct {
+	cfg       OIDCConfig
+	endpoints oidcEndpoints
+	http      *http.Client
+
+	mu      sync.Mutex
+	pending map[string]oidcLogin // by state
+}
+
+// oidcLogin is a login that has been sent to the issuer.
+type oidcLogin struct {
+	nonce    string
+	verifier string
+	next     string
+	expires  time.Time
+}
+
+var oidc *oidcClient
+
+// newOIDCClient resolves the issuer's endpoints, by discovery except for
+// GitHub.
+func newOIDCClient(cfg OIDCConfig) (*oidcClient, error) {
+	c := &oidcClient{cfg: cfg, http: &http.Client{Transport: upstreamTransport, Timeout: 10 * time.Second}, pending: map[string]oidcLogin{}}
+	switch cfg.Provider {
+	case "github":
+		c.endpoints = githubEndpoints
+		if len(c.cfg.Scopes) == 0 {
+			c.cfg.Scopes = []string{"read:user", "user:email"}
+		}
+		return c, nil
+	case "google":
+		if c.cfg.Issuer == "" {
+			c.cfg.Issuer = "https://accounts.google.com"
+		}
+	}
+	if len(c.cfg.Scopes) == 0 {
+		c.cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+
+	resp, err := c.http.Get(strings.TrimSuffix(c.cfg.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc discovery: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&c.endpoints); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	if c.endpoints.Authorization == "" || c.endpoints.Token == "" {
+		return nil, errors.New("oidc discovery: missing authorization or token endpoint")
+	}
+	return c, nil
+}
+
+func randomToken() string {
+	var b [24]byte
+	rand.Read(b[:])
+	return base64.RawURLEncoding.EncodeToString(b[:])
+}
+
+// handleLogin sends the browser to the issuer. ?next= is where to land
+// afterwards, a local path.
+func (c *oidcClient) handleLogin(w http.ResponseWriter, r *http.Request) {
+	login := oidcLogin{
+		nonce:    randomToken(),
+		verifier: randomToken(),
+		next:     localPath(r.URL.Query().Get("next")),
+		expires:  time.Now().Add(10 * time.Minute),
+	}
+	state := randomToken()
+	c.mu.Lock()
+	for k, l := range c.pending {
+		if time.Now().After(l.expires) {
+			delete(c.pending, k)
+		}
+	}
+	c.pending[state] = login
+	c.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(login.verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.cfg.ClientID},
+		"redirect_uri":          {c.cfg.RedirectURL},
+		"scope":                 {strings.Join(c.cfg.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {login.nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, c.endpoints.Authorization+"?"+q.Encode(), http.StatusFound)
+}
+
+// handleCallback finishes a login: exchange the code, establish who the
+// user is, check they are allowed and start a session.
+func (c *oidcClient) handleCallback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "Sign-in failed: "+e, http.StatusUnauthorized)
+		return
+	}
+	c.mu.Lock()
+	login, ok := c.pending[q.Get("state")]
+	delete(c.pending, q.Get("state"))
+	c.mu.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		http.Error(w, "Sign-in expired, try again", http.StatusBadRequest)
+		return
+	}
+
+	tok, err := c.exchange(q.Get("code"), login.verifier)
+	if err != nil {
+		slog.Warn("oidc", "err", err)
+		http.Error(w, "Sign-in failed", http.StatusBadGateway)
+		return
+	}
+	var user, email string
+	if c.cfg.Provider == "github" {
+		user, email, err = c.githubUser(tok.AccessToken)
+	} else {
+		user, email, err = c.idTokenUser(tok.IDToken, login.nonce)
+	}
+	if err != nil {
+		slog.Warn("oidc", "err", err)
+		http.Error(w, "Sign-in failed", http.StatusUnauthorized)
+		return
+	}
+	if !c.allowed(user, email) {
+		audit.record("login.denied", map[string]interface{}{"user": user, "remote": clientIP(r)})
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if err := sessions.start(w, user); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit.record("login", map[string]interface{}{"user": user, "remote": clientIP(r)})
+	http.Redirect(w, r, login.next, http.StatusFound)
+}
+
+type oidcTokens struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+	Error       string `json:"error"`
+}
+
+func (c *oidcClient) exchange(code, verifier string) (*oidcTokens, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.cfg.RedirectURL},
+		"client_id":     {c.cfg.ClientID},
+		"client_secret": {c.cfg.secret()},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", c.endpoints.Token, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tok oidcTokens
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tok); err != nil {
+		return nil, fmt.Errorf("token endpoint: %s: %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || tok.Error != "" {
+		return nil, fmt.Errorf("token endpoint: %s %s", resp.Status, tok.Error)
+	}
+	return &tok, nil
+}
+
+// idTokenUser reads the ID token's claims. The token came straight from
+// the token endpoint over TLS, which OIDC Core 3.1.3.7 accepts in place of
+// checking its signature; issuer, audience, expiry and nonce are checked.
+func (c *oidcClient) idTokenUser(idToken, nonce string) (user, email string, err error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return "", "", errors.New("id_token: malformed")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", "", fmt.Errorf("id_token: %w", err)
+	}
+	var claims struct {
+		Issuer        string          `json:"iss"`
+		Subject       string          `json:"sub"`
+		Audience      json.RawMessage `json:"aud"`
+		Expires       int64           `json:"exp"`
+		Nonce         string          `json:"nonce"`
+		Email         string          `json:"email"`
+		EmailVerified bool            `json:"email_verified"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", "", fmt.Errorf("id_token: %w", err)
+	}
+	var aud []string
+	if json.Unmarshal(claims.Audience, &aud) != nil {
+		aud = []string{strings.Trim(string(claims.Audience), `"`)}
+	}
+	switch {
+	case claims.Issuer != c.endpoints.Issuer && "https://"+claims.Issuer != c.endpoints.Issuer: // Google may omit the scheme
+		return "", "", fmt.Errorf("id_token: issuer %q, want %q", claims.Issuer, c.endpoints.Issuer)
+	case !slices.Contains(aud, c.cfg.ClientID):
+		return "", "", errors.New("id_token: not issued for this client")
+	case time.Now().Unix() > claims.Expires:
+		return "", "", errors.New("id_token: expired")
+	case claims.Nonce != nonce:
+		return "", "", errors.New("id_token: nonce mismatch")
+	}
+	// An email the provider doesn't vouch for could be anyone's, so only
+	// one marked verified names the user.
+	if claims.Email != "" && claims.EmailVerified {
+		return claims.Email, claims.Email, nil
+	}
+	return claims.Subject, "", nil
+}
+
+// githubUser looks up the signed-in GitHub account and its primary
+// verified email.
+func (c *oidcClient) githubUser(accessToken string) (user, email string, err error) {
+	get := func(path string, v interface{}) error {
+		req, _ := http.NewRequest("GET", "https://api.github.com"+path, nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		req.Header.Set("Accept", "application/vnd.github+json")
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("github %s: %s", path, resp.Status)
+		}
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+
+	var u struct {
+		Login string `json:"login"`
+	}
+	if err := get("/user", &u); err != nil {
+		return "", "", err
+	}
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if get("/user/emails", &emails) == nil {
+		for _, e := range emails {
+			if e.Primary && e.Verified {
+				email = e.Email
+			}
+		}
+	}
+	return u.Login, email, nil
+}
+
+func (c *oidcClient) allowed(user, email string) bool {
+	if len(c.cfg.AllowedDomains) == 0 && len(c.cfg.AllowedUsers) == 0 {
+		return true
+	}
+	if slices.Contains(c.cfg.AllowedUsers, user) {
+		return true
+	}
+	if _, domain, ok := strings.Cut(email, "@"); ok {
+		return slices.Contains(c.cfg.AllowedDomains, strings.ToLower(domain))
+	}
+	return false
+}
+
+// handleMe tells the UI who is signed in.
+func handleMe(w http.ResponseWriter, r *http.Request) {
+	user := sessions.user(r)
+	if user == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"user": user})
+}
+
+// requireLogin sends browsers without a session to sign in before they
+// load the UI.
+func requireLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sessions.user(r) == "" && r.Method == "GET" && !strings.HasPrefix(r.URL.Path, "/static/") {
+			http.Redirect(w, r, "/auth/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// localPath keeps post-login redirects on this site.
+func localPath(p string) string {
+	if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") || strings.HasPrefix(p, "/\\") {
+		return "/"
+	}
+	return p
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Ollama. Local models need no key, so any apiKey the frontend sends is
+// dropped rather than forwarded. OLLAMA_URL points at a non-default instance.
+func init() {
+	registerProvider(&providerSpec{
+		name:     "ollama",
+		endpoint: envOr("OLLAMA_URL", "http://localhost:11434/api/chat"),
+		dialect:  &ollamaDialect,
+		keyless:  true,
+		build:    buildOllamaRequest,
+	})
+}
+
+func buildOllamaRequest(p *providerSpec, body map[string]interface{}, _ string) (*http.Request, error) {
+	return newJSONRequest(p.Endpoint(), body)
+}
+
+type ollamaChat struct {
+	Model   string `json:"model"`
+	Message struct {
+		Content string `json:"content"`
+	} `json:"message"`
+	Done            bool   `json:"done"`
+	DoneReason      string `json:"done_reason"`
+	PromptEvalCount int    `json:"prompt_eval_count"`
+	EvalCount       int    `json:"eval_count"`
+}
+
+// ollamaMessages is openAIMessages in Ollama's shape, where a message's
+// images are a list of base64 strings beside its text.
+func ollamaMessages(cr *chatRequest) []interface{} {
+	out := make([]interface{}, 0, len(cr.Messages)+1)
+	if cr.System != "" {
+		out = append(out, map[string]interface{}{"role": "system", "content": cr.System})
+	}
+	for _, m := range cr.Messages {
+		msg := map[string]interface{}{"role": m.Role, "content": m.Content}
+		if len(m.images) > 0 {
+			images := make([]string, len(m.images))
+			for i, img := range m.images {
+				images[i] = img.base64()
+			}
+			msg["images"] = images
+		}
+		out = append(out, msg)
+	}
+	return out
+}
+
+var ollamaDialect = chatDialect{
+	schema: ollamaSchema,
+	body: func(cr *chatRequest) map[string]interface{} {
+		options := map[string]interface{}{}
+		setIf(options, "num_predict", cr.MaxTokens, cr.MaxTokens > 0)
+		setIf(options, "temperature", cr.Temperature, cr.Temperature != nil)
+		setIf(options, "top_p", cr.TopP, cr.TopP != nil)
+		setIf(options, "stop", cr.Stop, len(cr.Stop) > 0)
+
+		body := map[string]interface{}{
+			"model":    cr.Model,
+			"messages": ollamaMessages(cr),
+			"stream":   cr.Stream, // Ollama streams unless told otherwise
+		}
+		setIf(body, "options", options, len(options) > 0)
+		setIf(body, "format", cr.OutputSchema, len(cr.OutputSchema) > 0)
+		return body
+	},
+	parse: func(data []byte) (*chatResponse, error) {
+		var r ollamaChat
+		if err := json.Unmarshal(data, &r); err != nil {
+			return nil, err
+		}
+		return &chatResponse{
+			Model:      r.Model,
+			Content:    r.Message.Content,
+			StopReason: r.DoneReason,
+			Usage:      chatUsage{InputTokens: r.PromptEvalCount, OutputTokens: r.EvalCount},
+		}, nil
+	},
+	event: func(s *chatStream, _ string, data []byte) (string, bool) {
+		var r ollamaChat
+		if json.Unmarshal(data, &r) != nil {
+			return "", false
+		}
+		if r.Done {
+			s.stopReason = r.DoneReason
+			s.usage = chatUsage{InputTokens: r.PromptEvalCount, OutputTokens: r.EvalCount}
+		}
+		return r.Message.Content, r.Done
+	},
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+func init() {
+	registerProvider(&providerSpec{
+		name:       "openai",
+		endpoint:   "https://api.openai.com/v1/chat/completions",
+		dialect:    &openAIDialect,
+		embeddings: &openAIEmbeddings,
+		images:     &openAIImages,
+		transcribe: &openAITranscriptions,
+		speech:     &openAISpeech,
+		realtime:   &openAIRealtime,
+		idHeader:   "X-Client-Request-Id",
+		build:      bearerBuild,
+	})
+}
+
+// openAICompatible is the whole definition of a provider that takes an
+// OpenAI-shaped body and a Bearer key, streaming included.
+func openAICompatible(name, endpoint string) *providerSpec {
+	return &providerSpec{name: name, endpoint: endpoint, dialect: &openAIDialect, build: bearerBuild}
+}
+
+// openAIMessages prepends the system prompt as a message. A message with
+// images becomes content parts, its images as data URLs.
+func openAIMessages(cr *chatRequest) []interface{} {
+	out := make([]interface{}, 0, len(cr.Messages)+1)
+	if cr.System != "" {
+		out = append(out, map[string]interface{}{"role": "system", "content": cr.System})
+	}
+	for _, m := range cr.Messages {
+		if msg := openAIToolMessage(m); msg != nil {
+			out = append(out, msg)
+			continue
+		}
+		if len(m.images) == 0 {
+			out = append(out, map[string]interface{}{"role": m.Role, "content": m.Content})
+			continue
+		}
+		parts := make([]interface{}, 0, len(m.images)+1)
+		for _, img := range m.images {
+			parts = append(parts, map[string]interface{}{
+				"type":      "image_url",
+				"image_url": map[string]interface{}{"url": img.dataURL()},
+			})
+		}
+		if m.Content != "" {
+			parts = append(parts, map[string]interface{}{"type": "text", "text": m.Content})
+		}
+		out = append(out, map[string]interface{}{"role": m.Role, "content": parts})
+	}
+	return out
+}
+
+var openAIDialect = chatDialect{
+	schema: openAISchema,
+	body: func(cr *chatRequest) map[string]interface{} {
+		body := map[string]interface{}{
+			"model":    cr.Model,
+			"messages": openAIMessages(cr),
+		}
+		setIf(body, "max_tokens", cr.MaxTokens, cr.MaxTokens > 0)
+		setIf(body, "temperature", cr.Temperature, cr.Temperature != nil)
+		setIf(body, "top_p", cr.TopP, cr.TopP != nil)
+		setIf(body, "stop", cr.Stop, len(cr.Stop) > 0)
+		setIf(body, "stream", true, cr.Stream)
+		setIf(body, "response_format", openAIResponseFormat(cr), len(cr.OutputSchema) > 0)
+		if len(cr.Tools) > 0 {
+			openAITools(body, cr)
+		}
+		if cr.Stream && cr.Provider == "openai" {
+			body["stream_options"] = map[string]interface{}{"include_usage": true}
+		}
+		return body
+	},
+	parse: func(data []byte) (*chatResponse, error) {
+		var r struct {
+			Model   string `json:"model"`
+			Choices []struct {
+				Message struct {
+					Content   string `json:"content"`
+					ToolCalls []struct {
+						ID       string `json:"id"`
+						Function struct {
+							Name      string `json:"name"`
+							Arguments string `json:"arguments"`
+						} `json:"function"`
+					} `json:"tool_calls"`
+				} `json:"message"`
+				FinishReason string `json:"finish_reason"`
+			} `json:"choices"`
+			Usage struct {
+				PromptTokens     int `json:"prompt_tokens"`
+				CompletionTokens int `json:"completion_tokens"`
+			} `json:"usage"`
+		}
+		if err := json.Unmarshal(data, &r); err != nil {
+			return nil, err
+		}
+		out := &chatResponse{Model: r.Model, Usage: chatUsage{InputTokens: r.Usage.PromptTokens, OutputTokens: r.Usage.CompletionTokens}}
+		if len(r.Choices) > 0 {
+			out.Content = r.Choices[0].Message.Content
+			out.StopReason = r.Choices[0].FinishReason
+			for _, c := range r.Choices[0].Message.ToolCalls {
+				out.ToolCalls = append(out.ToolCalls, toolCall{ID: c.ID, Name: c.Function.Name, Arguments: toolArguments([]byte(c.Function.Arguments))})
+			}
+		}
+		return out, nil
+	},
+	event: func(s *chatStream, _ string, data []byte) (string, bool) {
+		if string(data) == "[DONE]" {
+			return "", true
+		}
+		var ev struct {
+			Choices []struct {
+				Delta struct {
+					Content   string `json:"content"`
+					ToolCalls []struct {
+						Index    int    `json:"index"`
+						ID       string `json:"id"`
+						Function struct {
+							Name      string `json:"name"`
+							Arguments string `json:"arguments"`
+						} `json:"function"`
+					} `json:"tool_calls"`
+				} `json:"delta"`
+				FinishReason string `json:"finish_reason"`
+			} `json:"choices"`
+			Usage *struct {
+				PromptTokens     int `json:"prompt_tokens"`
+				CompletionTokens int `json:"completion_tokens"`
+			} `json:"usage"`
+		}
+		if json.Unmarshal(data, &ev) != nil {
+			return "", false
+		}
+		if ev.Usage != nil {
+			s.usage = chatUsage{InputTokens: ev.Usage.PromptTokens, OutputTokens: ev.Usage.CompletionTokens}
+		}
+		if len(ev.Choices) == 0 {
+			return "", false
+		}
+		if ev.Choices[0].FinishReason != "" {
+			s.stopReason = ev.Choices[0].FinishReason
+		}
+		// A call's first delta has its id and name, later ones only more
+		// of its arguments.
+		for _, c := range ev.Choices[0].Delta.ToolCalls {
+			if c.ID != "" {
+				s.startCall(c.ID, c.Function.Name)
+			}
+			s.callDelta(c.Index, c.Function.Arguments)
+		}
+		return ev.Choices[0].Delta.Content, false
+	},
+	tools: true,
+}
+
+var openAIEmbeddings = embeddingDialect{
+	url: func(endpoint string) string {
+		return strings.TrimSuffix(endpoint, "/chat/completions") + "/embeddings"
+	},
+	body: func(er *embeddingRequest) map[string]interface{} {
+		body := map[string]interface{}{"model": er.Model, "input": er.Input}
+		setIf(body, "dimensions", er.Dimensions, er.Dimensions > 0)
+		return body
+	},
+	parse: parseOpenAIEmbeddings,
+}
+
+var openAIImages = imageDialect{
+	url: func(endpoint, _ string) string {
+		return strings.TrimSuffix(endpoint, "/chat/completions") + "/images/generations"
+	},
+	body: func(ir *imageRequest) map[string]interface{} {
+		body := map[string]interface{}{"model": ir.Model, "prompt": ir.Prompt}
+		setIf(body, "n", ir.N, ir.N > 0)
+		setIf(body, "size", ir.Size, ir.Size != "")
+		setIf(body, "quality", ir.Quality, ir.Quality != "")
+		setIf(body, "style", ir.Style, ir.Style != "")
+		// The gpt-image models always return base64 and reject the field.
+		if !strings.HasPrefix(ir.Model, "gpt-image") {
+			body["response_format"] = firstSet(ir.ResponseFormat, "url")
+		}
+		return body
+	},
+	parse: parseOpenAIImages,
+	auth:  func(req *http.Request, apiKey string) { req.Header.Set("Authorization", "Bearer "+apiKey) },
+}
@@ -0,0 +1,29 @@
+package main
+
+import "net/http"
+
+// OpenRouter. Besides the Bearer key, OpenRouter uses HTTP-Referer and
+// X-Title to attribute traffic to an app; they come from "siteUrl" and
+// "siteName" in the body or OPENROUTER_SITE_URL and OPENROUTER_SITE_NAME.
+func init() {
+	p := openAICompatible("openrouter", "https://openrouter.ai/api/v1/chat/completions")
+	p.build = buildOpenRouterRequest
+	registerProvider(p)
+}
+
+func buildOpenRouterRequest(p *providerSpec, body map[string]interface{}, apiKey string) (*http.Request, error) {
+	siteURL := takeString(body, "siteUrl", envOr("OPENROUTER_SITE_URL", ""))
+	siteName := takeString(body, "siteName", envOr("OPENROUTER_SITE_NAME", ""))
+
+	req, err := bearerBuild(p, body, apiKey)
+	if err != nil {
+		return nil, err
+	}
+	if siteURL != "" {
+		req.Header.Set("HTTP-Referer", siteURL)
+	}
+	if siteName != "" {
+		req.Header.Set("X-Title", siteName)
+	}
+	return req, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// OutboundConfig sends upstream calls through a forward proxy, for networks
+// without direct egress. Without it the usual HTTP_PROXY, HTTPS_PROXY and
+// NO_PROXY variables apply.
+type OutboundConfig struct {
+	// Proxy is an http, https or socks5 URL, with credentials as userinfo
+	// if the proxy needs them, or "direct" to ignore the environment.
+	// HTTPS upstreams are reached through a CONNECT tunnel.
+	Proxy string `json:"proxy"`
+	// NoProxy lists hosts, domains (".corp.example" or "corp.example") and
+	// CIDR ranges to reach directly, like NO_PROXY. Loopback always is.
+	NoProxy []string `json:"no_proxy"`
+}
+
+func (c OutboundConfig) validate() []error {
+	if c.Proxy == "" || c.Proxy == "direct" {
+		return nil
+	}
+	u, err := url.Parse(c.Proxy)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") {
+		return []error{fmt.Errorf("outbound.proxy: %q is not an http, https or socks5 URL", redactProxy(c.Proxy))}
+	}
+	return nil
+}
+
+// proxyFunc returns which proxy, if any, to use for each upstream URL.
+func (c OutboundConfig) proxyFunc() func(*url.URL) (*url.URL, error) {
+	switch c.Proxy {
+	case "":
+		return httpproxy.FromEnvironment().ProxyFunc()
+	case "direct":
+		return func(*url.URL) (*url.URL, error) { return nil, nil }
+	}
+	return (&httpproxy.Config{
+		HTTPProxy:  c.Proxy,
+		HTTPSProxy: c.Proxy,
+		NoProxy:    strings.Join(c.NoProxy, ","),
+	}).ProxyFunc()
+}
+
+// outboundProxy is the proxy choice for upstream calls; applyConfig sets it.
+var outboundProxy = OutboundConfig{}.proxyFunc()
+
+func proxyForRequest(r *http.Request) (*url.URL, error) { return outboundProxy(r.URL) }
+
+// redactProxy hides a password in a proxy URL for logs and errors.
+func redactProxy(proxy string) string {
+	if u, err := url.Parse(proxy); err == nil {
+		return u.Redacted()
+	}
+	return proxy
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A reply that does not match output_schema is asked for again this many
+// times by default, and at most maxSchemaRetries times.
+const (
+	defaultSchemaRetries = 2
+	maxSchemaRetries     = 5
+)
+
+// outputSchema compiles the request's output_schema, or returns nil when
+// it has none.
+func (cr *chatRequest) outputSchema() (*jsonSchema, error) {
+	if len(cr.OutputSchema) == 0 || string(cr.OutputSchema) == "null" {
+		return nil, nil
+	}
+	if n := cr.SchemaRetries; n != nil && (*n < 0 || *n > maxSchemaRetries) {
+		return nil, badRequest(fmt.Sprintf("schema_retries: must be between 0 and %d", maxSchemaRetries))
+	}
+	s, err := compileSchema(cr.OutputSchema)
+	if err != nil {
+		return nil, badRequest("output_schema: " + err.Error())
+	}
+	return s, nil
+}
+
+// askForSchema tells the model in the system prompt what to reply with.
+func (cr *chatRequest) askForSchema() {
+	var schema bytes.Buffer
+	json.Compact(&schema, cr.OutputSchema)
+	if cr.System != "" {
+		cr.System += "\n\n"
+	}
+	cr.System += "Reply with only a JSON value, and no other text, that conforms to this JSON Schema:\n" + schema.String()
+}
+
+// structuredTool is the tool Anthropic models are made to call with the
+// structured reply as its input.
+const structuredTool = "structured_output"
+
+// schemaIsObject reports whether the schema describes an object, which is
+// all Anthropic tool input can be.
+func schemaIsObject(raw json.RawMessage) bool {
+	var s struct {
+		Type interface{} `json:"type"`
+	}
+	json.Unmarshal(raw, &s)
+	return s.Type == "object"
+}
+
+// openAIResponseFormat is output_schema as an OpenAI response_format.
+// DeepSeek only has JSON mode, which the schema in the system prompt then
+// steers. The schema is not sent as strict, since strict mode refuses
+// schemas that leave properties optional.
+func openAIResponseFormat(cr *chatRequest) map[string]interface{} {
+	if cr.Provider == "deepseek" {
+		return map[string]interface{}{"type": "json_object"}
+	}
+	return map[string]interface{}{
+		"type":        "json_schema",
+		"json_schema": map[string]interface{}{"name": "output", "schema": cr.OutputSchema},
+	}
+}
+
+// anthropicStructured has the model answer through a tool whose input is
+// the schema, Anthropic's way of getting structured output. Schemas for
+// something other than an object are left to the system prompt.
+func anthropicStructured(body map[string]interface{}, cr *chatRequest) {
+	if !schemaIsObject(cr.OutputSchema) {
+		return
+	}
+	body["tools"] = []interface{}{map[string]interface{}{
+		"name":         structuredTool,
+		"description":  "Give the reply, structured as the schema says.",
+		"input_schema": cr.OutputSchema,
+	}}
+	body["tool_choice"] = map[string]interface{}{"type": "tool", "name": structuredTool}
+}
+
+// schemaMismatch is the error returned when no reply matched the schema.
+type schemaMismatch struct {
+	Error    string    `json:"error"`
+	Type     string    `json:"type"` // always "schema_mismatch"
+	Attempts int       `json:"attempts"`
+	Problems []string  `json:"problems"`
+	Content  string    `json:"content"` // the last reply
+	Usage    chatUsage `json:"usage"`
+}
+
+// enforceSchema checks a reply against the request's output schema. A reply
+// that does not match is shown to the model again with what is wrong with
+// it, up to schema_retries times, on the target that answered. It returns
+// the matching reply, its content trimmed to the JSON, with the usage of
+// every attempt; or nil once it has answered the request itself with a
+// schemaMismatch (422) or a failed retry.
+func enforceSchema(w http.ResponseWriter, r *http.Request, cr *chatRequest, schema *jsonSchema, at ChatTarget, target ChatProvider, apiKey string, out *chatResponse) *chatResponse {
+	retries := defaultSchemaRetries
+	if cr.SchemaRetries != nil {
+		retries = *cr.SchemaRetries
+	}
+	retry := *cr
+	retry.Provider, retry.Model = at.Provider, at.Model
+	retry.Messages = slices.Clone(cr.Messages)
+	total := out.Usage
+	rec := recordFrom(r)
+	for attempt := 1; ; attempt++ {
+		text, v, err := extractJSON(out.Content)
+		var problems []string
+		if err != nil {
+			problems = []string{"$: not valid JSON: " + err.Error()}
+		} else {
+			problems = schema.validate(v)
+		}
+		if len(problems) == 0 {
+			out.Content, out.Usage = text, total
+			rec.setUsage(total)
+			w.Header().Set("X-Schema-Attempts", strconv.Itoa(attempt))
+			return out
+		}
+		if attempt > retries {
+			rec.setUsage(total)
+			writeJSON(w, http.StatusUnprocessableEntity, schemaMismatch{
+				Error:    "Reply did not match output_schema",
+				Type:     "schema_mismatch",
+				Attempts: attempt,
+				Problems: problems,
+				Content:  out.Content,
+				Usage:    total,
+			})
+			return nil
+		}
+
+		retry.Messages = append(retry.Messages,
+			chatMessage{Role: "assistant", Content: out.Content},
+			chatMessage{Role: "user", Content: "That reply does not match the JSON Schema:\n- " + strings.Join(problems, "\n- ") +
+				"\nReply again with only the corrected JSON."})
+		body := target.Dialect().body(&retry)
+		estimated := estimateTokens(body)
+		resp, release, fail := sendChat(w, r, at, target, body, apiKey, estimated)
+		if fail != nil {
+			rec.setUsage(total)
+			fail.write(w)
+			return nil
+		}
+		raw, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		release()
+		if err != nil {
+			rec.setUsage(total)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return nil
+		}
+		next, err := target.Dialect().parse(raw)
+		if err != nil {
+			rec.setUsage(total)
+			http.Error(w, "Unexpected upstream response: "+err.Error(), http.StatusBadGateway)
+			return nil
+		}
+		quotas.settle(target, apiKey, estimated, next.Usage)
+		total.add(next.Usage)
+		out = next
+	}
+}
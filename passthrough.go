@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// PassthroughConfig allowlists upstreams for the generic /proxy route, so a
+// one-off OpenAI-compatible or other HTTP API can be used without a
+// dedicated provider. Requests to /proxy/<host>/<path> go to
+// <scheme>://<host>/<path> when host matches an entry.
+type PassthroughConfig struct {
+	Upstreams []PassthroughUpstream `json:"upstreams"`
+}
+
+// PassthroughUpstream is one allowed host and how requests to it are
+// rewritten.
+type PassthroughUpstream struct {
+	// Host is an exact host[:port], or "*.example.com" for any subdomain.
+	Host string `json:"host"`
+	// Scheme is "https" (the default) or "http".
+	Scheme string `json:"scheme"`
+	// SetHeaders are added to every request, replacing what the client
+	// sent. Values may refer to the environment as ${VAR}, which keeps
+	// keys out of the config.
+	SetHeaders map[string]string `json:"set_headers"`
+	// RemoveHeaders are dropped from client requests.
+	RemoveHeaders []string `json:"remove_headers"`
+}
+
+func (c PassthroughConfig) validate() []error {
+	var errs []error
+	for i, u := range c.Upstreams {
+		if u.Host == "" || strings.ContainsAny(u.Host, "/?#@") ||
+			(strings.HasPrefix(u.Host, "*") && !strings.HasPrefix(u.Host, "*.")) {
+			errs = append(errs, fmt.Errorf("passthrough.upstreams[%d].host: %q is not a host name", i, u.Host))
+		}
+		if u.Scheme != "" && u.Scheme != "https" && u.Scheme != "http" {
+			errs = append(errs, fmt.Errorf("passthrough.upstreams[%d].scheme: %q is not http or https", i, u.Scheme))
+		}
+	}
+	return errs
+}
+
+// upstream returns the entry allowing host, if any.
+func (c PassthroughConfig) upstream(host string) (PassthroughUpstream, bool) {
+	for _, u := range c.Upstreams {
+		if hostMatches(u.Host, host) {
+			return u, true
+		}
+	}
+	return PassthroughUpstream{}, false
+}
+
+// hostMatches reports whether host is pattern, or a subdomain of it when
+// pattern is "*.example.com".
+func hostMatches(pattern, host string) bool {
+	pattern, host = strings.ToLower(pattern), strings.ToLower(host)
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return host == pattern
+}
+
+// validHost reports whether host is a bare host[:port], made only of
+// letters, digits, dots, hyphens and colons.
+func validHost(host string) bool {
+	if host == "" {
+		return false
+	}
+	for _, c := range host {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == ':') {
+			return false
+		}
+	}
+	return true
+}
+
+// hopHeaders are connection-level and never forwarded either way.
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// handlePassthrough relays a request of any method to an allowlisted
+// upstream, streaming the response back. The proxy's own credentials, its
+// access token and session cookie, are not passed on.
+func handlePassthrough(w http.ResponseWriter, r *http.Request) {
+	// The host is taken from the path as sent, so an escaped "#" or "?"
+	// can't end it early once decoded.
+	host, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.EscapedPath(), "/proxy/"), "/")
+	if !validHost(host) {
+		http.Error(w, "Bad upstream host: "+host, http.StatusBadRequest)
+		return
+	}
+	u, ok := config.Passthrough.upstream(host)
+	if !ok {
+		http.Error(w, "Upstream not allowed: "+host, http.StatusForbidden)
+		return
+	}
+	path, err := url.PathUnescape("/" + rest)
+	if err != nil {
+		http.Error(w, "Bad path: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	target := &url.URL{Scheme: firstSet(u.Scheme, "https"), Host: host, Path: path, RawPath: "/" + rest, RawQuery: r.URL.RawQuery}
+
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, target.String(), r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := config.Passthrough.upstream(req.URL.Host); !ok || req.URL.Host != host {
+		http.Error(w, "Upstream not allowed: "+req.URL.Host, http.StatusForbidden)
+		return
+	}
+	req.ContentLength = r.ContentLength
+	req.Header = r.Header.Clone()
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	req.Header.Del("Cookie")
+	if accessTokens != nil {
+		req.Header.Del("Authorization")
+	}
+	for _, h := range u.RemoveHeaders {
+		req.Header.Del(h)
+	}
+	for k, v := range u.SetHeaders {
+		req.Header.Set(k, os.ExpandEnv(v))
+	}
+	if id := requestID(r.Context()); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+
+	ctx, sp := startSpan(req.Context(), "upstream "+host, spanClient)
+	defer sp.end()
+	if sp != nil {
+		req = req.WithContext(ctx)
+		req.Header.Set("traceparent", sp.traceparent())
+	}
+	req, finish := upstreamDeadline(req)
+	resp, err := finish(passthroughClient.Do(req))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		sp.fail(err)
+		switch {
+		case err == errUpstreamTimeout:
+			http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		case errors.As(err, &tooLarge):
+			writeTooLarge(w, tooLarge.Limit)
+		case !clientGone(r.Context()):
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		}
+		return
+	}
+	defer resp.Body.Close()
+	sp.set("http.response.status_code", resp.StatusCode)
+
+	for k, vs := range resp.Header {
+		w.Header()[k] = vs
+	}
+	for _, h := range append(hopHeaders, "Set-Cookie") {
+		w.Header().Del(h)
+	}
+	copyResponse(w, resp)
+}
@@ -0,0 +1,784 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"encoding/ascii85"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// pdfText returns the text of each page of a PDF. It reads what most PDFs
+// hold: content streams plain or Flate, ASCIIHex or ASCII85 encoded,
+// objects packed in object streams, form XObjects, and fonts mapped to
+// Unicode by a ToUnicode CMap or encoded close enough to Latin-1. Layout is
+// approximated from text positioning, and scanned pages have no text to
+// give.
+func pdfText(data []byte) ([]string, error) {
+	if !bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte("%PDF-")) {
+		return nil, errors.New("not a PDF")
+	}
+	if bytes.Contains(data, []byte("/Encrypt")) {
+		return nil, errors.New("encrypted PDFs are not supported")
+	}
+	doc := parsePDF(data)
+	pages := doc.pages()
+	if len(pages) == 0 {
+		return nil, errors.New("no pages found")
+	}
+	out := make([]string, len(pages))
+	for i, p := range pages {
+		var t pdfTextWriter
+		doc.showContent(&t, doc.contents(p.dict), p.resources, 0)
+		out[i] = strings.TrimSpace(t.b.String())
+	}
+	return out, nil
+}
+
+type (
+	pdfRef     struct{ num int }
+	pdfName    string
+	pdfKeyword string
+	pdfDict    map[string]interface{}
+	pdfStream  struct {
+		dict pdfDict
+		data []byte
+	}
+)
+
+type pdfDoc struct {
+	objects map[int]interface{}
+}
+
+var pdfObjectHeader = regexp.MustCompile(`(\d+)\s+\d+\s+obj\b`)
+
+// parsePDF reads every object it can find by scanning for object headers
+// rather than following the cross-reference table, so files with broken
+// offsets still read. A later definition of an object replaces an earlier
+// one, as in an incrementally updated file.
+func parsePDF(data []byte) *pdfDoc {
+	doc := &pdfDoc{objects: map[int]interface{}{}}
+	for _, m := range pdfObjectHeader.FindAllSubmatchIndex(data, -1) {
+		num, _ := strconv.Atoi(string(data[m[2]:m[3]]))
+		l := &pdfLexer{data: data, pos: m[1]}
+		obj, err := l.object()
+		if err != nil {
+			continue
+		}
+		if d, ok := obj.(pdfDict); ok {
+			if s := l.stream(d); s != nil {
+				obj = s
+			}
+		}
+		doc.objects[num] = obj
+	}
+	// Objects in object streams fill in what the scan didn't find.
+	for _, obj := range doc.objects {
+		s, ok := obj.(*pdfStream)
+		if !ok || s.dict["Type"] != pdfName("ObjStm") {
+			continue
+		}
+		body, err := doc.decode(s)
+		if err != nil {
+			continue
+		}
+		n, _ := s.dict["N"].(float64)
+		first, _ := s.dict["First"].(float64)
+		h := &pdfLexer{data: body}
+		for i := 0; i < int(n); i++ {
+			num, _ := h.token()
+			off, _ := h.token()
+			fn, ok1 := num.(float64)
+			fo, ok2 := off.(float64)
+			if !ok1 || !ok2 {
+				break
+			}
+			if _, seen := doc.objects[int(fn)]; seen || int(first+fo) >= len(body) {
+				continue
+			}
+			if obj, err := (&pdfLexer{data: body, pos: int(first + fo)}).object(); err == nil {
+				doc.objects[int(fn)] = obj
+			}
+		}
+	}
+	return doc
+}
+
+// resolve follows references to the object they name.
+func (doc *pdfDoc) resolve(v interface{}) interface{} {
+	for i := 0; i < 16; i++ {
+		ref, ok := v.(pdfRef)
+		if !ok {
+			return v
+		}
+		v = doc.objects[ref.num]
+	}
+	return nil
+}
+
+func (doc *pdfDoc) dict(v interface{}) pdfDict {
+	switch v := doc.resolve(v).(type) {
+	case pdfDict:
+		return v
+	case *pdfStream:
+		return v.dict
+	}
+	return nil
+}
+
+type pdfPage struct {
+	dict      pdfDict
+	resources pdfDict
+}
+
+// pages returns the pages in order, walking the page tree from the
+// catalog, with the resources each inherits.
+func (doc *pdfDoc) pages() []pdfPage {
+	var out []pdfPage
+	seen := map[interface{}]bool{}
+	var walk func(node interface{}, resources pdfDict)
+	walk = func(node interface{}, resources pdfDict) {
+		if ref, ok := node.(pdfRef); ok {
+			if seen[ref] {
+				return
+			}
+			seen[ref] = true
+		}
+		d := doc.dict(node)
+		if d == nil {
+			return
+		}
+		if r := doc.dict(d["Resources"]); r != nil {
+			resources = r
+		}
+		if kids, ok := doc.resolve(d["Kids"]).([]interface{}); ok {
+			for _, k := range kids {
+				walk(k, resources)
+			}
+			return
+		}
+		if d["Type"] == pdfName("Page") || d["Contents"] != nil {
+			out = append(out, pdfPage{d, resources})
+		}
+	}
+	for _, obj := range doc.objects {
+		if d, ok := obj.(pdfDict); ok && d["Type"] == pdfName("Catalog") {
+			walk(d["Pages"], nil)
+			break
+		}
+	}
+	if len(out) > 0 {
+		return out
+	}
+	// Without a usable catalog, take the page objects in number order.
+	var nums []int
+	for num, obj := range doc.objects {
+		if d, ok := obj.(pdfDict); ok && d["Type"] == pdfName("Page") {
+			nums = append(nums, num)
+		}
+	}
+	sort.Ints(nums)
+	for _, num := range nums {
+		d := doc.objects[num].(pdfDict)
+		out = append(out, pdfPage{d, doc.dict(d["Resources"])})
+	}
+	return out
+}
+
+// contents returns a page's content streams, decoded and joined.
+func (doc *pdfDoc) contents(page pdfDict) []byte {
+	var parts []interface{}
+	switch c := doc.resolve(page["Contents"]).(type) {
+	case []interface{}:
+		parts = c
+	case *pdfStream:
+		parts = []interface{}{c}
+	}
+	var b bytes.Buffer
+	for _, p := range parts {
+		if s, ok := doc.resolve(p).(*pdfStream); ok {
+			if data, err := doc.decode(s); err == nil {
+				b.Write(data)
+				b.WriteByte('\n')
+			}
+		}
+	}
+	return b.Bytes()
+}
+
+// decode applies a stream's filters.
+func (doc *pdfDoc) decode(s *pdfStream) ([]byte, error) {
+	var filters []interface{}
+	switch f := doc.resolve(s.dict["Filter"]).(type) {
+	case pdfName:
+		filters = []interface{}{f}
+	case []interface{}:
+		filters = f
+	}
+	data := s.data
+	for _, f := range filters {
+		var err error
+		switch doc.resolve(f) {
+		case pdfName("FlateDecode"), pdfName("Fl"):
+			var zr io.ReadCloser
+			if zr, err = zlib.NewReader(bytes.NewReader(data)); err != nil {
+				zr = flate.NewReader(bytes.NewReader(data))
+			}
+			// Truncated streams are common; keep what decompressed.
+			data, err = io.ReadAll(zr)
+			if len(data) > 0 {
+				err = nil
+			}
+		case pdfName("ASCIIHexDecode"), pdfName("AHx"):
+			data = pdfHex(bytes.TrimSuffix(bytes.TrimSpace(data), []byte(">")))
+		case pdfName("ASCII85Decode"), pdfName("A85"):
+			text := bytes.TrimSuffix(bytes.TrimSpace(data), []byte("~>"))
+			out := make([]byte, 4*len(text))
+			var n int
+			n, _, err = ascii85.Decode(out, text, true)
+			data = out[:n]
+		default:
+			return nil, fmt.Errorf("unsupported filter %v", f)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// pdfFont maps a font's character codes to text.
+type pdfFont struct {
+	cmap    map[string]string
+	lengths []int // code lengths in the cmap, shortest first
+	wide    bool  // two-byte codes with no ToUnicode map
+}
+
+func (doc *pdfDoc) font(resources pdfDict, name pdfName, cache map[pdfName]*pdfFont) *pdfFont {
+	if f, ok := cache[name]; ok {
+		return f
+	}
+	f := &pdfFont{}
+	if fd := doc.dict(doc.dict(resources["Font"])[string(name)]); fd != nil {
+		if s, ok := doc.resolve(fd["ToUnicode"]).(*pdfStream); ok {
+			if data, err := doc.decode(s); err == nil {
+				f.cmap, f.lengths = parseCMap(data)
+			}
+		}
+		f.wide = fd["Subtype"] == pdfName("Type0")
+	}
+	cache[name] = f
+	return f
+}
+
+// text decodes a string shown in the font.
+func (f *pdfFont) text(s []byte) string {
+	if f.cmap == nil {
+		if f.wide {
+			return "" // glyph IDs, with nothing to map them to
+		}
+		var b strings.Builder
+		for _, c := range s {
+			if r, ok := winAnsi[c]; ok {
+				b.WriteRune(r)
+			} else if c >= 0x20 {
+				b.WriteRune(rune(c))
+			}
+		}
+		return b.String()
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		step := f.lengths[0]
+		for _, n := range f.lengths {
+			if i+n <= len(s) {
+				if t, ok := f.cmap[string(s[i:i+n])]; ok {
+					b.WriteString(t)
+					step = n
+					break
+				}
+			}
+		}
+		i += step
+	}
+	return b.String()
+}
+
+// winAnsi is where WinAnsiEncoding differs from Latin-1.
+var winAnsi = map[byte]rune{
+	0x80: '€', 0x85: '…', 0x91: '‘', 0x92: '’', 0x93: '“', 0x94: '”',
+	0x95: '•', 0x96: '–', 0x97: '—', 0x99: '™', 0xa0: ' ',
+}
+
+// parseCMap reads the bfchar and bfrange mappings of a ToUnicode CMap.
+func parseCMap(data []byte) (map[string]string, []int) {
+	m := map[string]string{}
+	lengths := map[int]bool{}
+	l := &pdfLexer{data: data}
+	var operands []interface{}
+	for {
+		obj, err := l.object()
+		if err != nil {
+			break
+		}
+		kw, ok := obj.(pdfKeyword)
+		if !ok {
+			operands = append(operands, obj)
+			continue
+		}
+		switch kw {
+		case "endcodespacerange":
+			for i := 0; i+1 < len(operands); i += 2 {
+				if lo, ok := operands[i].([]byte); ok && len(lo) > 0 {
+					lengths[len(lo)] = true
+				}
+			}
+		case "endbfchar":
+			for i := 0; i+1 < len(operands); i += 2 {
+				src, ok1 := operands[i].([]byte)
+				dst, ok2 := operands[i+1].([]byte)
+				if ok1 && ok2 && len(src) > 0 {
+					m[string(src)] = utf16Text(dst)
+					lengths[len(src)] = true
+				}
+			}
+		case "endbfrange":
+			for i := 0; i+2 < len(operands); i += 3 {
+				lo, ok1 := operands[i].([]byte)
+				hi, ok2 := operands[i+1].([]byte)
+				if !ok1 || !ok2 || len(lo) == 0 || len(lo) != len(hi) {
+					continue
+				}
+				lengths[len(lo)] = true
+				start, end := beUint(lo), beUint(hi)
+				for c := start; c <= end && c-start < 1<<16; c++ {
+					code := make([]byte, len(lo))
+					for j, v := len(code)-1, c; j >= 0; j, v = j-1, v>>8 {
+						code[j] = byte(v)
+					}
+					switch dst := operands[i+2].(type) {
+					case []byte:
+						r := []rune(utf16Text(dst))
+						if len(r) > 0 {
+							r[len(r)-1] += rune(c - start)
+						}
+						m[string(code)] = string(r)
+					case []interface{}:
+						if k := int(c - start); k < len(dst) {
+							if s, ok := dst[k].([]byte); ok {
+								m[string(code)] = utf16Text(s)
+							}
+						}
+					}
+				}
+			}
+		}
+		operands = operands[:0]
+	}
+	var ls []int
+	for n := range lengths {
+		ls = append(ls, n)
+	}
+	sort.Ints(ls)
+	if len(ls) == 0 {
+		ls = []int{1}
+	}
+	return m, ls
+}
+
+func beUint(b []byte) uint32 {
+	var v uint32
+	for _, c := range b {
+		v = v<<8 | uint32(c)
+	}
+	return v
+}
+
+func utf16Text(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+	}
+	return string(utf16.Decode(u))
+}
+
+// pdfTextWriter collects shown text, keeping one space or line break
+// between runs.
+type pdfTextWriter struct {
+	b       strings.Builder
+	lastY   float64
+	tracked bool
+}
+
+func (t *pdfTextWriter) write(s string) { t.b.WriteString(s) }
+
+func (t *pdfTextWriter) breakWith(sep string) {
+	s := t.b.String()
+	if s == "" || strings.HasSuffix(s, "\n") || (sep == " " && strings.HasSuffix(s, " ")) {
+		return
+	}
+	t.b.WriteString(sep)
+}
+
+// showContent runs a content stream's text operators, and those of the
+// form XObjects it draws.
+func (doc *pdfDoc) showContent(t *pdfTextWriter, content []byte, resources pdfDict, depth int) {
+	fonts := map[pdfName]*pdfFont{}
+	font := &pdfFont{}
+	l := &pdfLexer{data: content}
+	var operands []interface{}
+	for {
+		obj, err := l.object()
+		if err != nil {
+			return
+		}
+		op, ok := obj.(pdfKeyword)
+		if !ok {
+			operands = append(operands, obj)
+			continue
+		}
+		num := func(i int) float64 {
+			if i < len(operands) {
+				f, _ := operands[i].(float64)
+				return f
+			}
+			return 0
+		}
+		switch op {
+		case "Tf":
+			if len(operands) > 0 {
+				if name, ok := operands[0].(pdfName); ok {
+					font = doc.font(resources, name, fonts)
+				}
+			}
+		case "Tj", "'", `"`:
+			if op != "Tj" {
+				t.breakWith("\n")
+			}
+			if len(operands) > 0 {
+				if s, ok := operands[len(operands)-1].([]byte); ok {
+					t.write(font.text(s))
+				}
+			}
+		case "TJ":
+			if len(operands) > 0 {
+				arr, _ := operands[0].([]interface{})
+				for _, v := range arr {
+					switch v := v.(type) {
+					case []byte:
+						t.write(font.text(v))
+					case float64:
+						if v < -200 {
+							t.breakWith(" ")
+						}
+					}
+				}
+			}
+		case "Td", "TD":
+			if num(1) != 0 {
+				t.breakWith("\n")
+			} else {
+				t.breakWith(" ")
+			}
+		case "T*":
+			t.breakWith("\n")
+		case "Tm":
+			if y := num(5); t.tracked && y != t.lastY {
+				t.breakWith("\n")
+			} else {
+				t.breakWith(" ")
+			}
+			t.lastY, t.tracked = num(5), true
+		case "ET":
+			t.breakWith(" ")
+		case "ID":
+			l.skipInlineImage()
+		case "Do":
+			if len(operands) == 0 || depth >= 8 {
+				break
+			}
+			name, _ := operands[0].(pdfName)
+			xobj, ok := doc.resolve(doc.dict(resources["XObject"])[string(name)]).(*pdfStream)
+			if !ok || xobj.dict["Subtype"] != pdfName("Form") {
+				break
+			}
+			if data, err := doc.decode(xobj); err == nil {
+				res := doc.dict(xobj.dict["Resources"])
+				if res == nil {
+					res = resources
+				}
+				doc.showContent(t, data, res, depth+1)
+			}
+		}
+		operands = operands[:0]
+	}
+}
+
+// pdfLexer reads PDF objects and content stream tokens.
+type pdfLexer struct {
+	data []byte
+	pos  int
+}
+
+func pdfSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func pdfDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+func (l *pdfLexer) skipSpace() {
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		if c == '%' {
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+		} else if !pdfSpace(c) {
+			return
+		}
+		l.pos++
+	}
+}
+
+// token returns the next number (float64), name, string ([]byte) or
+// keyword, delimiters included.
+func (l *pdfLexer) token() (interface{}, bool) {
+	l.skipSpace()
+	if l.pos >= len(l.data) {
+		return nil, false
+	}
+	d := l.data
+	start := l.pos
+	switch c := d[l.pos]; {
+	case c == '(':
+		return l.literal(), true
+	case c == '<' && l.pos+1 < len(d) && d[l.pos+1] == '<', c == '>' && l.pos+1 < len(d) && d[l.pos+1] == '>':
+		l.pos += 2
+		return pdfKeyword(d[start:l.pos]), true
+	case c == '<':
+		end := bytes.IndexByte(d[l.pos:], '>')
+		if end < 0 {
+			end = len(d) - l.pos
+		}
+		l.pos += end + 1
+		return pdfHex(d[start+1 : min(start+end, len(d))]), true
+	case c == '[' || c == ']' || c == '{' || c == '}' || c == ')' || c == '>':
+		l.pos++
+		return pdfKeyword(d[start:l.pos]), true
+	case c == '/':
+		l.pos++
+		for l.pos < len(d) && !pdfSpace(d[l.pos]) && !pdfDelimiter(d[l.pos]) {
+			l.pos++
+		}
+		return pdfName(unescapeName(d[start+1 : l.pos])), true
+	}
+	for l.pos < len(d) && !pdfSpace(d[l.pos]) && !pdfDelimiter(d[l.pos]) {
+		l.pos++
+	}
+	word := string(d[start:l.pos])
+	if f, err := strconv.ParseFloat(word, 64); err == nil {
+		return f, true
+	}
+	return pdfKeyword(word), true
+}
+
+func (l *pdfLexer) literal() []byte {
+	d := l.data
+	l.pos++
+	var out []byte
+	for depth := 1; l.pos < len(d); l.pos++ {
+		c := d[l.pos]
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				l.pos++
+				return out
+			}
+		case '\\':
+			l.pos++
+			if l.pos >= len(d) {
+				return out
+			}
+			switch e := d[l.pos]; e {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				if l.pos+1 < len(d) && d[l.pos+1] == '\n' {
+					l.pos++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if e >= '0' && e <= '7' {
+					v := 0
+					for n := 0; n < 3 && l.pos < len(d) && d[l.pos] >= '0' && d[l.pos] <= '7'; n++ {
+						v = v*8 + int(d[l.pos]-'0')
+						l.pos++
+					}
+					l.pos--
+					c = byte(v)
+				} else {
+					c = e
+				}
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func pdfHex(b []byte) []byte {
+	digits := make([]byte, 0, len(b))
+	for _, c := range b {
+		if !pdfSpace(c) {
+			digits = append(digits, c)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	out, _ := hex.DecodeString(string(digits))
+	return out
+}
+
+func unescapeName(b []byte) string {
+	if bytes.IndexByte(b, '#') < 0 {
+		return string(b)
+	}
+	var out []byte
+	for i := 0; i < len(b); i++ {
+		if b[i] == '#' && i+2 < len(b) {
+			if v, err := strconv.ParseUint(string(b[i+1:i+3]), 16, 8); err == nil {
+				out = append(out, byte(v))
+				i += 2
+				continue
+			}
+		}
+		out = append(out, b[i])
+	}
+	return string(out)
+}
+
+// object reads one object: a dictionary, array, reference or single
+// token. Keywords other than true, false and null come back as they are,
+// which is how content stream operators are read.
+func (l *pdfLexer) object() (interface{}, error) {
+	tok, ok := l.token()
+	if !ok {
+		return nil, io.ErrUnexpectedEOF
+	}
+	switch t := tok.(type) {
+	case pdfKeyword:
+		switch t {
+		case "<<":
+			d := pdfDict{}
+			for {
+				k, err := l.object()
+				if err != nil {
+					return nil, err
+				}
+				if k == pdfKeyword(">>") {
+					return d, nil
+				}
+				name, ok := k.(pdfName)
+				if !ok {
+					continue
+				}
+				v, err := l.object()
+				if err != nil {
+					return nil, err
+				}
+				d[string(name)] = v
+			}
+		case "[":
+			var arr []interface{}
+			for {
+				v, err := l.object()
+				if err != nil {
+					return nil, err
+				}
+				if v == pdfKeyword("]") {
+					return arr, nil
+				}
+				arr = append(arr, v)
+			}
+		case "true", "false":
+			return t == "true", nil
+		case "null":
+			return nil, nil
+		}
+	case float64:
+		// "n g R" is a reference.
+		save := l.pos
+		if g, ok := l.token(); ok {
+			if _, num := g.(float64); num {
+				if r, ok := l.token(); ok && r == pdfKeyword("R") {
+					return pdfRef{int(t)}, nil
+				}
+			}
+		}
+		l.pos = save
+	}
+	return tok, nil
+}
+
+// stream reads the stream data following a dictionary, if there is one.
+func (l *pdfLexer) stream(d pdfDict) *pdfStream {
+	save := l.pos
+	if tok, ok := l.token(); !ok || tok != pdfKeyword("stream") {
+		l.pos = save
+		return nil
+	}
+	data := l.data
+	if l.pos < len(data) && data[l.pos] == '\r' {
+		l.pos++
+	}
+	if l.pos < len(data) && data[l.pos] == '\n' {
+		l.pos++
+	}
+	start := l.pos
+	if n, ok := d["Length"].(float64); ok && start+int(n) <= len(data) {
+		if rest := bytes.TrimLeft(data[start+int(n):], " \r\n"); bytes.HasPrefix(rest, []byte("endstream")) {
+			return &pdfStream{d, data[start : start+int(n)]}
+		}
+	}
+	end := bytes.Index(data[start:], []byte("endstream"))
+	if end < 0 {
+		return &pdfStream{d, data[start:]}
+	}
+	return &pdfStream{d, bytes.TrimRight(data[start:start+end], "\r\n")}
+}
+
+// skipInlineImage moves past an inline image's data, which follows its ID
+// operator and runs to EI.
+func (l *pdfLexer) skipInlineImage() {
+	d := l.data
+	for i := l.pos + 1; i+2 <= len(d); i++ {
+		if d[i] == 'E' && d[i+1] == 'I' && pdfSpace(d[i-1]) && (i+2 == len(d) || pdfSpace(d[i+2])) {
+			l.pos = i + 2
+			return
+		}
+	}
+	l.pos = len(d)
+}
@@ -0,0 +1,8 @@
+package main
+
+// Perplexity. Responses are relayed byte for byte, so the citations and
+// search_results fields (top-level in both buffered and streamed chunks)
+// reach the client intact.
+func init() {
+	registerProvider(openAICompatible("perplexity", "https://api.perplexity.ai/chat/completions"))
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PIIConfig handles personal data in prompts before they leave the proxy.
+type PIIConfig struct {
+	// Mode is "detect" (report only), "redact" (replace with the kind, e.g.
+	// [EMAIL]) or "tokenize" (replace with numbered tokens such as
+	// [EMAIL_1] and put the originals back in the reply). Empty turns it off.
+	Mode string `json:"mode"`
+	// Detect lists the kinds to look for: email, phone, credit_card and
+	// national_id. Empty looks for all of them.
+	Detect []string `json:"detect"`
+}
+
+func (c PIIConfig) validate() []error {
+	var errs []error
+	switch c.Mode {
+	case "", "detect", "redact", "tokenize":
+	default:
+		errs = append(errs, fmt.Errorf("pii.mode: %q is not detect, redact or tokenize", c.Mode))
+	}
+	for i, kind := range c.Detect {
+		if piiDetectorFor(kind) == nil {
+			errs = append(errs, fmt.Errorf("pii.detect[%d]: %q is not email, phone, credit_card or national_id", i, kind))
+		}
+	}
+	return errs
+}
+
+// piiDetector finds one kind of personal data. valid, when set, weeds out
+// matches that only look the part.
+type piiDetector struct {
+	kind  string
+	re    *regexp.Regexp
+	valid func(string) bool
+}
+
+// piiDetectors run in this order, so card numbers and IDs are claimed
+// before the looser phone pattern sees their digits.
+var piiDetectors = []*piiDetector{
+	{"email", regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`), nil},
+	{"credit_card", regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`), luhnValid},
+	// US social security and UK national insurance numbers.
+	{"national_id", regexp.MustCompile(`\b(?:\d{3}-\d{2}-\d{4}|[A-CEGHJ-PR-TW-Z]{2} ?\d{2} ?\d{2} ?\d{2} ?[A-D])\b`), nationalIDValid},
+	{"phone", regexp.MustCompile(`(?:\+\d{1,3}[ .-]?|\b)(?:\(\d{1,4}\)[ .-]?)?\d{2,4}(?:[ .-]?\d{2,4}){1,4}\b`), phoneValid},
+}
+
+func piiDetectorFor(kind string) *piiDetector {
+	for _, d := range piiDetectors {
+		if d.kind == kind {
+			return d
+		}
+	}
+	return nil
+}
+
+func digitsOf(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if '0' <= c && c <= '9' {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+func luhnValid(s string) bool {
+	digits := digitsOf(s)
+	sum := 0
+	for i := range digits {
+		d := int(digits[len(digits)-1-i] - '0')
+		if i%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+// nationalIDValid drops social security numbers that are never issued.
+func nationalIDValid(s string) bool {
+	if len(s) != 11 || s[3] != '-' {
+		return true // a national insurance number
+	}
+	area, group, serial := s[:3], s[4:6], s[7:]
+	return area != "000" && area != "666" && area[0] != '9' && group != "00" && serial != "0000"
+}
+
+// phoneValid wants as many digits as an international number has.
+func phoneValid(s string) bool {
+	n := len(digitsOf(s))
+	return n >= 9 && n <= 15
+}
+
+// piiPolicy is the configured handling, or nil when it is off.
+type piiPolicy struct {
+	mode      string
+	detectors []*piiDetector
+}
+
+var piiHandling *piiPolicy
+
+func newPIIPolicy(c PIIConfig) *piiPolicy {
+	if c.Mode == "" {
+		return nil
+	}
+	p := &piiPolicy{mode: c.Mode}
+	for _, d := range piiDetectors {
+		if len(c.Detect) == 0 || slices.Contains(c.Detect, d.kind) {
+			p.detectors = append(p.detectors, d)
+		}
+	}
+	return p
+}
+
+// piiTokens maps the tokens sent upstream in place of personal data back to
+// the originals, for one request.
+type piiTokens struct {
+	token    map[string]string // original → token
+	original map[string]string // token → original
+	counts   map[string]int
+}
+
+func (t *piiTokens) tokenFor(kind, value string) string {
+	if tok, ok := t.token[value]; ok {
+		return tok
+	}
+	t.counts[kind]++
+	tok := "[" + strings.ToUpper(kind) + "_" + strconv.Itoa(t.counts[kind]) + "]"
+	t.token[value], t.original[tok] = tok, value
+	return tok
+}
+
+// restore puts the originals back in text.
+func (t *piiTokens) restore(text string) string {
+	if t == nil || len(t.original) == 0 {
+		return text
+	}
+	pairs := make([]string, 0, 2*len(t.original))
+	for tok, value := range t.original {
+		pairs = append(pairs, tok, value)
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+// scrub applies the policy to text, adding the kinds found to found.
+func (p *piiPolicy) scrub(text string, tokens *piiTokens, found map[string]bool) string {
+	for _, d := range p.detectors {
+		text = d.re.ReplaceAllStringFunc(text, func(m string) string {
+			if d.valid != nil && !d.valid(m) {
+				return m
+			}
+			found[d.kind] = true
+			switch p.mode {
+			case "redact":
+				return "[" + strings.ToUpper(d.kind) + "]"
+			case "tokenize":
+				return tokens.tokenFor(d.kind, m)
+			}
+			return m
+		})
+	}
+	return text
+}
+
+// scrubPII applies the PII policy to a chat request's system prompt and
+// messages, conversation history included, and notes the kinds found in
+// X-PII-Detected and the request log. It returns the tokens to restore in
+// the reply, or nil when nothing was tokenized.
+func scrubPII(w http.ResponseWriter, r *http.Request, cr *chatRequest) *piiTokens {
+	if piiHandling == nil {
+		return nil
+	}
+	tokens := &piiTokens{token: map[string]string{}, original: map[string]string{}, counts: map[string]int{}}
+	found := map[string]bool{}
+	cr.System = piiHandling.scrub(cr.System, tokens, found)
+	for i := range cr.Messages {
+		cr.Messages[i].Content = piiHandling.scrub(cr.Messages[i].Content, tokens, found)
+	}
+	if !notePII(w, r, found) || len(tokens.original) == 0 {
+		return nil
+	}
+	return tokens
+}
+
+// scrubBodies applies the PII policy to the prompt text of raw provider
+// bodies. Their replies are relayed as they come, so tokens are not put
+// back.
+func scrubBodies(w http.ResponseWriter, r *http.Request, bodies []map[string]interface{}) {
+	if piiHandling == nil {
+		return
+	}
+	tokens := &piiTokens{token: map[string]string{}, original: map[string]string{}, counts: map[string]int{}}
+	found := map[string]bool{}
+	for _, body := range bodies {
+		rewritePrompt(body, func(text string) string {
+			return piiHandling.scrub(text, tokens, found)
+		})
+	}
+	notePII(w, r, found)
+}
+
+// notePII notes the kinds found in X-PII-Detected and the request log,
+// reporting whether there were any.
+func notePII(w http.ResponseWriter, r *http.Request, found map[string]bool) bool {
+	if len(found) == 0 {
+		return false
+	}
+	kinds := make([]string, 0, len(found))
+	for k := range found {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	recordFrom(r).PII = strings.Join(kinds, ",")
+	w.Header().Set("X-PII-Detected", recordFrom(r).PII)
+	return true
+}
+
+// maxPIIToken is the longest token restore may have to wait for.
+const maxPIIToken = len("[CREDIT_CARD_9999]")
+
+// piiRestorer puts tokenized values back into a streamed reply, holding
+// back what may be the start of a token split across deltas.
+type piiRestorer struct {
+	tokens *piiTokens
+	held   string
+}
+
+func (p *piiRestorer) feed(text string) (string, bool) {
+	text = p.held + text
+	p.held = ""
+	if i := strings.LastIndexByte(text, '['); i >= 0 && !strings.Contains(text[i:], "]") && len(text)-i < maxPIIToken {
+		text, p.held = text[:i], text[i:]
+	}
+	return p.tokens.restore(text), false
+}
+
+func (p *piiRestorer) flush() (string, bool) {
+	held := p.held
+	p.held = ""
+	return p.tokens.restore(held), false
+}
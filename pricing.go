@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ModelPrice is what a model costs in US dollars per million tokens.
+type ModelPrice struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+// Prompt tokens written to Anthropic's cache cost a quarter more than
+// input tokens, and those read from it a tenth as much.
+const (
+	cacheWriteMultiplier = 1.25
+	cacheReadMultiplier  = 0.1
+)
+
+// defaultPricing holds list prices for common models, keyed by model name
+// prefix so dated snapshots match their family. [pricing] in the config
+// adds to and overrides it. Prices change; treat costs as estimates.
+var defaultPricing = map[string]ModelPrice{
+	// Anthropic
+	"claude-opus-4":     {15, 75},
+	"claude-sonnet-4":   {3, 15},
+	"claude-haiku-4":    {1, 5},
+	"claude-3-7-sonnet": {3, 15},
+	"claude-3-5-sonnet": {3, 15},
+	"claude-3-5-haiku":  {0.8, 4},
+	"claude-3-opus":     {15, 75},
+	"claude-3-haiku":    {0.25, 1.25},
+
+	// OpenAI
+	"gpt-5":         {1.25, 10},
+	"gpt-5-mini":    {0.25, 2},
+	"gpt-5-nano":    {0.05, 0.4},
+	"gpt-4.1":       {2, 8},
+	"gpt-4.1-mini":  {0.4, 1.6},
+	"gpt-4.1-nano":  {0.1, 0.4},
+	"gpt-4o":        {2.5, 10},
+	"gpt-4o-mini":   {0.15, 0.6},
+	"gpt-4-turbo":   {10, 30},
+	"gpt-4":         {30, 60},
+	"gpt-3.5-turbo": {0.5, 1.5},
+	"o1":            {15, 60},
+	"o3":            {2, 8},
+	"o3-mini":       {1.1, 4.4},
+	"o4-mini":       {1.1, 4.4},
+
+	// Google
+	"gemini-2.5-pro":   {1.25, 10},
+	"gemini-2.5-flash": {0.3, 2.5},
+	"gemini-2.0-flash": {0.1, 0.4},
+	"gemini-1.5-pro":   {1.25, 5},
+	"gemini-1.5-flash": {0.075, 0.3},
+
+	// Embeddings
+	"text-embedding-3-small": {0.02, 0},
+	"text-embedding-3-large": {0.13, 0},
+	"text-embedding-ada-002": {0.1, 0},
+	"embed-v4.0":             {0.12, 0},
+	"embed-english-v3.0":     {0.1, 0},
+	"embed-multilingual":     {0.1, 0},
+	"voyage-3-large":         {0.18, 0},
+	"voyage-3.5":             {0.06, 0},
+	"voyage-3.5-lite":        {0.02, 0},
+	"voyage-3":               {0.06, 0},
+	"voyage-3-lite":          {0.02, 0},
+	"voyage-code-3":          {0.18, 0},
+
+	// Image generation billed by token; DALL·E and Imagen bill per image
+	"gpt-image-1": {5, 40},
+
+	// Others
+	"mistral-large":        {2, 6},
+	"mistral-small":        {0.2, 0.6},
+	"command-r-plus":       {2.5, 10},
+	"command-r":            {0.15, 0.6},
+	"deepseek-chat":        {0.27, 1.1},
+	"deepseek-reasoner":    {0.55, 2.19},
+	"grok-2":               {2, 10},
+	"grok-3":               {3, 15},
+	"llama-3.1-8b-instant": {0.05, 0.08},
+	"sonar-pro":            {3, 15},
+	"sonar":                {1, 1},
+}
+
+// modelPrice finds the price for model, matching the longest known prefix.
+// Vendor prefixes used by gateways ("anthropic/", "us.anthropic.") are
+// ignored. Local models are free.
+func modelPrice(provider, model string) (ModelPrice, bool) {
+	if provider == "ollama" {
+		return ModelPrice{}, true
+	}
+	if i := strings.LastIndexByte(model, '/'); i >= 0 {
+		model = model[i+1:]
+	}
+	for _, vendor := range []string{"anthropic.", "meta.", "mistral.", "cohere."} {
+		if i := strings.Index(model, vendor); i >= 0 {
+			model = model[i+len(vendor):]
+		}
+	}
+
+	best, found := "", false
+	var price ModelPrice
+	for _, table := range []map[string]ModelPrice{defaultPricing, config.Pricing} {
+		for prefix, p := range table {
+			if strings.HasPrefix(model, prefix) && len(prefix) >= len(best) {
+				best, price, found = prefix, p, true
+			}
+		}
+	}
+	return price, found
+}
+
+// estimateCost prices usage for model, reporting false when the model is
+// not in the pricing table.
+func estimateCost(provider, model string, u chatUsage) (float64, bool) {
+	price, ok := modelPrice(provider, model)
+	if !ok {
+		return 0, false
+	}
+	input := float64(u.InputTokens) + cacheWriteMultiplier*float64(u.CacheCreationInputTokens) + cacheReadMultiplier*float64(u.CacheReadInputTokens)
+	return (input*price.Input + float64(u.OutputTokens)*price.Output) / 1e6, true
+}
+
+// costHeader is set on responses when cost_headers is on: as a header when
+// usage is known in time, otherwise as a trailer.
+const costHeader = "X-Cost-USD"
+
+func formatCost(cost float64) string {
+	return strconv.FormatFloat(cost, 'f', 6, 64)
+}
+
+// setCostHeader adds the cost of a buffered /api/chat reply up front.
+func setCostHeader(w http.ResponseWriter, provider, model string, u chatUsage) {
+	if !config.CostHeaders {
+		return
+	}
+	if cost, ok := estimateCost(provider, model, u); ok {
+		w.Header().Set(costHeader, formatCost(cost))
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// PromptCacheConfig sets up Anthropic prompt caching for clients that
+// don't mark cache breakpoints themselves. With AutoSystem, a system
+// prompt of about MinTokens (1024 by default, Anthropic's smallest
+// cacheable prefix) or more is marked for caching when the request marks
+// nothing, so repeated long prompts are billed at the cache read price.
+type PromptCacheConfig struct {
+	AutoSystem bool `json:"auto_system"`
+	MinTokens  int  `json:"min_tokens"`
+}
+
+func (c PromptCacheConfig) validate() []error {
+	if c.MinTokens < 0 {
+		return []error{errors.New("prompt_cache.min_tokens: must not be negative")}
+	}
+	return nil
+}
+
+func (c PromptCacheConfig) minTokens() int {
+	if c.MinTokens > 0 {
+		return c.MinTokens
+	}
+	return 1024
+}
+
+// ephemeral is Anthropic's one kind of cache breakpoint, kept five minutes.
+var ephemeral = json.RawMessage(`{"type":"ephemeral"}`)
+
+// cachedText is text as a one-block content list ending a cached prefix.
+func cachedText(text string, cacheControl json.RawMessage) []interface{} {
+	return []interface{}{map[string]interface{}{"type": "text", "text": text, "cache_control": cacheControl}}
+}
+
+// cacheLastBlock puts cacheControl, if set, on the last of blocks.
+func cacheLastBlock(blocks []interface{}, cacheControl json.RawMessage) []interface{} {
+	if len(cacheControl) > 0 && len(blocks) > 0 {
+		blocks[len(blocks)-1].(map[string]interface{})["cache_control"] = cacheControl
+	}
+	return blocks
+}
+
+// autoCacheSystem marks a messages body's system prompt for caching when
+// prompt_cache.auto_system is on, the prompt is long enough and the body
+// has no breakpoints of its own, which Anthropic caps at four.
+func autoCacheSystem(body map[string]interface{}) {
+	pc := config.PromptCache
+	if !pc.AutoSystem {
+		return
+	}
+	system, ok := body["system"].(string)
+	if !ok || estimatedCount(system) < pc.minTokens() {
+		return
+	}
+	raw, _ := json.Marshal(body)
+	if strings.Contains(string(raw), `"cache_control"`) {
+		return
+	}
+	body["system"] = cachedText(system, ephemeral)
+}
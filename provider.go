@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// Provider is one upstream API. Each provider lives in its own file and
+// registers itself from init, which mounts it at /api/<Name> and makes it
+// selectable on /api/chat.
+type Provider interface {
+	Name() string
+	// Endpoint is the upstream URL, or URL template for providers whose
+	// host or path depends on the request.
+	Endpoint() string
+	// BuildRequest turns a decoded client body into an upstream request.
+	// apiKey is empty for providers that don't require one.
+	BuildRequest(body map[string]interface{}, apiKey string) (*http.Request, error)
+	// TransformResponse adjusts an upstream response in place before it is
+	// relayed, e.g. re-encoding a proprietary stream format as SSE.
+	TransformResponse(resp *http.Response) error
+	SupportsStreaming() bool
+	// RequiresKey is false for local providers and those that sign
+	// requests with server-side credentials.
+	RequiresKey() bool
+}
+
+// ChatProvider is a Provider that /api/chat can translate to.
+type ChatProvider interface {
+	Provider
+	Dialect() *chatDialect
+}
+
+var providers = map[string]Provider{}
+
+// registerProvider adds p to the registry. Names must be unique.
+func registerProvider(p Provider) {
+	if _, dup := providers[p.Name()]; dup {
+		panic(fmt.Sprintf("provider %q registered twice", p.Name()))
+	}
+	providers[p.Name()] = p
+}
+
+func lookupProvider(name string) (Provider, bool) {
+	p, ok := providers[name]
+	return p, ok
+}
+
+// providerNames lists registered providers alphabetically.
+func providerNames() []string {
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// providerSpec implements Provider for the common case; a provider file
+// fills in the fields and a build function.
+type providerSpec struct {
+	name        string
+	endpoint    string
+	dialect     *chatDialect
+	embeddings  *embeddingDialect
+	images      *imageDialect
+	transcribe  *transcriptionDialect
+	speech      *speechDialect
+	realtime    *realtimeDialect
+	keyless     bool
+	noStreaming bool
+	keyEnv      string      // server-side key variable, if not <NAME>_API_KEY
+	schema      *bodySchema // if not the dialect's
+	idHeader    string      // header the upstream accepts a client request ID in
+	build       func(p *providerSpec, body map[string]interface{}, apiKey string) (*http.Request, error)
+	transform   func(resp *http.Response) error
+}
+
+func (p *providerSpec) Name() string     { return p.name }
+func (p *providerSpec) Endpoint() string { return p.endpoint }
+
+func (p *providerSpec) BuildRequest(body map[string]interface{}, apiKey string) (*http.Request, error) {
+	return p.build(p, body, apiKey)
+}
+
+func (p *providerSpec) TransformResponse(resp *http.Response) error {
+	if p.transform == nil {
+		return nil
+	}
+	return p.transform(resp)
+}
+
+func (p *providerSpec) SupportsStreaming() bool { return !p.noStreaming }
+func (p *providerSpec) RequiresKey() bool       { return !p.keyless }
+func (p *providerSpec) Dialect() *chatDialect   { return p.dialect }
+
+func (p *providerSpec) Embeddings() *embeddingDialect { return p.embeddings }
+func (p *providerSpec) Images() *imageDialect         { return p.images }
+
+func (p *providerSpec) Transcriptions() *transcriptionDialect { return p.transcribe }
+func (p *providerSpec) Speech() *speechDialect                { return p.speech }
+func (p *providerSpec) Realtime() *realtimeDialect            { return p.realtime }
+
+// Schema is what bodies on the provider's route are checked against, or
+// nil when they are forwarded as they are.
+func (p *providerSpec) Schema() *bodySchema {
+	if p.schema == nil && p.dialect != nil {
+		return p.dialect.schema
+	}
+	return p.schema
+}
+func (p *providerSpec) KeyEnv() string          { return p.keyEnv }
+func (p *providerSpec) RequestIDHeader() string { return p.idHeader }
+
+// bearerBuild posts body to the provider endpoint with a Bearer key, which
+// covers every OpenAI-compatible API.
+func bearerBuild(p *providerSpec, body map[string]interface{}, apiKey string) (*http.Request, error) {
+	req, err := newJSONRequest(p.Endpoint(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	return req, nil
+}
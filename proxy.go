@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// readJSONBody decodes a POSTed JSON body. On failure the error has already
+// been written and ok is false.
+func readJSONBody(w http.ResponseWriter, r *http.Request) (body map[string]interface{}, ok bool) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeDecodeError(w, err)
+		return nil, false
+	}
+	return body, true
+}
+
+// limitBody caps r's body at max_body_bytes. A body known to be larger is
+// refused at once with 413 and ok is false; one that only turns out larger
+// fails when read, with an error writeDecodeError reports.
+func limitBody(w http.ResponseWriter, r *http.Request) (ok bool) {
+	limit := config.MaxBodyBytes
+	if limit <= 0 || r.Body == nil {
+		return true
+	}
+	if r.ContentLength > limit {
+		writeTooLarge(w, limit)
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	return true
+}
+
+func writeTooLarge(w http.ResponseWriter, limit int64) {
+	http.Error(w, fmt.Sprintf("Request body too large; the limit is %d bytes", limit), http.StatusRequestEntityTooLarge)
+}
+
+// writeDecodeError answers for a request body that could not be decoded.
+func writeDecodeError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeTooLarge(w, tooLarge.Limit)
+		return
+	}
+	http.Error(w, "Invalid JSON", http.StatusBadRequest)
+}
+
+// providerHandler serves a provider's passthrough route: read the client
+// body, build the upstream request and relay the response. The apiKey field
+// the frontend sends alongside the payload is never forwarded as-is;
+// resolveAPIKey decides which key, if any, is used.
+func providerHandler(p Provider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, parse := startSpan(r.Context(), "parse request", spanInternal)
+		body, ok := readJSONBody(w, r)
+		parse.end()
+		if !ok {
+			return
+		}
+		if s, ok := p.(interface{ Schema() *bodySchema }); ok && s.Schema() != nil {
+			if err := s.Schema().check(body); err != nil {
+				writeBuildError(w, err)
+				return
+			}
+		}
+		profile := takeString(body, "keyProfile", r.Header.Get("X-Key-Profile"))
+		apiKey, err := resolveAPIKey(p, recordFrom(r).user(), takeString(body, "apiKey", ""), profile)
+		if err != nil {
+			writeBuildError(w, err)
+			return
+		}
+		stream, _ := body["stream"].(bool)
+		model, _ := body["model"].(string)
+		if resolved := aliases.resolveModel(p.Name(), model); resolved != model {
+			model, body["model"] = resolved, resolved
+		}
+		truncated, err := limitProviderBody(body, p.Name(), model, recordFrom(r).user())
+		if err != nil {
+			writeBuildError(w, err)
+			return
+		}
+		markTruncated(w, truncated)
+		if p.Name() == "anthropic" {
+			if err := allowBetas(r); err != nil {
+				writeBuildError(w, err)
+				return
+			}
+		}
+		if !checkPrompts(w, r, body) {
+			return
+		}
+		rec := recordFrom(r)
+		rec.describe(p.Name(), model, stream, body)
+		if cp, ok := p.(ChatProvider); ok {
+			rec.trackUsage(cp.Dialect())
+			injectSystem(body, p.Name(), cp.Dialect())
+		}
+		if stream && !p.SupportsStreaming() {
+			http.Error(w, p.Name()+" does not support streaming", http.StatusBadRequest)
+			return
+		}
+
+		// Only buffered responses are cached; the key is taken before
+		// BuildRequest consumes proxy-only fields.
+		var cacheKeyHash string
+		if cache != nil && !stream {
+			cacheKeyHash = cacheKey(betaScope(p.Name(), rec), body)
+			if serveCached(w, r, cacheKeyHash) {
+				return
+			}
+		}
+
+		rec.setKey(apiKey)
+		if err := checkBudgets(w, rec, p.Name(), apiKey); err != nil {
+			writeBuildError(w, err)
+			return
+		}
+		if err := quotas.reserve(p, apiKey, estimateTokens(body)); err != nil {
+			writeBuildError(w, err)
+			return
+		}
+
+		req, err := p.BuildRequest(body, apiKey)
+		if err != nil {
+			writeBuildError(w, err)
+			return
+		}
+		// The upstream call ends with the client's request, so a client
+		// that gives up stops paying for the generation.
+		req = req.WithContext(r.Context())
+		if cp, ok := p.(ChatProvider); ok {
+			if d := cp.Dialect(); d != nil && d.thinking && config.StripThinking {
+				req = withoutThinking(req)
+			}
+		}
+
+		release, err := acquireUpstream(w, r, p)
+		if err != nil {
+			writeAcquireError(w, err)
+			return
+		}
+		defer release()
+
+		if cacheKeyHash != "" {
+			forwardCached(w, p, req, cacheKeyHash)
+			return
+		}
+		forward(w, p, req)
+	}
+}
+
+// badRequest marks a build error as the client's fault (400) rather than
+// the proxy's (500).
+type badRequest string
+
+func (e badRequest) Error() string { return string(e) }
+
+func writeBuildError(w http.ResponseWriter, err error) {
+	switch err := err.(type) {
+	case badRequest:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case throttled:
+		writeThrottled(w, err)
+		return
+	case overBudget:
+		http.Error(w, err.Error(), http.StatusPaymentRequired)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// takeString removes key from body and returns its string value, or def when
+// the field is missing or empty.
+func takeString(body map[string]interface{}, key, def string) string {
+	v, _ := body[key].(string)
+	delete(body, key)
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+// envOr returns the environment variable key, or def when it is unset.
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// newJSONRequest builds an upstream POST carrying body as JSON.
+func newJSONRequest(url string, body map[string]interface{}) (*http.Request, error) {
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// forward sends req upstream and relays the response to the client.
+func forward(w http.ResponseWriter, p Provider, req *http.Request) {
+	resp, err := doUpstream(p, req)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	copyResponse(w, resp)
+}
+
+// writeUpstreamError answers for an upstream call that got no response.
+func writeUpstreamError(w http.ResponseWriter, err error) {
+	var open errCircuitOpen
+	if errors.As(err, &open) {
+		writeCircuitOpen(w, open)
+		return
+	}
+	switch {
+	case errors.Is(err, errUpstreamTimeout):
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	case errors.Is(err, context.Canceled):
+		// The client went away and took the upstream call with it.
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// doUpstream adds configured headers, sends req with retries and applies
+// the provider's response transform. It fails fast while the provider's
+// circuit is open.
+func doUpstream(p Provider, req *http.Request) (*http.Response, error) {
+	if err := circuits.allow(p.Name(), time.Now()); err != nil {
+		return nil, err
+	}
+	for k, v := range config.upstreamHeaders(p.Name()) {
+		req.Header.Set(k, v)
+	}
+	if p.Name() == "anthropic" {
+		setBetas(req)
+	}
+	if id := requestID(req.Context()); id != "" {
+		if h, ok := p.(interface{ RequestIDHeader() string }); ok && h.RequestIDHeader() != "" {
+			req.Header.Set(h.RequestIDHeader(), id)
+		}
+	}
+
+	ctx, sp := startSpan(req.Context(), "upstream "+p.Name(), spanClient)
+	defer sp.end()
+	if sp != nil {
+		req = req.WithContext(ctx)
+		req.Header.Set("traceparent", sp.traceparent())
+		sp.set("http.request.method", req.Method)
+		sp.set("server.address", req.URL.Host)
+		sp.set("url.path", req.URL.Path)
+	}
+
+	start, parent := time.Now(), req.Context()
+	req, finish := upstreamDeadline(req)
+	resp, err := finish(sendWithRetry(upstreamClient, p.Name(), req))
+	if clientGone(parent) {
+		circuits.abandon(p.Name())
+	} else {
+		circuits.done(p.Name(), upstreamFailed(resp, err), time.Now())
+	}
+	observeKey(p.Name(), req, resp)
+	if err != nil {
+		metricUpstreamErrors.inc(p.Name())
+		sp.fail(err)
+		return nil, err
+	}
+	metricUpstreamLatency.observeSince(start, p.Name())
+	sp.set("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= 400 {
+		metricUpstreamErrors.inc(p.Name())
+		sp.fail(errors.New(resp.Status))
+	}
+	if err := p.TransformResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	stripThinking(resp)
+	return resp, nil
+}
+
+// copyResponse writes an upstream response back to the client. Server-sent
+// event streams are flushed as each chunk arrives so tokens show up
+// incrementally instead of after the whole generation finishes.
+func copyResponse(w http.ResponseWriter, resp *http.Response) {
+	contentType := resp.Header.Get("Content-Type")
+	w.Header().Set("Content-Type", contentType)
+
+	flusher, ok := w.(http.Flusher)
+	if !isStreamingType(contentType) || !ok {
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(resp.StatusCode)
+	flusher.Flush()
+
+	_, sp := startSpan(resp.Request.Context(), "stream copy", spanInternal)
+	defer sp.end()
+
+	// Read only what is available and flush every write so deltas are not
+	// held back waiting for the copy buffer to fill.
+	fw := &flushWriter{w: w, f: flusher}
+	n, err := io.CopyBuffer(fw, resp.Body, make([]byte, 4096))
+	sp.set("quirk.bytes", n)
+	if fw.err != nil || clientGone(resp.Request.Context()) {
+		// The caller closes the body, ending the upstream stream.
+		slog.Info("client disconnected", "request_id", requestID(resp.Request.Context()), "upstream", resp.Request.URL.Host, "bytes", n)
+		return
+	}
+	if err != nil {
+		slog.Warn("stream error", "request_id", requestID(resp.Request.Context()), "upstream", resp.Request.URL.Host, "err", err)
+		sp.fail(err)
+	}
+}
+
+// isStreamingType reports whether an upstream content type is incremental:
+// SSE for the hosted APIs, newline-delimited JSON for Ollama.
+func isStreamingType(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/event-stream") ||
+		strings.HasPrefix(contentType, "application/x-ndjson")
+}
+
+// flushWriter flushes the underlying ResponseWriter after every write.
+type flushWriter struct {
+	w   io.Writer
+	f   http.Flusher
+	err error // first write error: the client has gone
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if err != nil && fw.err == nil {
+		fw.err = err
+	}
+	fw.f.Flush()
+	return n, err
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RAGConfig sets up retrieval. Document chunks are embedded with Model on
+// Provider and kept in DB (in memory without one); /api/chat requests that
+// ask for it get the closest chunks added to their system prompt.
+type RAGConfig struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	DB       string `json:"db"`
+	// TopK is how many chunks a request gets unless it asks for another
+	// number; chunks scoring below MinScore are left out.
+	TopK     int     `json:"top_k"`
+	MinScore float64 `json:"min_score"`
+	// Auto retrieves from the "default" collection for every /api/chat
+	// request, not just those that ask.
+	Auto bool `json:"auto"`
+	// ChunkSize and ChunkOverlap, in characters, are how /api/ingest cuts
+	// documents up unless a request says otherwise.
+	ChunkSize    int `json:"chunk_size"`
+	ChunkOverlap int `json:"chunk_overlap"`
+	// MaxUpload bounds an /api/ingest body, in bytes.
+	MaxUpload int64 `json:"max_upload"`
+}
+
+func (c RAGConfig) enabled() bool { return c.Provider != "" }
+
+func (c RAGConfig) validate() []error {
+	if !c.enabled() {
+		return nil
+	}
+	var errs []error
+	if p, ok := lookupProvider(c.Provider); !ok {
+		errs = append(errs, fmt.Errorf("rag.provider: unknown provider %q", c.Provider))
+	} else if ep, ok := p.(EmbeddingProvider); !ok || ep.Embeddings() == nil {
+		errs = append(errs, fmt.Errorf("rag.provider: %s has no embeddings API", c.Provider))
+	}
+	if c.Model == "" {
+		errs = append(errs, errors.New("rag.model: required"))
+	}
+	if c.TopK < 0 {
+		errs = append(errs, errors.New("rag.top_k: must not be negative"))
+	}
+	if c.MinScore < -1 || c.MinScore > 1 {
+		errs = append(errs, errors.New("rag.min_score: must be between -1 and 1"))
+	}
+	if c.ChunkSize < 0 || c.ChunkOverlap < 0 || c.MaxUpload < 0 {
+		errs = append(errs, errors.New("rag: chunk_size, chunk_overlap and max_upload must not be negative"))
+	} else if c.ChunkOverlap >= firstInt(c.ChunkSize, defaultChunkSize) {
+		errs = append(errs, errors.New("rag.chunk_overlap: must be less than chunk_size"))
+	}
+	return errs
+}
+
+const defaultCollection = "default"
+
+// ragChunk is a piece of a document. Source names the document, for
+// citations; Position orders the chunks within it.
+type ragChunk struct {
+	ID         int64             `json:"id"`
+	Collection string            `json:"collection"`
+	Source     string            `json:"source"`
+	Position   int               `json:"position"`
+	Text       string            `json:"text"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	Created    time.Time         `json:"created"`
+	vector     []float64         // unit length
+}
+
+// ragCitation is a retrieved chunk as shown to the client. Index is the
+// number the model was told to cite it by.
+type ragCitation struct {
+	Index    int               `json:"index"`
+	ID       int64             `json:"id"`
+	Source   string            `json:"source"`
+	Position int               `json:"position"`
+	Score    float64           `json:"score"`
+	Text     string            `json:"text,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// ragStore is the vector store: every chunk with its vector, in memory by
+// collection and, when configured, in SQLite. Search is an exact scan,
+// which is quick enough for the tens of thousands of chunks a docs server
+// holds.
+type ragStore struct {
+	cfg RAGConfig
+
+	mu          sync.RWMutex
+	collections map[string][]*ragChunk
+	nextID      int64
+	db          *sql.DB
+}
+
+// rag is the vector store, or nil when retrieval is not configured.
+var rag *ragStore
+
+var ragSchema = []string{`
+CREATE TABLE IF NOT EXISTS rag_chunks (
+	id         INTEGER PRIMARY KEY,
+	collection TEXT NOT NULL,
+	source     TEXT NOT NULL,
+	position   INTEGER NOT NULL,
+	text       TEXT NOT NULL,
+	metadata   TEXT NOT NULL,
+	model      TEXT NOT NULL,
+	vector     BLOB NOT NULL,
+	created    INTEGER NOT NULL
+)`,
+	`CREATE INDEX IF NOT EXISTS rag_chunks_source ON rag_chunks (collection, source)`,
+}
+
+// openRAG builds the store from config, loading the chunks in its
+// database. Chunks embedded with another model than the configured one
+// are skipped, since their vectors can't be compared.
+func openRAG(c RAGConfig) (*ragStore, error) {
+	s := &ragStore{cfg: c, collections: map[string][]*ragChunk{}, nextID: 1}
+	if c.DB == "" {
+		return s, nil
+	}
+	db, err := sql.Open("sqlite", c.DB)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	for _, stmt := range append([]string{"PRAGMA journal_mode=WAL", "PRAGMA busy_timeout=5000"}, ragSchema...) {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("rag: %w", err)
+		}
+	}
+	s.db = db
+	if err := db.QueryRow(`SELECT coalesce(max(id), 0) + 1 FROM rag_chunks`).Scan(&s.nextID); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("rag: %w", err)
+	}
+	rows, err := db.Query(`SELECT id, collection, source, position, text, metadata, vector, created
+		FROM rag_chunks WHERE model = ? ORDER BY id`, c.Model)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("rag: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		ch := &ragChunk{}
+		var meta string
+		var blob []byte
+		var created int64
+		if err := rows.Scan(&ch.ID, &ch.Collection, &ch.Source, &ch.Position, &ch.Text, &meta, &blob, &created); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("rag: %w", err)
+		}
+		json.Unmarshal([]byte(meta), &ch.Metadata)
+		ch.vector, ch.Created = decodeVector(blob), time.Unix(created, 0)
+		s.collections[ch.Collection] = append(s.collections[ch.Collection], ch)
+	}
+	return s, rows.Err()
+}
+
+func (s *ragStore) count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	for _, list := range s.collections {
+		n += len(list)
+	}
+	return n
+}
+
+func normalize(v []float64) []float64 {
+	var sum float64
+	for _, f := range v {
+		sum += f * f
+	}
+	if sum == 0 {
+		return v
+	}
+	norm := math.Sqrt(sum)
+	out := make([]float64, len(v))
+	for i, f := range v {
+		out[i] = f / norm
+	}
+	return out
+}
+
+// replace stores chunks as the whole of their source, dropping whatever the
+// source held before, so re-indexing a document doesn't duplicate it.
+func (s *ragStore) replace(collection, source string, chunks []*ragChunk) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ch := range chunks {
+		ch.ID = s.nextID
+		s.nextID++
+	}
+	if s.db != nil {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec(`DELETE FROM rag_chunks WHERE collection = ? AND source = ?`, collection, source); err != nil {
+			return err
+		}
+		for _, ch := range chunks {
+			meta, _ := json.Marshal(ch.Metadata)
+			if _, err := tx.Exec(`INSERT INTO rag_chunks (id, collection, source, position, text, metadata, model, vector, created)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, ch.ID, collection, source, ch.Position, ch.Text, string(meta),
+				s.cfg.Model, encodeVector(ch.vector), ch.Created.Unix()); err != nil {
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	kept := s.collections[collection][:0]
+	for _, ch := range s.collections[collection] {
+		if ch.Source != source {
+			kept = append(kept, ch)
+		}
+	}
+	s.collections[collection] = append(kept, chunks...)
+	return nil
+}
+
+// remove deletes a source's chunks, or a whole collection's when source is
+// empty, and returns how many went.
+func (s *ragStore) remove(collection, source string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db != nil {
+		var err error
+		if source == "" {
+			_, err = s.db.Exec(`DELETE FROM rag_chunks WHERE collection = ?`, collection)
+		} else {
+			_, err = s.db.Exec(`DELETE FROM rag_chunks WHERE collection = ? AND source = ?`, collection, source)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	list := s.collections[collection]
+	kept := list[:0]
+	for _, ch := range list {
+		if source != "" && ch.Source != source {
+			kept = append(kept, ch)
+		}
+	}
+	removed := len(list) - len(kept)
+	if len(kept) == 0 {
+		delete(s.collections, collection)
+	} else {
+		s.collections[collection] = kept
+	}
+	return removed, nil
+}
+
+// search returns up to k chunks of collection closest to vector, best
+// first.
+func (s *ragStore) search(collection string, vector []float64, k int) []ragCitation {
+	vector = normalize(vector)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var hits []ragCitation
+	for _, ch := range s.collections[collection] {
+		if len(ch.vector) != len(vector) {
+			continue
+		}
+		var score float64
+		for i := range vector {
+			score += vector[i] * ch.vector[i]
+		}
+		if score < s.cfg.MinScore {
+			continue
+		}
+		hits = append(hits, ragCitation{ID: ch.ID, Source: ch.Source, Position: ch.Position, Score: score, Text: ch.Text, Metadata: ch.Metadata})
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].Score > hits[j].Score })
+	if len(hits) > k {
+		hits = hits[:k]
+	}
+	for i := range hits {
+		hits[i].Index = i + 1
+	}
+	return hits
+}
+
+// ragEmbedBatch is how many texts go to the embedding provider per call.
+const ragEmbedBatch = 100
+
+// embedTexts gets vectors for texts from the retrieval embedding model,
+// using the server-side key and the caller's budgets.
+func (s *ragStore) embedTexts(w http.ResponseWriter, r *http.Request, texts []string, inputType string) ([][]float64, *chatFailure) {
+	p, _ := lookupProvider(s.cfg.Provider)
+	target := p.(EmbeddingProvider)
+	t := ChatTarget{s.cfg.Provider, s.cfg.Model}
+	key, err := resolveAPIKey(target, recordFrom(r).user(), "", "")
+	if err != nil {
+		return nil, &chatFailure{target: t, err: err}
+	}
+	var out [][]float64
+	for start := 0; start < len(texts); start += ragEmbedBatch {
+		er := &embeddingRequest{
+			Provider:  s.cfg.Provider,
+			Model:     s.cfg.Model,
+			Input:     texts[start:min(start+ragEmbedBatch, len(texts))],
+			InputType: inputType,
+		}
+		resp, fail := embed(w, r, target, er, key)
+		if fail != nil {
+			return nil, fail
+		}
+		out = append(out, resp.Embeddings...)
+	}
+	return out, nil
+}
+
+// ragInput is a chunk as clients send it.
+type ragInput struct {
+	Text     string            `json:"text"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// index embeds and stores chunks as the content of source.
+func (s *ragStore) index(w http.ResponseWriter, r *http.Request, collection, source string, inputs []ragInput) ([]*ragChunk, *chatFailure) {
+	texts := make([]string, len(inputs))
+	for i, in := range inputs {
+		texts[i] = in.Text
+	}
+	vectors, fail := s.embedTexts(w, r, texts, "document")
+	if fail != nil {
+		return nil, fail
+	}
+	now := time.Now()
+	chunks := make([]*ragChunk, len(inputs))
+	for i, in := range inputs {
+		chunks[i] = &ragChunk{
+			Collection: collection, Source: source, Position: i, Text: in.Text,
+			Metadata: in.Metadata, Created: now, vector: normalize(vectors[i]),
+		}
+	}
+	if err := s.replace(collection, source, chunks); err != nil {
+		return nil, &chatFailure{target: ChatTarget{s.cfg.Provider, s.cfg.Model}, err: err}
+	}
+	return chunks, nil
+}
+
+// retrievalOptions asks /api/chat to retrieve context for a request.
+type retrievalOptions struct {
+	Collection string `json:"collection,omitempty"`
+	TopK       int    `json:"top_k,omitempty"`
+}
+
+// retrieve adds the chunks closest to cr's last user message to its system
+// prompt, numbered for citation, and returns them. Requests that don't ask
+// for retrieval are left alone unless rag.auto is set.
+func (cr *chatRequest) retrieve(w http.ResponseWriter, r *http.Request) ([]ragCitation, *chatFailure) {
+	opts := cr.Retrieval
+	if rag == nil || (opts == nil && !rag.cfg.Auto) {
+		return nil, nil
+	}
+	if opts == nil {
+		opts = &retrievalOptions{}
+	}
+	collection, k := firstSet(opts.Collection, defaultCollection), opts.TopK
+	if k <= 0 {
+		k = firstInt(rag.cfg.TopK, 4)
+	}
+	query := ""
+	for i := len(cr.Messages) - 1; i >= 0; i-- {
+		if cr.Messages[i].Role == "user" {
+			query = cr.Messages[i].Content
+			break
+		}
+	}
+	if query == "" {
+		return nil, nil
+	}
+	vectors, fail := rag.embedTexts(w, r, []string{query}, "query")
+	if fail != nil {
+		return nil, fail
+	}
+	hits := screenRetrieved(w, r, rag.search(collection, vectors[0], k))
+	if len(hits) == 0 {
+		return nil, nil
+	}
+	var b strings.Builder
+	b.WriteString("Answer using the excerpts below where they are relevant, citing them by number like [1].\n")
+	for _, h := range hits {
+		fmt.Fprintf(&b, "\n[%d] %s\n%s\n", h.Index, h.Source, h.Text)
+	}
+	if cr.System != "" {
+		cr.System += "\n\n"
+	}
+	cr.System += strings.TrimSpace(b.String())
+	return hits, nil
+}
+
+func firstInt(values ...int) int {
+	for _, v := range values {
+		if v != 0 {
+			return v
+		}
+	}
+	return 0
+}
+
+// handleRAGChunks adds a source's chunks with {"collection", "source",
+// "chunks": [{"text", "metadata"}]} (POST), replacing what it held, and
+// deletes a source or, without ?source=, a whole ?collection= (DELETE).
+func handleRAGChunks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		var body struct {
+			Collection string     `json:"collection"`
+			Source     string     `json:"source"`
+			Chunks     []ragInput `json:"chunks"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeDecodeError(w, err)
+			return
+		}
+		if body.Source == "" {
+			http.Error(w, "source: required", http.StatusBadRequest)
+			return
+		}
+		if len(body.Chunks) == 0 {
+			http.Error(w, "chunks: must not be empty", http.StatusBadRequest)
+			return
+		}
+		for i, c := range body.Chunks {
+			if strings.TrimSpace(c.Text) == "" {
+				http.Error(w, fmt.Sprintf("chunks[%d].text: must not be empty", i), http.StatusBadRequest)
+				return
+			}
+		}
+		collection := firstSet(body.Collection, defaultCollection)
+		chunks, fail := rag.index(w, r, collection, body.Source, body.Chunks)
+		if fail != nil {
+			fail.write(w)
+			return
+		}
+		ids := make([]int64, len(chunks))
+		for i, ch := range chunks {
+			ids[i] = ch.ID
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"collection": collection, "source": body.Source, "ids": ids})
+
+	case "DELETE":
+		collection := firstSet(r.URL.Query().Get("collection"), defaultCollection)
+		n, err := rag.remove(collection, r.URL.Query().Get("source"))
+		if err != nil {
+			http.Error(w, "Deleting chunks: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n == 0 {
+			http.Error(w, "No chunks to delete", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"deleted": n})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRAGSearch returns the chunks closest to {"query"} in
+// {"collection"}, best first.
+func handleRAGSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Query      string `json:"query"`
+		Collection string `json:"collection"`
+		TopK       int    `json:"top_k"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if body.Query == "" {
+		http.Error(w, "query: required", http.StatusBadRequest)
+		return
+	}
+	vectors, fail := rag.embedTexts(w, r, []string{body.Query}, "query")
+	if fail != nil {
+		fail.write(w)
+		return
+	}
+	k := body.TopK
+	if k <= 0 {
+		k = firstInt(rag.cfg.TopK, 4)
+	}
+	hits := rag.search(firstSet(body.Collection, defaultCollection), vectors[0], k)
+	if hits == nil {
+		hits = []ragCitation{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"results": hits})
+}
+
+// handleRAGCollections lists collections with their sources and chunk
+// counts, or with ?collection= and ?source= a source's chunks in order.
+func handleRAGCollections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	rag.mu.RLock()
+	defer rag.mu.RUnlock()
+	if source := q.Get("source"); source != "" {
+		chunks := []*ragChunk{}
+		for _, ch := range rag.collections[firstSet(q.Get("collection"), defaultCollection)] {
+			if ch.Source == source {
+				chunks = append(chunks, ch)
+			}
+		}
+		sort.Slice(chunks, func(i, j int) bool { return chunks[i].Position < chunks[j].Position })
+		writeJSON(w, http.StatusOK, map[string]interface{}{"chunks": chunks})
+		return
+	}
+	out, total := []map[string]interface{}{}, 0
+	for name, list := range rag.collections {
+		total += len(list)
+		sources := map[string]int{}
+		for _, ch := range list {
+			sources[ch.Source]++
+		}
+		out = append(out, map[string]interface{}{"name": name, "chunks": len(list), "sources": sources})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i]["name"].(string) < out[j]["name"].(string) })
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"model":       rag.cfg.Provider + "/" + rag.cfg.Model,
+		"collections": out,
+		"total":       total,
+	})
+}
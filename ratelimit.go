@@ -0,0 +1,183 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenBucket refills at rate tokens per second up to burst. It is not
+// safe for concurrent use; owners hold their own lock.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+}
+
+// take removes n tokens if they are available. Otherwise it removes nothing
+// and reports how long until they will be.
+func (b *tokenBucket) take(n float64, now time.Time) (bool, time.Duration) {
+	if wait := b.wait(n, now); wait > 0 {
+		return false, wait
+	}
+	b.tokens -= n
+	return true, 0
+}
+
+// wait is how long until n tokens are available, zero if they are now.
+func (b *tokenBucket) wait(n float64, now time.Time) time.Duration {
+	b.refill(now)
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// ipLimiter keeps one bucket per client IP.
+type ipLimiter struct {
+	rate, burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+func newIPLimiter(rate float64, burst int) *ipLimiter {
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return &ipLimiter{rate: rate, burst: float64(burst), buckets: map[string]*tokenBucket{}}
+}
+
+func (l *ipLimiter) allow(ip string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return true, 0
+	}
+
+	// Drop buckets that have refilled completely; they hold no state.
+	if now.Sub(l.swept) > time.Minute {
+		for k, b := range l.buckets {
+			if b.refill(now); b.tokens >= b.burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = newTokenBucket(l.rate, l.burst, now)
+		l.buckets[ip] = b
+	}
+	return b.take(1, now)
+}
+
+// set changes the limit, starting every client with a full bucket. A zero
+// rate turns limiting off.
+func (l *ipLimiter) set(rate float64, burst int) {
+	n := newIPLimiter(rate, burst)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate, l.burst, l.buckets = n.rate, n.burst, map[string]*tokenBucket{}
+}
+
+func (l *ipLimiter) settings() (rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate, int(l.burst)
+}
+
+// limiter is the per-IP limiter for /api routes; applyConfig and the admin
+// API set its rate, zero until then.
+var limiter = newIPLimiter(0, 0)
+
+// rateLimited rejects clients over their request rate with 429 and a
+// Retry-After header.
+func rateLimited(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := limiter.allow(clientIP(r), time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// clientIP is the caller's address. Behind a trusted reverse proxy it is
+// taken from X-Forwarded-For, counting forwarded_hops entries from the
+// right, since anything to their left is whatever the client sent.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	rl := config.RateLimit
+	if !rl.TrustForwarded || !trustedProxy(host, rl.TrustedProxies) {
+		return host
+	}
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	n := rl.ForwardedHops
+	if n == 0 {
+		n = 1
+	}
+	if len(hops) < n || net.ParseIP(hops[len(hops)-n]) == nil {
+		return host
+	}
+	return hops[len(hops)-n]
+}
+
+// trustedProxy reports whether the peer at host is one of proxies, or on
+// loopback when none are listed.
+func trustedProxy(host string, proxies []string) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	if len(proxies) == 0 {
+		return addr.IsLoopback()
+	}
+	for _, p := range proxies {
+		if prefix, err := parsePrefix(p); err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefix reads a CIDR range, or a single address as a range of one.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// realtimeDialect is one upstream realtime API, reached over a WebSocket.
+type realtimeDialect struct {
+	url  func(endpoint, model string) string
+	auth func(req *http.Request, apiKey string)
+}
+
+// RealtimeProvider is a Provider that /api/realtime can bridge to.
+type RealtimeProvider interface {
+	Provider
+	Realtime() *realtimeDialect
+}
+
+var openAIRealtime = realtimeDialect{
+	url: func(endpoint, model string) string {
+		return strings.TrimSuffix(endpoint, "/chat/completions") + "/realtime?model=" + url.QueryEscape(model)
+	},
+	auth: func(req *http.Request, apiKey string) { req.Header.Set("Authorization", "Bearer "+apiKey) },
+}
+
+// Browsers cannot set headers on a WebSocket, so credentials ride in
+// subprotocols, as OpenAI's own browser clients do. Neither is passed on.
+const (
+	tokenProtocol  = "quirk-token."             // the proxy's access token
+	clientKeyProto = "openai-insecure-api-key." // the client's own provider key
+)
+
+// maxInspectedFrame bounds the server events read for usage; larger ones,
+// mostly audio, are relayed without a look.
+const maxInspectedFrame = 1 << 20
+
+func wsProtocols(r *http.Request) []string {
+	var out []string
+	for _, h := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(h, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				out = append(out, p)
+			}
+		}
+	}
+	return out
+}
+
+// realtimeToken takes the access token from a "quirk-token.<token>"
+// subprotocol when the request has no Authorization header.
+func realtimeToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			for _, p := range wsProtocols(r) {
+				if token, ok := strings.CutPrefix(p, tokenProtocol); ok {
+					r.Header.Set("Authorization", "Bearer "+token)
+				}
+			}
+		}
+		next(w, r)
+	}
+}
+
+// sameOrigin reports whether a WebSocket from origin may connect. Browsers
+// send cookies with cross-site WebSockets and CORS does not apply to them,
+// so other sites are turned away unless [cors] allows them.
+func sameOrigin(r *http.Request, origin string) bool {
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return config.CORS.allows(origin)
+}
+
+// handleRealtime bridges a browser WebSocket to a provider's realtime API
+// (GET /api/realtime?provider=openai&model=...). The upstream connection
+// carries the server-held key; once both handshakes are done, frames are
+// relayed as they are in both directions and usage is read from the
+// response.done events on the way back.
+func handleRealtime(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(w, "Expected a WebSocket upgrade", http.StatusUpgradeRequired)
+		return
+	}
+	if !sameOrigin(r, r.Header.Get("Origin")) {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	q := r.URL.Query()
+	provider, model := firstSet(q.Get("provider"), "openai"), q.Get("model")
+	p, _ := lookupProvider(provider)
+	target, ok := p.(RealtimeProvider)
+	if !ok || target.Realtime() == nil {
+		http.Error(w, "No realtime API for provider: "+provider, http.StatusBadRequest)
+		return
+	}
+	if !config.providerEnabled(provider) {
+		http.Error(w, "Provider disabled: "+provider, http.StatusBadRequest)
+		return
+	}
+	if model == "" {
+		http.Error(w, "model: required", http.StatusBadRequest)
+		return
+	}
+
+	var clientKey string
+	var protocols []string
+	for _, proto := range wsProtocols(r) {
+		if key, ok := strings.CutPrefix(proto, clientKeyProto); ok {
+			clientKey = key
+		} else if !strings.HasPrefix(proto, tokenProtocol) {
+			protocols = append(protocols, proto)
+		}
+	}
+	rec := recordFrom(r)
+	apiKey, err := resolveAPIKey(target, rec.user(), clientKey, firstSet(q.Get("keyProfile"), r.Header.Get("X-Key-Profile")))
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	rec.describe(provider, model, true, map[string]interface{}{"protocols": protocols})
+	rec.setKey(apiKey)
+	t := ChatTarget{provider, model}
+	if err := checkBudgets(w, rec, provider, apiKey); err != nil {
+		(&chatFailure{target: t, err: err}).write(w)
+		return
+	}
+
+	release, err := acquireUpstream(w, r, target)
+	if err != nil {
+		writeAcquireError(w, err)
+		return
+	}
+	defer release()
+	resp, err := dialRealtime(r, target, model, protocols, apiKey)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if resp.StatusCode != http.StatusSwitchingProtocols || !ok {
+		raw, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		status := resp.StatusCode
+		if status < 400 {
+			status = http.StatusBadGateway
+		}
+		(&chatFailure{target: t, status: status, body: raw, upstream: true}).write(w)
+		return
+	}
+	defer upstream.Close()
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "WebSockets are not supported on this connection", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	h := w.Header().Clone()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", resp.Header.Get("Sec-WebSocket-Accept"))
+	if proto := resp.Header.Get("Sec-WebSocket-Protocol"); proto != "" {
+		h.Set("Sec-WebSocket-Protocol", proto)
+	}
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	h.Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		return
+	}
+	rec.Status = http.StatusSwitchingProtocols
+
+	// Client frames arrive masked, as an upstream expects from a client,
+	// and no extensions were negotiated, so both directions copy through.
+	// Whichever side ends first closes the other.
+	var usage chatUsage
+	var once sync.Once
+	done := make(chan struct{})
+	hangUp := func() {
+		once.Do(func() {
+			conn.Close()
+			upstream.Close()
+		})
+	}
+	go func() {
+		defer close(done)
+		io.Copy(upstream, brw.Reader)
+		hangUp()
+	}()
+	err = relayServerFrames(conn, upstream, &usage)
+	hangUp()
+	<-done
+	if usage != (chatUsage{}) {
+		rec.setUsage(usage)
+	}
+	if err != nil && err != io.EOF && !errors.Is(err, net.ErrClosed) {
+		slog.Debug("realtime session ended", "request_id", requestID(r.Context()), "err", err)
+	}
+}
+
+// dialRealtime opens the upstream WebSocket through the shared transport,
+// so proxies, TLS settings and upstream headers apply as to any call. The
+// browser's Sec-WebSocket-Key goes along, so the upstream's accept answers
+// the browser.
+func dialRealtime(r *http.Request, target RealtimeProvider, model string, protocols []string, apiKey string) (*http.Response, error) {
+	if err := circuits.allow(target.Name(), time.Now()); err != nil {
+		return nil, err
+	}
+	dialect := target.Realtime()
+	req, err := http.NewRequestWithContext(r.Context(), "GET", dialect.url(target.Endpoint(), model), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", r.Header.Get("Sec-WebSocket-Version"))
+	req.Header.Set("Sec-WebSocket-Key", r.Header.Get("Sec-WebSocket-Key"))
+	if len(protocols) > 0 {
+		req.Header.Set("Sec-WebSocket-Protocol", strings.Join(protocols, ", "))
+	}
+	for k, v := range config.upstreamHeaders(target.Name()) {
+		req.Header.Set(k, v)
+	}
+	if h, ok := target.(interface{ RequestIDHeader() string }); ok && h.RequestIDHeader() != "" {
+		req.Header.Set(h.RequestIDHeader(), requestID(r.Context()))
+	}
+	if apiKey != "" {
+		dialect.auth(req, apiKey)
+	}
+	resp, err := upstreamClient.Do(req)
+	circuits.done(target.Name(), upstreamFailed(resp, err), time.Now())
+	return resp, err
+}
+
+// relayServerFrames copies WebSocket frames from src to dst unchanged,
+// adding the usage of each response.done event to usage.
+func relayServerFrames(dst io.Writer, src io.Reader, usage *chatUsage) error {
+	br := bufio.NewReaderSize(src, 32<<10)
+	var hdr [14]byte
+	for {
+		if _, err := io.ReadFull(br, hdr[:2]); err != nil {
+			return err
+		}
+		n, length := 2, uint64(hdr[1]&0x7f)
+		switch length {
+		case 126:
+			n += 2
+		case 127:
+			n += 8
+		}
+		if hdr[1]&0x80 != 0 {
+			n += 4 // a mask, though servers should not send one
+		}
+		if _, err := io.ReadFull(br, hdr[2:n]); err != nil {
+			return err
+		}
+		switch length {
+		case 126:
+			length = uint64(binary.BigEndian.Uint16(hdr[2:4]))
+		case 127:
+			length = binary.BigEndian.Uint64(hdr[2:10])
+		}
+		if _, err := dst.Write(hdr[:n]); err != nil {
+			return err
+		}
+
+		text, final, masked := hdr[0]&0x0f == 1, hdr[0]&0x80 != 0, hdr[1]&0x80 != 0
+		if !text || !final || masked || length > maxInspectedFrame {
+			if _, err := io.CopyN(dst, br, int64(length)); err != nil {
+				return err
+			}
+			continue
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return err
+		}
+		if _, err := dst.Write(payload); err != nil {
+			return err
+		}
+		if bytes.Contains(payload, []byte(`"response.done"`)) {
+			var ev struct {
+				Type     string `json:"type"`
+				Response struct {
+					Usage struct {
+						InputTokens  int `json:"input_tokens"`
+						OutputTokens int `json:"output_tokens"`
+					} `json:"usage"`
+				} `json:"response"`
+			}
+			if json.Unmarshal(payload, &ev) == nil && ev.Type == "response.done" {
+				usage.InputTokens += ev.Response.Usage.InputTokens
+				usage.OutputTokens += ev.Response.Usage.OutputTokens
+			}
+		}
+	}
+}
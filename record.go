@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// requestRecord describes one /api request as it is served. The recorded
+// middleware starts it and collects the response; handlers fill in what
+// only they know, such as provider, model and usage. Finished records go to
+// the usage tracker and the log store.
+type requestRecord struct {
+	ID         string
+	Start      time.Time
+	Method     string
+	Path       string
+	Provider   string
+	Model      string
+	User       string // authenticated user, empty when anonymous
+	KeyID      string // fingerprint of the upstream key used
+	Experiment string // experiment and variant the request was assigned to
+	Variant    string
+	Canary     string // canary rollout the request matched
+	OnCanary   bool   // and whether it got the canary side
+	Stream     bool
+	Aborted    bool     // the client went away before the response was complete
+	Cached     bool     // served from a cache; no upstream call, no usage
+	Batch      bool     // usage from a batch, priced at the batch discount
+	Flagged    string   // moderation categories the prompt tripped
+	Guardrails string   // guardrail rules that matched, comma-separated
+	PII        string   // kinds of personal data found in the prompt
+	Injection  float64  // highest prompt injection score that counted
+	Betas      []string // anthropic-beta features the client asked for
+	Request    []byte   // client body with keys removed
+	Usage      chatUsage
+	Cost       float64 // estimated USD, zero when unknown
+	Priced     bool    // Cost comes from the pricing table
+	Status     int
+	Bytes      int64
+	Latency    time.Duration
+	Response   bytes.Buffer // first maxLoggedBody bytes
+
+	tap *usageTap
+}
+
+type recordKey struct{}
+
+// statusClientClosed is logged for requests the client abandoned before
+// any response was written, as nginx does.
+const statusClientClosed = 499
+
+// clientGone reports whether the client behind ctx has disconnected or
+// given up. An upstream deadline cancels with its own cause and does not
+// count.
+func clientGone(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), context.Canceled)
+}
+
+// rejectedStatus reports whether a request was turned away for auth,
+// budget or rate-limit reasons, by the proxy or by the upstream.
+func rejectedStatus(status int) bool {
+	switch status {
+	case http.StatusUnauthorized, http.StatusPaymentRequired, http.StatusForbidden, http.StatusTooManyRequests:
+		return true
+	}
+	return false
+}
+
+// newRequestID reuses a well-formed X-Request-ID from the client, such as
+// one set by a load balancer, and otherwise makes a random one.
+func newRequestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); len(id) > 0 && len(id) <= 128 && strings.Trim(id,
+		"abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789._-") == "" {
+		return id
+	}
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// requestID returns the ID of the request ctx belongs to, or "". Upstream
+// request contexts carry it too.
+func requestID(ctx context.Context) string {
+	if rec, _ := ctx.Value(recordKey{}).(*requestRecord); rec != nil {
+		return rec.ID
+	}
+	return ""
+}
+
+// recordFrom returns the request's record, or nil outside recorded routes.
+// All methods accept a nil record.
+func recordFrom(r *http.Request) *requestRecord {
+	rec, _ := r.Context().Value(recordKey{}).(*requestRecord)
+	return rec
+}
+
+// describe notes what the request was for. body is stored as JSON and must
+// already be stripped of API keys.
+func (rec *requestRecord) describe(provider, model string, stream bool, body interface{}) {
+	if rec == nil {
+		return
+	}
+	rec.Provider, rec.Model, rec.Stream = provider, model, stream
+	rec.Request, _ = json.Marshal(body)
+}
+
+// failedOver notes that a fallback answered instead of the requested
+// provider, so usage and cost are counted against the one that did.
+func (rec *requestRecord) failedOver(provider, model string) {
+	if rec != nil {
+		rec.Provider, rec.Model = provider, model
+	}
+}
+
+func (rec *requestRecord) setExperiment(name, variant string) {
+	if rec != nil {
+		rec.Experiment, rec.Variant = name, variant
+	}
+}
+
+func (rec *requestRecord) setCanary(name string, onCanary bool) {
+	if rec != nil {
+		rec.Canary, rec.OnCanary = name, onCanary
+	}
+}
+
+// guardrailHit notes a guardrail rule that matched, once.
+func (rec *requestRecord) guardrailHit(rule string) {
+	if rec == nil {
+		return
+	}
+	for _, r := range strings.Split(rec.Guardrails, ",") {
+		if r == rule {
+			return
+		}
+	}
+	rec.Guardrails = strings.TrimPrefix(rec.Guardrails+","+rule, ",")
+}
+
+func (rec *requestRecord) cacheHit() {
+	if rec != nil {
+		rec.Cached = true
+		rec.tap = nil
+	}
+}
+
+func (rec *requestRecord) setUser(user string) {
+	if rec != nil {
+		rec.User = user
+	}
+}
+
+// user is who the request is authenticated as, or "".
+func (rec *requestRecord) user() string {
+	if rec == nil {
+		return ""
+	}
+	return rec.User
+}
+
+func (rec *requestRecord) setKey(apiKey string) {
+	if rec != nil {
+		rec.KeyID = keyFingerprint(apiKey)
+	}
+}
+
+func (rec *requestRecord) setUsage(u chatUsage) {
+	if rec != nil {
+		rec.Usage = u
+	}
+}
+
+// annotate copies what the record knows onto its server span.
+func (rec *requestRecord) annotate(sp *span) {
+	if sp == nil {
+		return
+	}
+	sp.set("quirk.request_id", rec.ID)
+	sp.set("http.request.method", rec.Method)
+	sp.set("url.path", rec.Path)
+	sp.set("http.response.status_code", rec.Status)
+	if rec.Provider != "" {
+		sp.set("gen_ai.system", rec.Provider)
+		sp.set("gen_ai.request.model", rec.Model)
+		sp.set("gen_ai.usage.input_tokens", rec.Usage.InputTokens)
+		sp.set("gen_ai.usage.output_tokens", rec.Usage.OutputTokens)
+		if rec.Usage.CacheReadInputTokens > 0 {
+			sp.set("gen_ai.usage.cache_read_input_tokens", rec.Usage.CacheReadInputTokens)
+		}
+		sp.set("quirk.stream", rec.Stream)
+		sp.set("quirk.cached", rec.Cached)
+	}
+	if rec.Status >= 500 {
+		sp.fail(errors.New(http.StatusText(rec.Status)))
+	}
+}
+
+// recorded wraps an /api handler so each request leaves a record and a
+// server span.
+func recorded(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &requestRecord{ID: newRequestID(r), Start: time.Now(), Method: r.Method, Path: r.URL.Path}
+		w.Header().Set("X-Request-ID", rec.ID)
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			rec.User = r.TLS.PeerCertificates[0].Subject.CommonName
+		}
+		rw := &recordingWriter{ResponseWriter: w, rec: rec}
+		ctx, sp := startServerSpan(r, r.Method+" "+r.URL.Path)
+		if limitBody(rw, r) {
+			next(rw, r.WithContext(context.WithValue(ctx, recordKey{}, rec)))
+		}
+
+		if rec.Status == 0 && clientGone(r.Context()) {
+			rec.Status = statusClientClosed
+		} else if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		rec.Latency = time.Since(rec.Start)
+		// A hijacked connection's context ends with the session, however it ends.
+		rec.Aborted = rec.Status != http.StatusSwitchingProtocols && (rw.writeFailed || clientGone(r.Context()))
+		if rec.tap != nil {
+			rec.Usage = rec.tap.finish(rec.Status, rec.Aborted)
+		}
+		if !rec.Cached {
+			rec.Cost, rec.Priced = estimateCost(rec.Provider, rec.Model, rec.Usage)
+			if rec.Batch {
+				rec.Cost *= batchDiscount
+			}
+		}
+		if rw.costTrailer && rec.Priced {
+			w.Header().Set(costHeader, formatCost(rec.Cost))
+		}
+		if rw.live != nil {
+			dashboard.streamEnded(rw.live)
+		}
+		dashboard.record(rec)
+		experiments.record(rec)
+		canaries.record(rec)
+		usage.record(rec)
+		spend.record(rec)
+		observeRequest(rec)
+		rec.annotate(sp)
+		sp.end()
+		slog.LogAttrs(r.Context(), logLevelFor(rec.Status), "request", rec.logAttrs()...)
+		if rejectedStatus(rec.Status) {
+			audit.record("request.rejected", map[string]interface{}{
+				"request_id": rec.ID,
+				"path":       rec.Path,
+				"provider":   rec.Provider,
+				"user":       rec.User,
+				"key_id":     rec.KeyID,
+				"status":     rec.Status,
+				"remote":     clientIP(r),
+			})
+		}
+		if logStore != nil {
+			logStore.add(rec)
+		}
+	}
+}
+
+// recordingWriter notes the status and size of a response and keeps the
+// start of its body.
+type recordingWriter struct {
+	http.ResponseWriter
+	rec         *requestRecord
+	costTrailer bool
+	live        *activeStream // while a stream is being written
+	writeFailed bool          // the client stopped reading
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	if rw.rec.Status == 0 {
+		rw.rec.Status = status
+		// Usage is only known once the body is through, so announce the
+		// cost as a trailer unless the handler already set it.
+		if config.CostHeaders && rw.rec.Provider != "" && rw.Header().Get(costHeader) == "" {
+			rw.Header().Add("Trailer", costHeader)
+			rw.costTrailer = true
+		}
+		if rw.rec.Stream && status == http.StatusOK {
+			rw.live = dashboard.streamStarted(rw.rec)
+		}
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	if rw.rec.Status == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if room := maxLoggedBody - rw.rec.Response.Len(); room > 0 && logStore != nil {
+		rw.rec.Response.Write(p[:min(room, len(p))])
+	}
+	if rw.rec.tap != nil {
+		rw.rec.tap.write(p, rw.Header().Get("Content-Type"))
+	}
+	n, err := rw.ResponseWriter.Write(p)
+	if err != nil {
+		rw.writeFailed = true
+	}
+	rw.rec.Bytes += int64(n)
+	if rw.live != nil {
+		rw.live.bytes.Add(int64(n))
+	}
+	return n, err
+}
+
+func (rw *recordingWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rw *recordingWriter) Unwrap() http.ResponseWriter { return rw.ResponseWriter }
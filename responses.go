@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// openAIResources are the stateful OpenAI APIs relayed under /api/openai/:
+// the Responses API, and assistants with their threads, messages and runs.
+// The last two are still versioned by a beta header.
+var openAIResources = map[string]string{
+	"responses":  "",
+	"assistants": "assistants=v2",
+	"threads":    "assistants=v2",
+}
+
+// pendingStatus are the run and background response states that are still
+// changing, which ?wait polls through.
+var pendingStatus = map[string]bool{"queued": true, "in_progress": true, "cancelling": true}
+
+// maxResourceWait bounds one ?wait poll.
+const maxResourceWait = time.Minute
+
+// resourcePath is the part of the request path after /api/openai/, as
+// sent. Escaped slashes and "." or ".." segments are refused, so the path
+// can't climb out of the allowlisted resource upstream.
+func resourcePath(r *http.Request) (string, bool) {
+	escaped := strings.Trim(strings.TrimPrefix(r.URL.EscapedPath(), "/api/openai/"), "/")
+	if lower := strings.ToLower(escaped); strings.Contains(lower, "%2f") || strings.Contains(lower, "%5c") {
+		return "", false
+	}
+	segments := strings.Split(escaped, "/")
+	for i, seg := range segments {
+		seg, err := url.PathUnescape(seg)
+		if err != nil || seg == "" || seg == "." || seg == ".." || strings.ContainsAny(seg, "?#\\") {
+			return "", false
+		}
+		segments[i] = seg
+	}
+	p := strings.Join(segments, "/")
+	return p, path.Clean("/"+p) == "/"+p
+}
+
+// handleOpenAIResources relays /api/openai/<path> to the same path on the
+// OpenAI API with the server-held key: creating and fetching responses,
+// managing threads and runs, submitting tool outputs. Bodies pass through
+// as they are, less apiKey and keyProfile. Usage is read from what POSTs
+// return, streamed or not. GET takes ?wait=30s to poll a run or background
+// response until its status settles, so clients need not poll themselves.
+func handleOpenAIResources(w http.ResponseWriter, r *http.Request) {
+	p, _ := lookupProvider("openai")
+	path, ok := resourcePath(r)
+	if !ok {
+		http.Error(w, "Bad path: "+r.URL.EscapedPath(), http.StatusBadRequest)
+		return
+	}
+	resource, _, _ := strings.Cut(path, "/")
+	beta, ok := openAIResources[resource]
+	if !ok {
+		http.Error(w, "No OpenAI API at /api/openai/"+path, http.StatusNotFound)
+		return
+	}
+	var body map[string]interface{}
+	switch r.Method {
+	case "GET", "DELETE":
+	case "POST":
+		// Some POSTs, such as cancel, take no body.
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+			writeDecodeError(w, err)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	var wait time.Duration
+	if s := query.Get("wait"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 || r.Method != "GET" {
+			http.Error(w, fmt.Sprintf("wait: %q is not a duration such as 30s, on a GET", s), http.StatusBadRequest)
+			return
+		}
+		wait = min(d, maxResourceWait)
+		query.Del("wait")
+	}
+
+	profile := takeString(body, "keyProfile", r.Header.Get("X-Key-Profile"))
+	rec := recordFrom(r)
+	apiKey, err := resolveAPIKey(p, rec.user(), takeString(body, "apiKey", ""), profile)
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	stream, _ := body["stream"].(bool)
+	model, _ := body["model"].(string)
+	if resolved := aliases.resolveModel(p.Name(), model); resolved != model {
+		model, body["model"] = resolved, resolved
+	}
+	if body != nil {
+		truncated, err := limitProviderBody(body, p.Name(), model, rec.user())
+		if err != nil {
+			writeBuildError(w, err)
+			return
+		}
+		markTruncated(w, truncated)
+		if !checkPrompts(w, r, body) {
+			return
+		}
+	}
+	rec.describe(p.Name(), model, stream, body)
+	if r.Method == "POST" {
+		rec.trackUsage(&openAIResourceUsage)
+		injectInstructions(body, p.Name(), path)
+	}
+	rec.setKey(apiKey)
+	if err := checkBudgets(w, rec, p.Name(), apiKey); err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	if body != nil {
+		if err := quotas.reserve(p, apiKey, estimateTokens(body)); err != nil {
+			writeBuildError(w, err)
+			return
+		}
+	}
+
+	target := strings.TrimSuffix(p.Endpoint(), "/chat/completions") + "/" + (&url.URL{Path: path}).EscapedPath()
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	newRequest := func() (*http.Request, error) {
+		var data io.Reader
+		if body != nil {
+			raw, err := json.Marshal(body)
+			if err != nil {
+				return nil, err
+			}
+			data = bytes.NewReader(raw)
+		}
+		req, err := http.NewRequestWithContext(r.Context(), r.Method, target, data)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if v := firstSet(r.Header.Get("OpenAI-Beta"), beta); v != "" {
+			req.Header.Set("OpenAI-Beta", v)
+		}
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		return req, nil
+	}
+	if wait > 0 {
+		awaitResource(w, r, p, newRequest, wait)
+		return
+	}
+
+	req, err := newRequest()
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	release, err := acquireUpstream(w, r, p)
+	if err != nil {
+		writeAcquireError(w, err)
+		return
+	}
+	defer release()
+	forward(w, p, req)
+}
+
+// awaitResource polls until the object's status is no longer pending or
+// wait runs out, then relays the last reply. Usage counts only when the
+// poll saw the object finish, so polling a finished run again is free.
+func awaitResource(w http.ResponseWriter, r *http.Request, p Provider, newRequest func() (*http.Request, error), wait time.Duration) {
+	deadline := time.Now().Add(wait)
+	delay, sawPending := 500*time.Millisecond, false
+	for {
+		req, err := newRequest()
+		if err != nil {
+			writeBuildError(w, err)
+			return
+		}
+		release, err := acquireUpstream(w, r, p)
+		if err != nil {
+			writeAcquireError(w, err)
+			return
+		}
+		resp, err := doUpstream(p, req)
+		if err != nil {
+			release()
+			writeUpstreamError(w, err)
+			return
+		}
+		raw, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		release()
+		if err != nil {
+			writeUpstreamError(w, err)
+			return
+		}
+
+		var obj struct {
+			Status string `json:"status"`
+		}
+		json.Unmarshal(raw, &obj)
+		left := time.Until(deadline)
+		if resp.StatusCode != http.StatusOK || !pendingStatus[obj.Status] || left <= 0 {
+			if sawPending && !pendingStatus[obj.Status] {
+				if out, err := openAIResourceUsage.parse(raw); err == nil {
+					rec := recordFrom(r)
+					if rec.Model == "" {
+						rec.Model = out.Model
+					}
+					rec.setUsage(out.Usage)
+				}
+			}
+			w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+			w.WriteHeader(resp.StatusCode)
+			w.Write(raw)
+			return
+		}
+		sawPending = true
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(min(delay, left)):
+		}
+		delay = min(2*delay, 2*time.Second)
+	}
+}
+
+// resourceUsage covers both shapes: responses report input and output
+// tokens, runs prompt and completion tokens.
+type resourceUsage struct {
+	InputTokens      int `json:"input_tokens"`
+	OutputTokens     int `json:"output_tokens"`
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+func (u resourceUsage) chat() chatUsage {
+	return chatUsage{InputTokens: u.InputTokens + u.PromptTokens, OutputTokens: u.OutputTokens + u.CompletionTokens}
+}
+
+// openAIResourceUsage reads usage from responses and runs, for the usage
+// tap; it builds no requests.
+var openAIResourceUsage = chatDialect{
+	parse: func(data []byte) (*chatResponse, error) {
+		var r struct {
+			Model string        `json:"model"`
+			Usage resourceUsage `json:"usage"`
+		}
+		if err := json.Unmarshal(data, &r); err != nil {
+			return nil, err
+		}
+		return &chatResponse{Model: r.Model, Usage: r.Usage.chat()}, nil
+	},
+	event: func(s *chatStream, event string, data []byte) (string, bool) {
+		var ev struct {
+			Type     string          `json:"type"`
+			Delta    json.RawMessage `json:"delta"`
+			Response struct {
+				Usage resourceUsage `json:"usage"`
+			} `json:"response"`
+			Usage resourceUsage `json:"usage"` // run events carry the run itself
+		}
+		if json.Unmarshal(data, &ev) != nil {
+			return "", false
+		}
+		switch firstSet(event, ev.Type) {
+		case "response.output_text.delta":
+			var text string
+			json.Unmarshal(ev.Delta, &text)
+			return text, false
+		case "response.completed", "response.incomplete", "response.failed":
+			s.usage = ev.Response.Usage.chat()
+			return "", true
+		case "thread.message.delta":
+			var delta struct {
+				Content []struct {
+					Text struct {
+						Value string `json:"value"`
+					} `json:"text"`
+				} `json:"content"`
+			}
+			json.Unmarshal(ev.Delta, &delta)
+			var text strings.Builder
+			for _, c := range delta.Content {
+				text.WriteString(c.Text.Value)
+			}
+			return text.String(), false
+		case "thread.run.completed", "thread.run.incomplete", "thread.run.failed", "thread.run.cancelled", "thread.run.expired":
+			s.usage = ev.Usage.chat()
+		}
+		return "", false
+	},
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryConfig retries upstream calls that failed before the upstream did
+// any work: connection errors and overloaded or rate-limited answers.
+type RetryConfig struct {
+	// Attempts is the most tries per request, the first included; 1
+	// turns retries off.
+	Attempts int `json:"attempts"`
+	// Backoff is the wait before the first retry, doubled for each one
+	// after, up to MaxBackoff. Each wait is jittered down by up to half.
+	Backoff    duration `json:"backoff"`
+	MaxBackoff duration `json:"max_backoff"`
+}
+
+func (c RetryConfig) validate() []error {
+	var errs []error
+	if c.Attempts < 1 {
+		errs = append(errs, errors.New("retry.attempts: must be at least 1"))
+	}
+	if c.Backoff < 0 || c.MaxBackoff < c.Backoff {
+		errs = append(errs, errors.New("retry.backoff: must not be negative or above max_backoff"))
+	}
+	return errs
+}
+
+// retryableStatus lists answers that mean "try again later". 529 is
+// Anthropic's overloaded error.
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, 529:
+		return true
+	}
+	return false
+}
+
+// retryableError reports whether a transport error is worth retrying.
+// Timeouts are not: the upstream may still be generating, and a retry
+// would double the wait.
+func retryableError(ctx context.Context, err error) bool {
+	var ne net.Error
+	return ctx.Err() == nil && !(errors.As(err, &ne) && ne.Timeout())
+}
+
+// retryDelay is the wait before retry n (1 for the first). An upstream's
+// Retry-After in seconds is honoured; ok is false when it asks for longer
+// than MaxBackoff, and the client is better off getting the answer.
+func (c RetryConfig) retryDelay(n int, resp *http.Response) (wait time.Duration, ok bool) {
+	if resp != nil {
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s >= 0 {
+			d := time.Duration(s) * time.Second
+			return d, d <= time.Duration(c.MaxBackoff)
+		}
+	}
+	d := time.Duration(c.Backoff)
+	for i := 1; i < n && d < time.Duration(c.MaxBackoff); i++ {
+		d *= 2
+	}
+	d = min(d, time.Duration(c.MaxBackoff))
+	if d <= 0 {
+		return 0, true
+	}
+	return d/2 + rand.N(d/2+1), true
+}
+
+// sendWithRetry sends req, retrying per config.Retry. Each attempt gets a
+// fresh copy of the body, so only requests with GetBody, as built by
+// http.NewRequest from a buffer, are retried.
+func sendWithRetry(client *http.Client, name string, req *http.Request) (*http.Response, error) {
+	rc := config.Retry
+	ctx := req.Context()
+	for attempt := 1; ; attempt++ {
+		try := req
+		if attempt > 1 {
+			try = req.Clone(ctx)
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				try.Body = body
+			}
+		}
+		resp, err := client.Do(try)
+
+		last := attempt >= rc.Attempts || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil)
+		var reason string
+		switch {
+		case err != nil && !last && retryableError(ctx, err):
+			reason = err.Error()
+		case err == nil && !last && retryableStatus(resp.StatusCode):
+			reason = resp.Status
+		default:
+			return resp, err
+		}
+
+		wait, ok := rc.retryDelay(attempt, resp)
+		if !ok {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		metricUpstreamRetries.inc(name)
+		slog.Warn("upstream retry", "request_id", requestID(ctx), "provider", name,
+			"attempt", attempt, "of", rc.Attempts, "reason", reason, "wait", wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
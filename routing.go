@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// RouteConfig is one routing rule for /api/chat. Rules are tried in order
+// and the first whose conditions all hold sends the request to its target,
+// so clients can ask for e.g. model "auto" and leave the choice to the
+// proxy. Conditions left empty always hold.
+type RouteConfig struct {
+	Name string `json:"name"`
+	// Models and Providers match what the client asked for; models may
+	// use * wildcards, as in "claude-*".
+	Models    []string `json:"models"`
+	Providers []string `json:"providers"`
+	Users     []string `json:"users"`
+	// Tags holds if the request carries any of them, in "tags".
+	Tags []string `json:"tags"`
+	// MinPromptTokens and MaxPromptTokens bound the estimated prompt size.
+	MinPromptTokens int `json:"min_prompt_tokens"`
+	MaxPromptTokens int `json:"max_prompt_tokens"`
+	// Hours is a daily window such as "09:00-17:30" or "22:00-06:00",
+	// in TimeZone (an IANA name; local time by default).
+	Hours    string     `json:"hours"`
+	TimeZone string     `json:"time_zone"`
+	To       ChatTarget `json:"to"`
+	// SystemPrompt is added to the system prompt of requests the rule
+	// routes; see SystemPromptConfig.
+	SystemPrompt string `json:"system_prompt"`
+}
+
+// validate checks the rule as entry i of section, routes or canaries.
+func (rc RouteConfig) validate(section string, i int) []error {
+	field := fmt.Sprintf("%s[%d]", section, i)
+	if rc.Name != "" {
+		field = section + "." + rc.Name
+	}
+	errs := rc.To.validate(field + ".to")
+	for _, m := range rc.Models {
+		if _, err := path.Match(m, ""); err != nil {
+			errs = append(errs, fmt.Errorf("%s.models: bad pattern %q", field, m))
+		}
+	}
+	if rc.MinPromptTokens < 0 || rc.MaxPromptTokens < 0 ||
+		(rc.MaxPromptTokens > 0 && rc.MaxPromptTokens < rc.MinPromptTokens) {
+		errs = append(errs, fmt.Errorf("%s: prompt token bounds must not be negative or crossed", field))
+	}
+	if rc.Hours != "" {
+		if _, _, ok := parseHours(rc.Hours); !ok {
+			errs = append(errs, fmt.Errorf("%s.hours: %q is not HH:MM-HH:MM", field, rc.Hours))
+		}
+	}
+	if _, err := time.LoadLocation(rc.TimeZone); err != nil {
+		errs = append(errs, fmt.Errorf("%s.time_zone: %w", field, err))
+	}
+	return errs
+}
+
+// parseHours reads "HH:MM-HH:MM" as minutes since midnight.
+func parseHours(s string) (from, to int, ok bool) {
+	a, b, found := strings.Cut(s, "-")
+	if !found {
+		return 0, 0, false
+	}
+	minutes := func(s string) (int, bool) {
+		t, err := time.Parse("15:04", strings.TrimSpace(s))
+		return t.Hour()*60 + t.Minute(), err == nil
+	}
+	from, okFrom := minutes(a)
+	to, okTo := minutes(b)
+	return from, to, okFrom && okTo
+}
+
+// matches reports whether the rule applies to cr from user at now.
+func (rc RouteConfig) matches(cr *chatRequest, user string, promptTokens int, now time.Time) bool {
+	if len(rc.Providers) > 0 && !slices.Contains(rc.Providers, cr.Provider) {
+		return false
+	}
+	if len(rc.Models) > 0 && !slices.ContainsFunc(rc.Models, func(m string) bool {
+		ok, _ := path.Match(m, cr.Model)
+		return ok
+	}) {
+		return false
+	}
+	if len(rc.Users) > 0 && !slices.Contains(rc.Users, user) {
+		return false
+	}
+	if len(rc.Tags) > 0 && !slices.ContainsFunc(cr.Tags, func(t string) bool { return slices.Contains(rc.Tags, t) }) {
+		return false
+	}
+	if promptTokens < rc.MinPromptTokens || (rc.MaxPromptTokens > 0 && promptTokens > rc.MaxPromptTokens) {
+		return false
+	}
+	if rc.Hours != "" {
+		loc, _ := time.LoadLocation(rc.TimeZone)
+		t := now.In(loc)
+		m := t.Hour()*60 + t.Minute()
+		from, to, _ := parseHours(rc.Hours)
+		if from <= to && (m < from || m >= to) || from > to && m < from && m >= to {
+			return false
+		}
+	}
+	return true
+}
+
+// routeChat applies the first matching rule to cr and returns its name,
+// or "" when none matched and cr is unchanged.
+func routeChat(cr *chatRequest, user string, now time.Time) string {
+	if len(config.Routes) == 0 {
+		return ""
+	}
+	promptTokens := len(cr.promptText()) / 4
+	for i, rc := range config.Routes {
+		if !rc.matches(cr, user, promptTokens, now) {
+			continue
+		}
+		name := rc.Name
+		if name == "" {
+			name = fmt.Sprintf("routes[%d]", i)
+		}
+		slog.Debug("chat route", "route", name, "from", cr.Provider+"/"+cr.Model, "to", rc.To.Provider+"/"+rc.To.Model)
+		cr.Provider, cr.Model, cr.routeSystem = rc.To.Provider, rc.To.Model, rc.SystemPrompt
+		return name
+	}
+	return ""
+}
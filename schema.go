@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+)
+
+// bodySchema is what an upstream API accepts in a request body. Bodies are
+// checked against it before they are forwarded, so a mistake gets a 400
+// naming the field instead of whatever the provider makes of it. Fields
+// that are not listed pass unchecked.
+type bodySchema struct {
+	required []string // top-level fields
+	messages string   // the array holding the conversation
+	roles    []string // allowed message roles
+	// roleOptional allows messages without a role, as Gemini does.
+	roleOptional bool
+	// ranges bounds numeric fields, by dotted path.
+	ranges map[string]numRange
+	// maxTemperature is the highest temperature the API takes, for
+	// checking /api/chat requests before they are translated.
+	maxTemperature float64
+}
+
+type numRange struct {
+	min, max float64
+	integer  bool
+}
+
+var unbounded = math.Inf(1)
+
+// optional returns a copy of s that does not require fields.
+func (s *bodySchema) optional(fields ...string) *bodySchema {
+	c := *s
+	c.required = slices.DeleteFunc(slices.Clone(s.required), func(f string) bool { return slices.Contains(fields, f) })
+	return &c
+}
+
+// check reports the first problem with body as a badRequest.
+func (s *bodySchema) check(body map[string]interface{}) error {
+	for _, f := range s.required {
+		if v, ok := body[f]; !ok || v == nil || v == "" {
+			return badRequest(f + ": required")
+		}
+	}
+	if s.messages != "" {
+		if v, ok := body[s.messages]; ok {
+			list, ok := v.([]interface{})
+			if !ok || len(list) == 0 {
+				return badRequest(s.messages + ": must be a non-empty array")
+			}
+			for i, m := range list {
+				if err := s.checkMessage(fmt.Sprintf("%s[%d]", s.messages, i), m); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	paths := make([]string, 0, len(s.ranges))
+	for p := range s.ranges {
+		paths = append(paths, p)
+	}
+	slices.Sort(paths)
+	for _, p := range paths {
+		v, ok := lookupPath(body, p)
+		if !ok || v == nil {
+			continue
+		}
+		n, ok := v.(float64)
+		if !ok {
+			return badRequest(p + ": must be a number")
+		}
+		if err := s.ranges[p].check(p, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *bodySchema) checkMessage(field string, m interface{}) error {
+	msg, ok := m.(map[string]interface{})
+	if !ok {
+		return badRequest(field + ": must be an object")
+	}
+	if len(s.roles) == 0 {
+		return nil
+	}
+	role, present := msg["role"]
+	if !present && s.roleOptional {
+		return nil
+	}
+	if r, _ := role.(string); !slices.Contains(s.roles, r) {
+		return badRequest(fmt.Sprintf("%s.role: %s is not one of %s", field, quoted(role), strings.Join(s.roles, ", ")))
+	}
+	return nil
+}
+
+func (r numRange) check(field string, n float64) error {
+	if r.integer && n != math.Trunc(n) {
+		return badRequest(fmt.Sprintf("%s: %g is not an integer", field, n))
+	}
+	if n < r.min || n > r.max {
+		if r.max == unbounded {
+			return badRequest(fmt.Sprintf("%s: %g is below the minimum of %g", field, n, r.min))
+		}
+		return badRequest(fmt.Sprintf("%s: %g is outside %g to %g", field, n, r.min, r.max))
+	}
+	return nil
+}
+
+// lookupPath finds a dotted path such as "generationConfig.temperature".
+func lookupPath(body map[string]interface{}, path string) (interface{}, bool) {
+	var v interface{} = body
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func quoted(v interface{}) string {
+	if v == nil {
+		return "missing"
+	}
+	if s, ok := v.(string); ok {
+		return fmt.Sprintf("%q", s)
+	}
+	return fmt.Sprint(v)
+}
+
+// validate checks a /api/chat request before it is translated, against
+// what schema's API takes.
+func (cr *chatRequest) validate(schema *bodySchema) error {
+	if len(cr.Messages) == 0 {
+		return badRequest("messages: must be a non-empty array")
+	}
+	if err := validateMessages(cr.Messages); err != nil {
+		return err
+	}
+	if cr.MaxTokens < 0 {
+		return badRequest("max_tokens: must not be negative")
+	}
+	if cr.Temperature != nil && schema != nil && schema.maxTemperature > 0 {
+		if err := (numRange{0, schema.maxTemperature, false}).check("temperature", *cr.Temperature); err != nil {
+			return err
+		}
+	}
+	if cr.TopP != nil {
+		if err := (numRange{0, 1, false}).check("top_p", *cr.TopP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateMessages checks canonical messages, wherever they come from.
+func validateMessages(list []chatMessage) error {
+	for i, m := range list {
+		if m.Role != "system" && m.Role != "user" && m.Role != "assistant" && m.Role != "tool" {
+			return badRequest(fmt.Sprintf("messages[%d].role: %q is not one of system, user, assistant, tool", i, m.Role))
+		}
+		if m.Role == "tool" && m.ToolCallID == "" {
+			return badRequest(fmt.Sprintf("messages[%d].tool_call_id: required on tool messages", i))
+		}
+		if len(m.ToolCalls) > 0 && m.Role != "assistant" {
+			return badRequest(fmt.Sprintf("messages[%d].tool_calls: only assistant messages can make tool calls", i))
+		}
+		if m.Content == "" && len(m.Images) == 0 && len(m.ToolCalls) == 0 && m.Role != "tool" {
+			return badRequest(fmt.Sprintf("messages[%d].content: must not be empty", i))
+		}
+		if len(m.Images) > 0 && m.Role != "user" {
+			return badRequest(fmt.Sprintf("messages[%d].images: only user messages can carry images", i))
+		}
+	}
+	return nil
+}
+
+var anthropicSchema = &bodySchema{
+	required: []string{"model", "max_tokens", "messages"},
+	messages: "messages",
+	roles:    []string{"user", "assistant"},
+	ranges: map[string]numRange{
+		"max_tokens":  {1, unbounded, true},
+		"temperature": {0, 1, false},
+		"top_p":       {0, 1, false},
+		"top_k":       {0, unbounded, true},
+	},
+	maxTemperature: 1,
+}
+
+var openAISchema = &bodySchema{
+	required: []string{"model", "messages"},
+	messages: "messages",
+	roles:    []string{"system", "developer", "user", "assistant", "tool", "function"},
+	ranges: map[string]numRange{
+		"max_tokens":            {1, unbounded, true},
+		"max_completion_tokens": {1, unbounded, true},
+		"n":                     {1, 128, true},
+		"temperature":           {0, 2, false},
+		"top_p":                 {0, 1, false},
+		"presence_penalty":      {-2, 2, false},
+		"frequency_penalty":     {-2, 2, false},
+		"top_logprobs":          {0, 20, true},
+	},
+	maxTemperature: 2,
+}
+
+var geminiSchema = &bodySchema{
+	required:     []string{"model", "contents"},
+	messages:     "contents",
+	roles:        []string{"user", "model"},
+	roleOptional: true,
+	ranges: map[string]numRange{
+		"generationConfig.maxOutputTokens": {1, unbounded, true},
+		"generationConfig.candidateCount":  {1, 8, true},
+		"generationConfig.temperature":     {0, 2, false},
+		"generationConfig.topP":            {0, 1, false},
+		"generationConfig.topK":            {0, unbounded, true},
+	},
+	maxTemperature: 2,
+}
+
+var cohereSchema = &bodySchema{
+	required: []string{"model", "messages"},
+	messages: "messages",
+	roles:    []string{"system", "user", "assistant", "tool"},
+	ranges: map[string]numRange{
+		"max_tokens":  {1, unbounded, true},
+		"temperature": {0, 1, false},
+	},
+	maxTemperature: 1,
+}
+
+var ollamaSchema = &bodySchema{
+	required:       []string{"model", "messages"},
+	messages:       "messages",
+	roles:          []string{"system", "user", "assistant", "tool"},
+	maxTemperature: 2,
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// semanticCache answers /api/chat requests whose prompt embeds close to one
+// already answered, for demos where many people ask the same thing in
+// slightly different words. Entries are grouped by provider and model and
+// compared by cosine similarity.
+type semanticCache struct {
+	embedder   Provider
+	model      string
+	threshold  float64
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string][]semanticEntry // provider/model -> oldest first
+}
+
+type semanticEntry struct {
+	vector  []float64
+	expires time.Time
+	body    []byte
+}
+
+// semCache is the semantic cache, or nil when it is not configured.
+var semCache *semanticCache
+
+// promptText is what gets embedded: the system prompt and the conversation.
+func (cr *chatRequest) promptText() string {
+	var b strings.Builder
+	if cr.System != "" {
+		b.WriteString("system: " + cr.System + "\n")
+	}
+	for _, m := range cr.Messages {
+		b.WriteString(m.Role + ": " + m.Content + "\n")
+		for _, img := range m.images {
+			b.WriteString("[image " + img.sum + "]\n")
+		}
+	}
+	return b.String()
+}
+
+// lookup returns the best cached reply above the threshold and its score.
+func (c *semanticCache) lookup(bucket string, vector []float64) ([]byte, float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	var best []byte
+	bestScore := 0.0
+	live := c.entries[bucket][:0]
+	for _, e := range c.entries[bucket] {
+		if now.After(e.expires) {
+			continue
+		}
+		live = append(live, e)
+		if score := cosine(vector, e.vector); score >= c.threshold && score > bestScore {
+			best, bestScore = e.body, score
+		}
+	}
+	c.entries[bucket] = live
+	return best, bestScore
+}
+
+func (c *semanticCache) store(bucket string, vector []float64, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := append(c.entries[bucket], semanticEntry{vector: vector, expires: time.Now().Add(c.ttl), body: body})
+	if c.maxEntries > 0 && len(entries) > c.maxEntries {
+		entries = entries[len(entries)-c.maxEntries:]
+	}
+	c.entries[bucket] = entries
+}
+
+func cosine(a, b []float64) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += a[i] * b[i]
+		na += a[i] * a[i]
+		nb += b[i] * b[i]
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(na*nb)
+}
+
+// embed gets a vector for text from the configured embedding provider,
+// using its server-side key.
+func (c *semanticCache) embed(ctx context.Context, text string) ([]float64, error) {
+	var url string
+	var body map[string]interface{}
+	switch endpoint := c.embedder.Endpoint(); {
+	case strings.HasSuffix(endpoint, "/api/chat"): // Ollama
+		url = strings.TrimSuffix(endpoint, "/chat") + "/embed"
+		body = map[string]interface{}{"model": c.model, "input": text}
+	case strings.HasSuffix(endpoint, "/chat/completions"): // OpenAI-compatible
+		url = strings.TrimSuffix(endpoint, "/chat/completions") + "/embeddings"
+		body = map[string]interface{}{"model": c.model, "input": text}
+	default:
+		return nil, fmt.Errorf("%s has no embeddings API", c.embedder.Name())
+	}
+
+	req, err := newJSONRequest(url, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.embedder.RequiresKey() {
+		key := serverAPIKey(c.embedder)
+		if key == "" {
+			return nil, errors.New("no server-side key for " + c.embedder.Name())
+		}
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	for k, v := range config.upstreamHeaders(c.embedder.Name()) {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := upstreamClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("embeddings: %s: %s", resp.Status, strings.TrimSpace(string(raw)))
+	}
+
+	var out struct {
+		Data []struct {
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+		Embeddings [][]float64 `json:"embeddings"` // Ollama
+	}
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(out.Data) > 0:
+		return out.Data[0].Embedding, nil
+	case len(out.Embeddings) > 0:
+		return out.Embeddings[0], nil
+	}
+	return nil, errors.New("embeddings: empty response")
+}
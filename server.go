@@ -1,101 +1,329 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"io"
-	"log"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
-	// Serve static files
-	fs := http.FileServer(http.Dir("."))
-	http.Handle("/", fs)
+	opts := registerFlags()
+	flag.Parse()
+	if opts.verifyAudit != "" {
+		os.Exit(runVerifyAudit(opts.verifyAudit))
+	}
 
-	// Anthropic proxy
-	http.HandleFunc("/api/anthropic", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
+	configPath := opts.configPath()
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		fatal("config", err)
+	}
+	opts.apply(cfg)
+	if err := cfg.validate(); err != nil {
+		fatal("config", err)
+	}
+	if served := cfg.servedSecrets(configPath); len(served) > 0 {
+		fatal("static_dir", fmt.Errorf("%q would serve %s; move them or serve another directory", cfg.StaticDir, strings.Join(served, ", ")))
+	}
+	config = cfg
+	setupLogging(cfg.Log)
+	applyConfig(cfg)
+
+	if cfg.VaultFile != "" {
+		if keyVault, err = openVault(cfg.VaultFile, os.Getenv("QUIRK_VAULT_PASSPHRASE")); err != nil {
+			fatal("vault", err)
 		}
+		slog.Info("🔐 Key vault", "path", cfg.VaultFile, "keys", len(keyVault.providers()))
+	}
 
-		var body map[string]interface{}
-		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
-			return
+	if cfg.AuditFile != "" {
+		if audit, err = openAuditLog(cfg.AuditFile, auditKey()); err != nil {
+			fatal("audit", err)
 		}
+		slog.Info("📜 Audit log", "path", cfg.AuditFile, "entries", audit.seq, "head", audit.prev)
+	}
+	loaded := map[string]interface{}{"path": configPath}
+	if data, err := os.ReadFile(configPath); err == nil {
+		loaded["sha256"] = sha256Hex(data)
+	}
+	audit.record("config.loaded", loaded)
 
-		apiKey, ok := body["apiKey"].(string)
-		if !ok || apiKey == "" {
-			http.Error(w, "API key required", http.StatusBadRequest)
-			return
+	if cfg.Log.DB != "" {
+		if logStore, err = openLogStore(cfg.Log.DB); err != nil {
+			fatal("request log", err)
+		}
+		if err := logStore.loadUsage(usage, spend); err != nil {
+			fatal("request log", err)
 		}
-		delete(body, "apiKey")
+		slog.Info("🗄️  Request log", "path", cfg.Log.DB)
+	}
 
-		jsonData, _ := json.Marshal(body)
-		req, _ := http.NewRequest("POST", "https://api.anthropic.com/v1/messages", bytes.NewBuffer(jsonData))
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("x-api-key", apiKey)
-		req.Header.Set("anthropic-version", "2023-06-01")
+	if cfg.EmbeddingCache.DB != "" {
+		if embedCache, err = openEmbeddingCache(cfg.EmbeddingCache); err != nil {
+			fatal("embedding cache", err)
+		}
+		slog.Info("🧮 Embedding cache", "path", cfg.EmbeddingCache.DB)
+	}
 
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	if cfg.RAG.enabled() {
+		if rag, err = openRAG(cfg.RAG); err != nil {
+			fatal("rag", err)
+		}
+		slog.Info("📚 Retrieval", "model", cfg.RAG.Provider+"/"+cfg.RAG.Model, "chunks", rag.count(), "path", cfg.RAG.DB)
+	}
+
+	if cfg.Templates.DB != "" {
+		if templates, err = openTemplateStore(cfg.Templates.DB); err != nil {
+			fatal("templates", err)
 		}
-		defer resp.Body.Close()
+		slog.Info("📝 Prompt templates", "path", cfg.Templates.DB, "templates", len(templates.versions))
+	}
 
-		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
-		w.WriteHeader(resp.StatusCode)
-		io.Copy(w, resp.Body)
-	})
+	if conversations, err = openConversations(cfg.Conversations); err != nil {
+		fatal("conversations", err)
+	}
+	if cfg.Conversations.DB != "" {
+		slog.Info("💬 Conversations", "path", cfg.Conversations.DB)
+	}
 
-	// OpenAI proxy
-	http.HandleFunc("/api/openai", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
+	if batches, err = openBatches(cfg.Batches); err != nil {
+		fatal("batches", err)
+	}
+	if cfg.Batches.DB != "" {
+		slog.Info("📦 Batches", "path", cfg.Batches.DB, "batches", len(batches.jobs))
+	}
+
+	if len(cfg.MCP) > 0 {
+		slog.Info("🔌 MCP servers", "servers", mcpNames())
+	}
+
+	if cfg.Auth.enabled() {
+		if accessTokens, err = newTokenStore(cfg.Auth); err != nil {
+			fatal("auth", err)
 		}
+	}
 
-		var body map[string]interface{}
-		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
-			return
+	if tracer = newTracerFromEnv(); tracer != nil {
+		slog.Info("🔭 Tracing", "endpoint", tracer.endpoint)
+	}
+
+	if cfg.OIDC.enabled() {
+		if sessions, err = openSessions(cfg.Sessions); err != nil {
+			fatal("sessions", err)
 		}
+		if oidc, err = newOIDCClient(cfg.OIDC); err != nil {
+			fatal("oidc", err)
+		}
+		slog.Info("👤 Sign-in", "provider", firstSet(cfg.OIDC.Provider, oidc.cfg.Issuer))
+	}
 
-		apiKey, ok := body["apiKey"].(string)
-		if !ok || apiKey == "" {
-			http.Error(w, "API key required", http.StatusBadRequest)
-			return
+	// Serve static files
+	var fs http.Handler = http.FileServer(http.Dir(cfg.StaticDir))
+	if oidc != nil {
+		fs = requireLogin(fs)
+		http.HandleFunc("/auth/login", oidc.handleLogin)
+		http.HandleFunc("/auth/callback", oidc.handleCallback)
+		http.HandleFunc("/auth/me", handleMe)
+		http.HandleFunc("/auth/logout", handleLogout)
+	}
+	http.Handle("/", fs)
+
+	for _, name := range providerNames() {
+		if !cfg.providerEnabled(name) {
+			continue
 		}
-		delete(body, "apiKey")
+		p, _ := lookupProvider(name)
+		http.HandleFunc("/api/"+name, withCORS(recorded(authenticated(rateLimited(fixtured(providerHandler(p)))))))
+	}
+	if cfg.providerEnabled("anthropic") {
+		http.HandleFunc("/api/anthropic/count_tokens", withCORS(recorded(authenticated(rateLimited(fixtured(handleAnthropicCountTokens))))))
+	}
+	if cfg.providerEnabled("openai") {
+		http.HandleFunc("/api/openai/", withCORS(recorded(authenticated(rateLimited(fixtured(handleOpenAIResources))))))
+		http.HandleFunc("/api/batches", withCORS(recorded(authenticated(rateLimited(fixtured(handleBatches))))))
+		http.HandleFunc("/api/batches/", withCORS(recorded(authenticated(rateLimited(fixtured(handleBatches))))))
+	}
+	http.HandleFunc("/api/chat", withCORS(recorded(authenticated(rateLimited(fixtured(handleChat))))))
+	http.HandleFunc("/api/tokenize", withCORS(recorded(authenticated(rateLimited(handleTokenize)))))
+	http.HandleFunc("/api/embeddings", withCORS(recorded(authenticated(rateLimited(fixtured(handleEmbeddings))))))
+	http.HandleFunc("/api/images", withCORS(recorded(authenticated(rateLimited(fixtured(handleImages))))))
+	http.HandleFunc("/api/transcribe", withCORS(recorded(authenticated(rateLimited(fixtured(handleTranscribe))))))
+	http.HandleFunc("/api/tts", withCORS(recorded(authenticated(rateLimited(fixtured(handleTTS))))))
+	http.HandleFunc("/api/realtime", withCORS(recorded(realtimeToken(authenticated(rateLimited(handleRealtime))))))
+	if rag != nil {
+		http.HandleFunc("/api/rag/chunks", withCORS(recorded(authenticated(rateLimited(fixtured(handleRAGChunks))))))
+		http.HandleFunc("/api/rag/search", withCORS(recorded(authenticated(rateLimited(fixtured(handleRAGSearch))))))
+		http.HandleFunc("/api/rag/collections", withCORS(recorded(authenticated(handleRAGCollections))))
+		http.HandleFunc("/api/ingest", withCORS(recorded(authenticated(rateLimited(fixtured(handleIngest))))))
+	}
+	http.HandleFunc("/api/uploads", withCORS(recorded(authenticated(handleUploads))))
+	http.HandleFunc("/api/uploads/", withCORS(recorded(authenticated(handleUploads))))
+	http.HandleFunc("/api/templates", withCORS(recorded(authenticated(handleTemplates))))
+	http.HandleFunc("/api/conversations", withCORS(recorded(authenticated(handleConversations))))
+	http.HandleFunc("/api/conversations/", withCORS(recorded(authenticated(handleConversations))))
+	http.HandleFunc("/api/feedback", withCORS(recorded(authenticated(handleFeedback))))
+	http.HandleFunc("/api/user/keys", withCORS(recorded(authenticated(handleUserKeys))))
+	http.HandleFunc("/api/admin/keys", withCORS(adminOnly(handleAdminKeys)))
+	http.HandleFunc("/api/admin/keys/rotate", withCORS(adminOnly(handleAdminKeyRotate)))
+	http.HandleFunc("/api/admin/keys/pools", withCORS(adminOnly(handleAdminKeyPools)))
+	http.HandleFunc("/api/admin/queue", withCORS(adminOnly(handleAdminQueue)))
+	http.HandleFunc("/api/admin/logs", withCORS(adminOnly(handleAdminLogs)))
+	http.HandleFunc("/api/admin/usage", withCORS(adminOnly(handleAdminUsage)))
+	http.HandleFunc("/api/admin/ratelimits", withCORS(adminOnly(handleAdminRateLimits)))
+	http.HandleFunc("/api/admin/users", withCORS(adminOnly(handleAdminUsers)))
+	http.HandleFunc("/api/admin/stats", withCORS(adminOnly(handleAdminStats)))
+	http.HandleFunc("/api/admin/aliases", withCORS(adminOnly(handleAdminAliases)))
+	http.HandleFunc("/api/admin/canaries", withCORS(adminOnly(handleAdminCanaries)))
+	http.HandleFunc("/api/admin/canaries/promote", withCORS(adminOnly(handleAdminCanaryAction)))
+	http.HandleFunc("/api/admin/canaries/rollback", withCORS(adminOnly(handleAdminCanaryAction)))
+	http.HandleFunc("/api/admin/templates", withCORS(adminOnly(handleAdminTemplates)))
+	http.HandleFunc("/api/admin/experiments", withCORS(adminOnly(handleAdminExperiments)))
+	http.HandleFunc("/api/admin/dashboard", withCORS(adminOnly(handleAdminDashboard)))
+	http.HandleFunc("/api/admin/dashboard/", withCORS(adminOnly(handleAdminDashboard)))
+	http.HandleFunc("/metrics", adminOnly(handleMetrics))
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz)
 
-		jsonData, _ := json.Marshal(body)
-		req, _ := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(jsonData))
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", "Bearer "+apiKey)
+	http.HandleFunc("/proxy/", withCORS(recorded(authenticated(rateLimited(fixtured(handlePassthrough))))))
 
-		client := &http.Client{}
-		resp, err := client.Do(req)
+	server := &http.Server{
+		Addr:         cfg.Listen,
+		ReadTimeout:  time.Duration(cfg.Timeouts.Read),
+		WriteTimeout: time.Duration(cfg.Timeouts.Write),
+		IdleTimeout:  time.Duration(cfg.Timeouts.Idle),
+	}
+
+	scheme := "http"
+	if cfg.TLS.enabled() {
+		if len(cfg.TLS.Autocert) > 0 {
+			slog.Info("🔒 Let's Encrypt", "hosts", cfg.TLS.Autocert, "cache", cfg.TLS.CacheDir)
+		}
+		redirect, err := setupTLS(server, cfg.TLS)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			fatal("tls", err)
+		}
+		if cfg.TLS.HTTPAddr != "" {
+			go serveHTTPRedirect(cfg.TLS.HTTPAddr, redirect)
+		}
+		scheme = "https"
+	}
+
+	base := scheme + "://" + displayAddr(cfg.Listen)
+	if configPath != "" {
+		slog.Info("⚙️  Config", "path", configPath)
+	}
+	slog.Info("🚀 Server running", "url", base)
+	if cfg.RateLimit.RPS > 0 {
+		slog.Info("🚦 Rate limit per client IP", "rps", cfg.RateLimit.RPS)
+	}
+	if accessTokens != nil {
+		slog.Info("🪪 Access tokens required on /api")
+	}
+	if p := cfg.Outbound.Proxy; p != "" && p != "direct" {
+		slog.Info("🌐 Outbound proxy", "proxy", redactProxy(p), "no_proxy", cfg.Outbound.NoProxy)
+	}
+	if t := cfg.Traffic; t.Mode == "record" {
+		slog.Info("⏺️  Recording upstream traffic", "dir", t.Dir)
+	} else if t.Mode == "replay" {
+		slog.Info("⏯️  Replaying recorded traffic; upstreams are not called", "dir", t.Dir, "pace", t.Pace)
+	}
+	if f := cfg.Fixtures; f.Dir != "" {
+		slog.Info("🧪 Answering /api requests from fixtures", "dir", f.Dir, "strict", f.Strict)
+	}
+	if cfg.ServerKeys {
+		slog.Info("🔑 Server-side keys only; apiKey from clients is ignored")
+	}
+	for _, name := range providerNames() {
+		if !cfg.providerEnabled(name) {
+			continue
+		}
+		if pc := cfg.Providers[name]; pc.BaseURL != "" || pc.Endpoint != "" {
+			p, _ := lookupProvider(name)
+			slog.Info("📝 Provider endpoint", "provider", name, "url", base+"/api/"+name, "upstream", p.Endpoint())
+		} else {
+			slog.Info("📝 Provider endpoint", "provider", name, "url", base+"/api/"+name)
+		}
+	}
+	slog.Info("📝 Unified chat endpoint", "url", base+"/api/chat")
+	slog.Info("📝 Token counting endpoint", "url", base+"/api/tokenize")
+	slog.Info("📝 Embeddings endpoint", "url", base+"/api/embeddings")
+	slog.Info("📝 Images endpoint", "url", base+"/api/images")
+	slog.Info("📝 Transcription endpoint", "url", base+"/api/transcribe")
+	slog.Info("📝 Speech endpoint", "url", base+"/api/tts")
+	slog.Info("📝 Realtime endpoint", "url", base+"/api/realtime")
+	slog.Info("📝 Responses and Assistants endpoints", "url", base+"/api/openai/")
+	slog.Info("📝 Batch endpoint", "url", base+"/api/batches")
+	if rag != nil {
+		slog.Info("📝 Retrieval endpoints", "url", base+"/api/rag/")
+		slog.Info("📝 Ingest endpoint", "url", base+"/api/ingest")
+	}
+	for _, u := range cfg.Passthrough.Upstreams {
+		slog.Info("📝 Passthrough", "upstream", u.Host, "url", base+"/proxy/"+u.Host+"/")
+	}
+	ready.Store(true)
+	serve(server, time.Duration(cfg.Timeouts.Shutdown))
+}
+
+// serve runs server until SIGTERM or SIGINT, then drains: /readyz starts
+// failing, the listener closes, and in-flight requests get up to drain to
+// finish before their connections are cut. Logs and traces are flushed
+// last so the drained requests are in them.
+func serve(server *http.Server, drain time.Duration) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	errc := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			errc <- server.ListenAndServeTLS("", "")
 			return
 		}
-		defer resp.Body.Close()
+		errc <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errc:
+		fatal("server", err)
+	case <-ctx.Done():
+	}
+	stop() // a second signal exits immediately
 
-		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
-		w.WriteHeader(resp.StatusCode)
-		io.Copy(w, resp.Body)
-	})
+	ready.Store(false)
+	slog.Info("🛑 Shutting down", "drain", drain)
+	shutdownCtx := context.Background()
+	if drain > 0 {
+		var cancel context.CancelFunc
+		shutdownCtx, cancel = context.WithTimeout(shutdownCtx, drain)
+		defer cancel()
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("drain timed out; closing remaining connections", "err", err)
+		server.Close()
+	}
 
-	http.HandleFunc("/proxy", func(w http.ResponseWriter, r *http.Request) {
-		log.Println(r)
-	})
+	closeMCP()
+	if logStore != nil {
+		if err := logStore.close(); err != nil {
+			slog.Error("request log", "err", err)
+		}
+	}
+	if tracer != nil {
+		tracer.shutdown()
+	}
+	audit.close()
+	slog.Info("👋 Stopped")
+}
 
-	log.Println("🚀 Server running on http://localhost:8080")
-	log.Println("📝 Anthropic endpoint: http://localhost:8080/api/anthropic")
-	log.Println("📝 OpenAI endpoint: http://localhost:8080/api/openai")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+// displayAddr turns a listen address like ":8080" into something clickable.
+func displayAddr(addr string) string {
+	if len(addr) > 0 && addr[0] == ':' {
+		return "localhost" + addr
+	}
+	return addr
 }
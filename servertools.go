@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+	"unicode/utf8"
+)
+
+// serverTool is a tool the proxy runs itself rather than handing the call
+// to the client. run returns the result for the model and whether it is an
+// error report.
+type serverTool struct {
+	def    chatTool
+	source string // e.g. "mcp:files", for the audit log
+	run    func(ctx context.Context, args json.RawMessage) (string, bool)
+}
+
+// serverCall is a call the proxy ran on the model's behalf, returned with
+// the reply so the client can show what happened.
+type serverCall struct {
+	ID        string          `json:"id"`
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+	Result    string          `json:"result"`
+	Error     bool            `json:"error,omitempty"`
+}
+
+// maxToolRounds bounds how often one request sends tool results back to
+// the model.
+const maxToolRounds = 8
+
+// addServerTools offers the built-in and MCP tools the request names.
+func (cr *chatRequest) addServerTools(ctx context.Context) error {
+	if cr.Stream {
+		return badRequest("builtin_tools, mcp: server tools run on buffered replies only")
+	}
+	if err := cr.addBuiltinTools(); err != nil {
+		return err
+	}
+	return cr.addMCPTools(ctx)
+}
+
+// offerServerTool adds t to the tools the request offers.
+func (cr *chatRequest) offerServerTool(t *serverTool) {
+	if cr.serverTools == nil {
+		cr.serverTools = map[string]*serverTool{}
+	}
+	cr.serverTools[t.def.Name] = t
+	cr.Tools = append(cr.Tools, t.def)
+}
+
+// serverSide reports whether the proxy can run every one of calls.
+func (cr *chatRequest) serverSide(calls []toolCall) bool {
+	for _, c := range calls {
+		if cr.serverTools[c.Name] == nil {
+			return false
+		}
+	}
+	return len(calls) > 0
+}
+
+// invoke runs one call, auditing it. Results longer than tools.max_result
+// are cut short.
+func (t *serverTool) invoke(r *http.Request, c toolCall) serverCall {
+	start := time.Now()
+	result, failed := t.run(r.Context(), c.Arguments)
+	if limit := config.Tools.maxResult(); utf8.RuneCountInString(result) > limit {
+		result = string([]rune(result)[:limit]) + "\n[truncated]"
+	}
+	rec := recordFrom(r)
+	audit.record("tool.call", map[string]interface{}{
+		"request_id": rec.ID,
+		"user":       rec.User,
+		"tool":       c.Name,
+		"source":     t.source,
+		"error":      failed,
+		"ms":         time.Since(start).Milliseconds(),
+	})
+	return serverCall{ID: c.ID, Name: c.Name, Arguments: c.Arguments, Result: result, Error: failed}
+}
+
+// runServerTools answers a reply's tool calls itself while the proxy can
+// run all of them: the calls and their results are added to the request's
+// messages and it goes back to the target that answered, up to
+// maxToolRounds times. It returns the first reply with calls it cannot
+// run, or none, with the usage of every round and the calls made; or nil
+// once it has answered the request itself because a round failed.
+func runServerTools(w http.ResponseWriter, r *http.Request, cr *chatRequest, at ChatTarget, target ChatProvider, apiKey string, out *chatResponse) *chatResponse {
+	total := out.Usage
+	rec := recordFrom(r)
+	var ran []serverCall
+	for round := 0; round < maxToolRounds && cr.serverSide(out.ToolCalls); round++ {
+		cr.Messages = append(cr.Messages, chatMessage{Role: "assistant", Content: out.Content, ToolCalls: out.ToolCalls, Thinking: out.Thinking})
+		for _, c := range out.ToolCalls {
+			call := cr.serverTools[c.Name].invoke(r, c)
+			ran = append(ran, call)
+			cr.Messages = append(cr.Messages, chatMessage{Role: "tool", ToolCallID: c.ID, Content: call.Result})
+		}
+
+		body := target.Dialect().body(cr)
+		estimated := estimateTokens(body)
+		resp, release, fail := sendChat(w, r, at, target, body, apiKey, estimated)
+		if fail != nil {
+			rec.setUsage(total)
+			fail.write(w)
+			return nil
+		}
+		raw, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		release()
+		if err != nil {
+			rec.setUsage(total)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return nil
+		}
+		next, err := target.Dialect().parse(raw)
+		if err != nil {
+			rec.setUsage(total)
+			http.Error(w, "Unexpected upstream response: "+err.Error(), http.StatusBadGateway)
+			return nil
+		}
+		quotas.settle(target, apiKey, estimated, next.Usage)
+		total.add(next.Usage)
+		out = next
+	}
+	out.Usage, out.ServerCalls = total, ran
+	rec.setUsage(total)
+	return out
+}
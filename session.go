@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sessionCookie = "quirk_session"
+
+// SessionConfig controls signed-in browser sessions. Store is "memory",
+// which forgets everyone on restart, or "sqlite", kept in DB.
+type SessionConfig struct {
+	Store string   `json:"store"`
+	DB    string   `json:"db"`
+	TTL   duration `json:"ttl"`
+}
+
+func (c SessionConfig) validate() []error {
+	var errs []error
+	switch c.Store {
+	case "memory":
+	case "sqlite":
+		if c.DB == "" {
+			errs = append(errs, errors.New("sessions.db: required for the sqlite store"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("sessions.store: %q is not memory or sqlite", c.Store))
+	}
+	if c.TTL <= 0 {
+		errs = append(errs, errors.New("sessions.ttl: must be positive"))
+	}
+	return errs
+}
+
+// session is a signed-in browser.
+type session struct {
+	User    string
+	Expires time.Time
+}
+
+// sessionBackend persists sessions by ID. Implementations drop expired
+// sessions in sweep.
+type sessionBackend interface {
+	put(id string, s session) error
+	get(id string) (session, bool)
+	delete(id string) error
+	sweep(now time.Time)
+}
+
+// sessionStore issues session cookies on top of a backend.
+type sessionStore struct {
+	ttl     time.Duration
+	backend sessionBackend
+}
+
+var sessions = &sessionStore{ttl: 24 * time.Hour, backend: newMemorySessions()}
+
+// openSessions builds the store from config.
+func openSessions(c SessionConfig) (*sessionStore, error) {
+	s := &sessionStore{ttl: time.Duration(c.TTL)}
+	if c.Store == "sqlite" {
+		b, err := openSQLiteSessions(c.DB)
+		if err != nil {
+			return nil, err
+		}
+		s.backend = b
+	} else {
+		s.backend = newMemorySessions()
+	}
+	go func() {
+		for now := range time.Tick(10 * time.Minute) {
+			s.backend.sweep(now)
+		}
+	}()
+	return s, nil
+}
+
+// start creates a session for user and sets its cookie.
+func (s *sessionStore) start(w http.ResponseWriter, user string) error {
+	var b [32]byte
+	rand.Read(b[:])
+	id := hex.EncodeToString(b[:])
+	expires := time.Now().Add(s.ttl)
+	if err := s.backend.put(id, session{User: user, Expires: expires}); err != nil {
+		return err
+	}
+	http.SetCookie(w, sessionCookieFor(id, expires))
+	return nil
+}
+
+// user returns the signed-in user for r, or "".
+func (s *sessionStore) user(r *http.Request) string {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+	sess, ok := s.backend.get(c.Value)
+	if !ok || time.Now().After(sess.Expires) {
+		return ""
+	}
+	return sess.User
+}
+
+// end deletes r's session, if any, and clears the cookie. It returns the
+// user who was signed in.
+func (s *sessionStore) end(w http.ResponseWriter, r *http.Request) string {
+	user := s.user(r)
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		if err := s.backend.delete(c.Value); err != nil {
+			slog.Error("sessions", "err", err)
+		}
+	}
+	http.SetCookie(w, sessionCookieFor("", time.Unix(0, 0)))
+	return user
+}
+
+func sessionCookieFor(id string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   config.TLS.enabled() || strings.HasPrefix(config.OIDC.RedirectURL, "https:"),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// handleLogout ends the browser's session.
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if user := sessions.end(w, r); user != "" {
+		audit.record("logout", map[string]interface{}{"user": user, "remote": clientIP(r)})
+	}
+	if r.Method == "GET" {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// memorySessions is the default backend.
+type memorySessions struct {
+	mu       sync.Mutex
+	sessions map[string]session
+}
+
+func newMemorySessions() *memorySessions {
+	return &memorySessions{sessions: map[string]session{}}
+}
+
+func (m *memorySessions) put(id string, s session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[id] = s
+	return nil
+}
+
+func (m *memorySessions) get(id string) (session, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	return s, ok
+}
+
+func (m *memorySessions) delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *memorySessions) sweep(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, s := range m.sessions {
+		if now.After(s.Expires) {
+			delete(m.sessions, id)
+		}
+	}
+}
+
+// sqliteSessions keeps sessions across restarts. Rows are keyed by a hash
+// of the cookie value, so the database alone cannot be used to sign in.
+type sqliteSessions struct {
+	db *sql.DB
+}
+
+const sessionSchema = `
+CREATE TABLE IF NOT EXISTS sessions (
+	id_hash TEXT PRIMARY KEY,
+	user    TEXT NOT NULL,
+	expires INTEGER NOT NULL
+)`
+
+func openSQLiteSessions(path string) (*sqliteSessions, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{"PRAGMA journal_mode=WAL", "PRAGMA busy_timeout=5000", sessionSchema} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("sessions: %w", err)
+		}
+	}
+	return &sqliteSessions{db: db}, nil
+}
+
+func (s *sqliteSessions) put(id string, sess session) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO sessions (id_hash, user, expires) VALUES (?, ?, ?)`,
+		sha256Hex([]byte(id)), sess.User, sess.Expires.Unix())
+	return err
+}
+
+func (s *sqliteSessions) get(id string) (session, bool) {
+	var sess session
+	var expires int64
+	err := s.db.QueryRow(`SELECT user, expires FROM sessions WHERE id_hash = ?`, sha256Hex([]byte(id))).Scan(&sess.User, &expires)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			slog.Error("sessions", "err", err)
+		}
+		return session{}, false
+	}
+	sess.Expires = time.Unix(expires, 0)
+	return sess, true
+}
+
+func (s *sqliteSessions) delete(id string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE id_hash = ?`, sha256Hex([]byte(id)))
+	return err
+}
+
+func (s *sqliteSessions) sweep(now time.Time) {
+	if _, err := s.db.Exec(`DELETE FROM sessions WHERE expires < ?`, now.Unix()); err != nil {
+		slog.Error("sessions", "err", err)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// awsCredentials is a resolved access key, optionally temporary.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expires         time.Time
+}
+
+var (
+	awsCredsMu     sync.Mutex
+	awsCredsCached *awsCredentials
+	// awsNoInstanceUntil skips the instance metadata probe for a while
+	// after it found nothing, so requests off EC2 don't each wait it out.
+	awsNoInstanceUntil time.Time
+)
+
+// awsInstanceRetry is how long a failed instance metadata probe is
+// remembered.
+const awsInstanceRetry = time.Minute
+
+// loadAWSCredentials walks the usual AWS provider chain: environment
+// variables, the shared credentials file, then container and instance
+// metadata. Temporary credentials are cached until shortly before expiry.
+func loadAWSCredentials() (*awsCredentials, error) {
+	if c := awsEnvCredentials(); c != nil {
+		return c, nil
+	}
+
+	awsCredsMu.Lock()
+	defer awsCredsMu.Unlock()
+	if c := awsCredsCached; c != nil && (c.Expires.IsZero() || time.Until(c.Expires) > 5*time.Minute) {
+		return c, nil
+	}
+
+	for _, source := range []func() (*awsCredentials, error){
+		awsSharedCredentials,
+		awsContainerCredentials,
+		awsInstanceCredentials,
+	} {
+		c, err := source()
+		if err != nil {
+			return nil, err
+		}
+		if c != nil {
+			awsCredsCached = c
+			return c, nil
+		}
+	}
+	return nil, errors.New("no AWS credentials found")
+}
+
+func awsEnvCredentials() *awsCredentials {
+	id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if id == "" || secret == "" {
+		return nil
+	}
+	return &awsCredentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: os.Getenv("AWS_SESSION_TOKEN")}
+}
+
+// awsSharedCredentials reads the AWS_PROFILE (or default) section of
+// ~/.aws/credentials or AWS_SHARED_CREDENTIALS_FILE.
+func awsSharedCredentials() (*awsCredentials, error) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	profile := envOr("AWS_PROFILE", "default")
+	var c awsCredentials
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != profile {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			c.AccessKeyID = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			c.SecretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			c.SessionToken = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return nil, nil
+	}
+	return &c, nil
+}
+
+// awsContainerCredentials queries the ECS/EKS credential endpoint when the
+// task role variables are set.
+func awsContainerCredentials() (*awsCredentials, error) {
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		endpoint = "http://169.254.170.2" + rel
+	}
+	if endpoint == "" {
+		return nil, nil
+	}
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	return fetchAWSMetadataCredentials(req)
+}
+
+// awsInstanceCredentials asks EC2 instance metadata (IMDSv2) for the
+// instance role's credentials. Off EC2 the request simply times out, and
+// the miss is remembered for awsInstanceRetry. The caller holds awsCredsMu.
+func awsInstanceCredentials() (*awsCredentials, error) {
+	if os.Getenv("AWS_EC2_METADATA_DISABLED") == "true" || time.Now().Before(awsNoInstanceUntil) {
+		return nil, nil
+	}
+	c, err := probeAWSInstance()
+	if c == nil && err == nil {
+		awsNoInstanceUntil = time.Now().Add(awsInstanceRetry)
+	}
+	return c, err
+}
+
+func probeAWSInstance() (*awsCredentials, error) {
+	client := &http.Client{Timeout: time.Second}
+	const base = "http://169.254.169.254/latest"
+
+	tokenReq, _ := http.NewRequest("PUT", base+"/api/token", nil)
+	tokenReq.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	resp, err := client.Do(tokenReq)
+	if err != nil {
+		return nil, nil
+	}
+	token, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	roleReq, _ := http.NewRequest("GET", base+"/meta-data/iam/security-credentials/", nil)
+	roleReq.Header.Set("X-aws-ec2-metadata-token", string(token))
+	resp, err = client.Do(roleReq)
+	if err != nil {
+		return nil, nil
+	}
+	role, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(role) == 0 {
+		return nil, nil
+	}
+
+	credReq, _ := http.NewRequest("GET", base+"/meta-data/iam/security-credentials/"+strings.TrimSpace(string(role)), nil)
+	credReq.Header.Set("X-aws-ec2-metadata-token", string(token))
+	return fetchAWSMetadataCredentials(credReq)
+}
+
+func fetchAWSMetadataCredentials(req *http.Request) (*awsCredentials, error) {
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("AWS credential endpoint returned " + resp.Status)
+	}
+
+	var out struct {
+		AccessKeyID     string
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return &awsCredentials{
+		AccessKeyID:     out.AccessKeyID,
+		SecretAccessKey: out.SecretAccessKey,
+		SessionToken:    out.Token,
+		Expires:         out.Expiration,
+	}, nil
+}
+
+// signSigV4 adds AWS Signature Version 4 headers to req. payload must be the
+// exact body that will be sent.
+func signSigV4(req *http.Request, payload []byte, creds *awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || lower == "accept" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.Join(values, ",")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		sigV4CanonicalURI(req.URL.EscapedPath()),
+		sigV4CanonicalQuery(req.URL.RawQuery),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// sigV4CanonicalURI encodes an already-escaped path a second time, as every
+// service other than S3 expects.
+func sigV4CanonicalURI(escapedPath string) string {
+	if escapedPath == "" {
+		return "/"
+	}
+	segments := strings.Split(escapedPath, "/")
+	for i, s := range segments {
+		segments[i] = awsURIEncode(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+func sigV4CanonicalQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	pairs := strings.Split(rawQuery, "&")
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// awsURIEncode percent-encodes everything except RFC 3986 unreserved bytes.
+func awsURIEncode(s string) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hexDigits[c>>4])
+		b.WriteByte(hexDigits[c&15])
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
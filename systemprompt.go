@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// SystemPromptConfig is a system prompt the proxy adds to every chat
+// request it forwards, for tone or compliance instructions clients can't
+// leave out. Providers and routes may add their own with system_prompt;
+// Text comes first, then the provider's, then the route's. Position
+// "prepend" (the default) puts them before the client's system prompt,
+// "append" after it, where they have the last word.
+type SystemPromptConfig struct {
+	Text     string `json:"text"`
+	Position string `json:"position"`
+}
+
+func (c SystemPromptConfig) validate() []error {
+	if c.Position != "" && c.Position != "prepend" && c.Position != "append" {
+		return []error{errors.New("system_prompt.position: must be prepend or append")}
+	}
+	return nil
+}
+
+// enforcedSystem is the configured system prompt for provider, with that
+// of the route that matched, or "".
+func enforcedSystem(provider, route string) string {
+	var parts []string
+	for _, s := range []string{config.SystemPrompt.Text, config.Providers[provider].SystemPrompt, route} {
+		if s = strings.TrimSpace(s); s != "" {
+			parts = append(parts, s)
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// joinSystem puts enforced before or after the client's system prompt.
+func joinSystem(enforced, client string) string {
+	switch {
+	case client == "":
+		return enforced
+	case config.SystemPrompt.Position == "append":
+		return client + "\n\n" + enforced
+	default:
+		return enforced + "\n\n" + client
+	}
+}
+
+// enforceSystem adds the configured system prompt to cr's, which
+// splitSystem has gathered into System.
+func (cr *chatRequest) enforceSystem() {
+	if enforced := enforcedSystem(cr.Provider, cr.routeSystem); enforced != "" {
+		cr.System = joinSystem(enforced, cr.System)
+	}
+}
+
+// injectSystem adds the configured system prompt to a provider's native
+// chat body in dialect d: Anthropic's system field, Gemini's
+// systemInstruction, or a system message in the others' messages.
+func injectSystem(body map[string]interface{}, provider string, d *chatDialect) {
+	enforced := enforcedSystem(provider, "")
+	if enforced == "" {
+		return
+	}
+	appendIt := config.SystemPrompt.Position == "append"
+	switch d {
+	case &anthropicDialect:
+		if _, ok := body["messages"]; !ok {
+			return // not a Claude body on Bedrock
+		}
+		switch system := body["system"].(type) {
+		case []interface{}:
+			body["system"] = withBlock(system, map[string]interface{}{"type": "text", "text": enforced}, appendIt)
+		case string:
+			body["system"] = joinSystem(enforced, system)
+		default:
+			body["system"] = enforced
+		}
+	case &geminiDialect:
+		key := "systemInstruction"
+		if _, ok := body["system_instruction"]; ok {
+			key = "system_instruction"
+		}
+		instruction, _ := body[key].(map[string]interface{})
+		if instruction == nil {
+			instruction = map[string]interface{}{}
+		}
+		parts, _ := instruction["parts"].([]interface{})
+		instruction["parts"] = withBlock(parts, map[string]interface{}{"text": enforced}, appendIt)
+		body[key] = instruction
+	default:
+		messages, ok := body["messages"].([]interface{})
+		if !ok {
+			return
+		}
+		// Appended, it goes after the system messages the client leads with.
+		at := 0
+		for appendIt && at < len(messages) {
+			m, _ := messages[at].(map[string]interface{})
+			if role, _ := m["role"].(string); role != "system" && role != "developer" {
+				break
+			}
+			at++
+		}
+		message := map[string]interface{}{"role": "system", "content": enforced}
+		body["messages"] = append(messages[:at:at], append([]interface{}{message}, messages[at:]...)...)
+	}
+}
+
+// withBlock adds block at the start of blocks, or at the end.
+func withBlock(blocks []interface{}, block interface{}, appendIt bool) []interface{} {
+	if appendIt {
+		return append(blocks, block)
+	}
+	return append([]interface{}{block}, blocks...)
+}
+
+// injectInstructions adds the configured system prompt to a body POSTed to
+// the OpenAI resource at path: the instructions of a new response, or those
+// of a new run, which replace the assistant's. A run that keeps the
+// assistant's gets it as additional_instructions.
+func injectInstructions(body map[string]interface{}, provider, path string) {
+	enforced := enforcedSystem(provider, "")
+	if enforced == "" || body == nil {
+		return
+	}
+	parts := strings.Split(path, "/")
+	run := parts[0] == "threads" && parts[len(parts)-1] == "runs" && len(parts) <= 3
+	if path != "responses" && !run {
+		return
+	}
+	key := "instructions"
+	if _, ok := body[key]; run && !ok {
+		key = "additional_instructions"
+	}
+	client, _ := body[key].(string)
+	body[key] = joinSystem(enforced, client)
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TemplatesConfig sets where prompt templates are kept. Without a DB they
+// live in memory and are lost on restart.
+type TemplatesConfig struct {
+	DB string `json:"db"`
+}
+
+// promptTemplate is one version of a named prompt. Its system prompt and
+// messages may hold {{variable}} placeholders, filled from a request's vars
+// or else from Defaults. Saving a template again adds a version; requests
+// get the latest unless they pin one.
+type promptTemplate struct {
+	Name        string            `json:"name"`
+	Version     int               `json:"version"`
+	Description string            `json:"description,omitempty"`
+	System      string            `json:"system,omitempty"`
+	Messages    []chatMessage     `json:"messages,omitempty"`
+	Defaults    map[string]string `json:"defaults,omitempty"`
+	Created     time.Time         `json:"created"`
+}
+
+var placeholder = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+func (t *promptTemplate) validate() error {
+	if t.Name == "" || strings.ContainsAny(t.Name, "@/ ") {
+		return badRequest("name: required, without spaces, / or @")
+	}
+	if t.System == "" && len(t.Messages) == 0 {
+		return badRequest("A template needs a system prompt or messages")
+	}
+	return validateMessages(t.Messages)
+}
+
+// variables lists the placeholders t uses, sorted.
+func (t *promptTemplate) variables() []string {
+	var names []string
+	add := func(s string) {
+		for _, m := range placeholder.FindAllStringSubmatch(s, -1) {
+			if !slices.Contains(names, m[1]) {
+				names = append(names, m[1])
+			}
+		}
+	}
+	add(t.System)
+	for _, m := range t.Messages {
+		add(m.Content)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// expand fills in t's placeholders. Every variable must have a value, and
+// every var given must be one the template uses, so typos are caught.
+func (t *promptTemplate) expand(vars map[string]string) (system string, messages []chatMessage, err error) {
+	used := t.variables()
+	for name := range vars {
+		if !slices.Contains(used, name) {
+			return "", nil, badRequest(fmt.Sprintf("Template %s has no variable %s", t.Name, name))
+		}
+	}
+	values := map[string]string{}
+	for _, name := range used {
+		v, ok := vars[name]
+		if !ok {
+			if v, ok = t.Defaults[name]; !ok {
+				return "", nil, badRequest(fmt.Sprintf("Template %s: missing variable %s", t.Name, name))
+			}
+		}
+		values[name] = v
+	}
+	fill := func(s string) string {
+		return placeholder.ReplaceAllStringFunc(s, func(m string) string {
+			return values[placeholder.FindStringSubmatch(m)[1]]
+		})
+	}
+	for _, m := range t.Messages {
+		messages = append(messages, chatMessage{Role: m.Role, Content: fill(m.Content)})
+	}
+	return fill(t.System), messages, nil
+}
+
+// templateStore holds every version of every template, in memory and, when
+// configured, in SQLite.
+type templateStore struct {
+	mu       sync.RWMutex
+	versions map[string][]*promptTemplate // oldest first
+	db       *sql.DB
+}
+
+var templates = &templateStore{versions: map[string][]*promptTemplate{}}
+
+const templateSchema = `
+CREATE TABLE IF NOT EXISTS templates (
+	name    TEXT NOT NULL,
+	version INTEGER NOT NULL,
+	body    TEXT NOT NULL,
+	PRIMARY KEY (name, version)
+)`
+
+// openTemplateStore opens or creates the database at path and loads the
+// templates in it.
+func openTemplateStore(path string) (*templateStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{"PRAGMA journal_mode=WAL", "PRAGMA busy_timeout=5000", templateSchema} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("templates: %w", err)
+		}
+	}
+	s := &templateStore{versions: map[string][]*promptTemplate{}, db: db}
+	rows, err := db.Query(`SELECT body FROM templates ORDER BY name, version`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("templates: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var body string
+		if err := rows.Scan(&body); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("templates: %w", err)
+		}
+		t := &promptTemplate{}
+		if err := json.Unmarshal([]byte(body), t); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("templates: %w", err)
+		}
+		s.versions[t.Name] = append(s.versions[t.Name], t)
+	}
+	return s, rows.Err()
+}
+
+// save stores t as the next version of its name, filling in its version.
+func (s *templateStore) save(t *promptTemplate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := s.versions[t.Name]
+	t.Version = 1
+	if len(list) > 0 {
+		t.Version = list[len(list)-1].Version + 1
+	}
+	if s.db != nil {
+		body, _ := json.Marshal(t)
+		if _, err := s.db.Exec(`INSERT INTO templates (name, version, body) VALUES (?, ?, ?)`, t.Name, t.Version, string(body)); err != nil {
+			return err
+		}
+	}
+	s.versions[t.Name] = append(list, t)
+	return nil
+}
+
+// get returns version of name, or its latest version for 0.
+func (s *templateStore) get(name string, version int) *promptTemplate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := s.versions[name]
+	if len(list) == 0 {
+		return nil
+	}
+	if version == 0 {
+		return list[len(list)-1]
+	}
+	for _, t := range list {
+		if t.Version == version {
+			return t
+		}
+	}
+	return nil
+}
+
+// delete removes name with all its versions, reporting whether it existed.
+func (s *templateStore) delete(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.versions[name]; !ok {
+		return false, nil
+	}
+	if s.db != nil {
+		if _, err := s.db.Exec(`DELETE FROM templates WHERE name = ?`, name); err != nil {
+			return false, err
+		}
+	}
+	delete(s.versions, name)
+	return true, nil
+}
+
+// latest lists the newest version of each template, by name.
+func (s *templateStore) latest() []map[string]interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]map[string]interface{}, 0, len(s.versions))
+	for _, list := range s.versions {
+		out = append(out, describeTemplate(list[len(list)-1], len(list)))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i]["name"].(string) < out[j]["name"].(string) })
+	return out
+}
+
+func describeTemplate(t *promptTemplate, versions int) map[string]interface{} {
+	return map[string]interface{}{
+		"name":        t.Name,
+		"version":     t.Version,
+		"versions":    versions,
+		"description": t.Description,
+		"variables":   t.variables(),
+		"defaults":    t.Defaults,
+		"created":     t.Created.UTC().Format(time.RFC3339),
+	}
+}
+
+// expandTemplate replaces a template reference in cr with the template's
+// system prompt and messages, which come before the request's own. It
+// returns the name@version used, or "" when cr names no template.
+func (cr *chatRequest) expandTemplate() (string, error) {
+	if cr.Template == "" {
+		return "", nil
+	}
+	t := templates.get(cr.Template, cr.TemplateVersion)
+	if t == nil {
+		if cr.TemplateVersion != 0 {
+			return "", badRequest(fmt.Sprintf("Unknown template: %s version %d", cr.Template, cr.TemplateVersion))
+		}
+		return "", badRequest("Unknown template: " + cr.Template)
+	}
+	system, messages, err := t.expand(cr.Vars)
+	if err != nil {
+		return "", err
+	}
+	if cr.System != "" {
+		system = strings.TrimSpace(system + "\n\n" + cr.System)
+	}
+	cr.System = system
+	cr.Messages = append(messages, cr.Messages...)
+	return t.Name + "@" + strconv.Itoa(t.Version), nil
+}
+
+// handleTemplates lists the templates clients can use, with the variables
+// each takes.
+func handleTemplates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"templates": templates.latest()})
+}
+
+// handleAdminTemplates lists templates (GET), or with ?name= returns every
+// version of one, or with &version= just that version. PUT saves a
+// template from JSON as its next version; DELETE ?name= removes it and all
+// its versions.
+func handleAdminTemplates(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	switch r.Method {
+	case "GET":
+		if name == "" {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"templates": templates.latest()})
+			return
+		}
+		if v := r.URL.Query().Get("version"); v != "" {
+			n, _ := strconv.Atoi(v)
+			t := templates.get(name, n)
+			if t == nil || n == 0 {
+				http.Error(w, "No template "+name+" version "+v, http.StatusNotFound)
+				return
+			}
+			writeJSON(w, http.StatusOK, t)
+			return
+		}
+		templates.mu.RLock()
+		list := slices.Clone(templates.versions[name])
+		templates.mu.RUnlock()
+		if len(list) == 0 {
+			http.Error(w, "No template "+name, http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "versions": list})
+
+	case "PUT":
+		var t promptTemplate
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			writeDecodeError(w, err)
+			return
+		}
+		if err := t.validate(); err != nil {
+			writeBuildError(w, err)
+			return
+		}
+		t.Created = time.Now()
+		if err := templates.save(&t); err != nil {
+			http.Error(w, "Saving template: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit.record("template.saved", map[string]interface{}{
+			"name":      t.Name,
+			"version":   t.Version,
+			"variables": t.variables(),
+			"remote":    clientIP(r),
+		})
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"name": t.Name, "version": t.Version})
+
+	case "DELETE":
+		ok, err := templates.delete(name)
+		if err != nil {
+			http.Error(w, "Deleting template: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "No template "+name, http.StatusNotFound)
+			return
+		}
+		audit.record("template.deleted", map[string]interface{}{"name": name, "remote": clientIP(r)})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// thinkingOptions turn on Claude's extended thinking for a /api/chat
+// request, as Anthropic's own thinking parameter does.
+type thinkingOptions struct {
+	Type         string `json:"type,omitempty"` // "enabled" by default
+	BudgetTokens int    `json:"budget_tokens"`
+}
+
+// thinkingBlock is one block of a reply's thinking. The signature lets
+// Anthropic check the block when it is sent back; redacted thinking comes
+// as encrypted data only.
+type thinkingBlock struct {
+	Type      string `json:"type"` // "thinking" or "redacted_thinking"
+	Thinking  string `json:"thinking,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Data      string `json:"data,omitempty"`
+}
+
+// minThinkingBudget is the smallest budget Anthropic accepts.
+const minThinkingBudget = 1024
+
+func (cr *chatRequest) validateThinking(d *chatDialect) error {
+	if cr.Thinking == nil {
+		return nil
+	}
+	if !d.thinking {
+		return badRequest("thinking: " + cr.Provider + " has no extended thinking on /api/chat")
+	}
+	if cr.Thinking.BudgetTokens < minThinkingBudget {
+		return badRequest(fmt.Sprintf("thinking.budget_tokens: must be at least %d", minThinkingBudget))
+	}
+	if cr.MaxTokens != 0 && cr.Thinking.BudgetTokens >= cr.MaxTokens {
+		return badRequest("thinking.budget_tokens: must be less than max_tokens")
+	}
+	if len(cr.OutputSchema) > 0 || (cr.ToolChoice != "" && cr.ToolChoice != "auto" && cr.ToolChoice != "none") {
+		return badRequest("thinking: can't be combined with output_schema or a tool_choice that forces a call")
+	}
+	return nil
+}
+
+// anthropicThinking is an assistant message's thinking as content blocks,
+// which go before its text and tool calls.
+func anthropicThinking(m chatMessage) []interface{} {
+	blocks := make([]interface{}, 0, len(m.Thinking)+len(m.images)+1)
+	for _, t := range m.Thinking {
+		if t.Type == "redacted_thinking" {
+			blocks = append(blocks, map[string]interface{}{"type": t.Type, "data": t.Data})
+			continue
+		}
+		blocks = append(blocks, map[string]interface{}{"type": "thinking", "thinking": t.Thinking, "signature": t.Signature})
+	}
+	return blocks
+}
+
+// shownThinking is the thinking a client gets to see: none with
+// strip_thinking.
+func shownThinking(blocks []thinkingBlock) []thinkingBlock {
+	if config.StripThinking {
+		return nil
+	}
+	return blocks
+}
+
+// isThinking reports whether a content block type is thinking.
+func isThinking(blockType string) bool {
+	return blockType == "thinking" || blockType == "redacted_thinking"
+}
+
+type stripThinkingKey struct{}
+
+// withoutThinking marks a passthrough upstream request so doUpstream takes
+// thinking blocks out of its response.
+func withoutThinking(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), stripThinkingKey{}, true))
+}
+
+// stripThinking removes thinking blocks from an Anthropic messages
+// response, buffered or streamed. Stream events are renumbered so the
+// blocks left keep consecutive indexes. Usage is untouched, so the
+// thinking is still counted.
+func stripThinking(resp *http.Response) {
+	if ok, _ := resp.Request.Context().Value(stripThinkingKey{}).(bool); !ok || resp.Header.Get("Content-Encoding") != "" {
+		return
+	}
+	contentType := resp.Header.Get("Content-Type")
+	switch {
+	case strings.HasPrefix(contentType, "text/event-stream"):
+		pr, pw := io.Pipe()
+		src := *resp
+		go func() {
+			pw.CloseWithError(writeWithoutThinking(pw, &src))
+		}()
+		resp.Body = &pipedBody{PipeReader: pr, upstream: src.Body}
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+	case strings.HasPrefix(contentType, "application/json"):
+		raw, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if stripped, ok := withoutThinkingBlocks(raw); err == nil && ok {
+			raw = stripped
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(raw))
+		resp.ContentLength = int64(len(raw))
+		resp.Header.Set("Content-Length", fmt.Sprint(len(raw)))
+	}
+}
+
+// withoutThinkingBlocks is a messages body without its thinking blocks,
+// reporting false when it had none.
+func withoutThinkingBlocks(raw []byte) ([]byte, bool) {
+	var msg map[string]json.RawMessage
+	var content []json.RawMessage
+	if json.Unmarshal(raw, &msg) != nil || json.Unmarshal(msg["content"], &content) != nil {
+		return nil, false
+	}
+	kept := content[:0]
+	for _, c := range content {
+		var block struct {
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(c, &block) == nil && isThinking(block.Type) {
+			continue
+		}
+		kept = append(kept, c)
+	}
+	if len(kept) == len(content) {
+		return nil, false
+	}
+	msg["content"], _ = json.Marshal(kept)
+	out, err := json.Marshal(msg)
+	return out, err == nil
+}
+
+// writeWithoutThinking copies an SSE stream to w, leaving out the events
+// of thinking blocks.
+func writeWithoutThinking(w io.Writer, resp *http.Response) error {
+	dropped := map[int]bool{}
+	var werr error
+	err := readUpstreamEvents(resp, func(event string, data []byte) bool {
+		var ev struct {
+			Type         string `json:"type"`
+			Index        *int   `json:"index"`
+			ContentBlock struct {
+				Type string `json:"type"`
+			} `json:"content_block"`
+		}
+		if json.Unmarshal(data, &ev) == nil && ev.Index != nil {
+			i := *ev.Index
+			if ev.Type == "content_block_start" && isThinking(ev.ContentBlock.Type) {
+				dropped[i] = true
+			}
+			if dropped[i] {
+				return true
+			}
+			if shift := droppedBefore(dropped, i); shift > 0 {
+				var fields map[string]json.RawMessage
+				json.Unmarshal(data, &fields)
+				fields["index"], _ = json.Marshal(i - shift)
+				data, _ = json.Marshal(fields)
+			}
+		}
+		if event != "" {
+			_, werr = fmt.Fprintf(w, "event: %s\n", event)
+		}
+		if werr == nil {
+			_, werr = fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+		return werr == nil
+	})
+	if werr != nil {
+		return werr
+	}
+	return err
+}
+
+func droppedBefore(dropped map[int]bool, i int) int {
+	n := 0
+	for d := range dropped {
+		if d < i {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// bpeEncoding is one of OpenAI's byte-pair encodings, read from the
+// .tiktoken file tiktoken itself downloads: a base64 token and its rank
+// per line. split cuts text into the pieces BPE runs on, as the
+// encoding's regular expression does.
+type bpeEncoding struct {
+	name  string
+	ranks map[string]int
+	split func(r []rune, i int) int
+}
+
+// bpeEncodings are loaded from tokenizer.encodings_dir on first use; a
+// missing or unreadable file is remembered as nil.
+var bpeEncodings = struct {
+	sync.Mutex
+	loaded map[string]*bpeEncoding
+}{loaded: map[string]*bpeEncoding{}}
+
+// encodingFor names the encoding OpenAI uses for model, or "" for models
+// it doesn't know. OpenRouter's "openai/" prefix is ignored.
+func encodingFor(model string) string {
+	model = strings.TrimPrefix(model, "openai/")
+	for _, prefix := range []string{"gpt-4o", "gpt-4.1", "gpt-4.5", "gpt-5", "chatgpt-4o", "gpt-oss", "o1", "o3", "o4"} {
+		if strings.HasPrefix(model, prefix) {
+			return "o200k_base"
+		}
+	}
+	for _, prefix := range []string{"gpt-4", "gpt-3.5", "gpt-35", "text-embedding-3", "text-embedding-ada-002"} {
+		if strings.HasPrefix(model, prefix) {
+			return "cl100k_base"
+		}
+	}
+	return ""
+}
+
+// loadEncoding returns the named encoding, or nil if it isn't available.
+func loadEncoding(name string) *bpeEncoding {
+	bpeEncodings.Lock()
+	defer bpeEncodings.Unlock()
+	if e, ok := bpeEncodings.loaded[name]; ok {
+		return e
+	}
+	e, err := readEncoding(name)
+	if err != nil {
+		slog.Warn("tokenizer", "encoding", name, "err", err)
+	}
+	bpeEncodings.loaded[name] = e
+	return e
+}
+
+func readEncoding(name string) (*bpeEncoding, error) {
+	dir := config.Tokenizer.EncodingsDir
+	if dir == "" {
+		return nil, nil
+	}
+	e := &bpeEncoding{name: name, ranks: map[string]int{}, split: cl100kPiece}
+	if name == "o200k_base" {
+		e.split = o200kPiece
+	}
+	f, err := os.Open(filepath.Join(dir, name+".tiktoken"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lines := bufio.NewScanner(f)
+	for n := 1; lines.Scan(); n++ {
+		token, rank, ok := strings.Cut(lines.Text(), " ")
+		if !ok {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		r, err := strconv.Atoi(rank)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		e.ranks[string(raw)] = r
+	}
+	if err := lines.Err(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// count is the number of tokens text encodes to. Special tokens such as
+// <|endoftext|> are counted as ordinary text.
+func (e *bpeEncoding) count(text string) int {
+	r := []rune(text)
+	n := 0
+	for i := 0; i < len(r); {
+		end := e.split(r, i)
+		n += e.merge([]byte(string(r[i:end])))
+		i = end
+	}
+	return n
+}
+
+// merge runs byte-pair merging on one piece and returns how many tokens
+// are left: starting from single bytes, the adjacent pair with the lowest
+// rank is merged until no pair is a token.
+func (e *bpeEncoding) merge(piece []byte) int {
+	if _, ok := e.ranks[string(piece)]; ok {
+		return 1
+	}
+	bounds := make([]int, len(piece)+1)
+	for i := range bounds {
+		bounds[i] = i
+	}
+	for len(bounds) > 2 {
+		best, at := math.MaxInt, -1
+		for i := 0; i+2 < len(bounds); i++ {
+			if rank, ok := e.ranks[string(piece[bounds[i]:bounds[i+2]])]; ok && rank < best {
+				best, at = rank, i
+			}
+		}
+		if at < 0 {
+			break
+		}
+		bounds = append(bounds[:at+1], bounds[at+2:]...)
+	}
+	return len(bounds) - 1
+}
+
+// The piece functions return where the piece starting at r[i] ends. They
+// follow the encodings' patterns alternative by alternative, the first
+// that matches winning; cl100k_base's is
+//
+//	(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}|
+//	 ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+
+//
+// and o200k_base's splits words before capitals, keeps contractions with
+// their word and lets "/" trail punctuation.
+
+func cl100kPiece(r []rune, i int) int {
+	if end := contraction(r, i); end > 0 {
+		return end
+	}
+	start := i
+	if isWordPrefix(r[i]) && i+1 < len(r) && unicode.IsLetter(r[i+1]) {
+		start++
+	}
+	if unicode.IsLetter(r[start]) {
+		return runOf(r, start, unicode.IsLetter)
+	}
+	if end := digitsAndPunct(r, i, "\r\n"); end > 0 {
+		return end
+	}
+	return whitespace(r, i)
+}
+
+func o200kPiece(r []rune, i int) int {
+	starts := []int{i}
+	if isWordPrefix(r[i]) && i+1 < len(r) {
+		starts = []int{i + 1, i}
+	}
+	// Upper* Lower+, then Upper+ Lower*, each with an optional prefix.
+	for _, s := range starts {
+		upper := runOf(r, s, isUpperish)
+		for q := upper; q >= s; q-- {
+			if end := runOf(r, q, isLowerish); end > q {
+				return withContraction(r, end)
+			}
+		}
+	}
+	for _, s := range starts {
+		if upper := runOf(r, s, isUpperish); upper > s {
+			return withContraction(r, runOf(r, upper, isLowerish))
+		}
+	}
+	if end := digitsAndPunct(r, i, "\r\n/"); end > 0 {
+		return end
+	}
+	return whitespace(r, i)
+}
+
+// contraction matches (?i:'s|'t|'re|'ve|'m|'ll|'d) at i.
+func contraction(r []rune, i int) int {
+	if r[i] != '\'' || i+1 >= len(r) {
+		return 0
+	}
+	switch unicode.ToLower(r[i+1]) {
+	case 's', 't', 'm', 'd':
+		return i + 2
+	}
+	if i+2 < len(r) {
+		switch strings.ToLower(string(r[i+1 : i+3])) {
+		case "re", "ve", "ll":
+			return i + 3
+		}
+	}
+	return 0
+}
+
+func withContraction(r []rune, end int) int {
+	if end < len(r) {
+		if c := contraction(r, end); c > 0 {
+			return c
+		}
+	}
+	return end
+}
+
+// digitsAndPunct matches \p{N}{1,3} or ` ?[^\s\p{L}\p{N}]+[trailing]*`.
+func digitsAndPunct(r []rune, i int, trailing string) int {
+	if unicode.IsNumber(r[i]) {
+		end := i
+		for end < len(r) && end < i+3 && unicode.IsNumber(r[end]) {
+			end++
+		}
+		return end
+	}
+	start := i
+	if r[i] == ' ' && i+1 < len(r) && isPunct(r[i+1]) {
+		start++
+	}
+	if !isPunct(r[start]) {
+		return 0
+	}
+	end := runOf(r, start, isPunct)
+	return runOf(r, end, func(c rune) bool { return strings.ContainsRune(trailing, c) })
+}
+
+// whitespace matches \s*[\r\n]+, then \s+(?!\S), then \s+, for the run
+// of whitespace at i.
+func whitespace(r []rune, i int) int {
+	end := runOf(r, i, unicode.IsSpace)
+	for p := end - 1; p >= i; p-- {
+		if r[p] == '\r' || r[p] == '\n' {
+			return p + 1
+		}
+	}
+	if end == len(r) || end-1 == i {
+		return max(end, i+1)
+	}
+	return end - 1
+}
+
+func runOf(r []rune, i int, in func(rune) bool) int {
+	for i < len(r) && in(r[i]) {
+		i++
+	}
+	return i
+}
+
+// isWordPrefix is [^\r\n\p{L}\p{N}], which may start a word's piece.
+func isWordPrefix(c rune) bool {
+	return c != '\r' && c != '\n' && !unicode.IsLetter(c) && !unicode.IsNumber(c)
+}
+
+func isPunct(c rune) bool {
+	return !unicode.IsSpace(c) && !unicode.IsLetter(c) && !unicode.IsNumber(c)
+}
+
+// isUpperish is [\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}] and isLowerish
+// [\p{Ll}\p{Lm}\p{Lo}\p{M}].
+func isUpperish(c rune) bool {
+	return unicode.In(c, unicode.Lu, unicode.Lt, unicode.Lm, unicode.Lo, unicode.M)
+}
+
+func isLowerish(c rune) bool {
+	return unicode.In(c, unicode.Ll, unicode.Lm, unicode.Lo, unicode.M)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSConfig terminates TLS on the listener, with a certificate from
+// CertFile/KeyFile or issued by Let's Encrypt for the Autocert hostnames.
+type TLSConfig struct {
+	CertFile string   `json:"cert_file"`
+	KeyFile  string   `json:"key_file"`
+	Autocert []string `json:"autocert"`
+	// CacheDir keeps issued certificates and the ACME account key.
+	CacheDir string `json:"cache_dir"`
+	Email    string `json:"email"`
+	// HTTPAddr, e.g. ":80", answers ACME HTTP-01 challenges and redirects
+	// everything else to HTTPS. Without it autocert relies on TLS-ALPN-01,
+	// which needs the proxy listening on port 443.
+	HTTPAddr string `json:"http_addr"`
+	// ClientCA requires every client to present a certificate issued by
+	// one of the CAs in this PEM file; ClientCRL, a CRL from that CA in
+	// PEM or DER, lists revoked ones and is re-read when it changes.
+	ClientCA  string `json:"client_ca"`
+	ClientCRL string `json:"client_crl"`
+	// HTTP1Only turns off HTTP/2, which is otherwise negotiated with
+	// clients that support it so one connection carries many streams.
+	HTTP1Only bool `json:"http1_only"`
+}
+
+func (t TLSConfig) enabled() bool { return t.CertFile != "" || len(t.Autocert) > 0 }
+
+func (t TLSConfig) validate() []error {
+	var errs []error
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		errs = append(errs, errors.New("tls: cert_file and key_file go together"))
+	}
+	if t.CertFile != "" && len(t.Autocert) > 0 {
+		errs = append(errs, errors.New("tls: use cert_file or autocert, not both"))
+	}
+	if t.HTTPAddr != "" && !t.enabled() {
+		errs = append(errs, errors.New("tls.http_addr: needs cert_file or autocert"))
+	}
+	if t.ClientCA != "" && !t.enabled() {
+		errs = append(errs, errors.New("tls.client_ca: needs cert_file or autocert"))
+	}
+	if t.ClientCRL != "" && t.ClientCA == "" {
+		errs = append(errs, errors.New("tls.client_crl: needs client_ca"))
+	}
+	if t.HTTPAddr != "" {
+		if _, _, err := net.SplitHostPort(t.HTTPAddr); err != nil {
+			errs = append(errs, errors.New("tls.http_addr: "+err.Error()))
+		}
+	}
+	return errs
+}
+
+// setupTLS fills in server.TLSConfig and returns the handler for the plain
+// HTTP listener, if one is configured.
+func setupTLS(server *http.Server, t TLSConfig) (http.Handler, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	redirect := http.HandlerFunc(redirectHTTPS)
+
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+		server.TLSConfig = cfg
+		setHTTP1Only(server, t)
+		return redirect, requireClientCerts(cfg, t)
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(t.Autocert...),
+		Cache:      autocert.DirCache(t.CacheDir),
+		Email:      t.Email,
+	}
+	cfg = m.TLSConfig() // offers h2, http/1.1 and acme-tls/1
+	cfg.MinVersion = tls.VersionTLS12
+	server.TLSConfig = cfg
+	setHTTP1Only(server, t)
+	return m.HTTPHandler(redirect), requireClientCerts(cfg, t)
+}
+
+// setHTTP1Only stops server from negotiating HTTP/2 when t says so.
+func setHTTP1Only(server *http.Server, t TLSConfig) {
+	if !t.HTTP1Only {
+		return
+	}
+	server.TLSConfig.NextProtos = slices.DeleteFunc(server.TLSConfig.NextProtos, func(p string) bool { return p == "h2" })
+	server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+}
+
+// requireClientCerts turns on mutual TLS when client_ca is set.
+func requireClientCerts(cfg *tls.Config, t TLSConfig) error {
+	if t.ClientCA == "" {
+		return nil
+	}
+	data, err := os.ReadFile(t.ClientCA)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("tls.client_ca: no certificates in %s", t.ClientCA)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+
+	if t.ClientCRL == "" {
+		return nil
+	}
+	crl := &revocationList{path: t.ClientCRL, issuers: parseCerts(data)}
+	if err := crl.refresh(); err != nil {
+		return err
+	}
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return nil
+		}
+		if err := crl.refresh(); err != nil {
+			slog.Warn("tls: client_crl", "err", err) // keep the last good list
+		}
+		if crl.revoked(cs.PeerCertificates[0]) {
+			return errors.New("tls: client certificate revoked")
+		}
+		return nil
+	}
+	return nil
+}
+
+// revocationList is a CRL file, reloaded whenever its mtime changes.
+type revocationList struct {
+	path    string
+	issuers []*x509.Certificate
+
+	mu      sync.Mutex
+	modTime time.Time
+	serials map[string]bool
+}
+
+func (l *revocationList) refresh() error {
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if info.ModTime().Equal(l.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	rl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return fmt.Errorf("tls.client_crl: %w", err)
+	}
+	signed := false
+	for _, ca := range l.issuers {
+		if rl.CheckSignatureFrom(ca) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return errors.New("tls.client_crl: not signed by a client_ca certificate")
+	}
+
+	serials := make(map[string]bool, len(rl.RevokedCertificateEntries))
+	for _, entry := range rl.RevokedCertificateEntries {
+		serials[entry.SerialNumber.String()] = true
+	}
+	l.serials, l.modTime = serials, info.ModTime()
+	return nil
+}
+
+func (l *revocationList) revoked(cert *x509.Certificate) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.serials[cert.SerialNumber.String()]
+}
+
+// parseCerts decodes every certificate in a PEM bundle.
+func parseCerts(data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			return certs
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
+
+// redirectHTTPS sends plain HTTP clients to the same URL over HTTPS.
+func redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	_, port, _ := net.SplitHostPort(config.Listen)
+	if port != "" && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// serveHTTPRedirect runs the plain HTTP side listener until the process
+// exits.
+func serveHTTPRedirect(addr string, h http.Handler) {
+	slog.Info("↪️  HTTP redirect", "addr", addr)
+	s := &http.Server{Addr: addr, Handler: h, ReadTimeout: time.Duration(config.Timeouts.Read)}
+	if err := s.ListenAndServe(); err != nil {
+		slog.Error("http redirect", "err", err)
+	}
+}
@@ -0,0 +1,7 @@
+package main
+
+// Together AI, for hosted open-weight models (Llama, Qwen, ...), which use
+// the OpenAI chat completions envelope.
+func init() {
+	registerProvider(openAICompatible("together", "https://api.together.xyz/v1/chat/completions"))
+}
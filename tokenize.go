@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// TokenizerConfig sets up /api/tokenize. EncodingsDir holds OpenAI's
+// cl100k_base.tiktoken and o200k_base.tiktoken; without them OpenAI
+// models are estimated like any other.
+type TokenizerConfig struct {
+	EncodingsDir string `json:"encodings_dir"`
+}
+
+func (c TokenizerConfig) validate() []error {
+	if c.EncodingsDir == "" {
+		return nil
+	}
+	if info, err := os.Stat(c.EncodingsDir); err != nil || !info.IsDir() {
+		return []error{fmt.Errorf("tokenizer.encodings_dir: %q is not a directory", c.EncodingsDir)}
+	}
+	return nil
+}
+
+// tokenizeRequest is the /api/tokenize body: Text on its own, or a chat
+// request's System, Messages and Tools, counted as the model would see
+// them.
+type tokenizeRequest struct {
+	Provider string        `json:"provider"`
+	Model    string        `json:"model"`
+	Text     *string       `json:"text,omitempty"`
+	System   string        `json:"system,omitempty"`
+	Messages []chatMessage `json:"messages,omitempty"`
+	Tools    []chatTool    `json:"tools,omitempty"`
+	// Exact asks the provider's counting API where there is no local
+	// tokenizer for the model, at the cost of a round trip.
+	Exact      bool   `json:"exact,omitempty"`
+	APIKey     string `json:"apiKey,omitempty"`
+	KeyProfile string `json:"keyProfile,omitempty"`
+}
+
+type tokenizeResponse struct {
+	Provider string `json:"provider,omitempty"`
+	Model    string `json:"model"`
+	Tokens   int    `json:"tokens"`
+	// Method is "tiktoken", "api" (the provider counted) or "estimate".
+	Method   string `json:"method"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// imageTokens is what an image is assumed to cost when counting locally:
+// a 1024x1024 image at high detail on OpenAI's models.
+const imageTokens = 765
+
+// The chat framing OpenAI adds, per its cookbook: each message costs three
+// tokens besides its role and content, and the reply is primed with three.
+const (
+	tokensPerMessage = 3
+	tokensPerReply   = 3
+)
+
+func (tr *tokenizeRequest) validate() error {
+	if tr.Model == "" {
+		return badRequest("model: required")
+	}
+	if (tr.Text == nil) == (len(tr.Messages) == 0) {
+		return badRequest("text or messages: set exactly one")
+	}
+	if tr.Text != nil && (tr.System != "" || len(tr.Tools) > 0) {
+		return badRequest("system, tools: only count with messages")
+	}
+	return nil
+}
+
+// count counts tr with n, which counts one string. Images are charged at
+// imageTokens and tools as their JSON definitions.
+func (tr *tokenizeRequest) count(n func(string) int) int {
+	if tr.Text != nil {
+		return n(*tr.Text)
+	}
+	total := tokensPerReply
+	if tr.System != "" {
+		total += tokensPerMessage + n("system") + n(tr.System)
+	}
+	for _, m := range tr.Messages {
+		total += tokensPerMessage + n(m.Role) + n(m.Content) + imageTokens*len(m.Images)
+		for _, c := range m.ToolCalls {
+			total += n(c.Name) + n(string(c.Arguments))
+		}
+	}
+	for _, t := range tr.Tools {
+		def, _ := json.Marshal(map[string]interface{}{"name": t.Name, "description": t.Description, "parameters": t.parameters()})
+		total += n(string(def))
+	}
+	return total
+}
+
+// estimatedCount is the four-bytes-a-token guess used across the proxy.
+func estimatedCount(s string) int {
+	return (len(s) + 3) / 4
+}
+
+// Token counting endpoint (POST /api/tokenize). OpenAI models are counted
+// with their own encoding when tokenizer.encodings_dir has it, and other
+// models estimated, so a UI can show context use without asking anyone.
+// With "exact": true, Anthropic models are counted by its count_tokens API.
+func handleTokenize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var tr tokenizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&tr); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if err := tr.validate(); err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	out := tokenizeResponse{Provider: tr.Provider, Model: tr.Model}
+	if name := encodingFor(tr.Model); name != "" {
+		if e := loadEncoding(name); e != nil {
+			out.Tokens, out.Method, out.Encoding = tr.count(e.count), "tiktoken", name
+			writeJSON(w, http.StatusOK, out)
+			return
+		}
+	}
+	if !tr.Exact {
+		out.Tokens, out.Method = tr.count(estimatedCount), "estimate"
+		writeJSON(w, http.StatusOK, out)
+		return
+	}
+	if tr.Provider != "anthropic" {
+		writeBuildError(w, badRequest("exact: "+firstSet(tr.Provider, "this provider")+" has no counting API the proxy uses"))
+		return
+	}
+	if !config.providerEnabled(tr.Provider) {
+		http.Error(w, "Provider disabled: "+tr.Provider, http.StatusBadRequest)
+		return
+	}
+
+	p, _ := lookupProvider(tr.Provider)
+	target := p.(ChatProvider)
+	if tr.KeyProfile == "" {
+		tr.KeyProfile = r.Header.Get("X-Key-Profile")
+	}
+	rec := recordFrom(r)
+	apiKey, err := resolveAPIKey(target, rec.user(), tr.APIKey, tr.KeyProfile)
+	if err == nil {
+		err = allowBetas(r)
+	}
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	logged := tr
+	logged.APIKey = ""
+	rec.describe(tr.Provider, tr.Model, false, logged)
+
+	cr := chatRequest{Provider: tr.Provider, Model: tr.Model, System: tr.System, Messages: tr.Messages, Tools: tr.Tools}
+	if tr.Text != nil {
+		cr.Messages = []chatMessage{{Role: "user", Content: *tr.Text}}
+	}
+	if err := cr.attachImages(rec.user()); err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	t := ChatTarget{tr.Provider, tr.Model}
+	body := target.Dialect().body(&cr)
+	delete(body, "max_tokens")
+	req, err := countTokensRequest(target, body, apiKey)
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	resp, err := doUpstream(target, req.WithContext(r.Context()))
+	if err != nil {
+		(&chatFailure{target: t, err: err, upstream: !clientGone(r.Context())}).write(w)
+		return
+	}
+	raw, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if resp.StatusCode >= 300 {
+		(&chatFailure{target: t, status: resp.StatusCode, body: raw}).write(w)
+		return
+	}
+	var counted struct {
+		InputTokens int `json:"input_tokens"`
+	}
+	if err := json.Unmarshal(raw, &counted); err != nil {
+		http.Error(w, "Unexpected upstream response: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	out.Tokens, out.Method = counted.InputTokens, "api"
+	writeJSON(w, http.StatusOK, out)
+}
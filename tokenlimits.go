@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+)
+
+// TokenLimitConfig caps how big one request may be, so a single giant
+// prompt cannot spend a day's budget. It applies to requests for the
+// Models (with * wildcards), Providers and Users listed; lists left empty
+// match everything. MaxInputTokens bounds the estimated prompt and
+// MaxTokens the max_tokens a request asks for, and is what /api/chat
+// requests that ask for none get. Action "reject" (the default) refuses
+// requests over a limit; "truncate" lowers max_tokens to it and, on
+// /api/chat, drops the oldest messages until the prompt fits.
+type TokenLimitConfig struct {
+	Models         []string `json:"models"`
+	Providers      []string `json:"providers"`
+	Users          []string `json:"users"`
+	MaxInputTokens int      `json:"max_input_tokens"`
+	MaxTokens      int      `json:"max_tokens"`
+	Action         string   `json:"action"`
+}
+
+func (l TokenLimitConfig) validate(i int) []error {
+	var errs []error
+	for _, m := range l.Models {
+		if _, err := path.Match(m, ""); err != nil {
+			errs = append(errs, fmt.Errorf("token_limits[%d].models: bad pattern %q", i, m))
+		}
+	}
+	for _, p := range l.Providers {
+		if _, ok := lookupProvider(p); !ok {
+			errs = append(errs, fmt.Errorf("token_limits[%d].providers: unknown provider %q", i, p))
+		}
+	}
+	if l.MaxInputTokens < 0 || l.MaxTokens < 0 || (l.MaxInputTokens == 0 && l.MaxTokens == 0) {
+		errs = append(errs, fmt.Errorf("token_limits[%d]: max_input_tokens or max_tokens must be positive", i))
+	}
+	if l.Action != "" && l.Action != "reject" && l.Action != "truncate" {
+		errs = append(errs, fmt.Errorf("token_limits[%d].action: %q is not reject or truncate", i, l.Action))
+	}
+	return errs
+}
+
+func (l TokenLimitConfig) matches(provider, model, user string) bool {
+	if len(l.Providers) > 0 && !slices.Contains(l.Providers, provider) {
+		return false
+	}
+	if len(l.Models) > 0 && !slices.ContainsFunc(l.Models, func(m string) bool {
+		ok, _ := path.Match(m, model)
+		return ok
+	}) {
+		return false
+	}
+	return len(l.Users) == 0 || slices.Contains(l.Users, user)
+}
+
+// limitChat holds cr to every token limit that applies to it, estimating
+// the prompt as routing does. It reports whether it truncated anything.
+func limitChat(cr *chatRequest, user string) (bool, error) {
+	truncated := false
+	for _, l := range config.TokenLimits {
+		if !l.matches(cr.Provider, cr.Model, user) {
+			continue
+		}
+		if l.MaxTokens > 0 {
+			switch {
+			case cr.MaxTokens == 0:
+				cr.MaxTokens = l.MaxTokens
+			case cr.MaxTokens > l.MaxTokens && l.Action == "truncate":
+				cr.MaxTokens, truncated = l.MaxTokens, true
+			case cr.MaxTokens > l.MaxTokens:
+				return false, badRequest(fmt.Sprintf("max_tokens: %d is over the limit of %d for %s", cr.MaxTokens, l.MaxTokens, cr.Model))
+			}
+		}
+		if l.MaxInputTokens == 0 {
+			continue
+		}
+		tokens := len(cr.promptText()) / 4
+		if tokens > l.MaxInputTokens && l.Action == "truncate" {
+			for len(cr.Messages) > 1 && tokens > l.MaxInputTokens {
+				cr.dropOldest()
+				tokens, truncated = len(cr.promptText())/4, true
+			}
+		}
+		if tokens > l.MaxInputTokens {
+			return false, badRequest(fmt.Sprintf("messages: the prompt is about %d tokens, over the limit of %d for %s", tokens, l.MaxInputTokens, cr.Model))
+		}
+	}
+	return truncated, nil
+}
+
+// dropOldest removes the oldest message and then any that no longer make
+// sense at the start, such as tool results whose call went with it, so the
+// history begins with a user message again. The last message is kept.
+func (cr *chatRequest) dropOldest() {
+	cr.Messages = cr.Messages[1:]
+	for len(cr.Messages) > 1 && cr.Messages[0].Role != "user" {
+		cr.Messages = cr.Messages[1:]
+	}
+}
+
+// limitProviderBody holds a provider's native body to the token limits
+// that apply to it. Messages can't be dropped from a body the proxy
+// doesn't parse, so an over-long prompt is refused whatever the action,
+// and a body without a max_tokens field is left without one.
+func limitProviderBody(body map[string]interface{}, provider, model, user string) (bool, error) {
+	truncated := false
+	for _, l := range config.TokenLimits {
+		if !l.matches(provider, model, user) {
+			continue
+		}
+		if l.MaxTokens > 0 {
+			field, asked := "", 0
+			for _, key := range []string{"max_tokens", "max_completion_tokens", "max_output_tokens", "num_predict"} {
+				if v, ok := body[key].(float64); ok {
+					field, asked = key, int(v)
+					break
+				}
+			}
+			switch {
+			case asked > l.MaxTokens && l.Action == "truncate":
+				body[field], truncated = l.MaxTokens, true
+			case asked > l.MaxTokens:
+				return false, badRequest(fmt.Sprintf("%s: %d is over the limit of %d for %s", field, asked, l.MaxTokens, model))
+			}
+		}
+		if l.MaxInputTokens > 0 {
+			raw, _ := json.Marshal(body)
+			if tokens := len(raw) / 4; tokens > l.MaxInputTokens {
+				return false, badRequest(fmt.Sprintf("the prompt is about %d tokens, over the limit of %d for %s", tokens, l.MaxInputTokens, model))
+			}
+		}
+	}
+	return truncated, nil
+}
+
+// markTruncated tells the client a token limit cut its request down.
+func markTruncated(w http.ResponseWriter, truncated bool) {
+	if truncated {
+		w.Header().Set("X-Token-Limit", "truncated")
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// parseTOML decodes the subset of TOML used by quirk config files: tables,
+// arrays of tables, dotted and quoted keys, strings in all four forms,
+// integers, floats, booleans, arrays and inline tables. Dates are not
+// supported; use strings.
+func parseTOML(src string) (map[string]interface{}, error) {
+	p := &tomlParser{src: src, line: 1}
+	root := map[string]interface{}{}
+	current := root
+
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return root, nil
+		}
+
+		if p.peek() == '[' {
+			p.pos++
+			array := false
+			if p.peek() == '[' {
+				array = true
+				p.pos++
+			}
+			p.skipSpace()
+			path, err := p.parseKey()
+			if err != nil {
+				return nil, err
+			}
+			p.skipSpace()
+			if !p.consume(']') || (array && !p.consume(']')) {
+				return nil, p.errorf("expected ] after table name")
+			}
+			if current, err = p.openTable(root, path, array); err != nil {
+				return nil, err
+			}
+		} else {
+			path, err := p.parseKey()
+			if err != nil {
+				return nil, err
+			}
+			p.skipSpace()
+			if !p.consume('=') {
+				return nil, p.errorf("expected = after key %q", strings.Join(path, "."))
+			}
+			p.skipSpace()
+			value, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.setKey(current, path, value); err != nil {
+				return nil, err
+			}
+		}
+
+		p.skipSpace()
+		p.skipComment()
+		if !p.eof() && !p.consumeNewline() {
+			return nil, p.errorf("expected end of line")
+		}
+	}
+}
+
+type tomlParser struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (p *tomlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+func (p *tomlParser) eof() bool { return p.pos >= len(p.src) }
+
+func (p *tomlParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *tomlParser) consume(c byte) bool {
+	if p.peek() == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *tomlParser) consumeNewline() bool {
+	if strings.HasPrefix(p.src[p.pos:], "\r\n") {
+		p.pos += 2
+	} else if p.peek() == '\n' {
+		p.pos++
+	} else {
+		return false
+	}
+	p.line++
+	return true
+}
+
+func (p *tomlParser) skipSpace() {
+	for p.peek() == ' ' || p.peek() == '\t' {
+		p.pos++
+	}
+}
+
+func (p *tomlParser) skipComment() {
+	if p.peek() != '#' {
+		return
+	}
+	for !p.eof() && p.peek() != '\n' && p.peek() != '\r' {
+		p.pos++
+	}
+}
+
+// skipBlank skips whitespace, comments and newlines.
+func (p *tomlParser) skipBlank() {
+	for {
+		p.skipSpace()
+		p.skipComment()
+		if !p.consumeNewline() {
+			return
+		}
+	}
+}
+
+func (p *tomlParser) parseKey() ([]string, error) {
+	var path []string
+	for {
+		var part string
+		switch c := p.peek(); {
+		case c == '"' || c == '\'':
+			s, err := p.parseString()
+			if err != nil {
+				return nil, err
+			}
+			part = s
+		default:
+			start := p.pos
+			for !p.eof() && isBareKeyChar(p.peek()) {
+				p.pos++
+			}
+			if start == p.pos {
+				return nil, p.errorf("expected key")
+			}
+			part = p.src[start:p.pos]
+		}
+		path = append(path, part)
+
+		p.skipSpace()
+		if !p.consume('.') {
+			return path, nil
+		}
+		p.skipSpace()
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_' || c == '-'
+}
+
+// openTable returns the table a [header] or [[header]] refers to, creating
+// intermediate tables as needed.
+func (p *tomlParser) openTable(root map[string]interface{}, path []string, array bool) (map[string]interface{}, error) {
+	t := root
+	for i, key := range path {
+		last := i == len(path)-1
+		switch v := t[key].(type) {
+		case nil:
+			if last && array {
+				next := map[string]interface{}{}
+				t[key] = []interface{}{next}
+				return next, nil
+			}
+			next := map[string]interface{}{}
+			t[key] = next
+			t = next
+		case map[string]interface{}:
+			if last && array {
+				return nil, p.errorf("%q is a table, not an array of tables", key)
+			}
+			t = v
+		case []interface{}:
+			if len(v) == 0 {
+				return nil, p.errorf("%q is not a table", key)
+			}
+			if last && array {
+				next := map[string]interface{}{}
+				t[key] = append(v, next)
+				return next, nil
+			}
+			tbl, ok := v[len(v)-1].(map[string]interface{})
+			if !ok {
+				return nil, p.errorf("%q is not a table", key)
+			}
+			t = tbl
+		default:
+			return nil, p.errorf("%q is already a value", key)
+		}
+	}
+	return t, nil
+}
+
+// setKey assigns a dotted key within t.
+func (p *tomlParser) setKey(t map[string]interface{}, path []string, value interface{}) error {
+	for _, key := range path[:len(path)-1] {
+		switch v := t[key].(type) {
+		case nil:
+			next := map[string]interface{}{}
+			t[key] = next
+			t = next
+		case map[string]interface{}:
+			t = v
+		default:
+			return p.errorf("%q is already a value", key)
+		}
+	}
+	key := path[len(path)-1]
+	if _, dup := t[key]; dup {
+		return p.errorf("duplicate key %q", key)
+	}
+	t[key] = value
+	return nil
+}
+
+func (p *tomlParser) parseValue() (interface{}, error) {
+	switch c := p.peek(); {
+	case c == '"' || c == '\'':
+		return p.parseString()
+	case c == '[':
+		return p.parseArray()
+	case c == '{':
+		return p.parseInlineTable()
+	case strings.HasPrefix(p.src[p.pos:], "true"):
+		p.pos += 4
+		return true, nil
+	case strings.HasPrefix(p.src[p.pos:], "false"):
+		p.pos += 5
+		return false, nil
+	default:
+		return p.parseNumber()
+	}
+}
+
+func (p *tomlParser) parseString() (string, error) {
+	rest := p.src[p.pos:]
+	switch {
+	case strings.HasPrefix(rest, `"""`):
+		p.pos += 3
+		p.consumeNewline() // a newline right after the opening quotes is trimmed
+		return p.parseBasic(`"""`, true)
+	case strings.HasPrefix(rest, "'''"):
+		p.pos += 3
+		p.consumeNewline()
+		end := strings.Index(p.src[p.pos:], "'''")
+		if end < 0 {
+			return "", p.errorf("unterminated string")
+		}
+		s := p.src[p.pos : p.pos+end]
+		p.line += strings.Count(s, "\n")
+		p.pos += end + 3
+		return s, nil
+	case strings.HasPrefix(rest, `"`):
+		p.pos++
+		return p.parseBasic(`"`, false)
+	default:
+		p.pos++
+		end := strings.IndexAny(p.src[p.pos:], "'\n")
+		if end < 0 || p.src[p.pos+end] != '\'' {
+			return "", p.errorf("unterminated string")
+		}
+		s := p.src[p.pos : p.pos+end]
+		p.pos += end + 1
+		return s, nil
+	}
+}
+
+// parseBasic reads a double-quoted string body up to the closing delimiter,
+// handling escapes.
+func (p *tomlParser) parseBasic(delim string, multiline bool) (string, error) {
+	var b strings.Builder
+	for {
+		if p.eof() {
+			return "", p.errorf("unterminated string")
+		}
+		if strings.HasPrefix(p.src[p.pos:], delim) {
+			p.pos += len(delim)
+			return b.String(), nil
+		}
+		c := p.src[p.pos]
+		switch {
+		case c == '\n':
+			if !multiline {
+				return "", p.errorf("newline in string")
+			}
+			p.line++
+			b.WriteByte(c)
+			p.pos++
+		case c == '\\':
+			p.pos++
+			if multiline && (p.peek() == '\n' || p.peek() == '\r' || p.peek() == ' ' || p.peek() == '\t') {
+				// line-ending backslash trims following whitespace
+				for !p.eof() && strings.ContainsRune(" \t\r\n", rune(p.peek())) {
+					if p.peek() == '\n' {
+						p.line++
+					}
+					p.pos++
+				}
+				continue
+			}
+			r, err := p.parseEscape()
+			if err != nil {
+				return "", err
+			}
+			b.WriteRune(r)
+		default:
+			r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+			b.WriteRune(r)
+			p.pos += size
+		}
+	}
+}
+
+func (p *tomlParser) parseEscape() (rune, error) {
+	c := p.peek()
+	p.pos++
+	switch c {
+	case 'b':
+		return '\b', nil
+	case 't':
+		return '\t', nil
+	case 'n':
+		return '\n', nil
+	case 'f':
+		return '\f', nil
+	case 'r':
+		return '\r', nil
+	case '"':
+		return '"', nil
+	case '\\':
+		return '\\', nil
+	case 'u', 'U':
+		n := 4
+		if c == 'U' {
+			n = 8
+		}
+		if p.pos+n > len(p.src) {
+			return 0, p.errorf("short unicode escape")
+		}
+		v, err := strconv.ParseUint(p.src[p.pos:p.pos+n], 16, 32)
+		if err != nil {
+			return 0, p.errorf("invalid unicode escape")
+		}
+		p.pos += n
+		return rune(v), nil
+	}
+	return 0, p.errorf("invalid escape \\%c", c)
+}
+
+func (p *tomlParser) parseArray() ([]interface{}, error) {
+	p.pos++ // [
+	values := []interface{}{}
+	for {
+		p.skipBlank()
+		if p.consume(']') {
+			return values, nil
+		}
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		p.skipBlank()
+		if p.consume(']') {
+			return values, nil
+		}
+		if !p.consume(',') {
+			return nil, p.errorf("expected , or ] in array")
+		}
+	}
+}
+
+func (p *tomlParser) parseInlineTable() (map[string]interface{}, error) {
+	p.pos++ // {
+	t := map[string]interface{}{}
+	p.skipSpace()
+	if p.consume('}') {
+		return t, nil
+	}
+	for {
+		p.skipSpace()
+		path, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if !p.consume('=') {
+			return nil, p.errorf("expected = in inline table")
+		}
+		p.skipSpace()
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.setKey(t, path, v); err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.consume('}') {
+			return t, nil
+		}
+		if !p.consume(',') {
+			return nil, p.errorf("expected , or } in inline table")
+		}
+	}
+}
+
+func (p *tomlParser) parseNumber() (interface{}, error) {
+	start := p.pos
+	for !p.eof() && strings.IndexByte("+-0123456789_.eExabcdefABCDEFoinf", p.peek()) >= 0 {
+		p.pos++
+	}
+	raw := p.src[start:p.pos]
+	if raw == "" {
+		return nil, p.errorf("expected value")
+	}
+	s := strings.ReplaceAll(raw, "_", "")
+	if i, err := strconv.ParseInt(s, 0, 64); err == nil {
+		return i, nil
+	}
+	switch s {
+	case "inf", "+inf", "-inf", "nan", "+nan", "-nan":
+		return nil, p.errorf("inf and nan are not supported")
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil && !strings.ContainsAny(s, "xob") {
+		return f, nil
+	}
+	return nil, p.errorf("invalid value %q", raw)
+}
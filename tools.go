@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// chatTool is a function the model may call, its arguments described by a
+// JSON Schema. The same definition goes to every provider that can call
+// tools.
+type chatTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// toolCall is a call the model made. Arguments is the JSON object it
+// passed; streams build it up piece by piece.
+type toolCall struct {
+	ID        string          `json:"id"`
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+var toolName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// parameters is the tool's argument schema, an empty object when it
+// takes none.
+func (t chatTool) parameters() json.RawMessage {
+	if len(t.Parameters) == 0 {
+		return json.RawMessage(`{"type":"object","properties":{}}`)
+	}
+	return t.Parameters
+}
+
+// toolArguments makes arguments as received safe to send on as JSON:
+// nothing becomes {}, and anything that is not JSON, such as a stream cut
+// short, a JSON string.
+func toolArguments(args []byte) json.RawMessage {
+	if len(args) == 0 {
+		return json.RawMessage("{}")
+	}
+	if json.Valid(args) {
+		return json.RawMessage(args)
+	}
+	quoted, _ := json.Marshal(string(args))
+	return quoted
+}
+
+// usesTools reports whether the request offers tools or carries an
+// earlier exchange with them.
+func (cr *chatRequest) usesTools() bool {
+	if len(cr.Tools) > 0 {
+		return true
+	}
+	for _, m := range cr.Messages {
+		if len(m.ToolCalls) > 0 || m.Role == "tool" {
+			return true
+		}
+	}
+	return false
+}
+
+// validateTools checks tools, tool_choice and tool messages, and that the
+// dialect can carry them.
+func (cr *chatRequest) validateTools(d *chatDialect) error {
+	if !cr.usesTools() {
+		if cr.ToolChoice != "" {
+			return badRequest("tool_choice: needs tools")
+		}
+		return nil
+	}
+	if !d.tools {
+		return badRequest("tools: " + cr.Provider + " has no tool calling on /api/chat")
+	}
+	names := map[string]bool{}
+	for i, t := range cr.Tools {
+		if !toolName.MatchString(t.Name) {
+			return badRequest(fmt.Sprintf("tools[%d].name: %q must be 1-64 letters, digits, _ or -", i, t.Name))
+		}
+		if t.Name == structuredTool {
+			return badRequest(fmt.Sprintf("tools[%d].name: %q is reserved for output_schema", i, t.Name))
+		}
+		if names[t.Name] {
+			return badRequest(fmt.Sprintf("tools[%d].name: %q is defined twice", i, t.Name))
+		}
+		names[t.Name] = true
+		if len(t.Parameters) > 0 {
+			var schema map[string]interface{}
+			if json.Unmarshal(t.Parameters, &schema) != nil {
+				return badRequest(fmt.Sprintf("tools[%d].parameters: must be a JSON Schema object", i))
+			}
+		}
+	}
+	switch cr.ToolChoice {
+	case "", "auto", "none", "required":
+	default:
+		if !names[cr.ToolChoice] {
+			return badRequest(fmt.Sprintf("tool_choice: %q is not auto, none, required or one of the tools", cr.ToolChoice))
+		}
+	}
+	calls := map[string]bool{}
+	for i, m := range cr.Messages {
+		for j, c := range m.ToolCalls {
+			if c.ID == "" || c.Name == "" {
+				return badRequest(fmt.Sprintf("messages[%d].tool_calls[%d]: id and name are required", i, j))
+			}
+			calls[c.ID] = true
+		}
+		if m.Role == "tool" && !calls[m.ToolCallID] {
+			return badRequest(fmt.Sprintf("messages[%d].tool_call_id: %q answers no earlier tool call", i, m.ToolCallID))
+		}
+	}
+	return nil
+}
+
+// startCall begins a streamed tool call, for the client to hear of.
+func (s *chatStream) startCall(id, name string) {
+	i := len(s.calls)
+	s.calls = append(s.calls, toolCall{ID: id, Name: name})
+	s.pending = append(s.pending, chatStreamEvent{Type: "tool_call", Index: &i, ID: id, Name: name})
+}
+
+// callDelta adds a piece of the i'th call's arguments.
+func (s *chatStream) callDelta(i int, args string) {
+	if i < 0 || i >= len(s.calls) || args == "" {
+		return
+	}
+	s.calls[i].Arguments = append(s.calls[i].Arguments, args...)
+	s.pending = append(s.pending, chatStreamEvent{Type: "tool_delta", Index: &i, Arguments: args})
+}
+
+// toolCalls are the calls the stream made, arguments whole.
+func (s *chatStream) toolCalls() []toolCall {
+	out := make([]toolCall, len(s.calls))
+	for i, c := range s.calls {
+		out[i] = toolCall{ID: c.ID, Name: c.Name, Arguments: toolArguments(c.Arguments)}
+	}
+	return out
+}
+
+// openAITools sets tools and tool_choice in OpenAI's function calling
+// shape.
+func openAITools(body map[string]interface{}, cr *chatRequest) {
+	tools := make([]interface{}, len(cr.Tools))
+	for i, t := range cr.Tools {
+		fn := map[string]interface{}{"name": t.Name, "parameters": t.parameters()}
+		setIf(fn, "description", t.Description, t.Description != "")
+		tools[i] = map[string]interface{}{"type": "function", "function": fn}
+	}
+	body["tools"] = tools
+	switch cr.ToolChoice {
+	case "":
+	case "auto", "none", "required":
+		body["tool_choice"] = cr.ToolChoice
+	default:
+		body["tool_choice"] = map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": cr.ToolChoice}}
+	}
+}
+
+// openAIToolMessage is a tool call or result as an OpenAI message, or nil
+// for an ordinary message.
+func openAIToolMessage(m chatMessage) map[string]interface{} {
+	switch {
+	case m.Role == "tool":
+		return map[string]interface{}{"role": "tool", "tool_call_id": m.ToolCallID, "content": m.Content}
+	case len(m.ToolCalls) > 0:
+		calls := make([]interface{}, len(m.ToolCalls))
+		for i, c := range m.ToolCalls {
+			calls[i] = map[string]interface{}{
+				"id":       c.ID,
+				"type":     "function",
+				"function": map[string]interface{}{"name": c.Name, "arguments": string(toolArguments(c.Arguments))},
+			}
+		}
+		msg := map[string]interface{}{"role": m.Role, "content": nil, "tool_calls": calls}
+		setIf(msg, "content", m.Content, m.Content != "")
+		return msg
+	}
+	return nil
+}
+
+// anthropicTools sets tools and tool_choice in Anthropic's tool use shape.
+func anthropicTools(body map[string]interface{}, cr *chatRequest) {
+	tools := make([]interface{}, len(cr.Tools))
+	for i, t := range cr.Tools {
+		tool := map[string]interface{}{"name": t.Name, "input_schema": t.parameters()}
+		setIf(tool, "description", t.Description, t.Description != "")
+		tools[i] = tool
+	}
+	body["tools"] = tools
+	switch cr.ToolChoice {
+	case "":
+	case "auto", "none":
+		body["tool_choice"] = map[string]interface{}{"type": cr.ToolChoice}
+	case "required":
+		body["tool_choice"] = map[string]interface{}{"type": "any"}
+	default:
+		body["tool_choice"] = map[string]interface{}{"type": "tool", "name": cr.ToolChoice}
+	}
+}
+
+// anthropicToolBlocks is an assistant message's text and tool calls as
+// content blocks.
+func anthropicToolBlocks(m chatMessage) []interface{} {
+	blocks := make([]interface{}, 0, len(m.ToolCalls)+1)
+	if m.Content != "" {
+		blocks = append(blocks, map[string]interface{}{"type": "text", "text": m.Content})
+	}
+	for _, c := range m.ToolCalls {
+		blocks = append(blocks, map[string]interface{}{
+			"type": "tool_use", "id": c.ID, "name": c.Name, "input": toolArguments(c.Arguments),
+		})
+	}
+	return blocks
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing follows the OpenTelemetry model closely enough for any OTLP
+// collector: W3C traceparent in and out, and spans exported as OTLP/HTTP
+// JSON. It is configured from the standard OTEL_* environment variables
+// and off unless an OTLP endpoint is set.
+
+type span struct {
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	kind    int // 1 internal, 2 server, 3 client
+	start   time.Time
+	attrs   map[string]interface{}
+	err     string
+
+	once sync.Once
+}
+
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+)
+
+type spanKey struct{}
+
+// spanFrom returns the active span in ctx, or nil.
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// startSpan begins a child of the span in ctx, or a new trace. It returns
+// a nil span when tracing is off; span methods accept nil.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: map[string]interface{}{}}
+	rand.Read(s.spanID[:])
+	if parent := spanFrom(ctx); parent != nil {
+		s.traceID, s.parent = parent.traceID, parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// startServerSpan continues the caller's trace when it sent traceparent.
+func startServerSpan(r *http.Request, name string) (context.Context, *span) {
+	ctx, s := startSpan(r.Context(), name, spanServer)
+	if s != nil {
+		if traceID, parent, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			s.traceID, s.parent = traceID, parent
+		}
+	}
+	return ctx, s
+}
+
+func (s *span) set(key string, value interface{}) {
+	if s != nil {
+		s.attrs[key] = value
+	}
+}
+
+func (s *span) fail(err error) {
+	if s != nil && err != nil {
+		s.err = err.Error()
+	}
+}
+
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() { tracer.export(s, time.Now()) })
+}
+
+// traceparent renders the W3C header naming s as the parent.
+func (s *span) traceparent() string {
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+func parseTraceparent(h string) (traceID [16]byte, parent [8]byte, ok bool) {
+	parts := strings.Split(h, "-")
+	if len(parts) < 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return traceID, parent, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, parent, false
+	}
+	if _, err := hex.Decode(parent[:], []byte(parts[2])); err != nil {
+		return traceID, parent, false
+	}
+	return traceID, parent, traceID != [16]byte{} && parent != [8]byte{}
+}
+
+// otlpExporter batches finished spans and posts them to the collector.
+type otlpExporter struct {
+	endpoint string
+	headers  map[string]string
+	service  string
+	spans    chan otlpSpan
+	done     chan struct{}
+
+	mu     sync.RWMutex // guards closed against late spans during shutdown
+	closed bool
+}
+
+var tracer *otlpExporter
+
+// newTracerFromEnv reads OTEL_EXPORTER_OTLP_TRACES_ENDPOINT (or
+// OTEL_EXPORTER_OTLP_ENDPOINT plus /v1/traces), OTEL_EXPORTER_OTLP_HEADERS
+// and OTEL_SERVICE_NAME. Only the http/json protocol is supported.
+func newTracerFromEnv() *otlpExporter {
+	if os.Getenv("OTEL_SDK_DISABLED") == "true" || os.Getenv("OTEL_TRACES_EXPORTER") == "none" {
+		return nil
+	}
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return nil
+		}
+		endpoint = strings.TrimRight(base, "/") + "/v1/traces"
+	}
+	if proto := envOr("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL", os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")); proto != "" && proto != "http/json" {
+		slog.Warn("tracing: protocol not supported, using http/json", "protocol", proto)
+	}
+
+	headers := map[string]string{}
+	for _, pair := range strings.Split(envOr("OTEL_EXPORTER_OTLP_TRACES_HEADERS", os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")), ",") {
+		if k, v, ok := strings.Cut(pair, "="); ok {
+			headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	t := &otlpExporter{
+		endpoint: endpoint,
+		headers:  headers,
+		service:  envOr("OTEL_SERVICE_NAME", "quirk"),
+		spans:    make(chan otlpSpan, 2048),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// OTLP/HTTP JSON encoding of a span.
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func otlpAttributes(attrs map[string]interface{}) []otlpAttribute {
+	out := make([]otlpAttribute, 0, len(attrs))
+	for k, v := range attrs {
+		var value map[string]interface{}
+		switch v := v.(type) {
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case float64:
+			value = map[string]interface{}{"doubleValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": toString(v)}
+		}
+		out = append(out, otlpAttribute{Key: k, Value: value})
+	}
+	return out
+}
+
+func toString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func (t *otlpExporter) export(s *span, end time.Time) {
+	o := otlpSpan{
+		TraceID:    hex.EncodeToString(s.traceID[:]),
+		SpanID:     hex.EncodeToString(s.spanID[:]),
+		Name:       s.name,
+		Kind:       s.kind,
+		Start:      strconv.FormatInt(s.start.UnixNano(), 10),
+		End:        strconv.FormatInt(end.UnixNano(), 10),
+		Attributes: otlpAttributes(s.attrs),
+	}
+	if s.parent != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	if s.err != "" {
+		o.Status = &otlpStatus{Code: 2, Message: s.err}
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.spans <- o:
+	default: // collector is behind; drop rather than block requests
+	}
+}
+
+func (t *otlpExporter) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	var batch []otlpSpan
+	for {
+		select {
+		case s, ok := <-t.spans:
+			if !ok {
+				t.post(batch)
+				return
+			}
+			if batch = append(batch, s); len(batch) >= 512 {
+				t.post(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			t.post(batch)
+			batch = nil
+		}
+	}
+}
+
+func (t *otlpExporter) post(batch []otlpSpan) {
+	if len(batch) == 0 {
+		return
+	}
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": otlpAttributes(map[string]interface{}{"service.name": t.service})},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "quirk"},
+				"spans": batch,
+			}},
+		}},
+	}
+	data, _ := json.Marshal(payload)
+	req, err := http.NewRequest("POST", t.endpoint, bytes.NewReader(data))
+	if err != nil {
+		slog.Warn("tracing", "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		slog.Warn("tracing", "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Warn("tracing: collector rejected spans", "status", resp.Status)
+	}
+}
+
+// shutdown exports the spans still queued.
+func (t *otlpExporter) shutdown() {
+	t.mu.Lock()
+	t.closed = true
+	close(t.spans)
+	t.mu.Unlock()
+	<-t.done
+}
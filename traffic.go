@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// TrafficConfig records upstream traffic to disk, or answers from such a
+// recording instead of calling out, so a frontend can be worked on or
+// demoed offline with the same replies every time.
+type TrafficConfig struct {
+	// Mode is "record" (call upstreams and save each exchange in Dir) or
+	// "replay" (answer from Dir and call nothing). Empty is neither.
+	Mode string `json:"mode"`
+	Dir  string `json:"dir"`
+	// Pace replays streams at the pace they were recorded at instead of
+	// all at once.
+	Pace bool `json:"pace"`
+}
+
+func (c TrafficConfig) validate() []error {
+	switch c.Mode {
+	case "":
+		return nil
+	case "record", "replay":
+	default:
+		return []error{fmt.Errorf("traffic.mode: %q is not record or replay", c.Mode)}
+	}
+	if c.Dir == "" {
+		return []error{errors.New("traffic.dir: required")}
+	}
+	if info, err := os.Stat(c.Dir); c.Mode == "replay" && (err != nil || !info.IsDir()) {
+		return []error{fmt.Errorf("traffic.dir: %q is not a directory", c.Dir)}
+	}
+	return nil
+}
+
+// trafficRecord is one saved exchange, a JSON file in the traffic dir.
+type trafficRecord struct {
+	Recorded time.Time      `json:"recorded"`
+	Request  trafficMessage `json:"request"`
+	Response trafficMessage `json:"response"`
+}
+
+// trafficMessage is a request or response as recorded. A body that is not
+// UTF-8 is kept as base64. Chunks note where a streamed body arrived in
+// pieces, and when.
+type trafficMessage struct {
+	Method     string            `json:"method,omitempty"`
+	URL        string            `json:"url,omitempty"`
+	Status     int               `json:"status,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Body       string            `json:"body,omitempty"`
+	BodyBase64 string            `json:"body_base64,omitempty"`
+	Chunks     []trafficChunk    `json:"chunks,omitempty"`
+}
+
+// trafficChunk is a piece of a streamed body: it ended at byte End, MS
+// milliseconds after the headers came.
+type trafficChunk struct {
+	MS  int64 `json:"ms"`
+	End int   `json:"end"`
+}
+
+func (m *trafficMessage) setBody(data []byte) {
+	if utf8.Valid(data) {
+		m.Body = string(data)
+	} else {
+		m.BodyBase64 = base64.StdEncoding.EncodeToString(data)
+	}
+}
+
+func (m *trafficMessage) body() []byte {
+	if m.BodyBase64 != "" {
+		data, _ := base64.StdEncoding.DecodeString(m.BodyBase64)
+		return data
+	}
+	return []byte(m.Body)
+}
+
+// secretName reports whether a header or query parameter name looks like
+// it carries a credential.
+func secretName(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range []string{"key", "token", "secret", "auth", "cookie", "signature", "credential", "password"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeURL redacts credentials in u's query string.
+func sanitizeURL(u *url.URL) string {
+	clean := *u
+	clean.User = nil
+	if q := u.Query(); len(q) > 0 {
+		for name := range q {
+			if secretName(name) {
+				q.Set(name, "REDACTED")
+			}
+		}
+		clean.RawQuery = q.Encode()
+	}
+	return clean.String()
+}
+
+// recordedHeaders are h without credentials, cookies or hop-by-hop and
+// per-message headers.
+func recordedHeaders(h http.Header) map[string]string {
+	out := map[string]string{}
+	for name, values := range h {
+		switch {
+		case secretName(name):
+			out[name] = "REDACTED"
+		case name == "Date" || name == "Content-Length" || slices.Contains(hopHeaders, name):
+		default:
+			out[name] = strings.Join(values, ", ")
+		}
+	}
+	return out
+}
+
+// trafficKey identifies a request by method, sanitized URL and body, JSON
+// bodies compared whatever their key order and spacing. It names the
+// recording's file.
+func trafficKey(req *http.Request, body []byte) string {
+	var v interface{}
+	if json.Unmarshal(body, &v) == nil {
+		body, _ = json.Marshal(v)
+	}
+	sum := sha256.Sum256([]byte(req.Method + " " + sanitizeURL(req.URL) + "\n" + string(body)))
+	host := strings.NewReplacer(":", "_", "/", "_").Replace(req.URL.Host)
+	return host + "_" + hex.EncodeToString(sum[:16])
+}
+
+// trafficTransport records or replays what passes through next.
+type trafficTransport struct {
+	cfg  TrafficConfig
+	next http.RoundTripper
+}
+
+// withTraffic wraps t as c says, or returns it as is.
+func withTraffic(c TrafficConfig, t http.RoundTripper) http.RoundTripper {
+	if c.Mode == "" {
+		return t
+	}
+	return &trafficTransport{cfg: c, next: t}
+}
+
+func (t *trafficTransport) path(key string) string {
+	return filepath.Join(t.cfg.Dir, key+".json")
+}
+
+func (t *trafficTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	key := trafficKey(req, body)
+	if t.cfg.Mode == "replay" {
+		return t.replay(req, key)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	rec := &trafficRecord{
+		Recorded: time.Now().UTC(),
+		Request:  trafficMessage{Method: req.Method, URL: sanitizeURL(req.URL), Headers: recordedHeaders(req.Header)},
+		Response: trafficMessage{Status: resp.StatusCode, Headers: recordedHeaders(resp.Header)},
+	}
+	rec.Request.setBody(body)
+	mediaType := resp.Header.Get("Content-Type")
+	resp.Body = &recordingBody{
+		ReadCloser: resp.Body,
+		save:       func() { t.save(key, rec) },
+		rec:        rec,
+		start:      time.Now(),
+		stream:     strings.HasPrefix(mediaType, "text/event-stream") || strings.Contains(mediaType, "ndjson"),
+	}
+	return resp, nil
+}
+
+// save writes a recording, replacing any earlier one of the same request.
+func (t *trafficTransport) save(key string, rec *trafficRecord) {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(t.cfg.Dir, 0o755)
+	}
+	if err == nil {
+		tmp := t.path(key) + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o644); err == nil {
+			err = os.Rename(tmp, t.path(key))
+		}
+	}
+	if err != nil {
+		slog.Error("traffic record", "url", rec.Request.URL, "err", err)
+	}
+}
+
+// replay answers from the recording of req. A request never recorded gets
+// a 404 saying so, which is neither retried nor failed over.
+func (t *trafficTransport) replay(req *http.Request, key string) (*http.Response, error) {
+	resp := &http.Response{
+		Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1,
+		Header:  http.Header{},
+		Request: req,
+	}
+	var rec trafficRecord
+	data, err := os.ReadFile(t.path(key))
+	if err == nil {
+		err = json.Unmarshal(data, &rec)
+	}
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Error("traffic replay", "file", t.path(key), "err", err)
+		}
+		msg, _ := json.Marshal(map[string]interface{}{"error": map[string]string{
+			"message": "Not in the traffic recording: " + req.Method + " " + sanitizeURL(req.URL),
+			"type":    "replay_miss",
+		}})
+		resp.StatusCode = http.StatusNotFound
+		resp.Header.Set("Content-Type", "application/json")
+		resp.Header.Set("X-Replay", "miss")
+		resp.Body, resp.ContentLength = io.NopCloser(bytes.NewReader(msg)), int64(len(msg))
+		resp.Status = strconv.Itoa(resp.StatusCode) + " " + http.StatusText(resp.StatusCode)
+		return resp, nil
+	}
+
+	resp.StatusCode = rec.Response.Status
+	resp.Status = strconv.Itoa(resp.StatusCode) + " " + http.StatusText(resp.StatusCode)
+	for name, v := range rec.Response.Headers {
+		resp.Header.Set(name, v)
+	}
+	resp.Header.Set("X-Replay", "hit")
+	body := rec.Response.body()
+	resp.ContentLength = int64(len(body))
+	if t.cfg.Pace && len(rec.Response.Chunks) > 0 {
+		resp.Body = &pacedBody{req: req, data: body, chunks: rec.Response.Chunks, start: time.Now()}
+	} else {
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	return resp, nil
+}
+
+// recordingBody copies a response body as it is read, saving the exchange
+// once it has been read to the end. A body abandoned part way is not saved.
+type recordingBody struct {
+	io.ReadCloser
+	save   func()
+	rec    *trafficRecord
+	start  time.Time
+	stream bool
+	buf    bytes.Buffer
+	chunks []trafficChunk
+	saved  bool
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.buf.Write(p[:n])
+		if b.stream {
+			b.chunks = append(b.chunks, trafficChunk{MS: time.Since(b.start).Milliseconds(), End: b.buf.Len()})
+		}
+	}
+	if err == io.EOF && !b.saved {
+		b.saved = true
+		b.rec.Response.setBody(b.buf.Bytes())
+		b.rec.Response.Chunks = b.chunks
+		b.save()
+	}
+	return n, err
+}
+
+// Close first finishes reading a body the caller stopped short of its end,
+// as stream readers do on the final event, so the recording is whole. One
+// that does not end within a moment was abandoned, and is not saved.
+func (b *recordingBody) Close() error {
+	if !b.saved {
+		drained := make(chan struct{})
+		go func() {
+			io.Copy(io.Discard, b)
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+	return b.ReadCloser.Close()
+}
+
+// pacedBody gives a replayed stream's chunks out no sooner than they
+// first arrived.
+type pacedBody struct {
+	req    *http.Request
+	data   []byte
+	chunks []trafficChunk
+	start  time.Time
+	pos    int
+}
+
+func (b *pacedBody) Read(p []byte) (int, error) {
+	if b.pos >= len(b.data) {
+		return 0, io.EOF
+	}
+	end := len(b.data)
+	for len(b.chunks) > 0 {
+		c := b.chunks[0]
+		if c.End <= b.pos {
+			b.chunks = b.chunks[1:]
+			continue
+		}
+		if wait := time.Until(b.start.Add(time.Duration(c.MS) * time.Millisecond)); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-b.req.Context().Done():
+				return 0, b.req.Context().Err()
+			}
+		}
+		end = min(c.End, len(b.data))
+		break
+	}
+	n := copy(p, b.data[b.pos:end])
+	b.pos += n
+	return n, nil
+}
+
+func (b *pacedBody) Close() error { return nil }
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// maxAudioBytes is the largest upload the Whisper APIs take.
+const maxAudioBytes = 25 << 20
+
+// transcription is the canonical /api/transcribe reply. Segments and
+// words are only there when timestamps were asked for.
+type transcription struct {
+	Provider string               `json:"provider"`
+	Model    string               `json:"model"`
+	Text     string               `json:"text"`
+	Language string               `json:"language,omitempty"`
+	Duration float64              `json:"duration,omitempty"`
+	Segments []transcriptSegment  `json:"segments,omitempty"`
+	Words    []transcriptWordTime `json:"words,omitempty"`
+}
+
+type transcriptSegment struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Text  string  `json:"text"`
+}
+
+type transcriptWordTime struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Word  string  `json:"word"`
+}
+
+// transcriptionDialect is one upstream transcription API. Those proxied so
+// far all take OpenAI's multipart form, so only the URL differs.
+type transcriptionDialect struct {
+	url func(endpoint string) string
+}
+
+// TranscriptionProvider is a Provider that /api/transcribe can reach.
+type TranscriptionProvider interface {
+	Provider
+	Transcriptions() *transcriptionDialect
+}
+
+var openAITranscriptions = transcriptionDialect{
+	url: func(endpoint string) string {
+		return strings.TrimSuffix(endpoint, "/chat/completions") + "/audio/transcriptions"
+	},
+}
+
+// handleTranscribe turns an audio upload into text. The multipart form
+// carries the audio as "file" with provider and model, and optionally
+// language, prompt, temperature and timestamps ("segment", "word" or
+// both, comma separated). The audio goes upstream as a new multipart form.
+func handleTranscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxAudioBytes+1<<20)
+	if err := r.ParseMultipartForm(8 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeTooLarge(w, tooLarge.Limit)
+			return
+		}
+		http.Error(w, "Expected a multipart form with the audio as \"file\"", http.StatusBadRequest)
+		return
+	}
+	provider, model := r.FormValue("provider"), r.FormValue("model")
+	p, _ := lookupProvider(provider)
+	target, ok := p.(TranscriptionProvider)
+	if !ok || target.Transcriptions() == nil {
+		http.Error(w, "No transcription API for provider: "+provider, http.StatusBadRequest)
+		return
+	}
+	if !config.providerEnabled(provider) {
+		http.Error(w, "Provider disabled: "+provider, http.StatusBadRequest)
+		return
+	}
+	if model == "" {
+		http.Error(w, "model: required", http.StatusBadRequest)
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, `file: required`, http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	if header.Size > maxAudioBytes {
+		writeTooLarge(w, maxAudioBytes)
+		return
+	}
+	var granularities []string
+	if ts := r.FormValue("timestamps"); ts != "" {
+		for _, g := range strings.Split(ts, ",") {
+			g = strings.TrimSpace(g)
+			if g != "segment" && g != "word" {
+				http.Error(w, fmt.Sprintf("timestamps: %q is not segment or word", g), http.StatusBadRequest)
+				return
+			}
+			granularities = append(granularities, g)
+		}
+	}
+
+	rec := recordFrom(r)
+	apiKey, err := resolveAPIKey(target, rec.user(), r.FormValue("apiKey"), firstSet(r.FormValue("keyProfile"), r.Header.Get("X-Key-Profile")))
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	rec.describe(provider, model, false, map[string]interface{}{
+		"file": header.Filename, "bytes": header.Size, "language": r.FormValue("language"), "timestamps": granularities,
+	})
+
+	// The upstream form: the audio under its own name and type, then the
+	// options, with verbose_json when timestamps are wanted.
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part := textproto.MIMEHeader{}
+	filename := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(firstSet(header.Filename, "audio"))
+	part.Set("Content-Disposition", `form-data; name="file"; filename="`+filename+`"`)
+	part.Set("Content-Type", firstSet(header.Header.Get("Content-Type"), "application/octet-stream"))
+	fw, err := mw.CreatePart(part)
+	if err == nil {
+		_, err = io.Copy(fw, file)
+	}
+	if err != nil {
+		http.Error(w, "Reading upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	mw.WriteField("model", model)
+	for _, field := range []string{"language", "prompt", "temperature"} {
+		if v := r.FormValue(field); v != "" {
+			mw.WriteField(field, v)
+		}
+	}
+	if len(granularities) > 0 {
+		mw.WriteField("response_format", "verbose_json")
+		for _, g := range granularities {
+			mw.WriteField("timestamp_granularities[]", g)
+		}
+	} else {
+		mw.WriteField("response_format", "json")
+	}
+	mw.Close()
+
+	out, fail := transcribeUpstream(w, r, target, ChatTarget{provider, model}, &body, mw.FormDataContentType(), apiKey)
+	if fail != nil {
+		fail.write(w)
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// transcribeUpstream makes the upstream call and reads its reply.
+func transcribeUpstream(w http.ResponseWriter, r *http.Request, target TranscriptionProvider, t ChatTarget, body *bytes.Buffer, contentType, apiKey string) (*transcription, *chatFailure) {
+	failed := func(err error, upstream bool) (*transcription, *chatFailure) {
+		return nil, &chatFailure{target: t, err: err, upstream: upstream}
+	}
+	recordFrom(r).setKey(apiKey)
+	if err := checkBudgets(w, recordFrom(r), t.Provider, apiKey); err != nil {
+		return failed(err, false)
+	}
+	req, err := http.NewRequestWithContext(r.Context(), "POST", target.Transcriptions().url(target.Endpoint()), bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return failed(err, false)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+
+	release, err := acquireUpstream(w, r, target)
+	if err != nil {
+		return failed(err, false)
+	}
+	defer release()
+	resp, err := doUpstream(target, req)
+	if err != nil {
+		return failed(err, true)
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return failed(err, true)
+	}
+	if resp.StatusCode >= 300 {
+		return nil, &chatFailure{target: t, status: resp.StatusCode, body: raw, upstream: true}
+	}
+	out := &transcription{}
+	if err := json.Unmarshal(raw, out); err != nil {
+		return nil, &chatFailure{target: t, status: http.StatusBadGateway, body: []byte("Unexpected upstream response: " + err.Error())}
+	}
+	out.Provider, out.Model = t.Provider, t.Model
+	for i := range out.Segments {
+		out.Segments[i].Text = strings.TrimSpace(out.Segments[i].Text)
+	}
+	out.Text = strings.TrimSpace(out.Text)
+	return out, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// conversationExport is the JSON transcript of a conversation, and what
+// the import endpoint takes, so a conversation can be moved between
+// proxies or archived and restored.
+type conversationExport struct {
+	Format   string                `json:"format"` // always "quirk.conversation"
+	Version  int                   `json:"version"`
+	Exported time.Time             `json:"exported"`
+	Title    string                `json:"title,omitempty"`
+	Created  time.Time             `json:"created"`
+	Updated  time.Time             `json:"updated"`
+	Messages []conversationMessage `json:"messages"`
+}
+
+const conversationFormat = "quirk.conversation"
+
+// markdownTranscript renders c for reading: a heading per message, naming
+// the model behind each reply.
+func markdownTranscript(c *conversation, now time.Time) string {
+	var b strings.Builder
+	title := c.Title
+	if title == "" {
+		title = "Conversation " + c.ID
+	}
+	fmt.Fprintf(&b, "# %s\n\n", title)
+	fmt.Fprintf(&b, "_Started %s, exported %s._\n", c.Created.UTC().Format(time.RFC3339), now.UTC().Format(time.RFC3339))
+	for _, m := range c.Messages {
+		heading := strings.ToUpper(m.Role[:1]) + m.Role[1:]
+		if m.Model != "" {
+			heading += fmt.Sprintf(" (%s/%s)", m.Provider, m.Model)
+		}
+		fmt.Fprintf(&b, "\n## %s\n\n%s\n", heading, strings.TrimSpace(m.Content))
+	}
+	return b.String()
+}
+
+// handleConversationExport serves GET /api/conversations/{id}/export, as
+// JSON or, with ?format=markdown, as a Markdown transcript.
+func handleConversationExport(w http.ResponseWriter, r *http.Request, c *conversation) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	now := time.Now()
+	switch f := r.URL.Query().Get("format"); f {
+	case "", "json":
+		w.Header().Set("Content-Disposition", `attachment; filename="conversation-`+c.ID+`.json"`)
+		writeJSON(w, http.StatusOK, conversationExport{
+			Format:   conversationFormat,
+			Version:  1,
+			Exported: now,
+			Title:    c.Title,
+			Created:  c.Created,
+			Updated:  c.Updated,
+			Messages: c.Messages,
+		})
+	case "markdown", "md":
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="conversation-`+c.ID+`.md"`)
+		w.Write([]byte(markdownTranscript(c, now)))
+	default:
+		http.Error(w, "Unknown format "+f+", expected json or markdown", http.StatusBadRequest)
+	}
+}
+
+// handleConversationImport serves POST /api/conversations/import: it
+// stores a JSON export as a new conversation of the caller's, keeping its
+// title, times and messages.
+func handleConversationImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var in conversationExport
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if in.Format != conversationFormat || in.Version != 1 {
+		http.Error(w, `Not a conversation export: expected format "quirk.conversation", version 1`, http.StatusBadRequest)
+		return
+	}
+	plain := make([]chatMessage, len(in.Messages))
+	for i, m := range in.Messages {
+		plain[i] = chatMessage{Role: m.Role, Content: m.Content}
+	}
+	if err := validateMessages(plain); err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	now := time.Now()
+	for i := range in.Messages {
+		if in.Messages[i].Created.IsZero() {
+			in.Messages[i].Created = now
+		}
+	}
+	c := &conversation{
+		ID:           newConversationID(),
+		User:         recordFrom(r).user(),
+		Title:        in.Title,
+		Created:      firstTime(in.Created, now),
+		Updated:      firstTime(in.Updated, now),
+		MessageCount: len(in.Messages),
+		Messages:     in.Messages,
+	}
+	if err := conversations.backend.create(c); err != nil {
+		http.Error(w, "Importing conversation: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, c)
+}
+
+// firstTime returns the first of times that is set.
+func firstTime(times ...time.Time) time.Time {
+	for _, t := range times {
+		if !t.IsZero() {
+			return t
+		}
+	}
+	return time.Time{}
+}
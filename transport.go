@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ConnectionsConfig tunes the connection pool all upstream calls share.
+// Keeping connections to each provider open saves a TCP and TLS handshake
+// per request; TLS sessions are cached so new connections resume rather
+// than renegotiate.
+type ConnectionsConfig struct {
+	// MaxIdlePerHost is how many idle connections to keep per upstream
+	// host. Go's default of 2 makes concurrent streams reconnect.
+	MaxIdlePerHost int `json:"max_idle_per_host"`
+	// MaxPerHost caps connections per host, busy ones included; 0 is no cap.
+	MaxPerHost  int      `json:"max_per_host"`
+	IdleTimeout duration `json:"idle_timeout"`
+	KeepAlive   duration `json:"keep_alive"` // TCP keep-alive probe interval
+	// HTTP1Only turns off HTTP/2 to upstreams, for proxies or gateways
+	// that mishandle it. Otherwise it is used wherever TLS negotiates it.
+	HTTP1Only bool `json:"http1_only"`
+}
+
+func (c ConnectionsConfig) validate() []error {
+	if c.MaxIdlePerHost < 0 || c.MaxPerHost < 0 || c.IdleTimeout < 0 || c.KeepAlive < 0 {
+		return []error{errors.New("connections: values must not be negative")}
+	}
+	return nil
+}
+
+var (
+	// upstreamTransport carries all upstream calls; applyConfig replaces it.
+	upstreamTransport http.RoundTripper = http.DefaultTransport
+	// upstreamClient is shared by provider calls, so they share the pool.
+	upstreamClient = &http.Client{Transport: upstreamTransport}
+	// passthroughClient hands redirects back to the client, since
+	// following them could leave the passthrough allowlist.
+	passthroughClient = &http.Client{Transport: upstreamTransport, CheckRedirect: noRedirects}
+)
+
+func noRedirects(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+// newUpstreamTransport builds the shared transport from c.
+func newUpstreamTransport(c *Config) *http.Transport {
+	cc := c.Connections
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: time.Duration(cc.KeepAlive)}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxyForRequest
+	transport.DialContext = dialer.DialContext
+	transport.ResponseHeaderTimeout = time.Duration(c.Timeouts.Upstream)
+	transport.MaxIdleConns = 0 // bounded per host instead
+	transport.MaxIdleConnsPerHost = cc.MaxIdlePerHost
+	transport.MaxConnsPerHost = cc.MaxPerHost
+	transport.IdleConnTimeout = time.Duration(cc.IdleTimeout)
+	transport.TLSClientConfig = &tls.Config{ClientSessionCache: tls.NewLRUClientSessionCache(256)}
+	// A custom TLS config or dialer would otherwise turn HTTP/2 off.
+	transport.ForceAttemptHTTP2 = !cc.HTTP1Only
+	if cc.HTTP1Only {
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport
+}
+
+// setUpstreamTransport makes t carry every upstream call.
+func setUpstreamTransport(t http.RoundTripper) {
+	upstreamTransport = t
+	upstreamClient = &http.Client{Transport: t}
+	passthroughClient = &http.Client{Transport: t, CheckRedirect: noRedirects}
+}
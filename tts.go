@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// speechRequest is the canonical body accepted by /api/tts.
+type speechRequest struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	Input    string `json:"input"`
+	Voice    string `json:"voice"`
+	// Format is mp3 (the default), opus, aac, flac, wav or pcm, as far as
+	// the provider offers it.
+	Format string   `json:"format,omitempty"`
+	Speed  *float64 `json:"speed,omitempty"`
+	// Instructions steer delivery on models that take them.
+	Instructions string `json:"instructions,omitempty"`
+	APIKey       string `json:"apiKey,omitempty"`
+	KeyProfile   string `json:"keyProfile,omitempty"`
+}
+
+// speechDialect is one upstream text-to-speech API.
+type speechDialect struct {
+	// formats maps the canonical formats the API offers to its own names.
+	formats map[string]string
+	build   func(endpoint string, sr *speechRequest, format, apiKey string) (*http.Request, error)
+}
+
+// SpeechProvider is a Provider that /api/tts can translate to.
+type SpeechProvider interface {
+	Provider
+	Speech() *speechDialect
+}
+
+// speechContentTypes are the types audio is served as, whatever the
+// upstream labels it. OpenAI's opus comes in an Ogg container and its pcm
+// is 24kHz 16-bit mono.
+var speechContentTypes = map[string]string{
+	"mp3":  "audio/mpeg",
+	"opus": "audio/ogg; codecs=opus",
+	"aac":  "audio/aac",
+	"flac": "audio/flac",
+	"wav":  "audio/wav",
+	"pcm":  "audio/pcm;rate=24000",
+}
+
+func (sr *speechRequest) validate(d *speechDialect) error {
+	if sr.Model == "" {
+		return badRequest("model: required")
+	}
+	if strings.TrimSpace(sr.Input) == "" {
+		return badRequest("input: required")
+	}
+	if sr.Voice == "" {
+		return badRequest("voice: required")
+	}
+	if _, ok := d.formats[firstSet(sr.Format, "mp3")]; !ok {
+		var offered []string
+		for _, f := range []string{"mp3", "opus", "aac", "flac", "wav", "pcm"} {
+			if _, ok := d.formats[f]; ok {
+				offered = append(offered, f)
+			}
+		}
+		return badRequest(fmt.Sprintf("format: %q is not one %s offers: %s", sr.Format, sr.Provider, strings.Join(offered, ", ")))
+	}
+	if sr.Speed != nil {
+		if err := (numRange{0.25, 4, false}).check("speed", *sr.Speed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unified text-to-speech endpoint. Audio is relayed as it arrives, so
+// playback can start before the whole reply is spoken.
+func handleTTS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var sr speechRequest
+	if err := json.NewDecoder(r.Body).Decode(&sr); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	p, _ := lookupProvider(sr.Provider)
+	target, ok := p.(SpeechProvider)
+	if !ok || target.Speech() == nil {
+		http.Error(w, "No speech API for provider: "+sr.Provider, http.StatusBadRequest)
+		return
+	}
+	if !config.providerEnabled(sr.Provider) {
+		http.Error(w, "Provider disabled: "+sr.Provider, http.StatusBadRequest)
+		return
+	}
+	dialect := target.Speech()
+	if err := sr.validate(dialect); err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	if sr.KeyProfile == "" {
+		sr.KeyProfile = r.Header.Get("X-Key-Profile")
+	}
+	rec := recordFrom(r)
+	apiKey, err := resolveAPIKey(target, rec.user(), sr.APIKey, sr.KeyProfile)
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	logged := sr
+	logged.APIKey = ""
+	rec.describe(sr.Provider, sr.Model, true, logged)
+	rec.setKey(apiKey)
+	t := ChatTarget{sr.Provider, sr.Model}
+	if err := checkBudgets(w, rec, sr.Provider, apiKey); err != nil {
+		(&chatFailure{target: t, err: err}).write(w)
+		return
+	}
+	format := firstSet(sr.Format, "mp3")
+	req, err := dialect.build(target.Endpoint(), &sr, dialect.formats[format], apiKey)
+	if err != nil {
+		writeBuildError(w, err)
+		return
+	}
+	req = req.WithContext(r.Context())
+
+	release, err := acquireUpstream(w, r, target)
+	if err != nil {
+		writeAcquireError(w, err)
+		return
+	}
+	defer release()
+	resp, err := doUpstream(target, req)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		raw, _ := io.ReadAll(resp.Body)
+		(&chatFailure{target: t, status: resp.StatusCode, body: raw, upstream: true}).write(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", speechContentTypes[format])
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	var out io.Writer = w
+	if f, ok := w.(http.Flusher); ok {
+		out = &flushWriter{w: w, f: f}
+	}
+	n, err := io.CopyBuffer(out, resp.Body, make([]byte, 16<<10))
+	if err != nil && !clientGone(r.Context()) {
+		slog.Warn("speech stream error", "request_id", requestID(r.Context()), "upstream", req.URL.Host, "bytes", n, "err", err)
+	}
+}
+
+var openAISpeech = speechDialect{
+	formats: map[string]string{"mp3": "mp3", "opus": "opus", "aac": "aac", "flac": "flac", "wav": "wav", "pcm": "pcm"},
+	build: func(endpoint string, sr *speechRequest, format, apiKey string) (*http.Request, error) {
+		body := map[string]interface{}{"model": sr.Model, "input": sr.Input, "voice": sr.Voice, "response_format": format}
+		setIf(body, "speed", sr.Speed, sr.Speed != nil)
+		setIf(body, "instructions", sr.Instructions, sr.Instructions != "")
+		req, err := newJSONRequest(strings.TrimSuffix(endpoint, "/chat/completions")+"/audio/speech", body)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		return req, nil
+	},
+}
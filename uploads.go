@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UploadsConfig bounds the images clients upload for /api/chat messages.
+// Uploads are held in memory until they expire.
+type UploadsConfig struct {
+	TTL duration `json:"ttl"`
+	// MaxBytes limits one image; MaxTotal everything held at once.
+	MaxBytes int64 `json:"max_bytes"`
+	MaxTotal int64 `json:"max_total"`
+}
+
+func (c UploadsConfig) validate() []error {
+	if c.TTL < 0 || c.MaxBytes < 0 || c.MaxTotal < 0 {
+		return []error{errors.New("uploads: ttl, max_bytes and max_total must not be negative")}
+	}
+	return nil
+}
+
+const (
+	defaultUploadTTL   = time.Hour
+	defaultUploadBytes = 20 << 20
+	defaultUploadTotal = 512 << 20
+)
+
+// imageTypes are the formats every provider with vision accepts.
+var imageTypes = map[string]bool{"image/png": true, "image/jpeg": true, "image/gif": true, "image/webp": true}
+
+// upload is an image a client sent ahead of the message that uses it.
+type upload struct {
+	ID        string    `json:"id"`
+	MediaType string    `json:"media_type"`
+	Size      int       `json:"size"`
+	Filename  string    `json:"filename,omitempty"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+	user      string
+	data      []byte
+	sum       string
+}
+
+func (u *upload) base64() string { return base64.StdEncoding.EncodeToString(u.data) }
+
+func (u *upload) dataURL() string { return "data:" + u.MediaType + ";base64," + u.base64() }
+
+type uploadStore struct {
+	mu    sync.Mutex
+	byID  map[string]*upload
+	total int64
+}
+
+var uploads = &uploadStore{byID: map[string]*upload{}}
+
+// expire drops uploads past their time. Callers hold s.mu.
+func (s *uploadStore) expire(now time.Time) {
+	for id, u := range s.byID {
+		if now.After(u.Expires) {
+			s.total -= int64(u.Size)
+			delete(s.byID, id)
+		}
+	}
+}
+
+func (s *uploadStore) put(u *upload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(u.Created)
+	if s.total+int64(u.Size) > firstInt64(config.Uploads.MaxTotal, defaultUploadTotal) {
+		return errors.New("Upload storage is full; try again once older uploads expire")
+	}
+	s.byID[u.ID] = u
+	s.total += int64(u.Size)
+	return nil
+}
+
+// get returns upload id if user may use it, or nil.
+func (s *uploadStore) get(id, user string) *upload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(time.Now())
+	if u := s.byID[id]; u != nil && u.user == user {
+		return u
+	}
+	return nil
+}
+
+func (s *uploadStore) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.byID[id]; u != nil {
+		s.total -= int64(u.Size)
+		delete(s.byID, id)
+	}
+}
+
+func firstInt64(values ...int64) int64 {
+	for _, v := range values {
+		if v != 0 {
+			return v
+		}
+	}
+	return 0
+}
+
+func newUploadID() string {
+	var b [12]byte
+	rand.Read(b[:])
+	return "upl_" + hex.EncodeToString(b[:])
+}
+
+// attachImages resolves the upload IDs in cr's messages to the images they
+// name, for the dialects to inline.
+func (cr *chatRequest) attachImages(user string) error {
+	for i := range cr.Messages {
+		m := &cr.Messages[i]
+		m.images = nil
+		for j, id := range m.Images {
+			u := uploads.get(id, user)
+			if u == nil {
+				return badRequest(fmt.Sprintf("messages[%d].images[%d]: no upload %s; it may have expired", i, j, id))
+			}
+			m.images = append(m.images, u)
+		}
+	}
+	return nil
+}
+
+// handleUploads stores images from "file" parts of a multipart form, or
+// one image sent as the body, for messages to reference by ID (POST
+// /api/uploads). GET /api/uploads/{id} returns an image and DELETE
+// removes it. Uploads belong to the caller who made them.
+func handleUploads(w http.ResponseWriter, r *http.Request) {
+	user := recordFrom(r).user()
+	if id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/uploads"), "/"); id != "" {
+		u := uploads.get(id, user)
+		if u == nil {
+			http.Error(w, "No upload "+id, http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			w.Header().Set("Content-Type", u.MediaType)
+			w.Header().Set("Cache-Control", "private, max-age=60")
+			w.Write(u.data)
+		case "DELETE":
+			uploads.remove(id)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	maxBytes := firstInt64(config.Uploads.MaxBytes, defaultUploadBytes)
+	type part struct {
+		filename string
+		data     []byte
+	}
+	var parts []part
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mt == "multipart/form-data" {
+		r.Body = http.MaxBytesReader(w, r.Body, 16*maxBytes)
+		if err := r.ParseMultipartForm(8 << 20); err != nil {
+			http.Error(w, "Reading upload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, fh := range r.MultipartForm.File["file"] {
+			if fh.Size > maxBytes {
+				http.Error(w, fmt.Sprintf("%s is larger than %d bytes", fh.Filename, maxBytes), http.StatusRequestEntityTooLarge)
+				return
+			}
+			f, err := fh.Open()
+			if err != nil {
+				http.Error(w, "Reading upload: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			data, err := io.ReadAll(f)
+			f.Close()
+			if err != nil {
+				http.Error(w, "Reading upload: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			parts = append(parts, part{fh.Filename, data})
+		}
+		if len(parts) == 0 {
+			http.Error(w, `file: no "file" parts in the form`, http.StatusBadRequest)
+			return
+		}
+	} else {
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBytes))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Upload larger than %d bytes", maxBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		parts = append(parts, part{"", data})
+	}
+
+	now := time.Now()
+	ttl := time.Duration(config.Uploads.TTL)
+	if ttl == 0 {
+		ttl = defaultUploadTTL
+	}
+	stored := make([]*upload, 0, len(parts))
+	for _, p := range parts {
+		// The type is sniffed from the bytes rather than trusted from the
+		// client, since providers reject images whose declared type is wrong.
+		mediaType := http.DetectContentType(p.data)
+		if !imageTypes[mediaType] {
+			name := firstSet(p.filename, "upload")
+			http.Error(w, name+" is not a PNG, JPEG, GIF or WebP image", http.StatusUnsupportedMediaType)
+			return
+		}
+		stored = append(stored, &upload{
+			ID: newUploadID(), MediaType: mediaType, Size: len(p.data), Filename: p.filename,
+			Created: now, Expires: now.Add(ttl), user: user, data: p.data, sum: sha256Hex(p.data),
+		})
+	}
+	for i, u := range stored {
+		if err := uploads.put(u); err != nil {
+			for _, done := range stored[:i] {
+				uploads.remove(done.ID)
+			}
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"uploads": stored})
+}
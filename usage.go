@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// usageTap reads token usage out of a passthrough response as it is relayed
+// to the client, using the provider's chat dialect: streams are fed event by
+// event, buffered bodies are parsed whole once the handler is done.
+type usageTap struct {
+	dialect *chatDialect
+	stream  chatStream
+	kind    string // "sse", "ndjson" or "" for a buffered body
+	line    []byte
+	event   string
+	data    []byte
+	body    bytes.Buffer
+}
+
+// maxUsageBody bounds how much of a buffered response is kept for parsing.
+const maxUsageBody = 8 << 20
+
+// trackUsage asks the recorder to extract usage from the response using
+// dialect; /api/chat sets usage directly instead.
+func (rec *requestRecord) trackUsage(dialect *chatDialect) {
+	if rec != nil && dialect != nil {
+		rec.tap = &usageTap{dialect: dialect}
+	}
+}
+
+func (t *usageTap) write(p []byte, contentType string) {
+	if t.kind == "" && t.body.Len() == 0 && len(t.line) == 0 {
+		switch {
+		case strings.HasPrefix(contentType, "text/event-stream"):
+			t.kind = "sse"
+		case strings.HasPrefix(contentType, "application/x-ndjson"):
+			t.kind = "ndjson"
+		}
+	}
+	if t.kind == "" {
+		if room := maxUsageBody - t.body.Len(); room > 0 {
+			t.body.Write(p[:min(room, len(p))])
+		}
+		return
+	}
+	t.line = append(t.line, p...)
+	for {
+		i := bytes.IndexByte(t.line, '\n')
+		if i < 0 {
+			return
+		}
+		t.handleLine(string(bytes.TrimRight(t.line[:i], "\r")))
+		t.line = t.line[i+1:]
+	}
+}
+
+func (t *usageTap) handleLine(line string) {
+	if t.kind == "ndjson" {
+		if line = strings.TrimSpace(line); line != "" {
+			t.relay(t.dialect.event(&t.stream, "", []byte(line)))
+		}
+		return
+	}
+	switch {
+	case line == "":
+		if len(t.data) > 0 {
+			t.relay(t.dialect.event(&t.stream, t.event, t.data))
+		}
+		t.event, t.data = "", nil
+	case strings.HasPrefix(line, "event:"):
+		t.event = strings.TrimSpace(line[len("event:"):])
+	case strings.HasPrefix(line, "data:"):
+		if len(t.data) > 0 {
+			t.data = append(t.data, '\n')
+		}
+		t.data = append(t.data, strings.TrimPrefix(line[len("data:"):], " ")...)
+	}
+}
+
+func (t *usageTap) relay(text string, _ bool) {
+	t.stream.relayed += len(text)
+	t.stream.pending = t.stream.pending[:0] // only streamChat relays tool events
+}
+
+// finish returns the usage seen in the response, estimated for a stream the
+// client abandoned.
+func (t *usageTap) finish(status int, aborted bool) chatUsage {
+	if t.kind == "" {
+		if status != http.StatusOK || t.body.Len() == 0 {
+			return chatUsage{}
+		}
+		out, err := t.dialect.parse(t.body.Bytes())
+		if err != nil {
+			return chatUsage{}
+		}
+		return out.Usage
+	}
+	if len(t.line) > 0 {
+		t.handleLine(string(t.line))
+	}
+	t.handleLine("")
+	if aborted {
+		return t.stream.partial()
+	}
+	return t.stream.usage
+}
+
+// usageKey is one aggregation cell.
+type usageKey struct {
+	Day      string `json:"day,omitempty"`
+	Provider string `json:"provider,omitempty"`
+	Model    string `json:"model,omitempty"`
+	User     string `json:"user,omitempty"`
+}
+
+type usageTotals struct {
+	Requests         int64   `json:"requests"`
+	InputTokens      int64   `json:"input_tokens"`
+	OutputTokens     int64   `json:"output_tokens"`
+	CacheWriteTokens int64   `json:"cache_write_tokens,omitempty"`
+	CacheReadTokens  int64   `json:"cache_read_tokens,omitempty"`
+	CostUSD          float64 `json:"cost_usd"`
+}
+
+func (u *usageTotals) add(o usageTotals) {
+	u.Requests += o.Requests
+	u.InputTokens += o.InputTokens
+	u.OutputTokens += o.OutputTokens
+	u.CacheWriteTokens += o.CacheWriteTokens
+	u.CacheReadTokens += o.CacheReadTokens
+	u.CostUSD += o.CostUSD
+}
+
+// usageTracker aggregates token usage and estimated cost per day,
+// provider, model and user.
+// It is seeded from the request log at startup when one is configured.
+type usageTracker struct {
+	mu    sync.Mutex
+	cells map[usageKey]*usageTotals
+}
+
+var usage = &usageTracker{cells: map[usageKey]*usageTotals{}}
+
+func (t *usageTracker) add(k usageKey, u usageTotals) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cell, ok := t.cells[k]
+	if !ok {
+		cell = &usageTotals{}
+		t.cells[k] = cell
+	}
+	cell.add(u)
+}
+
+func (t *usageTracker) record(rec *requestRecord) {
+	if rec.Provider == "" {
+		return
+	}
+	t.add(usageKey{
+		Day:      rec.Start.UTC().Format("2006-01-02"),
+		Provider: rec.Provider,
+		Model:    rec.Model,
+		User:     rec.User,
+	}, usageTotals{
+		Requests:         1,
+		InputTokens:      int64(rec.Usage.InputTokens),
+		OutputTokens:     int64(rec.Usage.OutputTokens),
+		CacheWriteTokens: int64(rec.Usage.CacheCreationInputTokens),
+		CacheReadTokens:  int64(rec.Usage.CacheReadInputTokens),
+		CostUSD:          rec.Cost,
+	})
+}
+
+// usageRow is one line of an aggregation report.
+type usageRow struct {
+	usageKey
+	usageTotals
+}
+
+// report merges cells by the fields in groupBy, keeping those within
+// [from, to] (inclusive YYYY-MM-DD, either may be empty) that match filter.
+func (t *usageTracker) report(groupBy map[string]bool, from, to string, filter usageKey) ([]usageRow, usageTotals) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	merged := map[usageKey]*usageTotals{}
+	var total usageTotals
+	for k, u := range t.cells {
+		if (from != "" && k.Day < from) || (to != "" && k.Day > to) ||
+			(filter.Provider != "" && k.Provider != filter.Provider) ||
+			(filter.Model != "" && k.Model != filter.Model) ||
+			(filter.User != "" && k.User != filter.User) {
+			continue
+		}
+		var g usageKey
+		if groupBy["day"] {
+			g.Day = k.Day
+		}
+		if groupBy["provider"] {
+			g.Provider = k.Provider
+		}
+		if groupBy["model"] {
+			g.Model = k.Model
+		}
+		if groupBy["user"] {
+			g.User = k.User
+		}
+		cell, ok := merged[g]
+		if !ok {
+			cell = &usageTotals{}
+			merged[g] = cell
+		}
+		cell.add(*u)
+		total.add(*u)
+	}
+
+	rows := make([]usageRow, 0, len(merged))
+	for k, u := range merged {
+		rows = append(rows, usageRow{k, *u})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i].usageKey, rows[j].usageKey
+		if a.Day != b.Day {
+			return a.Day > b.Day
+		}
+		if a.Provider != b.Provider {
+			return a.Provider < b.Provider
+		}
+		if a.Model != b.Model {
+			return a.Model < b.Model
+		}
+		return a.User < b.User
+	})
+	return rows, total
+}
+
+// handleAdminUsage reports aggregated token usage. Query parameters:
+// group_by (comma-separated day, provider, model, user; default all),
+// from and to (YYYY-MM-DD, inclusive), and provider, model or user to
+// filter.
+func handleAdminUsage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	groupBy := map[string]bool{"day": true, "provider": true, "model": true, "user": true}
+	if g := q.Get("group_by"); g != "" {
+		groupBy = map[string]bool{}
+		for _, field := range strings.Split(g, ",") {
+			field = strings.TrimSpace(field)
+			if field != "day" && field != "provider" && field != "model" && field != "user" {
+				http.Error(w, "Unknown group_by field: "+field, http.StatusBadRequest)
+				return
+			}
+			groupBy[field] = true
+		}
+	}
+	rows, total := usage.report(groupBy, q.Get("from"), q.Get("to"), usageKey{
+		Provider: q.Get("provider"),
+		Model:    q.Get("model"),
+		User:     q.Get("user"),
+	})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"usage": rows, "total": total})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// handleUserKeys lets a signed-in user manage their own provider keys,
+// kept encrypted in the vault. GET lists providers with a key fingerprint,
+// POST {"provider", "key"} stores one and DELETE ?provider= removes it.
+func handleUserKeys(w http.ResponseWriter, r *http.Request) {
+	user := recordFrom(r).user()
+	if user == "" {
+		http.Error(w, "Sign in or send an access token to store keys", http.StatusUnauthorized)
+		return
+	}
+	if keyVault == nil {
+		http.Error(w, "No key vault configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		prefix := userKeyName(user, "")
+		keys := []map[string]string{}
+		for _, name := range keyVault.providers() {
+			if provider, ok := strings.CutPrefix(name, prefix); ok {
+				keys = append(keys, map[string]string{
+					"provider":    provider,
+					"fingerprint": keyFingerprint(keyVault.get(name)),
+				})
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"user": user, "keys": keys})
+
+	case "POST":
+		var body struct {
+			Provider string `json:"provider"`
+			Key      string `json:"key"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeDecodeError(w, err)
+			return
+		}
+		if _, ok := lookupProvider(body.Provider); !ok {
+			http.Error(w, "Unknown provider: "+body.Provider, http.StatusBadRequest)
+			return
+		}
+		if body.Key == "" {
+			http.Error(w, "Key required", http.StatusBadRequest)
+			return
+		}
+		name := userKeyName(user, body.Provider)
+		previous := keyFingerprint(keyVault.get(name))
+		if err := keyVault.set(name, body.Key); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		event := "key.added"
+		if previous != "" {
+			event = "key.rotated"
+		}
+		audit.record(event, map[string]interface{}{
+			"user":     user,
+			"provider": body.Provider,
+			"previous": previous,
+			"current":  keyFingerprint(body.Key),
+			"remote":   clientIP(r),
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	case "DELETE":
+		provider := r.URL.Query().Get("provider")
+		if err := keyVault.delete(userKeyName(user, provider)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit.record("key.deleted", map[string]interface{}{
+			"user":     user,
+			"provider": provider,
+			"remote":   clientIP(r),
+		})
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// vault keeps provider keys encrypted at rest. The whole key map is sealed
+// with AES-256-GCM under a key derived from the master passphrase with
+// scrypt, and rewritten on every change.
+type vault struct {
+	path string
+	key  []byte // derived AES key
+	salt []byte
+
+	mu   sync.RWMutex
+	keys map[string]string // provider or provider:profile -> API key
+}
+
+// vaultFile is the on-disk format.
+type vaultFile struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+const (
+	vaultScryptN = 1 << 15
+	vaultScryptR = 8
+	vaultScryptP = 1
+)
+
+// keyVault is the open vault, or nil when none is configured.
+var keyVault *vault
+
+// openVault decrypts the vault at path, creating an empty one if the file
+// does not exist yet.
+func openVault(path, passphrase string) (*vault, error) {
+	if passphrase == "" {
+		return nil, errors.New("vault: QUIRK_VAULT_PASSPHRASE is not set")
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		key, err := scrypt.Key([]byte(passphrase), salt, vaultScryptN, vaultScryptR, vaultScryptP, 32)
+		if err != nil {
+			return nil, err
+		}
+		v := &vault{path: path, key: key, salt: salt, keys: map[string]string{}}
+		return v, v.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var f vaultFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("vault: %w", err)
+	}
+	if f.Version != 1 || f.KDF != "scrypt" {
+		return nil, fmt.Errorf("vault: unsupported format %d/%s", f.Version, f.KDF)
+	}
+	key, err := scrypt.Key([]byte(passphrase), f.Salt, f.N, f.R, f.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, f.Nonce, f.Ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("vault: wrong passphrase or corrupted file")
+	}
+
+	v := &vault{path: path, key: key, salt: f.Salt}
+	if err := json.Unmarshal(plain, &v.keys); err != nil {
+		return nil, fmt.Errorf("vault: %w", err)
+	}
+	if v.keys == nil {
+		v.keys = map[string]string{}
+	}
+	return v, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// save re-encrypts the key map with a fresh nonce and atomically replaces
+// the file. Callers hold mu or own v exclusively.
+func (v *vault) save() error {
+	plain, err := json.Marshal(v.keys)
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM(v.key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(vaultFile{
+		Version:    1,
+		KDF:        "scrypt",
+		N:          vaultScryptN,
+		R:          vaultScryptR,
+		P:          vaultScryptP,
+		Salt:       v.salt,
+		Nonce:      nonce,
+		Ciphertext: gcm.Seal(nil, nonce, plain, nil),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(v.path), ".vault-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), v.path)
+}
+
+func (v *vault) get(provider string) string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.keys[provider]
+}
+
+func (v *vault) set(provider, key string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys[provider] = key
+	return v.save()
+}
+
+func (v *vault) delete(provider string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.keys, provider)
+	return v.save()
+}
+
+// providers lists the stored entry names, never the keys.
+func (v *vault) providers() []string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	names := make([]string, 0, len(v.keys))
+	for name := range v.keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,26 @@
+package main
+
+// Voyage AI serves embeddings only, with an OpenAI-shaped API. Its route
+// forwards raw bodies; /api/embeddings translates canonical ones.
+func init() {
+	registerProvider(&providerSpec{
+		name:        "voyage",
+		endpoint:    "https://api.voyageai.com/v1/embeddings",
+		embeddings:  &voyageEmbeddings,
+		noStreaming: true,
+		build:       bearerBuild,
+	})
+}
+
+// voyageEmbeddings passes input_type through; Voyage takes "query" and
+// "document".
+var voyageEmbeddings = embeddingDialect{
+	url: func(endpoint string) string { return endpoint },
+	body: func(er *embeddingRequest) map[string]interface{} {
+		body := map[string]interface{}{"model": er.Model, "input": er.Input}
+		setIf(body, "input_type", er.InputType, er.InputType != "")
+		setIf(body, "output_dimension", er.Dimensions, er.Dimensions > 0)
+		return body
+	},
+	parse: parseOpenAIEmbeddings,
+}
@@ -1014,17 +1014,14 @@ class AIChat {
     let requestBody;
 
     if (isAnthropic) {
-      // Anthropic via proxy
-      if (!this.apiKey) {
-        throw new Error('API key required for Anthropic Claude. Please add your API key in settings.');
-      }
+      // Anthropic via proxy. Without a key here the proxy falls back to
+      // its own server-side key, if one is configured.
 
       // Anthropic requires system prompt separate from messages
       const systemMessage = messages.find(m => m.role === 'system');
       const userMessages = messages.filter(m => m.role !== 'system');
 
       requestBody = {
-        apiKey: this.apiKey, // Proxy extracts this
         model: this.apiModel,
         max_tokens: 20000,
         messages: userMessages,
@@ -1032,6 +1029,10 @@ class AIChat {
         stream: true,
       };
 
+      if (this.apiKey) {
+        requestBody.apiKey = this.apiKey; // Proxy extracts this
+      }
+
       // Only add temperature if configured (some models require default)
       if (this.temperature !== null && this.temperature !== undefined) {
         requestBody.temperature = this.temperature;
@@ -1041,13 +1042,8 @@ class AIChat {
         requestBody.system = systemMessage.content;
       }
     } else if (isOpenAI) {
-      // OpenAI via proxy
-      if (!this.apiKey) {
-        throw new Error('API key required for OpenAI. Please add your API key in settings.');
-      }
-
+      // OpenAI via proxy, which may supply a server-side key
       requestBody = {
-        apiKey: this.apiKey, // Proxy extracts this
         model: this.apiModel,
         messages: messages,
         tools: this.getToolDefinitions(), // Native tool use
@@ -1055,6 +1051,10 @@ class AIChat {
         stream: true,
       };
 
+      if (this.apiKey) {
+        requestBody.apiKey = this.apiKey; // Proxy extracts this
+      }
+
       // Only add temperature if configured (some models require default)
       if (this.temperature !== null && this.temperature !== undefined) {
         requestBody.temperature = this.temperature;
@@ -1370,16 +1370,15 @@ class ExecutionManager {
           body: JSON.stringify(requestBody)
         });
       } else if (isAnthropic) {
-        // Anthropic via proxy
-        if (!apiKey) {
-          throw new Error('API key required for Anthropic. Please configure in LLM Config.');
-        }
+        // Anthropic via proxy, which may supply a server-side key
         const baseBody = {
-          apiKey: apiKey, // Proxy extracts this
           model: model,
           messages: [{ role: 'user', content: prompt }],
           stream: true
         };
+        if (apiKey) {
+          baseBody.apiKey = apiKey; // Proxy extracts this
+        }
         const { response: anthropicResponse } = await this.sendAnthropicRequest(endpoint, headers, baseBody);
         response = anthropicResponse;
       } else {
@@ -1527,15 +1526,14 @@ class ExecutionManager {
           body: JSON.stringify(requestBody)
         });
       } else if (isAnthropic) {
-        // Anthropic via proxy
-        if (!apiKey) {
-          throw new Error('API key required for Anthropic. Please configure in LLM Config.');
-        }
+        // Anthropic via proxy, which may supply a server-side key
         const baseBody = {
-          apiKey: apiKey, // Proxy extracts this
           model: model,
           messages: [{ role: 'user', content: prompt }]
         };
+        if (apiKey) {
+          baseBody.apiKey = apiKey; // Proxy extracts this
+        }
         const { response: anthropicResponse } = await this.sendAnthropicRequest(endpoint, headers, baseBody);
         response = anthropicResponse;
       } else {
@@ -0,0 +1,6 @@
+package main
+
+// xAI, for Grok models via the OpenAI-compatible chat API.
+func init() {
+	registerProvider(openAICompatible("xai", "https://api.x.ai/v1/chat/completions"))
+}